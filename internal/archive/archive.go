@@ -0,0 +1,218 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+)
+
+/*
+Archive is a gzipped tar, which contains all not deleted control objects with their
+image records, image files and facial features vectors, so FACEDB deployment may be
+backed up or moved to another ClickHouse DB cluster and images store. Entries are
+written in the order, in which they are imported:
+  - images/{img_id}: image files;
+  - control_objects.jsonl, imgs.jsonl, facial_features.jsonl: records, one JSON per line;
+  - manifest.json: format version, numbers of records and SHA-256 of all other entries.
+Import reads archive twice: first all entries are verified by manifest, then they are
+imported. Centroids are not archived: they are rebuilt by importing server.
+Archive is not a snapshot: records, written during export, may be partially included.
+*/
+
+const (
+	// Format is a value of manifest format field.
+	Format = "facedb-archive"
+	// FormatVersion is a version of archive layout and records.
+	FormatVersion = 1
+
+	imgsDir            = "images/"
+	controlObjectsFile = "control_objects.jsonl"
+	imgsFile           = "imgs.jsonl"
+	ffvsFile           = "facial_features.jsonl"
+	manifestFile       = "manifest.json"
+)
+
+// Manifest describes archive.
+type Manifest struct {
+	Format            string    `json:"format"`
+	FormatVersion     int       `json:"format_version"`
+	FACEDBVersion     string    `json:"facedb_version"`
+	CreatedAt         time.Time `json:"created_at"`
+	ControlObjectsNum uint64    `json:"control_objects_num"`
+	ImgsNum           uint64    `json:"imgs_num"`
+	ImgFilesNum       uint64    `json:"img_files_num"`
+	FFVsNum           uint64    `json:"ffvs_num"`
+	Files             []File    `json:"files"`
+}
+
+// File is an archive entry with its checksum.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type controlObjectRecord struct {
+	ID         string    `json:"id"`
+	TS         time.Time `json:"ts"`
+	Passport   string    `json:"passport"`
+	Surname    string    `json:"surname"`
+	Name       string    `json:"name"`
+	Patronymic string    `json:"patronymic"`
+	Sex        string    `json:"sex"`
+	BirthDate  string    `json:"birthdate"`
+	PhoneNum   string    `json:"phone_num"`
+	Email      string    `json:"email"`
+	Address    string    `json:"address"`
+	// Attributes are missing in archives, written before attributes were added.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func createControlObjectRecord(cob *proto.ControlObject) *controlObjectRecord {
+	return &controlObjectRecord{
+		ID:         cob.ID,
+		TS:         cob.TS,
+		Passport:   cob.Passport,
+		Surname:    cob.Surname,
+		Name:       cob.Name,
+		Patronymic: cob.Patronymic,
+		Sex:        cob.Sex,
+		BirthDate:  cob.BirthDate,
+		PhoneNum:   cob.PhoneNum,
+		Email:      cob.Email,
+		Address:    cob.Address,
+		Attributes: cob.Attributes,
+	}
+}
+
+func (r *controlObjectRecord) controlObject() proto.ControlObject {
+	return proto.ControlObject{
+		ID:         r.ID,
+		TS:         r.TS,
+		Passport:   r.Passport,
+		Surname:    r.Surname,
+		Name:       r.Name,
+		Patronymic: r.Patronymic,
+		Sex:        r.Sex,
+		BirthDate:  r.BirthDate,
+		PhoneNum:   r.PhoneNum,
+		Email:      r.Email,
+		Address:    r.Address,
+		Attributes: r.Attributes,
+	}
+}
+
+// imgRecord is an image record. File is empty, if image file couldn't be read on export.
+type imgRecord struct {
+	ID      string    `json:"id"`
+	TS      time.Time `json:"ts"`
+	FaceIDs []string  `json:"face_ids"`
+	File    string    `json:"file"`
+}
+
+type ffvRecord struct {
+	ID                   string                     `json:"id"`
+	CobID                string                     `json:"cob_id"`
+	ImgID                string                     `json:"img_id"`
+	FaceBox              proto.FaceBox              `json:"facebox"`
+	Model                string                     `json:"model"`
+	FacialFeaturesVector proto.FacialFeaturesVector `json:"ff"`
+}
+
+// walk calls fn for every archive entry until fn returns error.
+func walk(path string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to open archive")
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Wrap(err, "unable to read archive")
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to read archive")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Verify checks, that archive contains all files of its manifest with the same
+// checksums and no other files, and returns manifest.
+func Verify(path string) (*Manifest, error) {
+	sums := make(map[string]File)
+	var manifest *Manifest
+	err := walk(path, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name == manifestFile {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return errors.Wrap(err, "unable to read manifest")
+			}
+			manifest = &Manifest{}
+			return errors.Wrap(json.Unmarshal(data, manifest), "unable to parse manifest")
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, r)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read \"%s\"", hdr.Name)
+		}
+		sums[hdr.Name] = File{
+			Name:   hdr.Name,
+			Size:   n,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("archive has no \"%s\"", manifestFile)
+	}
+	if manifest.Format != Format {
+		return nil, fmt.Errorf("unknown archive format \"%s\"", manifest.Format)
+	}
+	if manifest.FormatVersion != FormatVersion {
+		return nil, fmt.Errorf("unsupported archive format version %d (expected %d)",
+			manifest.FormatVersion, FormatVersion)
+	}
+	for _, file := range manifest.Files {
+		sum, ok := sums[file.Name]
+		if !ok {
+			return nil, fmt.Errorf("archive has no \"%s\"", file.Name)
+		}
+		if (sum.Size != file.Size) || (sum.SHA256 != file.SHA256) {
+			return nil, fmt.Errorf("checksum of \"%s\" doesn't match manifest", file.Name)
+		}
+		delete(sums, file.Name)
+	}
+	for name := range sums {
+		return nil, fmt.Errorf("\"%s\" is not listed in manifest", name)
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,277 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+type testDeployment struct {
+	fs       *storages.MemoryFaceStorage
+	imgStore *imgstores.FSImgStore
+}
+
+func createTestDeployment(t *testing.T, dir string) *testDeployment {
+	imgStore, err := imgstores.CreateFSImgStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDeployment{
+		fs:       storages.CreateMemoryFaceStorage(0.95, -1),
+		imgStore: imgStore,
+	}
+}
+
+func createTestControlObject(id, passport, surname string) proto.ControlObject {
+	cob := proto.CreateDefaultControlObject()
+	cob.ID = id
+	cob.TS = time.Unix(time.Now().Unix(), 0)
+	cob.Passport = passport
+	cob.Surname = surname
+	cob.Attributes = map[string]string{"department": "5"}
+	return *cob
+}
+
+// fill inserts two control objects (the second one without passport) with two
+// images and three facial features vectors.
+func (d *testDeployment) fill(t *testing.T, cobs []proto.ControlObject) {
+	if err := d.fs.InsertControlObjects(cobs); err != nil {
+		t.Fatal(err)
+	}
+	imgsFaceIDs := [][]string{{cobs[0].ID, cobs[1].ID}, {cobs[0].ID}}
+	for i, faceIDs := range imgsFaceIDs {
+		id := uuid.Must(uuid.NewV4()).String()
+		data := append([]byte("\x89PNG\r\n\x1a\n"), id...)
+		key, err := d.imgStore.Put(id, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.fs.InsertImgs([]storages.Img{{
+			ID:      id,
+			TS:      time.Unix(time.Now().Unix(), 0),
+			Path:    key,
+			FaceIDs: faceIDs,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		for j, cobID := range faceIDs {
+			ffv := storages.FFV{
+				ID:                   uuid.Must(uuid.NewV4()).String(),
+				CobID:                cobID,
+				ImgID:                id,
+				FaceBox:              proto.FaceBox{0, 0, 10, 10},
+				FacialFeaturesVector: proto.FacialFeaturesVector{1.0, float64(i), float64(j)},
+			}
+			if _, err := d.fs.InsertFFVs([]storages.FFV{ffv}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// images returns data of images of control object, keyed by image ID.
+func (d *testDeployment) images(t *testing.T, cobID string) map[string][]byte {
+	ffvs, err := d.fs.SelectFFVsByControlObject(cobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(ffvs))
+	for _, ffv := range ffvs {
+		ids = append(ids, ffv.ImgID)
+	}
+	imgs, err := d.fs.SelectImgs(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make(map[string][]byte, len(imgs))
+	for _, img := range imgs {
+		if data[img.ID], err = d.imgStore.Get(img.Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+func TestExportImport(t *testing.T) {
+	srcCobs := []proto.ControlObject{
+		createTestControlObject(uuid.Must(uuid.NewV4()).String(), "4510 123456", "Ivanov"),
+		createTestControlObject(uuid.Must(uuid.NewV4()).String(), proto.DefaultStringField, "Petrov"),
+	}
+	tests := []struct {
+		name string
+		// existing control object with passport of the first one is in database.
+		existing    bool
+		overwrite   bool
+		importsNum  int
+		wantStats   ImportStats
+		wantSurname string
+	}{
+		{
+			name:        "empty database",
+			importsNum:  1,
+			wantStats:   ImportStats{CreatedControlObjectsNum: 2, ImgsNum: 2, ImgFilesNum: 2, FFVsNum: 3},
+			wantSurname: "Ivanov",
+		},
+		{
+			name:        "repeated",
+			importsNum:  2,
+			wantStats:   ImportStats{MergedControlObjectsNum: 2, ImgsNum: 2, ImgFilesNum: 2, FFVsNum: 0},
+			wantSurname: "Ivanov",
+		},
+		{
+			name:        "existing passport",
+			existing:    true,
+			importsNum:  1,
+			wantStats:   ImportStats{CreatedControlObjectsNum: 1, MergedControlObjectsNum: 1, ImgsNum: 2, ImgFilesNum: 2, FFVsNum: 3},
+			wantSurname: "Sidorov",
+		},
+		{
+			name:        "existing passport overwritten",
+			existing:    true,
+			overwrite:   true,
+			importsNum:  1,
+			wantStats:   ImportStats{CreatedControlObjectsNum: 1, MergedControlObjectsNum: 1, ImgsNum: 2, ImgFilesNum: 2, FFVsNum: 3},
+			wantSurname: "Ivanov",
+		},
+	}
+
+	im, err := identities.CreateModel(&cfgparser.IdentitiesCFG{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "facedb-archive")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			src := createTestDeployment(t, filepath.Join(dir, "src"))
+			src.fill(t, srcCobs)
+
+			path := filepath.Join(dir, "facedb.tar.gz")
+			buf := &bytes.Buffer{}
+			manifest, err := Export(src.fs, src.imgStore, buf, logger)
+			if err != nil {
+				t.Fatalf("Export() error: %s", err)
+			}
+			if (manifest.ControlObjectsNum != 2) || (manifest.ImgsNum != 2) || (manifest.FFVsNum != 3) {
+				t.Fatalf("Export() manifest = %+v, want 2 control objects, 2 images and 3 ffvs", manifest)
+			}
+			if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			dst := createTestDeployment(t, filepath.Join(dir, "dst"))
+			wantIDs := []string{srcCobs[0].ID, srcCobs[1].ID}
+			if tt.existing {
+				existing := createTestControlObject(uuid.Must(uuid.NewV4()).String(), srcCobs[0].Passport, "Sidorov")
+				if err := dst.fs.InsertControlObjects([]proto.ControlObject{existing}); err != nil {
+					t.Fatal(err)
+				}
+				wantIDs[0] = existing.ID
+			}
+			var stats *ImportStats
+			for i := 0; i < tt.importsNum; i++ {
+				if stats, err = Import(path, dst.fs, dst.imgStore, im, tt.overwrite, logger); err != nil {
+					t.Fatalf("Import() error: %s", err)
+				}
+			}
+			if *stats != tt.wantStats {
+				t.Errorf("Import() stats = %+v, want %+v", *stats, tt.wantStats)
+			}
+
+			for i, srcCob := range srcCobs {
+				cobs, err := dst.fs.SelectControlObjectsByIDs([]string{wantIDs[i]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(cobs) != 1 {
+					t.Fatalf("control object \"%s\" is not imported", wantIDs[i])
+				}
+				wantSurname := srcCob.Surname
+				if i == 0 {
+					wantSurname = tt.wantSurname
+				}
+				if (cobs[0].Passport != srcCob.Passport) || (cobs[0].Surname != wantSurname) ||
+					(cobs[0].Attributes["department"] != "5") {
+					t.Errorf("imported control object = %+v, want passport %q and surname %q",
+						cobs[0], srcCob.Passport, wantSurname)
+				}
+
+				srcImgs := src.images(t, srcCob.ID)
+				dstImgs := dst.images(t, wantIDs[i])
+				if len(dstImgs) != len(srcImgs) {
+					t.Errorf("control object \"%s\" has %d images, want %d", wantIDs[i], len(dstImgs), len(srcImgs))
+				}
+				for id, data := range srcImgs {
+					if !bytes.Equal(dstImgs[id], data) {
+						t.Errorf("image \"%s\" data is not imported", id)
+					}
+				}
+
+				centroids, err := dst.fs.SelectCentroids(wantIDs[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (len(centroids) != 1) || (centroids[0].FFVsNum != uint64(len(srcImgs))) {
+					t.Errorf("centroids of \"%s\" = %+v, want one of %d ffvs", wantIDs[i], centroids, len(srcImgs))
+				}
+			}
+		})
+	}
+}
+
+func TestImportRejectsTamperedArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "facedb-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	src := createTestDeployment(t, filepath.Join(dir, "src"))
+	src.fill(t, []proto.ControlObject{
+		createTestControlObject(uuid.Must(uuid.NewV4()).String(), "4510 123456", "Ivanov"),
+		createTestControlObject(uuid.Must(uuid.NewV4()).String(), proto.DefaultStringField, "Petrov"),
+	})
+	buf := &bytes.Buffer{}
+	if _, err := Export(src.fs, src.imgStore, buf, logger); err != nil {
+		t.Fatalf("Export() error: %s", err)
+	}
+	data := buf.Bytes()
+	data[len(data)/2] ^= 1
+	path := filepath.Join(dir, "facedb.tar.gz")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	im, err := identities.CreateModel(&cfgparser.IdentitiesCFG{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := createTestDeployment(t, filepath.Join(dir, "dst"))
+	if _, err := Import(path, dst.fs, dst.imgStore, im, false, logger); err == nil {
+		t.Fatal("Import() of tampered archive succeeded")
+	}
+	cobs, err := dst.fs.SelectControlObjects(&storages.ControlObjectsFilter{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cobs) != 0 {
+		t.Errorf("%d control objects are imported from tampered archive", len(cobs))
+	}
+}
@@ -0,0 +1,229 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/nofacedb/facedb/internal/version"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const exportBatchSize = 1000
+
+type writer struct {
+	tw       *tar.Writer
+	manifest *Manifest
+	ts       time.Time
+}
+
+// write writes archive entry from r of given size and adds it to manifest.
+func (w *writer) write(name string, size int64, r io.Reader) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  w.ts,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return errors.Wrapf(err, "unable to write \"%s\"", name)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w.tw, h), r); err != nil {
+		return errors.Wrapf(err, "unable to write \"%s\"", name)
+	}
+	w.manifest.Files = append(w.manifest.Files, File{
+		Name:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	})
+	return nil
+}
+
+// recordsFile is a temporary file with records, written before archiving, because
+// size of tar entry should be known before its data.
+type recordsFile struct {
+	name string
+	f    *os.File
+	bw   *bufio.Writer
+	enc  *json.Encoder
+}
+
+func createRecordsFile(dir, name string) (*recordsFile, error) {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create temporary file")
+	}
+	bw := bufio.NewWriter(f)
+	return &recordsFile{
+		name: name,
+		f:    f,
+		bw:   bw,
+		enc:  json.NewEncoder(bw),
+	}, nil
+}
+
+func (rf *recordsFile) archive(w *writer) error {
+	if err := rf.bw.Flush(); err != nil {
+		return errors.Wrap(err, "unable to write temporary file")
+	}
+	size, err := rf.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrap(err, "unable to write temporary file")
+	}
+	if _, err := rf.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "unable to read temporary file")
+	}
+	return w.write(rf.name, size, rf.f)
+}
+
+// Export writes archive of all not deleted control objects to out and returns its manifest.
+func Export(fs storages.FaceStorage, imgStore imgstores.ImgStore, out io.Writer, logger *log.Logger) (*Manifest, error) {
+	tmpDir, err := ioutil.TempDir("", "facedb-export")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create temporary directory")
+	}
+	defer os.RemoveAll(tmpDir)
+
+	gz := gzip.NewWriter(out)
+	w := &writer{
+		tw: tar.NewWriter(gz),
+		manifest: &Manifest{
+			Format:        Format,
+			FormatVersion: FormatVersion,
+			FACEDBVersion: version.Version,
+			CreatedAt:     time.Now(),
+			Files:         make([]File, 0, 1024),
+		},
+		ts: time.Now(),
+	}
+
+	cobsRecords, err := createRecordsFile(tmpDir, controlObjectsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer cobsRecords.f.Close()
+	cobIDs := make(map[string]struct{})
+	for offset := uint64(0); ; offset += exportBatchSize {
+		cobs, err := fs.SelectControlObjects(&storages.ControlObjectsFilter{}, offset, exportBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for i := range cobs {
+			cobIDs[cobs[i].ID] = struct{}{}
+			if err := cobsRecords.enc.Encode(createControlObjectRecord(&(cobs[i]))); err != nil {
+				return nil, errors.Wrap(err, "unable to write control object")
+			}
+		}
+		if len(cobs) < exportBatchSize {
+			break
+		}
+	}
+	w.manifest.ControlObjectsNum = uint64(len(cobIDs))
+	logger.Debugf("exported %d control objects", len(cobIDs))
+
+	// Images files are archived at once, records are archived after them.
+	imgsRecords, err := createRecordsFile(tmpDir, imgsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer imgsRecords.f.Close()
+	err = fs.ScanImgs(func(img *storages.Img) error {
+		rec := &imgRecord{
+			ID:      img.ID,
+			TS:      img.TS,
+			FaceIDs: make([]string, 0, len(img.FaceIDs)),
+		}
+		for _, faceID := range img.FaceIDs {
+			if _, ok := cobIDs[faceID]; ok {
+				rec.FaceIDs = append(rec.FaceIDs, faceID)
+			}
+		}
+		if len(rec.FaceIDs) == 0 {
+			return nil
+		}
+		data, err := imgStore.Get(img.Path)
+		if err != nil {
+			logger.Warnf("unable to read image \"%s\", its file is not exported: %s", img.Path, err)
+		} else {
+			rec.File = imgsDir + img.ID
+			if err := w.write(rec.File, int64(len(data)), bytes.NewReader(data)); err != nil {
+				return err
+			}
+			w.manifest.ImgFilesNum++
+		}
+		w.manifest.ImgsNum++
+		return errors.Wrap(imgsRecords.enc.Encode(rec), "unable to write image record")
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("exported %d images", w.manifest.ImgsNum)
+
+	ffvsRecords, err := createRecordsFile(tmpDir, ffvsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer ffvsRecords.f.Close()
+	err = fs.ScanFFVs(func(ffv *storages.FFV) error {
+		if _, ok := cobIDs[ffv.CobID]; !ok {
+			return nil
+		}
+		w.manifest.FFVsNum++
+		return errors.Wrap(ffvsRecords.enc.Encode(&ffvRecord{
+			ID:                   ffv.ID,
+			CobID:                ffv.CobID,
+			ImgID:                ffv.ImgID,
+			FaceBox:              ffv.FaceBox,
+			Model:                ffv.Model,
+			FacialFeaturesVector: ffv.FacialFeaturesVector,
+		}), "unable to write facial features vector")
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("exported %d facial features vectors", w.manifest.FFVsNum)
+
+	for _, rf := range []*recordsFile{cobsRecords, imgsRecords, ffvsRecords} {
+		if err := rf.archive(w); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal manifest")
+	}
+	if err := w.tw.WriteHeader(&tar.Header{
+		Name:     manifestFile,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  w.ts,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return nil, errors.Wrap(err, "unable to write manifest")
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return nil, errors.Wrap(err, "unable to write manifest")
+	}
+	if err := w.tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "unable to write archive")
+	}
+	if err := gz.Close(); err != nil {
+		return nil, errors.Wrap(err, "unable to write archive")
+	}
+
+	return w.manifest, nil
+}
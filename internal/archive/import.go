@@ -0,0 +1,310 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Import merges archive into existing database. Archived control object with the same
+passport as existing one is merged into it: its images and facial features vectors
+are attached to existing control object, and its fields are kept (or replaced by
+archived ones, if overwrite is set). Control object without passport is merged into
+existing one with the same ID and without passport. Archived control object, which ID
+is already used by control object with other passport, gets new ID. Images and facial
+features vectors with already existing IDs are skipped, so import may be repeated.
+*/
+
+const (
+	importBatchSize    = 1000
+	centroidsBatchSize = 100
+)
+
+// ImportStats contains numbers of imported records.
+type ImportStats struct {
+	CreatedControlObjectsNum uint64
+	MergedControlObjectsNum  uint64
+	ImgsNum                  uint64
+	ImgFilesNum              uint64
+	FFVsNum                  uint64
+}
+
+type importer struct {
+	fs        storages.FaceStorage
+	imgStore  imgstores.ImgStore
+	overwrite bool
+	stats     *ImportStats
+	// cobIDs maps archived control objects IDs to IDs in database.
+	cobIDs   map[string]string
+	imgPaths map[string]string
+	logger   *log.Logger
+}
+
+// Import verifies archive and imports it into fs and imgStore.
+func Import(path string, fs storages.FaceStorage, imgStore imgstores.ImgStore,
+	im *identities.Model, overwrite bool, logger *log.Logger) (*ImportStats, error) {
+	manifest, err := Verify(path)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("verified archive, created at %s by FACEDB (%s)",
+		manifest.CreatedAt, manifest.FACEDBVersion)
+
+	imp := &importer{
+		fs:        fs,
+		imgStore:  imgStore,
+		overwrite: overwrite,
+		stats:     &ImportStats{},
+		cobIDs:    make(map[string]string),
+		imgPaths:  make(map[string]string),
+		logger:    logger,
+	}
+	err = walk(path, func(hdr *tar.Header, r io.Reader) error {
+		switch {
+		case strings.HasPrefix(hdr.Name, imgsDir):
+			return imp.importImgFile(hdr.Name, r)
+		case hdr.Name == controlObjectsFile:
+			return imp.importControlObjects(r)
+		case hdr.Name == imgsFile:
+			return imp.importImgs(r)
+		case hdr.Name == ffvsFile:
+			return imp.importFFVs(r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(imp.cobIDs))
+	seen := make(map[string]struct{}, len(imp.cobIDs))
+	for _, id := range imp.cobIDs {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			ids = append(ids, id)
+		}
+	}
+	for i := 0; i < len(ids); i += centroidsBatchSize {
+		j := i + centroidsBatchSize
+		if j > len(ids) {
+			j = len(ids)
+		}
+		if err := storages.RefreshCentroids(fs, im, ids[i:j]); err != nil {
+			return nil, errors.Wrap(err, "unable to rebuild centroids")
+		}
+	}
+
+	return imp.stats, nil
+}
+
+// decode calls fn for every JSON record of r.
+func decode(r io.Reader, newRecord func() interface{}, fn func(rec interface{}) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		rec := newRecord()
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "unable to parse record")
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func (imp *importer) importImgFile(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read \"%s\"", name)
+	}
+	uid, err := uuid.FromString(strings.TrimPrefix(name, imgsDir))
+	if err != nil {
+		return errors.Wrapf(err, "invalid image file name \"%s\"", name)
+	}
+	id := uid.String()
+	key, err := imp.imgStore.Put(id, data)
+	if err != nil {
+		return errors.Wrapf(err, "unable to store image \"%s\"", id)
+	}
+	imp.imgPaths[name] = key
+	imp.stats.ImgFilesNum++
+	return nil
+}
+
+// noPassport returns true, if passport is not specified.
+func noPassport(passport string) bool {
+	return (passport == "") || (passport == proto.DefaultStringField)
+}
+
+// resolveControlObject returns ID of control object in database and
+// control object to insert (nil, if existing one is kept).
+func (imp *importer) resolveControlObject(cob proto.ControlObject) (string, *proto.ControlObject, error) {
+	if !noPassport(cob.Passport) {
+		dbCob, err := imp.fs.SelectControlObjectByPassport(cob.Passport)
+		if err != nil {
+			return "", nil, err
+		}
+		if dbCob.ID != proto.DefaultStringField {
+			imp.stats.MergedControlObjectsNum++
+			if !imp.overwrite {
+				return dbCob.ID, nil, nil
+			}
+			cob.ID = dbCob.ID
+			return cob.ID, &cob, nil
+		}
+	}
+	dbCobs, err := imp.fs.SelectControlObjectsByIDs([]string{cob.ID})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(dbCobs) != 0 {
+		// The same control object without passport was imported before.
+		if (dbCobs[0].Passport == cob.Passport) ||
+			(noPassport(dbCobs[0].Passport) && noPassport(cob.Passport)) {
+			imp.stats.MergedControlObjectsNum++
+			if !imp.overwrite {
+				return cob.ID, nil, nil
+			}
+			return cob.ID, &cob, nil
+		}
+		cob.ID = uuid.Must(uuid.NewV4()).String()
+	}
+	imp.stats.CreatedControlObjectsNum++
+	return cob.ID, &cob, nil
+}
+
+func (imp *importer) importControlObjects(r io.Reader) error {
+	cobs := make([]proto.ControlObject, 0, importBatchSize)
+	flush := func() error {
+		if len(cobs) == 0 {
+			return nil
+		}
+		if err := imp.fs.InsertControlObjects(cobs); err != nil {
+			return err
+		}
+		cobs = cobs[:0]
+		return nil
+	}
+	err := decode(r, func() interface{} { return &controlObjectRecord{} }, func(rec interface{}) error {
+		cobRec := rec.(*controlObjectRecord)
+		id, cob, err := imp.resolveControlObject(cobRec.controlObject())
+		if err != nil {
+			return err
+		}
+		imp.cobIDs[cobRec.ID] = id
+		if cob == nil {
+			return nil
+		}
+		cobs = append(cobs, *cob)
+		if len(cobs) < importBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (imp *importer) importImgs(r io.Reader) error {
+	imgs := make([]storages.Img, 0, importBatchSize)
+	flush := func() error {
+		if len(imgs) == 0 {
+			return nil
+		}
+		if err := imp.fs.InsertImgs(imgs); err != nil {
+			return err
+		}
+		imp.stats.ImgsNum += uint64(len(imgs))
+		imgs = imgs[:0]
+		return nil
+	}
+	err := decode(r, func() interface{} { return &imgRecord{} }, func(rec interface{}) error {
+		imgRec := rec.(*imgRecord)
+		if imgRec.File == "" {
+			imp.logger.Warnf("image \"%s\" has no file in archive, it is skipped", imgRec.ID)
+			return nil
+		}
+		path, ok := imp.imgPaths[imgRec.File]
+		if !ok {
+			return fmt.Errorf("image \"%s\" file \"%s\" was not imported", imgRec.ID, imgRec.File)
+		}
+		img := storages.Img{
+			ID:      imgRec.ID,
+			TS:      imgRec.TS,
+			Path:    path,
+			FaceIDs: make([]string, 0, len(imgRec.FaceIDs)),
+		}
+		for _, faceID := range imgRec.FaceIDs {
+			if id, ok := imp.cobIDs[faceID]; ok {
+				img.FaceIDs = append(img.FaceIDs, id)
+			}
+		}
+		imgs = append(imgs, img)
+		if len(imgs) < importBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (imp *importer) importFFVs(r io.Reader) error {
+	ffvs := make([]storages.FFV, 0, importBatchSize)
+	flush := func() error {
+		if len(ffvs) == 0 {
+			return nil
+		}
+		inserted, err := imp.fs.InsertFFVs(ffvs)
+		if err != nil {
+			return err
+		}
+		imp.stats.FFVsNum += uint64(len(inserted))
+		ffvs = ffvs[:0]
+		return nil
+	}
+	err := decode(r, func() interface{} { return &ffvRecord{} }, func(rec interface{}) error {
+		ffvRec := rec.(*ffvRecord)
+		cobID, ok := imp.cobIDs[ffvRec.CobID]
+		if !ok {
+			return fmt.Errorf("facial features vector \"%s\" belongs to unknown control object \"%s\"",
+				ffvRec.ID, ffvRec.CobID)
+		}
+		ffvs = append(ffvs, storages.FFV{
+			ID:                   ffvRec.ID,
+			CobID:                cobID,
+			ImgID:                ffvRec.ImgID,
+			FaceBox:              ffvRec.FaceBox,
+			Model:                ffvRec.Model,
+			FacialFeaturesVector: ffvRec.FacialFeaturesVector,
+		})
+		if len(ffvs) < importBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,118 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+)
+
+// Decision is operator decision about one facebox: Before is control object, suggested
+// by DB server (nil for facebox, marked by operator), After is control object, sent by
+// operator (nil for suggested facebox, which operator didn't send; on submit it has ID
+// of stored control object). Control objects aren't appended to log, only IDs, names
+// of changed fields and digest of their values.
+type Decision struct {
+	FaceBox proto.FaceBox
+	Before  *proto.ControlObject
+	After   *proto.ControlObject
+}
+
+// fields returns business-logic fields of cob, keyed by name.
+func fields(cob *proto.ControlObject) map[string]string {
+	f := map[string]string{
+		"passport":   cob.Passport,
+		"surname":    cob.Surname,
+		"name":       cob.Name,
+		"patronymic": cob.Patronymic,
+		"sex":        cob.Sex,
+		"birthdate":  cob.BirthDate,
+		"phone_num":  cob.PhoneNum,
+		"email":      cob.Email,
+		"address":    cob.Address,
+	}
+	for k, v := range cob.Attributes {
+		f["attributes."+k] = v
+	}
+	return f
+}
+
+// changedFields returns sorted names of fields of after, which differ from before,
+// and their values in after. If before is nil, all not default fields are changed.
+func changedFields(before, after *proto.ControlObject) ([]string, map[string]string) {
+	afterFields := fields(after)
+	beforeFields := map[string]string{}
+	if before != nil {
+		beforeFields = fields(before)
+	}
+	names := make([]string, 0)
+	values := make(map[string]string)
+	for name, v := range afterFields {
+		old, ok := beforeFields[name]
+		if ok && (old == v) {
+			continue
+		}
+		if !ok && ((v == proto.DefaultStringField) || (v == "")) {
+			continue
+		}
+		names = append(names, name)
+		values[name] = v
+	}
+	for name := range beforeFields {
+		if _, ok := afterFields[name]; !ok {
+			names = append(names, name)
+			values[name] = ""
+		}
+	}
+	sort.Strings(names)
+	return names, values
+}
+
+// digest returns hex-encoded HMAC-SHA256 of values, keyed by salt.
+func digest(salt []byte, values map[string]string) (string, error) {
+	// Keys of map are marshaled sorted, so digest doesn't depend on order.
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal changed fields")
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// createEntry returns audit entry of d with digest, keyed by salt.
+func createEntry(d *Decision, salt []byte) (proto.AuditEntry, error) {
+	e := proto.AuditEntry{
+		FaceBox: d.FaceBox,
+		Changed: make([]string, 0),
+	}
+	if d.Before != nil {
+		e.SuggestedID = d.Before.ID
+	}
+	switch {
+	case d.After == nil:
+		e.Decision = proto.AuditRejected
+		return e, nil
+	case d.Before == nil:
+		e.Decision = proto.AuditAdded
+	default:
+		e.Decision = proto.AuditConfirmed
+	}
+	e.CobID = d.After.ID
+
+	names, values := changedFields(d.Before, d.After)
+	if len(names) == 0 {
+		return e, nil
+	}
+	if d.Before != nil {
+		e.Decision = proto.AuditCorrected
+	}
+	e.Changed = names
+	var err error
+	e.Digest, err = digest(salt, values)
+	return e, err
+}
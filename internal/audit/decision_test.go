@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+func createTestControlObject(id, surname string) *proto.ControlObject {
+	cob := proto.CreateDefaultControlObject()
+	cob.ID = id
+	cob.Passport = "4510 123456"
+	cob.Surname = surname
+	return cob
+}
+
+func TestCreateEntry(t *testing.T) {
+	tests := []struct {
+		name         string
+		decision     Decision
+		wantDecision string
+		wantChanged  []string
+		wantDigest   bool
+	}{
+		{
+			name: "confirmed",
+			decision: Decision{
+				Before: createTestControlObject("cob-1", "Ivanov"),
+				After:  createTestControlObject("cob-1", "Ivanov"),
+			},
+			wantDecision: proto.AuditConfirmed,
+			wantChanged:  []string{},
+		},
+		{
+			name: "corrected",
+			decision: Decision{
+				Before: createTestControlObject("cob-1", "Ivanov"),
+				After:  createTestControlObject("cob-1", "Petrov"),
+			},
+			wantDecision: proto.AuditCorrected,
+			wantChanged:  []string{"surname"},
+			wantDigest:   true,
+		},
+		{
+			name: "added",
+			decision: Decision{
+				After: createTestControlObject("cob-2", "Petrov"),
+			},
+			wantDecision: proto.AuditAdded,
+			wantChanged:  []string{"passport", "surname"},
+			wantDigest:   true,
+		},
+		{
+			name: "rejected",
+			decision: Decision{
+				Before: createTestControlObject("cob-1", "Ivanov"),
+			},
+			wantDecision: proto.AuditRejected,
+			wantChanged:  []string{},
+		},
+	}
+	salt := []byte("salt")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := createEntry(&(tt.decision), salt)
+			if err != nil {
+				t.Fatalf("createEntry() error: %s", err)
+			}
+			if e.Decision != tt.wantDecision {
+				t.Errorf("Decision = %q, want %q", e.Decision, tt.wantDecision)
+			}
+			if !reflect.DeepEqual(e.Changed, tt.wantChanged) {
+				t.Errorf("Changed = %v, want %v", e.Changed, tt.wantChanged)
+			}
+			if (e.Digest != "") != tt.wantDigest {
+				t.Errorf("Digest = %q, want digest %v", e.Digest, tt.wantDigest)
+			}
+			data, err := json.Marshal(&e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range []string{"4510", "Ivanov", "Petrov"} {
+				if strings.Contains(string(data), v) {
+					t.Errorf("entry %s contains personal data %q", data, v)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestDependsOnSalt(t *testing.T) {
+	values := map[string]string{"surname": "Petrov"}
+	d1, err := digest([]byte("salt-1"), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := digest([]byte("salt-2"), values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 == d2 {
+		t.Errorf("digests with different salts are equal")
+	}
+}
@@ -0,0 +1,174 @@
+package audit
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+/*
+Audit log is an append-only log of operators decisions. It consists of chains:
+every Log appends records to its own chain with random ID, so servers never append
+records with the same Seq. Every record contains Seq (its position in chain, starting
+from 1) and hash of previous record of chain, and its own hash is SHA-256 of previous
+hash and JSON of all other fields except salt, so change or removal of any record
+(except the last ones) breaks chain after it. Hashes of the last records, returned by
+verification, may be saved elsewhere to detect removal of records from the ends of
+chains. If record isn't inserted, Log starts new chain, because it may be inserted
+partially.
+
+Records don't contain control objects, only their IDs, names of changed fields and
+HMAC of their values, keyed by random salt of record. Salt isn't hashed, so it may
+be cleared without breaking chain, and then digests can't be compared with personal
+data anymore.
+*/
+
+// Log appends records to its chain of audit log and verifies all chains.
+type Log struct {
+	fs       storages.FaceStorage
+	mu       sync.Mutex
+	chain    string
+	lastSeq  uint64
+	lastHash string
+}
+
+// CreateLog creates Log, which keeps records in fs.
+func CreateLog(fs storages.FaceStorage) *Log {
+	return &Log{
+		fs:    fs,
+		mu:    sync.Mutex{},
+		chain: uuid.Must(uuid.NewV4()).String(),
+	}
+}
+
+// hashedRecord is a part of AuditRecord, which hash is computed.
+// TS is UNIX timestamp, because storage keeps only seconds.
+type hashedRecord struct {
+	Chain    string             `json:"chain"`
+	Seq      uint64             `json:"seq"`
+	ID       string             `json:"id"`
+	TS       int64              `json:"ts"`
+	SrcAddr  string             `json:"src_addr"`
+	Command  string             `json:"command"`
+	ImgUUID  string             `json:"img_uuid"`
+	Entries  []proto.AuditEntry `json:"entries"`
+	PrevHash string             `json:"prev_hash"`
+}
+
+// Hash returns hex-encoded hash of rec.
+func Hash(rec *proto.AuditRecord) (string, error) {
+	data, err := json.Marshal(&hashedRecord{
+		Chain:    rec.Chain,
+		Seq:      rec.Seq,
+		ID:       rec.ID,
+		TS:       rec.TS.Unix(),
+		SrcAddr:  rec.SrcAddr,
+		Command:  rec.Command,
+		ImgUUID:  rec.ImgUUID,
+		Entries:  rec.Entries,
+		PrevHash: rec.PrevHash,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to marshal audit record %d", rec.Seq)
+	}
+	h := sha256.New()
+	h.Write([]byte(rec.PrevHash))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Append appends record of decisions with given command on image with imgUUID,
+// sent from control panel srcAddr.
+func (l *Log) Append(srcAddr, command, imgUUID string, decisions []Decision) (*proto.AuditRecord, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "unable to generate salt")
+	}
+	entries := make([]proto.AuditEntry, 0, len(decisions))
+	for i := range decisions {
+		e, err := createEntry(&(decisions[i]), salt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec := &proto.AuditRecord{
+		Chain:    l.chain,
+		Seq:      l.lastSeq + 1,
+		ID:       uuid.Must(uuid.NewV4()).String(),
+		TS:       time.Unix(time.Now().Unix(), 0),
+		SrcAddr:  srcAddr,
+		Command:  command,
+		ImgUUID:  imgUUID,
+		Entries:  entries,
+		Salt:     hex.EncodeToString(salt),
+		PrevHash: l.lastHash,
+	}
+	hash, err := Hash(rec)
+	if err != nil {
+		return nil, err
+	}
+	rec.Hash = hash
+	if err := l.fs.InsertAuditRecord(rec); err != nil {
+		l.chain, l.lastSeq, l.lastHash = uuid.Must(uuid.NewV4()).String(), 0, ""
+		return nil, errors.Wrap(err, "unable to insert audit record")
+	}
+	l.lastSeq, l.lastHash = rec.Seq, rec.Hash
+	return rec, nil
+}
+
+var errBrokenChain = errors.New("audit log hash chain is broken")
+
+// Verify checks records of all chains of audit log in Seq order and returns the
+// first broken one. RecordsNum is number of valid records before it.
+func (l *Log) Verify() (*proto.AuditVerification, error) {
+	v := &proto.AuditVerification{
+		Valid:      true,
+		LastHashes: make(map[string]string),
+	}
+	seqs := make(map[string]uint64)
+	err := l.fs.ScanAuditRecords(func(rec *proto.AuditRecord) error {
+		reason := ""
+		if rec.Seq != seqs[rec.Chain]+1 {
+			reason = fmt.Sprintf("expected seq %d, got %d", seqs[rec.Chain]+1, rec.Seq)
+		} else if rec.PrevHash != v.LastHashes[rec.Chain] {
+			reason = "previous hash doesn't match hash of previous record"
+		} else if hash, err := Hash(rec); err != nil {
+			return err
+		} else if hash != rec.Hash {
+			reason = "hash doesn't match record"
+		}
+		if reason != "" {
+			seq := rec.Seq
+			v.Valid = false
+			v.BrokenChain = rec.Chain
+			v.BrokenSeq = &seq
+			v.Reason = reason
+			return errBrokenChain
+		}
+		if seqs[rec.Chain] == 0 {
+			v.ChainsNum++
+		}
+		seqs[rec.Chain] = rec.Seq
+		v.RecordsNum++
+		v.LastHashes[rec.Chain] = rec.Hash
+		return nil
+	})
+	if (err != nil) && (err != errBrokenChain) {
+		return nil, errors.Wrap(err, "unable to verify audit log")
+	}
+	return v, nil
+}
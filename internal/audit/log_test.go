@@ -0,0 +1,179 @@
+package audit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+)
+
+const testRecordsNum = 5
+
+// createTestChain returns valid chain of records in Seq order.
+func createTestChain(t *testing.T) []proto.AuditRecord {
+	fs := storages.CreateMemoryFaceStorage(0.95, -1)
+	l := CreateLog(fs)
+	for i := 0; i < testRecordsNum; i++ {
+		decisions := []Decision{{
+			Before: &proto.ControlObject{ID: fmt.Sprintf("cob-%d", i), Surname: "Ivanov"},
+			After:  &proto.ControlObject{ID: fmt.Sprintf("cob-%d", i), Surname: "Petrov"},
+		}}
+		if _, err := l.Append("http://127.0.0.1:9091", "put_control", fmt.Sprintf("img-%d", i), decisions); err != nil {
+			t.Fatalf("Append() error: %s", err)
+		}
+	}
+	recs, err := fs.SelectAuditRecords(&storages.AuditFilter{}, 0, testRecordsNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+		recs[i], recs[j] = recs[j], recs[i]
+	}
+	return recs
+}
+
+func rehash(t *testing.T, rec *proto.AuditRecord) {
+	hash, err := Hash(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Hash = hash
+}
+
+func TestLogVerify(t *testing.T) {
+	tests := []struct {
+		name       string
+		tamper     func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord
+		brokenSeq  uint64
+		recordsNum uint64
+	}{
+		{
+			name:       "valid",
+			tamper:     func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord { return recs },
+			recordsNum: testRecordsNum,
+		},
+		{
+			name: "changed command",
+			tamper: func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord {
+				recs[2].Command = "delete_control"
+				return recs
+			},
+			brokenSeq:  3,
+			recordsNum: 2,
+		},
+		{
+			name: "changed entry",
+			tamper: func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord {
+				recs[1].Entries[0].Changed = []string{"name"}
+				return recs
+			},
+			brokenSeq:  2,
+			recordsNum: 1,
+		},
+		{
+			name: "cleared salt",
+			tamper: func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord {
+				recs[2].Salt = ""
+				return recs
+			},
+			recordsNum: testRecordsNum,
+		},
+		{
+			name: "changed and rehashed",
+			tamper: func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord {
+				recs[2].SrcAddr = "http://127.0.0.1:9092"
+				rehash(t, &(recs[2]))
+				return recs
+			},
+			brokenSeq:  4,
+			recordsNum: 3,
+		},
+		{
+			name: "removed",
+			tamper: func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord {
+				return append(recs[:1], recs[2:]...)
+			},
+			brokenSeq:  3,
+			recordsNum: 1,
+		},
+		{
+			name: "removed and renumbered",
+			tamper: func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord {
+				recs = append(recs[:1], recs[2:]...)
+				for i := 1; i < len(recs); i++ {
+					recs[i].Seq = uint64(i + 1)
+					rehash(t, &(recs[i]))
+				}
+				return recs
+			},
+			brokenSeq:  2,
+			recordsNum: 1,
+		},
+		{
+			name: "swapped",
+			tamper: func(t *testing.T, recs []proto.AuditRecord) []proto.AuditRecord {
+				recs[3], recs[4] = recs[4], recs[3]
+				return recs
+			},
+			brokenSeq:  5,
+			recordsNum: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := storages.CreateMemoryFaceStorage(0.95, -1)
+			for _, rec := range tt.tamper(t, createTestChain(t)) {
+				if err := fs.InsertAuditRecord(&rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			v, err := CreateLog(fs).Verify()
+			if err != nil {
+				t.Fatalf("Verify() error: %s", err)
+			}
+			if v.RecordsNum != tt.recordsNum {
+				t.Errorf("RecordsNum = %d, want %d", v.RecordsNum, tt.recordsNum)
+			}
+			if tt.brokenSeq == 0 {
+				if !v.Valid || (v.BrokenSeq != nil) {
+					t.Errorf("Verify() = invalid at %v (%s), want valid", v.BrokenSeq, v.Reason)
+				}
+				return
+			}
+			if v.Valid || (v.BrokenSeq == nil) || (*(v.BrokenSeq) != tt.brokenSeq) || (v.Reason == "") {
+				t.Errorf("Verify() = valid %v, broken seq %v, want broken seq %d", v.Valid, v.BrokenSeq, tt.brokenSeq)
+			}
+		})
+	}
+}
+
+func TestLogChains(t *testing.T) {
+	fs := storages.CreateMemoryFaceStorage(0.95, -1)
+	logs := []*Log{CreateLog(fs), CreateLog(fs)}
+	lastHashes := make(map[string]string)
+	for i := 0; i < testRecordsNum; i++ {
+		for _, l := range logs {
+			rec, err := l.Append("http://127.0.0.1:9091", "put_control", fmt.Sprintf("img-%d", i), nil)
+			if err != nil {
+				t.Fatalf("Append() error: %s", err)
+			}
+			if rec.Seq != uint64(i+1) {
+				t.Errorf("Seq = %d, want %d", rec.Seq, i+1)
+			}
+			lastHashes[rec.Chain] = rec.Hash
+		}
+	}
+	v, err := CreateLog(fs).Verify()
+	if err != nil {
+		t.Fatalf("Verify() error: %s", err)
+	}
+	if !v.Valid || (v.ChainsNum != 2) || (v.RecordsNum != 2*testRecordsNum) {
+		t.Errorf("Verify() = %+v, want valid 2 chains of %d records", v, testRecordsNum)
+	}
+	for chain, hash := range lastHashes {
+		if v.LastHashes[chain] != hash {
+			t.Errorf("last hash of chain \"%s\" = %q, want %q", chain, v.LastHashes[chain], hash)
+		}
+	}
+}
@@ -9,9 +9,11 @@ import (
 )
 
 type cArgs struct {
-	ConfigPath string
-	Addr       string
-	Port       int
+	ConfigPath  string
+	Addr        string
+	Port        int
+	Command     string
+	CommandArgs []string
 }
 
 func parseCArgs() *cArgs {
@@ -28,5 +30,10 @@ func parseCArgs() *cArgs {
 		os.Exit(0)
 	}
 
+	if flag.NArg() != 0 {
+		cargs.Command = flag.Arg(0)
+		cargs.CommandArgs = flag.Args()[1:]
+	}
+
 	return cargs
 }
@@ -49,19 +49,92 @@ type HTTPClientCFG struct {
 	TimeoutMS int `yaml:"timeout_ms"`
 }
 
+// IndexCFG contains config for in-process approximate nearest neighbour
+// index of control objects embedded facial features vectors.
+type IndexCFG struct {
+	SnapshotPath       string `yaml:"snapshot_path"`
+	SnapshotIntervalMS int    `yaml:"snapshot_interval_ms"`
+	ReloadIntervalMS   int    `yaml:"reload_interval_ms"`
+	M                  int    `yaml:"m"`
+	EfConstruction     int    `yaml:"ef_construction"`
+	EfSearch           int    `yaml:"ef_search"`
+	// ReadOnlySnapshot is set by commands: snapshot is loaded, but isn't written,
+	// because it belongs to servers.
+	ReadOnlySnapshot bool `yaml:"-"`
+}
+
 // StorageCFG contains config for facial features storage.
 type StorageCFG struct {
-	Addr           string  `yaml:"addr"`
-	Port           int     `yaml:"port"`
-	User           string  `yaml:"user"`
-	Password       string  `yaml:"passwd"`
-	MaxPings       int     `yaml:"max_pings"`
-	DefaultDB      string  `yaml:"default_db"`
-	WriteTimeoutMS int     `yaml:"write_timeout_ms"`
-	ReadTimeoutMS  int     `yaml:"read_timeout_ms"`
-	ImgPath        string  `yaml:"img_path"`
-	Debug          bool    `yaml:"debug"`
-	CosineBoundary float64 `yaml:"cosine_boundary"`
+	Type           string        `yaml:"type"`
+	Addr           string        `yaml:"addr"`
+	Port           int           `yaml:"port"`
+	User           string        `yaml:"user"`
+	Password       string        `yaml:"passwd"`
+	MaxPings       int           `yaml:"max_pings"`
+	DefaultDB      string        `yaml:"default_db"`
+	WriteTimeoutMS int           `yaml:"write_timeout_ms"`
+	ReadTimeoutMS  int           `yaml:"read_timeout_ms"`
+	ImgPath        string        `yaml:"img_path"`
+	ImgStoreCFG    ImgStoreCFG   `yaml:"img_store"`
+	Debug          bool          `yaml:"debug"`
+	AutoMigrate    bool          `yaml:"auto_migrate"`
+	CosineBoundary float64       `yaml:"cosine_boundary"`
+	TopK           int           `yaml:"top_k"`
+	MatchMode      string        `yaml:"match_mode"`
+	BucketRadius   int           `yaml:"bucket_radius"`
+	IndexCFG       IndexCFG      `yaml:"index"`
+	WALCFG         WALCFG        `yaml:"wal"`
+	BatchCFG       BatchCFG      `yaml:"batch"`
+	IdentitiesCFG  IdentitiesCFG `yaml:"identities"`
+	EncryptionCFG  EncryptionCFG `yaml:"encryption"`
+}
+
+// EncryptionCFG contains config for encryption of personal data and images at rest.
+// Empty Provider disables encryption.
+type EncryptionCFG struct {
+	Provider         string `yaml:"provider"`
+	KeyFile          string `yaml:"keyfile"`
+	ReloadIntervalMS int    `yaml:"reload_interval_ms"`
+}
+
+// IdentitiesCFG contains config for robust centroids of control objects.
+type IdentitiesCFG struct {
+	Method             string  `yaml:"method"`
+	OutlierThreshold   float64 `yaml:"outlier_threshold"`
+	TrimFraction       float64 `yaml:"trim_fraction"`
+	MinFFVs            int     `yaml:"min_ffvs"`
+	DuplicateThreshold float64 `yaml:"duplicate_threshold"`
+}
+
+// WALCFG contains config for write-ahead log of commits intents.
+type WALCFG struct {
+	Path            string `yaml:"path"`
+	RetryIntervalMS int    `yaml:"retry_interval_ms"`
+	MaxAttempts     int    `yaml:"max_attempts"`
+}
+
+// BatchCFG contains config for batched ClickHouse DB inserts.
+type BatchCFG struct {
+	MaxRows         int `yaml:"max_rows"`
+	MaxPendingRows  int `yaml:"max_pending_rows"`
+	FlushIntervalMS int `yaml:"flush_interval_ms"`
+}
+
+// ImgStoreCFG contains config for images store.
+// Local filesystem store keeps images in StorageCFG.ImgPath.
+type ImgStoreCFG struct {
+	Type  string `yaml:"type"`
+	S3CFG S3CFG  `yaml:"s3"`
+}
+
+// S3CFG contains config for S3-compatible images store.
+type S3CFG struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	TimeoutMS int    `yaml:"timeout_ms"`
 }
 
 // FaceRecognizersCFG contains config for face recognition engine.
@@ -80,6 +153,57 @@ type ControlPanelsCFG struct {
 	ACQCleanMS    int      `yaml:"ac_q_clean_ms"`
 }
 
+// WatchlistsCFG contains config for watchlists alerts.
+type WatchlistsCFG struct {
+	ReloadIntervalMS int `yaml:"reload_interval_ms"`
+}
+
+// NameSearchCFG contains config for search of control objects by names.
+type NameSearchCFG struct {
+	ReloadIntervalMS int `yaml:"reload_interval_ms"`
+	MaxDistance      int `yaml:"max_distance"`
+}
+
+// ClusteringCFG contains config for clustering of unmatched faces.
+type ClusteringCFG struct {
+	MaxDistance        float64 `yaml:"max_distance"`
+	MinFaces           int     `yaml:"min_faces"`
+	RepresentativesNum int     `yaml:"representatives_num"`
+	MaxSightings       uint64  `yaml:"max_sightings"`
+}
+
+// RetentionCFG contains config for expiry of images and faces. Zero days keep data forever.
+type RetentionCFG struct {
+	IntervalMS               int                  `yaml:"interval_ms"`
+	BatchSize                uint64               `yaml:"batch_size"`
+	SightingsImagesDays      int                  `yaml:"sightings_images_days"`
+	ControlObjectsImagesDays int                  `yaml:"control_objects_images_days"`
+	UnmatchedFacesDays       int                  `yaml:"unmatched_faces_days"`
+	SightingsDays            int                  `yaml:"sightings_days"`
+	Sources                  []SourceRetentionCFG `yaml:"sources"`
+}
+
+// SourceRetentionCFG contains config for expiry of matched faces from image source.
+type SourceRetentionCFG struct {
+	SrcAddr string `yaml:"src_addr"`
+	Days    int    `yaml:"days"`
+}
+
+// EnrollmentCFG contains config for bulk enrollment command.
+type EnrollmentCFG struct {
+	Listen    string `yaml:"listen"`
+	SrcAddr   string `yaml:"src_addr"`
+	TimeoutMS int    `yaml:"timeout_ms"`
+	Workers   int    `yaml:"workers"`
+}
+
+// ValidationCFG contains config for validation of incoming messages.
+type ValidationCFG struct {
+	ModelsDims map[string]int `yaml:"models_dims"`
+	MinFFVNorm float64        `yaml:"min_ffv_norm"`
+	MaxFFVNorm float64        `yaml:"max_ffv_norm"`
+}
+
 // LoggerCFG ...
 type LoggerCFG struct {
 	Output          string `yaml:"output"`
@@ -96,7 +220,17 @@ type CFG struct {
 	StorageCFG         StorageCFG         `yaml:"storage"`
 	FaceRecognizersCFG FaceRecognizersCFG `yaml:"face_recognizers"`
 	ControlPanelsCFG   ControlPanelsCFG   `yaml:"control_panels"`
+	WatchlistsCFG      WatchlistsCFG      `yaml:"watchlists"`
+	NameSearchCFG      NameSearchCFG      `yaml:"name_search"`
+	ClusteringCFG      ClusteringCFG      `yaml:"clustering"`
+	RetentionCFG       RetentionCFG       `yaml:"retention"`
+	EnrollmentCFG      EnrollmentCFG      `yaml:"enrollment"`
+	ValidationCFG      ValidationCFG      `yaml:"validation"`
 	LoggerCFG          LoggerCFG          `yaml:"logger"`
+	// Command is a name of command, which is run instead of server
+	// (if specified), and CommandArgs are its arguments.
+	Command     string   `yaml:"-"`
+	CommandArgs []string `yaml:"-"`
 }
 
 func readCFG(configPath string) (*CFG, error) {
@@ -110,7 +244,8 @@ func readCFG(configPath string) (*CFG, error) {
 		return nil, errors.Wrap(err, "unable to parse configuration file")
 	}
 
-	if cfg.StorageCFG.ImgPath[len(cfg.StorageCFG.ImgPath)-1] == '/' {
+	if (cfg.StorageCFG.ImgPath != "") &&
+		(cfg.StorageCFG.ImgPath[len(cfg.StorageCFG.ImgPath)-1] == '/') {
 		cfg.StorageCFG.ImgPath = cfg.StorageCFG.ImgPath[:len(cfg.StorageCFG.ImgPath)-1]
 	}
 
@@ -128,6 +263,8 @@ func GetCFG() (*CFG, error) {
 	if err != nil {
 		return nil, err
 	}
+	cfg.Command = cargs.Command
+	cfg.CommandArgs = cargs.CommandArgs
 
 	return cfg, nil
 }
@@ -0,0 +1,192 @@
+package clustering
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+/*
+Faces, which were not matched with any control object, are grouped into anonymous
+identities by DBSCAN on cosine distance (1 - cosine similarity): face with at least
+min_faces faces (itself included) within max_distance is a core face, and cluster is
+a set of core faces, reachable from each other through faces within max_distance,
+with all faces within max_distance from them. Other faces are noise and belong to no
+cluster. DBSCAN needs no number of clusters and doesn't force every face into some
+cluster, so passers-by, who were seen only once, are not grouped. Representatives of
+cluster are its faces, the most similar to its centroid (mean of its faces).
+All pairs of faces are compared, so number of clustered faces should be limited.
+*/
+
+const (
+	defaultMaxDistance        = 0.1
+	defaultMinFaces           = 3
+	defaultRepresentativesNum = 3
+
+	noise      = -1
+	unassigned = -2
+)
+
+// Point is a face to cluster.
+type Point struct {
+	ID string
+	FF proto.FacialFeaturesVector
+}
+
+// Cluster is a group of similar faces.
+type Cluster struct {
+	Centroid          proto.FacialFeaturesVector
+	IDs               []string
+	RepresentativeIDs []string
+}
+
+// DBSCAN clusters faces.
+type DBSCAN struct {
+	maxDistance        float64
+	minFaces           int
+	representativesNum int
+}
+
+// CreateDBSCAN ...
+func CreateDBSCAN(cfg *cfgparser.ClusteringCFG) (*DBSCAN, error) {
+	d := &DBSCAN{
+		maxDistance:        cfg.MaxDistance,
+		minFaces:           cfg.MinFaces,
+		representativesNum: cfg.RepresentativesNum,
+	}
+	if d.maxDistance == 0 {
+		d.maxDistance = defaultMaxDistance
+	}
+	if (d.maxDistance < 0.0) || (d.maxDistance > 2.0) {
+		return nil, fmt.Errorf("max distance %g is out of (0, 2]", d.maxDistance)
+	}
+	if d.minFaces < 1 {
+		d.minFaces = defaultMinFaces
+	}
+	if d.representativesNum < 1 {
+		d.representativesNum = defaultRepresentativesNum
+	}
+	return d, nil
+}
+
+// Cluster returns clusters of points (of the same model and dimension), the largest first.
+func (d *DBSCAN) Cluster(points []Point) []Cluster {
+	normalized := make([]proto.FacialFeaturesVector, len(points))
+	for i, p := range points {
+		normalized[i] = normalize(p.FF)
+	}
+	labels := make([]int, len(points))
+	for i := range labels {
+		labels[i] = unassigned
+	}
+
+	clustersNum := 0
+	for i := range points {
+		if labels[i] != unassigned {
+			continue
+		}
+		neighbours := d.region(normalized, i)
+		if len(neighbours) < d.minFaces {
+			labels[i] = noise
+			continue
+		}
+		label := clustersNum
+		clustersNum++
+		labels[i] = label
+		queue := neighbours
+		for len(queue) != 0 {
+			j := queue[0]
+			queue = queue[1:]
+			if labels[j] == noise {
+				// Border face.
+				labels[j] = label
+			}
+			if labels[j] != unassigned {
+				continue
+			}
+			labels[j] = label
+			if jNeighbours := d.region(normalized, j); len(jNeighbours) >= d.minFaces {
+				queue = append(queue, jNeighbours...)
+			}
+		}
+	}
+
+	members := make([][]int, clustersNum)
+	for i, label := range labels {
+		if label >= 0 {
+			members[label] = append(members[label], i)
+		}
+	}
+	clusters := make([]Cluster, 0, clustersNum)
+	for _, idxs := range members {
+		clusters = append(clusters, d.cluster(points, normalized, idxs))
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i].IDs) > len(clusters[j].IDs)
+	})
+	return clusters
+}
+
+// region returns indexes of all points within max distance from point i (i included).
+func (d *DBSCAN) region(normalized []proto.FacialFeaturesVector, i int) []int {
+	idxs := make([]int, 0, d.minFaces)
+	for j := range normalized {
+		if 1.0-dot(normalized[i], normalized[j]) <= d.maxDistance {
+			idxs = append(idxs, j)
+		}
+	}
+	return idxs
+}
+
+func (d *DBSCAN) cluster(points []Point, normalized []proto.FacialFeaturesVector, idxs []int) Cluster {
+	c := Cluster{
+		Centroid: make(proto.FacialFeaturesVector, len(points[idxs[0]].FF)),
+		IDs:      make([]string, 0, len(idxs)),
+	}
+	for _, i := range idxs {
+		c.IDs = append(c.IDs, points[i].ID)
+		for j := 0; (j < len(c.Centroid)) && (j < len(points[i].FF)); j++ {
+			c.Centroid[j] += points[i].FF[j]
+		}
+	}
+	for j := range c.Centroid {
+		c.Centroid[j] /= float64(len(idxs))
+	}
+
+	centroid := normalize(c.Centroid)
+	sorted := append([]int{}, idxs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return dot(normalized[sorted[i]], centroid) > dot(normalized[sorted[j]], centroid)
+	})
+	if len(sorted) > d.representativesNum {
+		sorted = sorted[:d.representativesNum]
+	}
+	c.RepresentativeIDs = make([]string, 0, len(sorted))
+	for _, i := range sorted {
+		c.RepresentativeIDs = append(c.RepresentativeIDs, points[i].ID)
+	}
+	return c
+}
+
+func dot(a, b proto.FacialFeaturesVector) float64 {
+	s := 0.0
+	for i := 0; (i < len(a)) && (i < len(b)); i++ {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+func normalize(ff proto.FacialFeaturesVector) proto.FacialFeaturesVector {
+	norm := math.Sqrt(dot(ff, ff))
+	normalized := make(proto.FacialFeaturesVector, len(ff))
+	if norm == 0 {
+		return normalized
+	}
+	for i, x := range ff {
+		normalized[i] = x / norm
+	}
+	return normalized
+}
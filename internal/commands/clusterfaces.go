@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/clustering"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+cluster_faces groups the newest unmatched faces (sightings without control object)
+into anonymous identities and replaces all not promoted clusters with found ones.
+It is meant to be run periodically (e.g. by cron); clusters are reviewed and
+promoted to control objects through REST API.
+*/
+
+const defaultMaxSightings = 20000
+
+func parseTimeFlag(name, v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid \"%s\" value", name)
+	}
+	return t, nil
+}
+
+func runClusterFaces(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	clusteringCFG := cfg.ClusteringCFG
+	if clusteringCFG.MaxSightings == 0 {
+		clusteringCFG.MaxSightings = defaultMaxSightings
+	}
+	flags := flag.NewFlagSet("cluster_faces", flag.ContinueOnError)
+	fromStr := flags.String("from", "", "cluster faces, found since this RFC 3339 time")
+	toStr := flags.String("to", "", "cluster faces, found before this RFC 3339 time")
+	flags.Float64Var(&(clusteringCFG.MaxDistance), "max_distance", clusteringCFG.MaxDistance,
+		"max cosine distance between neighbour faces")
+	flags.IntVar(&(clusteringCFG.MinFaces), "min_faces", clusteringCFG.MinFaces,
+		"min number of faces within max_distance of core face")
+	flags.Uint64Var(&(clusteringCFG.MaxSightings), "limit", clusteringCFG.MaxSightings,
+		"max number of the newest faces to cluster")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	from, err := parseTimeFlag("from", *fromStr)
+	if err != nil {
+		return err
+	}
+	to, err := parseTimeFlag("to", *toStr)
+	if err != nil {
+		return err
+	}
+
+	d, err := clustering.CreateDBSCAN(&clusteringCFG)
+	if err != nil {
+		return err
+	}
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+
+	clusters, err := storages.ClusterSightings(fStorage, d, from, to, clusteringCFG.MaxSightings)
+	if err != nil {
+		return errors.Wrap(err, "unable to cluster faces")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMODEL\tFACES")
+	facesNum := 0
+	for _, c := range clusters {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", c.ID, c.Model, len(c.SightingIDs))
+		facesNum += len(c.SightingIDs)
+	}
+	w.Flush()
+	fmt.Printf("clusters:  %d\nfaces:     %d\n", len(clusters), facesNum)
+	return nil
+}
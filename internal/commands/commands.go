@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	log "github.com/sirupsen/logrus"
+)
+
+// command is a FACEDB command, which is run instead of server.
+type command struct {
+	name  string
+	usage string
+	run   func(cfg *cfgparser.CFG, args []string, logger *log.Logger) error
+}
+
+var commands = []command{
+	{
+		name:  "cluster_faces",
+		usage: "cluster unmatched faces into anonymous identities",
+		run:   runClusterFaces,
+	},
+	{
+		name:  "enroll",
+		usage: "enroll persons from manifest with their photos",
+		run:   runEnroll,
+	},
+	{
+		name:  "erase",
+		usage: "erase control object with all its faces and images",
+		run:   runErase,
+	},
+	{
+		name:  "evaluate_bucketing",
+		usage: "measure how many matches are lost by cosine_on_ort bucketing",
+		run:   runEvaluateBucketing,
+	},
+	{
+		name:  "export",
+		usage: "write archive of control objects with their faces and images",
+		run:   runExport,
+	},
+	{
+		name:  "find_duplicates",
+		usage: "report pairs of control objects with near-identical centroids",
+		run:   runFindDuplicates,
+	},
+	{
+		name:  "import",
+		usage: "verify archive and merge it into database",
+		run:   runImport,
+	},
+	{
+		name:  "merge",
+		usage: "merge duplicate control object into survivor",
+		run:   runMerge,
+	},
+	{
+		name:  "migrate",
+		usage: "apply (up), revert (down) or show (status) schema migrations",
+		run:   runMigrate,
+	},
+	{
+		name:  "purge",
+		usage: "delete expired images and faces by retention policies",
+		run:   runPurge,
+	},
+	{
+		name:  "rebuild_centroids",
+		usage: "rebuild robust centroids of all control objects",
+		run:   runRebuildCentroids,
+	},
+	{
+		name:  "rotate_keys",
+		usage: "encrypt personal data and images and rewrap their data keys by active key",
+		run:   runRotateKeys,
+	},
+}
+
+// Run runs command, specified in config.
+func Run(cfg *cfgparser.CFG, logger *log.Logger) error {
+	for _, cmd := range commands {
+		if cmd.name == cfg.Command {
+			cfg.StorageCFG.IndexCFG.ReadOnlySnapshot = true
+			return cmd.run(cfg, cfg.CommandArgs, logger)
+		}
+	}
+
+	printUsage()
+	return fmt.Errorf("unknown command \"%s\"", cfg.Command)
+}
+
+func printUsage() {
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "available commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	w.Flush()
+}
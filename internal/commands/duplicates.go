@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+find_duplicates reports pairs of control objects with near-identical centroids
+(probably the same person), and merge merges duplicate control object of such
+pair into survivor.
+*/
+
+func runFindDuplicates(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	im, err := identities.CreateModel(&(cfg.StorageCFG.IdentitiesCFG))
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("find_duplicates", flag.ContinueOnError)
+	threshold := flags.Float64("threshold", im.DuplicateThreshold(), "min similarity of duplicates centroids")
+	k := flags.Int("k", 5, "number of the most similar control objects, compared with every one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *k < 1 {
+		*k = 1
+	}
+
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+
+	duplicates, err := storages.FindDuplicates(fStorage, *threshold, *k)
+	if err != nil {
+		return errors.Wrap(err, "unable to find duplicates")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "similarity\tmodel\tfirst\tfirst passport\tsecond\tsecond passport")
+	for _, d := range duplicates {
+		fmt.Fprintf(w, "%.4f\t%s\t%s\t%s\t%s\t%s\n", d.Similarity, d.Model,
+			d.First.ID, d.First.Passport, d.Second.ID, d.Second.Passport)
+	}
+	w.Flush()
+	logger.Debugf("found %d duplicates", len(duplicates))
+	return nil
+}
+
+func runMerge(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+	survivorID := flags.String("survivor_id", "", "ID of control object, which gets all data")
+	duplicateID := flags.String("duplicate_id", "", "ID of control object, which is retired")
+	requestedBy := flags.String("requested_by", os.Getenv("USER"), "merge requester")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (*survivorID == "") || (*duplicateID == "") {
+		return errors.New("both \"-survivor_id\" and \"-duplicate_id\" should be set")
+	}
+
+	im, err := identities.CreateModel(&(cfg.StorageCFG.IdentitiesCFG))
+	if err != nil {
+		return err
+	}
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+
+	merge, err := storages.MergeControlObjects(fStorage, im, *survivorID, *duplicateID, *requestedBy, logger)
+	if err != nil {
+		return errors.Wrap(err, "unable to merge control objects")
+	}
+	if merge == nil {
+		return fmt.Errorf("there is no control object \"%s\" or \"%s\"", *survivorID, *duplicateID)
+	}
+
+	fmt.Printf("merge:            %s\n", merge.ID)
+	fmt.Printf("survivor:         %s\n", merge.SurvivorID)
+	fmt.Printf("duplicate:        %s\n", merge.DuplicateID)
+	fmt.Printf("ffvs:             %d\n", merge.FFVsNum)
+	fmt.Printf("imgs:             %d\n", merge.ImgsNum)
+	fmt.Printf("sightings:        %d\n", merge.SightingsNum)
+	return nil
+}
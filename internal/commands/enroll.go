@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/enrollment"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+enroll creates control objects for persons from CSV/JSON manifest (or for every
+subdirectory of photos directory, named by passport) with faces from their photos.
+Results of persons are appended to progress file, so interrupted enrollment is
+resumed by the same command: already enrolled persons are skipped, failed ones
+are retried. Facerecognizers should be able to reach command by src_addr.
+*/
+
+func runEnroll(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	enrollmentCFG := cfg.EnrollmentCFG
+	flags := flag.NewFlagSet("enroll", flag.ContinueOnError)
+	manifestPath := flags.String("manifest", "", "CSV or JSON manifest of persons (subdirectories of photos, if empty)")
+	photosDir := flags.String("photos", "", "root directory of persons photos directories")
+	progressPath := flags.String("progress", "", "progress file (manifest or photos path with \".progress\", if empty)")
+	flags.StringVar(&(enrollmentCFG.Listen), "listen", enrollmentCFG.Listen,
+		"address, on which facerecognizers results are received")
+	flags.StringVar(&(enrollmentCFG.SrcAddr), "src_addr", enrollmentCFG.SrcAddr,
+		"address of command for facerecognizers")
+	flags.IntVar(&(enrollmentCFG.Workers), "workers", enrollmentCFG.Workers,
+		"number of persons, enrolled at once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *photosDir == "" {
+		if *manifestPath == "" {
+			return fmt.Errorf("\"photos\" is required")
+		}
+		*photosDir = filepath.Dir(*manifestPath)
+	}
+	if *progressPath == "" {
+		if *manifestPath != "" {
+			*progressPath = *manifestPath + ".progress"
+		} else {
+			*progressPath = filepath.Clean(*photosDir) + ".progress"
+		}
+	}
+
+	var persons []enrollment.Person
+	var err error
+	if *manifestPath != "" {
+		persons, err = enrollment.ReadManifest(*manifestPath)
+	} else {
+		persons, err = enrollment.ReadPhotosDir(*photosDir)
+	}
+	if err != nil {
+		return err
+	}
+	progress, err := enrollment.OpenProgress(*progressPath)
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	im, err := identities.CreateModel(&(cfg.StorageCFG.IdentitiesCFG))
+	if err != nil {
+		return err
+	}
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+	imgStore, err := imgstores.CreateImgStore(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	committer, err := storages.CreateCommitter(fStorage, imgStore, im, &(cfg.StorageCFG.WALCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer committer.Close()
+	client := &http.Client{
+		Timeout: time.Millisecond * time.Duration(cfg.HTTPClientCFG.TimeoutMS),
+	}
+	enroller, err := enrollment.CreateEnroller(cfg, &enrollmentCFG, *photosDir, fStorage, committer, client, logger)
+	if err != nil {
+		return err
+	}
+	defer enroller.Close()
+
+	results, err := enroller.Enroll(persons, progress)
+	if err != nil {
+		return errors.Wrap(err, "unable to enroll")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PASSPORT\tSTATUS\tCOB_ID\tFACES\tPHOTOS\tERROR")
+	counts := make(map[string]int)
+	for _, res := range results {
+		counts[res.Status]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n",
+			res.Passport, res.Status, res.CobID, res.FacesNum, res.PhotosNum, res.Error)
+		for _, warning := range res.Warnings {
+			fmt.Fprintf(w, "\t\t\t\t\t%s\n", strings.Replace(warning, "\t", " ", -1))
+		}
+	}
+	w.Flush()
+	fmt.Printf("enrolled:         %d\n", counts[enrollment.EnrolledStatus])
+	fmt.Printf("skipped:          %d\n", counts[enrollment.SkippedStatus])
+	fmt.Printf("failed:           %d\n", counts[enrollment.FailedStatus])
+	fmt.Printf("progress:         %s\n", *progressPath)
+	if counts[enrollment.FailedStatus] != 0 {
+		return fmt.Errorf("%d persons were not enrolled, run command again to retry them",
+			counts[enrollment.FailedStatus])
+	}
+	return nil
+}
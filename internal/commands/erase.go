@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+erase erases control object, specified by ID or passport, with all its facial
+features vectors and images (right to be forgotten), and prints its tombstone.
+*/
+
+func runErase(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("erase", flag.ContinueOnError)
+	id := flags.String("id", "", "control object ID")
+	passport := flags.String("passport", "", "control object passport (if ID is not set)")
+	reason := flags.String("reason", "", "erasure reason, e.g. request number")
+	requestedBy := flags.String("requested_by", os.Getenv("USER"), "erasure requester")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (*id == "") == (*passport == "") {
+		return errors.New("exactly one of \"-id\" and \"-passport\" should be set")
+	}
+	if *reason == "" {
+		return errors.New("erasure reason is not set")
+	}
+
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+	imgStore, err := imgstores.CreateImgStore(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+
+	if *id == "" {
+		cob, err := fStorage.SelectControlObjectByPassport(*passport)
+		if err != nil {
+			return errors.Wrap(err, "unable to select control object")
+		}
+		if cob.ID == proto.DefaultStringField {
+			return fmt.Errorf("there is no control object with passport \"%s\"", *passport)
+		}
+		*id = cob.ID
+	}
+
+	erasure, err := storages.EraseControlObject(fStorage, imgStore, *id, *reason, *requestedBy, logger)
+	if err != nil {
+		return errors.Wrap(err, "unable to erase control object")
+	}
+	if erasure == nil {
+		return fmt.Errorf("there is no control object \"%s\"", *id)
+	}
+
+	fmt.Printf("erasure:          %s\n", erasure.ID)
+	fmt.Printf("control object:   %s\n", erasure.CobID)
+	fmt.Printf("ffvs:             %d\n", erasure.FFVsNum)
+	fmt.Printf("imgs:             %d\n", erasure.ImgsNum)
+	fmt.Printf("deleted imgs:     %d\n", erasure.DeletedImgsNum)
+	fmt.Printf("sightings:        %d\n", erasure.SightingsNum)
+	fmt.Printf("clusters:         %d\n", erasure.ClustersNum)
+	fmt.Printf("audit records:    %d\n", erasure.AuditRecordsNum)
+	return nil
+}
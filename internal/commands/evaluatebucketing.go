@@ -0,0 +1,209 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+evaluate_bucketing uses every stored facial features vector as a probe and compares
+the best control object, found by exact search, with the best control object, found
+by bucketed search with radius 0, 1, ..., max_radius. Match is:
+  - lost, if exact search found control object, but bucketed search didn't;
+  - changed, if searches found different control objects;
+  - own lost, if probe's own control object is similar enough, but out of radius.
+Stored centroid of probe's own control object is built from probe itself, so probe is
+compared with leave-one-out centroid instead: one, rebuilt from all other vectors of
+control object. Control object without other vectors of probe's model is skipped.
+*/
+
+// bucketingStats is evaluation result for one bucket radius.
+type bucketingStats struct {
+	found   uint64
+	lost    uint64
+	changed uint64
+	ownLost uint64
+}
+
+func runEvaluateBucketing(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("evaluate_bucketing", flag.ContinueOnError)
+	maxRadius := flags.Int("max_radius", storages.SafeBucketRadius(cfg.StorageCFG.CosineBoundary),
+		"max bucket radius to evaluate")
+	limit := flags.Int("limit", 0, "max number of probes (0 means all stored vectors)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *maxRadius > storages.MaxBucketRadius {
+		*maxRadius = storages.MaxBucketRadius
+	}
+
+	im, err := identities.CreateModel(&(cfg.StorageCFG.IdentitiesCFG))
+	if err != nil {
+		return err
+	}
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+
+	effs, err := fStorage.SelectEmbeddedFFVs()
+	if err != nil {
+		return errors.Wrap(err, "unable to select embedded facial features vectors")
+	}
+	logger.Debugf("evaluating bucketing on %d control objects", len(effs))
+
+	boundary := cfg.StorageCFG.CosineBoundary
+	stats := make([]bucketingStats, *maxRadius+1)
+	exactFound := uint64(0)
+	probes := 0
+	errLimit := fmt.Errorf("limit reached")
+	own := &ownVectors{}
+	err = fStorage.ScanFFVs(func(ffv *storages.FFV) error {
+		if (*limit > 0) && (probes >= *limit) {
+			return errLimit
+		}
+		probes++
+
+		ff := ffv.FacialFeaturesVector
+		bucket := float64(ff.CosineOnOrt())
+		ownEFF, err := own.leaveOneOut(fStorage, im, ffv)
+		if err != nil {
+			return err
+		}
+		ownBucket := float64(ownEFF.CosineOnOrt())
+		exactIdx := -1
+		ownDist := -1
+		// bestByDist[d] is the most similar control object at bucket distance d.
+		bestByDist := make([]int, *maxRadius+1)
+		for d := range bestByDist {
+			bestByDist[d] = -1
+		}
+		sims := make([]float64, len(effs))
+		for i := range effs {
+			// Vectors of other models are not comparable with ff.
+			if (effs[i].Model != ffv.Model) || (len(effs[i].EFF) != len(ff)) {
+				continue
+			}
+			eff, effBucket := effs[i].EFF, effs[i].CosineOnOrt
+			if effs[i].CobID == ffv.CobID {
+				if len(ownEFF) == 0 {
+					continue
+				}
+				eff, effBucket = ownEFF, ownBucket
+			}
+			sims[i] = ff.Cosine(eff)
+			if !(sims[i] >= boundary) {
+				continue
+			}
+			if (exactIdx == -1) || (sims[i] > sims[exactIdx]) {
+				exactIdx = i
+			}
+			d := int(math.Ceil(math.Abs(effBucket - bucket)))
+			if effs[i].CobID == ffv.CobID {
+				ownDist = d
+			}
+			if d > *maxRadius {
+				continue
+			}
+			if (bestByDist[d] == -1) || (sims[i] > sims[bestByDist[d]]) {
+				bestByDist[d] = i
+			}
+		}
+		if exactIdx != -1 {
+			exactFound++
+		}
+
+		bestIdx := -1
+		for r := 0; r <= *maxRadius; r++ {
+			if (bestByDist[r] != -1) && ((bestIdx == -1) || (sims[bestByDist[r]] > sims[bestIdx])) {
+				bestIdx = bestByDist[r]
+			}
+			switch {
+			case bestIdx != -1:
+				stats[r].found++
+				if effs[bestIdx].CobID != effs[exactIdx].CobID {
+					stats[r].changed++
+				}
+			case exactIdx != -1:
+				stats[r].lost++
+			}
+			if ownDist > r {
+				stats[r].ownLost++
+			}
+		}
+		return nil
+	})
+	if (err != nil) && (err != errLimit) {
+		return errors.Wrap(err, "unable to scan facial features vectors")
+	}
+
+	fmt.Printf("probes: %d, control objects: %d, cosine boundary: %.3f, matched by exact search: %d\n",
+		probes, len(effs), boundary, exactFound)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "radius\tfound\tlost\tlost, %\tchanged\town lost\t")
+	for r, s := range stats {
+		lostPercent := 0.0
+		if exactFound != 0 {
+			lostPercent = 100.0 * float64(s.lost) / float64(exactFound)
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%.2f\t%d\t%d\t\n",
+			r, s.found, s.lost, lostPercent, s.changed, s.ownLost)
+	}
+	return w.Flush()
+}
+
+// ownVectors caches vectors of the last probed control object, because vectors
+// of the same control object are usually scanned one after another.
+type ownVectors struct {
+	cobID    string
+	ffvs     []storages.FFV
+	accepted map[string]map[string]struct{} // model -> accepted on review vector IDs.
+}
+
+// leaveOneOut returns centroid of ffv control object, built from all its vectors
+// of ffv model except ffv. It is empty, if there are no such vectors.
+func (own *ownVectors) leaveOneOut(fs storages.FaceStorage, im *identities.Model,
+	ffv *storages.FFV) (proto.FacialFeaturesVector, error) {
+	if (own.ffvs == nil) || (own.cobID != ffv.CobID) {
+		ffvs, err := fs.SelectFFVsByControlObject(ffv.CobID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to select facial features vectors of control object \"%s\"", ffv.CobID)
+		}
+		centroids, err := fs.SelectCentroids(ffv.CobID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to select centroids of control object \"%s\"", ffv.CobID)
+		}
+		own.cobID = ffv.CobID
+		own.ffvs = ffvs
+		own.accepted = make(map[string]map[string]struct{}, len(centroids))
+		for _, c := range centroids {
+			own.accepted[c.Model] = make(map[string]struct{}, len(c.AcceptedIDs))
+			for _, id := range c.AcceptedIDs {
+				own.accepted[c.Model][id] = struct{}{}
+			}
+		}
+	}
+
+	vectors := make([]identities.Vector, 0, len(own.ffvs))
+	for _, other := range own.ffvs {
+		if (other.ID == ffv.ID) || (other.Model != ffv.Model) {
+			continue
+		}
+		vectors = append(vectors, identities.Vector{
+			ID: other.ID,
+			FF: other.FacialFeaturesVector,
+		})
+	}
+	return im.Build(vectors, own.accepted[ffv.Model]).Centroid, nil
+}
@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nofacedb/facedb/internal/archive"
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+export writes archive of all control objects with their images and facial features
+vectors, which may be imported into another FACEDB deployment. Archive is written to
+temporary file and renamed, so interrupted export doesn't leave broken archive.
+*/
+
+func runExport(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("out", "", "path of archive to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("\"out\" is required")
+	}
+
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+	imgStore, err := imgstores.CreateImgStore(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := *out + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to create archive")
+	}
+	manifest, err := archive.Export(fStorage, imgStore, f, logger)
+	if err == nil {
+		err = errors.Wrap(f.Sync(), "unable to write archive")
+	}
+	if closeErr := f.Close(); (err == nil) && (closeErr != nil) {
+		err = errors.Wrap(closeErr, "unable to write archive")
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "unable to export")
+	}
+	if err := os.Rename(tmpPath, *out); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "unable to rename archive")
+	}
+
+	fmt.Printf("archive:          %s\n", *out)
+	fmt.Printf("control objects:  %d\n", manifest.ControlObjectsNum)
+	fmt.Printf("imgs:             %d\n", manifest.ImgsNum)
+	fmt.Printf("img files:        %d\n", manifest.ImgFilesNum)
+	fmt.Printf("ffvs:             %d\n", manifest.FFVsNum)
+	return nil
+}
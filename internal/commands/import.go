@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/nofacedb/facedb/internal/archive"
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+import verifies checksums of archive, written by export, and merges it into database
+and images store. Control objects are matched by passport; existing control objects
+keep their fields unless overwrite is set. With verify only checksums are checked.
+*/
+
+func runImport(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	in := flags.String("in", "", "path of archive to read")
+	overwrite := flags.Bool("overwrite", false, "replace fields of existing control objects by archived ones")
+	verify := flags.Bool("verify", false, "only verify archive checksums")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return fmt.Errorf("\"in\" is required")
+	}
+
+	if *verify {
+		manifest, err := archive.Verify(*in)
+		if err != nil {
+			return errors.Wrap(err, "archive is broken")
+		}
+		fmt.Printf("created at:       %s\n", manifest.CreatedAt)
+		fmt.Printf("facedb version:   %s\n", manifest.FACEDBVersion)
+		fmt.Printf("control objects:  %d\n", manifest.ControlObjectsNum)
+		fmt.Printf("imgs:             %d\n", manifest.ImgsNum)
+		fmt.Printf("img files:        %d\n", manifest.ImgFilesNum)
+		fmt.Printf("ffvs:             %d\n", manifest.FFVsNum)
+		return nil
+	}
+
+	im, err := identities.CreateModel(&(cfg.StorageCFG.IdentitiesCFG))
+	if err != nil {
+		return err
+	}
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+	imgStore, err := imgstores.CreateImgStore(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+
+	stats, err := archive.Import(*in, fStorage, imgStore, im, *overwrite, logger)
+	if err != nil {
+		return errors.Wrap(err, "unable to import")
+	}
+
+	fmt.Printf("created cobs:     %d\n", stats.CreatedControlObjectsNum)
+	fmt.Printf("merged cobs:      %d\n", stats.MergedControlObjectsNum)
+	fmt.Printf("imgs:             %d\n", stats.ImgsNum)
+	fmt.Printf("img files:        %d\n", stats.ImgFilesNum)
+	fmt.Printf("ffvs:             %d\n", stats.FFVsNum)
+	return nil
+}
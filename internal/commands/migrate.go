@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/migrations"
+	"github.com/nofacedb/facedb/internal/storages"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+migrate applies or reverts ClickHouse DB schema migrations:
+  - "migrate up [-to N]" applies all migrations up to N (the latest by default);
+  - "migrate down [-to N]" reverts all migrations down to N (previous by default);
+  - "migrate status" prints current schema version and all known migrations.
+*/
+
+func runMigrate(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	if len(args) == 0 {
+		return fmt.Errorf("migrate subcommand (\"up\", \"down\" or \"status\") is not specified")
+	}
+	subcommand := args[0]
+	flags := flag.NewFlagSet("migrate "+subcommand, flag.ContinueOnError)
+	to := flags.Int64("to", -1, "target schema version")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if subcommand == "up" {
+		if err := storages.CreateClickHouseDB(&(cfg.StorageCFG), logger); err != nil {
+			return err
+		}
+	}
+	db, err := storages.CreateClickHouseDBConn(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator := migrations.CreateMigrator(db, logger)
+	version, err := migrator.Version()
+	if err != nil {
+		return err
+	}
+
+	switch subcommand {
+	case "up":
+		target := migrations.Latest()
+		if *to >= 0 {
+			target = uint64(*to)
+		}
+		if err := migrator.Up(target); err != nil {
+			return err
+		}
+	case "down":
+		target := uint64(0)
+		if *to >= 0 {
+			target = uint64(*to)
+		} else {
+			for _, mig := range migrations.All() {
+				if mig.Version < version {
+					target = mig.Version
+				}
+			}
+		}
+		if err := migrator.Down(target); err != nil {
+			return err
+		}
+	case "status":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "current schema version: %d, latest: %d\n", version, migrations.Latest())
+		for _, mig := range migrations.All() {
+			state := "pending"
+			if mig.Version <= version {
+				state = "applied"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", mig.Version, mig.Name, state)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate subcommand \"%s\"", subcommand)
+	}
+
+	version, err = migrator.Version()
+	if err != nil {
+		return err
+	}
+	logger.Infof("schema version is %d", version)
+	return nil
+}
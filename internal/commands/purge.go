@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/retention"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+purge enforces retention policies once (e.g. from cron, when scheduled enforcement
+is disabled) and prints, what was purged. Days of rules may be overridden by flags.
+*/
+
+func runPurge(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	retentionCFG := cfg.RetentionCFG
+	retentionCFG.IntervalMS = 0
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	flags.IntVar(&(retentionCFG.SightingsImagesDays), "sightings_images_days", retentionCFG.SightingsImagesDays,
+		"delete images of sightings after this number of days (0 keeps them)")
+	flags.IntVar(&(retentionCFG.ControlObjectsImagesDays), "control_objects_images_days",
+		retentionCFG.ControlObjectsImagesDays,
+		"delete images of control objects and their faces after this number of days (0 keeps them)")
+	flags.IntVar(&(retentionCFG.UnmatchedFacesDays), "unmatched_faces_days", retentionCFG.UnmatchedFacesDays,
+		"delete unmatched faces after this number of days (0 keeps them)")
+	flags.IntVar(&(retentionCFG.SightingsDays), "sightings_days", retentionCFG.SightingsDays,
+		"delete all sightings after this number of days (0 keeps them)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+	imgStore, err := imgstores.CreateImgStore(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	im, err := identities.CreateModel(&(cfg.StorageCFG.IdentitiesCFG))
+	if err != nil {
+		return err
+	}
+	enforcer, err := retention.CreateEnforcer(&retentionCFG, fStorage, imgStore, im, logger)
+	if err != nil {
+		return err
+	}
+	defer enforcer.Close()
+
+	purge, err := enforcer.Enforce()
+	if err != nil {
+		return errors.Wrap(err, "unable to enforce retention policies")
+	}
+
+	fmt.Printf("purge:            %s\n", purge.ID)
+	fmt.Printf("deleted imgs:     %d\n", purge.ImgsNum)
+	fmt.Printf("failed imgs:      %d\n", purge.FailedImgsNum)
+	fmt.Printf("cob imgs:         %d\n", purge.CobImgsNum)
+	fmt.Printf("cob ffvs:         %d\n", purge.FFVsNum)
+	fmt.Printf("unmatched faces:  %d\n", purge.UnmatchedFacesNum)
+	fmt.Printf("source faces:     %d\n", purge.SourcesFacesNum)
+	fmt.Printf("sightings:        %d\n", purge.SightingsNum)
+	return nil
+}
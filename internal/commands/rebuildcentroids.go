@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+rebuild_centroids rebuilds centroids of all control objects from their facial
+features vectors, e.g. after identities config change or after migration, which
+seeds plain mean centroids. Accepted on review vectors are kept accepted.
+*/
+
+func runRebuildCentroids(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("rebuild_centroids", flag.ContinueOnError)
+	batchSize := flags.Int("batch_size", 100, "number of control objects, rebuilt at once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize < 1 {
+		*batchSize = 1
+	}
+
+	im, err := identities.CreateModel(&(cfg.StorageCFG.IdentitiesCFG))
+	if err != nil {
+		return err
+	}
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+
+	cobIDs := make([]string, 0, 1024)
+	seen := make(map[string]struct{})
+	err = fStorage.ScanFFVs(func(ffv *storages.FFV) error {
+		if _, ok := seen[ffv.CobID]; !ok {
+			seen[ffv.CobID] = struct{}{}
+			cobIDs = append(cobIDs, ffv.CobID)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to scan facial features vectors")
+	}
+	logger.Debugf("rebuilding centroids of %d control objects", len(cobIDs))
+
+	for i := 0; i < len(cobIDs); i += *batchSize {
+		j := i + *batchSize
+		if j > len(cobIDs) {
+			j = len(cobIDs)
+		}
+		if err := storages.RefreshCentroids(fStorage, im, cobIDs[i:j]); err != nil {
+			return errors.Wrap(err, "unable to rebuild centroids")
+		}
+		logger.Debugf("rebuilt centroids of %d/%d control objects", j, len(cobIDs))
+	}
+
+	fmt.Printf("control objects:  %d\n", len(cobIDs))
+	return nil
+}
@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/encryption"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+rotate_keys optionally adds new active key to keyfile, then rewraps data keys of
+personal data of control objects and images, which were wrapped by other keys, by
+active key. Data, which was stored before encryption was enabled, is rejected by
+servers and is encrypted only with -migrate_plaintext. Servers reload keyfile after
+storage.encryption.reload_interval_ms and wrap new data keys by old key until then,
+so command should be run again after it; old key may be removed from keyfile, when
+nothing is rotated.
+*/
+
+func runRotateKeys(cfg *cfgparser.CFG, args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("rotate_keys", flag.ContinueOnError)
+	newKey := flags.String("new_key", "", "ID of new key, which is generated and made active in keyfile")
+	batchSize := flags.Uint64("batch_size", 1000, "number of control objects, rotated at once")
+	skipImages := flags.Bool("skip_images", false, "don't rotate keys of images")
+	migratePlaintext := flags.Bool("migrate_plaintext", false,
+		"encrypt data, stored before encryption was enabled, instead of failing on it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize < 1 {
+		*batchSize = 1
+	}
+	encryptionCFG := &(cfg.StorageCFG.EncryptionCFG)
+	if encryptionCFG.Provider == "" {
+		return fmt.Errorf("encryption is disabled (storage.encryption.provider is not set)")
+	}
+	if *newKey != "" {
+		if encryptionCFG.Provider != encryption.KeyFileProviderType {
+			return fmt.Errorf("new key can be added only to \"%s\" key provider", encryption.KeyFileProviderType)
+		}
+		if err := encryption.AddKeyFileKey(encryptionCFG.KeyFile, *newKey); err != nil {
+			return errors.Wrap(err, "unable to add new key")
+		}
+		logger.Debugf("added active key \"%s\" to keyfile \"%s\"", *newKey, encryptionCFG.KeyFile)
+	}
+
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	defer fStorage.Close()
+	efs := storages.FindEncryptedFaceStorage(fStorage)
+	if efs == nil {
+		return fmt.Errorf("face storage is not encrypted")
+	}
+	imgStore, err := imgstores.CreateImgStore(&(cfg.StorageCFG), logger)
+	if err != nil {
+		return err
+	}
+	eis, ok := imgStore.(*imgstores.EncryptedImgStore)
+	if !ok {
+		return fmt.Errorf("images store is not encrypted")
+	}
+	if *migratePlaintext {
+		efs.AllowPlaintext()
+		eis.AllowPlaintext()
+	}
+
+	cobsNum, rotatedCobsNum, err := efs.RotateKeys(*batchSize)
+	if err != nil {
+		return errors.Wrapf(err, "unable to rotate keys of control objects (%d of %d were rotated)",
+			rotatedCobsNum, cobsNum)
+	}
+	logger.Debugf("rotated keys of %d of %d control objects", rotatedCobsNum, cobsNum)
+
+	imgsNum, rotatedImgsNum, failedImgsNum := 0, 0, 0
+	if !*skipImages {
+		keys := make([]string, 0, 1024)
+		seen := make(map[string]struct{})
+		collect := func(img *storages.Img) error {
+			if _, ok := seen[img.Path]; !ok && (img.Path != "") {
+				seen[img.Path] = struct{}{}
+				keys = append(keys, img.Path)
+			}
+			return nil
+		}
+		if err := fStorage.ScanImgs(collect); err != nil {
+			return errors.Wrap(err, "unable to scan images")
+		}
+		if err := fStorage.ScanSightingsImgs(collect); err != nil {
+			return errors.Wrap(err, "unable to scan images of sightings")
+		}
+		imgsNum = len(keys)
+		for i, key := range keys {
+			rotated, err := eis.RotateKey(key)
+			if err != nil {
+				logger.Warn(err)
+				failedImgsNum++
+			} else if rotated {
+				rotatedImgsNum++
+			}
+			if (i+1)%1000 == 0 {
+				logger.Debugf("rotated keys of %d/%d images", i+1, len(keys))
+			}
+		}
+	}
+
+	fmt.Printf("control objects:  %d\n", cobsNum)
+	fmt.Printf("rotated cobs:     %d\n", rotatedCobsNum)
+	fmt.Printf("imgs:             %d\n", imgsNum)
+	fmt.Printf("rotated imgs:     %d\n", rotatedImgsNum)
+	fmt.Printf("failed imgs:      %d\n", failedImgsNum)
+	if failedImgsNum != 0 {
+		return fmt.Errorf("keys of %d images were not rotated", failedImgsNum)
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Encrypted string is "enc:v1:{key ID}:{wrapped data key}:{nonce and ciphertext}"
+(both are base64-encoded), encrypted bytes are magic, key ID length (1 byte),
+key ID, wrapped data key length (2 bytes), wrapped data key, nonce and ciphertext.
+Both data keys and values are encrypted by AES-256-GCM; value is sealed with
+additional data, which identifies its place (e.g. row ID and field name), so
+value, copied to another place, can't be decrypted. Values without prefix (magic)
+are plaintext, which was stored before encryption was enabled: they are rejected,
+unless plaintext is allowed for migration (see AllowPlaintext).
+
+Blind index of value is its HMAC-SHA256 by index key, so equal values can be
+found by their indexes without decryption.
+*/
+
+const stringPrefix = "enc:v1:"
+
+var bytesMagic = []byte("FDBENC1\n")
+
+// ErrPlaintext is returned on attempt to decrypt or rewrap not encrypted value,
+// if plaintext is not allowed.
+var ErrPlaintext = errors.New("value is not encrypted")
+
+// Cipher encrypts and decrypts values with data keys, wrapped by key provider.
+type Cipher struct {
+	provider       KeyProvider
+	allowPlaintext bool
+}
+
+// CreateProviderCipher creates Cipher with given key provider.
+func CreateProviderCipher(provider KeyProvider) *Cipher {
+	return &Cipher{
+		provider: provider,
+	}
+}
+
+func createAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create cipher")
+	}
+	return aead, nil
+}
+
+// AllowPlaintext makes not encrypted values to be returned as is by DecryptString
+// and DecryptBytes and to be encrypted by RewrapString and RewrapBytes. It should
+// be used only for migration of data, stored before encryption was enabled.
+func (c *Cipher) AllowPlaintext() {
+	c.allowPlaintext = true
+}
+
+// seal returns nonce and ciphertext of plaintext, authenticated with additional data.
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "unable to generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts nonce and ciphertext, returned by seal with the same additional data.
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// envelope is encrypted value.
+type envelope struct {
+	keyID   string
+	wrapped []byte
+	sealed  []byte
+}
+
+func (c *Cipher) encrypt(plaintext, aad []byte) (*envelope, error) {
+	keyID, err := c.provider.ActiveKeyID()
+	if err != nil {
+		return nil, err
+	}
+	dek := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, errors.Wrap(err, "unable to generate data key")
+	}
+	aead, err := createAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(aead, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := c.provider.WrapKey(keyID, dek)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{keyID, wrapped, sealed}, nil
+}
+
+func (c *Cipher) decrypt(env *envelope, aad []byte) ([]byte, error) {
+	dek, err := c.provider.UnwrapKey(env.keyID, env.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := createAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(aead, env.sealed, aad)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decrypt value")
+	}
+	return plaintext, nil
+}
+
+// rewrap wraps data key of env by active key, if it is wrapped by another one.
+func (c *Cipher) rewrap(env *envelope) (bool, error) {
+	keyID, err := c.provider.ActiveKeyID()
+	if err != nil {
+		return false, err
+	}
+	if env.keyID == keyID {
+		return false, nil
+	}
+	dek, err := c.provider.UnwrapKey(env.keyID, env.wrapped)
+	if err != nil {
+		return false, err
+	}
+	wrapped, err := c.provider.WrapKey(keyID, dek)
+	if err != nil {
+		return false, err
+	}
+	env.keyID = keyID
+	env.wrapped = wrapped
+	return true, nil
+}
+
+func (env *envelope) string() string {
+	return stringPrefix + env.keyID + ":" +
+		base64.RawStdEncoding.EncodeToString(env.wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(env.sealed)
+}
+
+func parseStringEnvelope(s string) (*envelope, error) {
+	parts := strings.Split(strings.TrimPrefix(s, stringPrefix), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid encrypted value")
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encrypted value")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encrypted value")
+	}
+	return &envelope{parts[0], wrapped, sealed}, nil
+}
+
+func (env *envelope) bytes() []byte {
+	data := make([]byte, 0, len(bytesMagic)+1+len(env.keyID)+2+len(env.wrapped)+len(env.sealed))
+	data = append(data, bytesMagic...)
+	data = append(data, byte(len(env.keyID)))
+	data = append(data, env.keyID...)
+	data = append(data, 0, 0)
+	binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(env.wrapped)))
+	data = append(data, env.wrapped...)
+	return append(data, env.sealed...)
+}
+
+func parseBytesEnvelope(data []byte) (*envelope, error) {
+	data = data[len(bytesMagic):]
+	if len(data) < 1 {
+		return nil, errors.New("invalid encrypted data")
+	}
+	keyIDLen := int(data[0])
+	data = data[1:]
+	if len(data) < keyIDLen+2 {
+		return nil, errors.New("invalid encrypted data")
+	}
+	keyID := string(data[:keyIDLen])
+	data = data[keyIDLen:]
+	wrappedLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < wrappedLen {
+		return nil, errors.New("invalid encrypted data")
+	}
+	return &envelope{keyID, data[:wrappedLen], data[wrappedLen:]}, nil
+}
+
+// IsEncryptedString returns true, if s was encrypted by EncryptString.
+func IsEncryptedString(s string) bool {
+	return strings.HasPrefix(s, stringPrefix)
+}
+
+// EncryptString encrypts s, which is bound to aad.
+func (c *Cipher) EncryptString(s string, aad []byte) (string, error) {
+	env, err := c.encrypt([]byte(s), aad)
+	if err != nil {
+		return "", err
+	}
+	return env.string(), nil
+}
+
+// DecryptString decrypts s, which was encrypted with the same aad.
+// Not encrypted s is returned as is, only if plaintext is allowed.
+func (c *Cipher) DecryptString(s string, aad []byte) (string, error) {
+	if !IsEncryptedString(s) {
+		if !c.allowPlaintext {
+			return "", ErrPlaintext
+		}
+		return s, nil
+	}
+	env, err := parseStringEnvelope(s)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := c.decrypt(env, aad)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// RewrapString rewraps data key of s by active key or encrypts s with aad, if it is
+// not encrypted and plaintext is allowed. It returns false, if s is already
+// encrypted with active key.
+func (c *Cipher) RewrapString(s string, aad []byte) (string, bool, error) {
+	if !IsEncryptedString(s) {
+		if !c.allowPlaintext {
+			return "", false, ErrPlaintext
+		}
+		encrypted, err := c.EncryptString(s, aad)
+		return encrypted, err == nil, err
+	}
+	env, err := parseStringEnvelope(s)
+	if err != nil {
+		return "", false, err
+	}
+	changed, err := c.rewrap(env)
+	if (err != nil) || !changed {
+		return s, false, err
+	}
+	return env.string(), true, nil
+}
+
+// IsEncryptedBytes returns true, if data was encrypted by EncryptBytes.
+func IsEncryptedBytes(data []byte) bool {
+	return bytes.HasPrefix(data, bytesMagic)
+}
+
+// EncryptBytes encrypts data, which is bound to aad.
+func (c *Cipher) EncryptBytes(data, aad []byte) ([]byte, error) {
+	env, err := c.encrypt(data, aad)
+	if err != nil {
+		return nil, err
+	}
+	return env.bytes(), nil
+}
+
+// DecryptBytes decrypts data, which was encrypted with the same aad.
+// Not encrypted data is returned as is, only if plaintext is allowed.
+func (c *Cipher) DecryptBytes(data, aad []byte) ([]byte, error) {
+	if !IsEncryptedBytes(data) {
+		if !c.allowPlaintext {
+			return nil, ErrPlaintext
+		}
+		return data, nil
+	}
+	env, err := parseBytesEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.decrypt(env, aad)
+}
+
+// RewrapBytes rewraps data key of data by active key or encrypts data with aad, if it
+// is not encrypted and plaintext is allowed. It returns false, if data is already
+// encrypted with active key.
+func (c *Cipher) RewrapBytes(data, aad []byte) ([]byte, bool, error) {
+	if !IsEncryptedBytes(data) {
+		if !c.allowPlaintext {
+			return nil, false, ErrPlaintext
+		}
+		encrypted, err := c.EncryptBytes(data, aad)
+		return encrypted, err == nil, err
+	}
+	env, err := parseBytesEnvelope(data)
+	if err != nil {
+		return nil, false, err
+	}
+	changed, err := c.rewrap(env)
+	if (err != nil) || !changed {
+		return data, false, err
+	}
+	return env.bytes(), true, nil
+}
+
+// BlindIndex returns hex-encoded blind index of s.
+func (c *Cipher) BlindIndex(s string) (string, error) {
+	indexKey, err := c.provider.IndexKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,198 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createTestCipher returns cipher with keyfile of one key "k1" in dir and path of keyfile.
+func createTestCipher(t *testing.T, dir string) (*Cipher, string) {
+	path := filepath.Join(dir, "keys.yaml")
+	if err := AddKeyFileKey(path, "k1"); err != nil {
+		t.Fatal(err)
+	}
+	// Keyfile is reloaded on every call, so rotation is seen at once.
+	provider, err := CreateKeyFileProvider(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CreateProviderCipher(provider), path
+}
+
+func createTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "facedb-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	c, _ := createTestCipher(t, dir)
+	tests := []struct {
+		name  string
+		value string
+		aad   string
+	}{
+		{"empty", "", "cob-1/passport"},
+		{"ascii", "1234 567890", "cob-1/passport"},
+		{"unicode", "Иванов Иван Иванович", "cob-1/name"},
+		{"separators", "enc:v1:a:b:c", "cob-1/address"},
+		{"no aad", "value", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := c.EncryptString(tt.value, []byte(tt.aad))
+			if err != nil {
+				t.Fatalf("EncryptString() error: %s", err)
+			}
+			if !IsEncryptedString(s) || ((tt.value != "") && strings.Contains(s, tt.value)) {
+				t.Fatalf("EncryptString() = %q is not encrypted", s)
+			}
+			got, err := c.DecryptString(s, []byte(tt.aad))
+			if err != nil {
+				t.Fatalf("DecryptString() error: %s", err)
+			}
+			if got != tt.value {
+				t.Errorf("DecryptString() = %q, want %q", got, tt.value)
+			}
+
+			data, err := c.EncryptBytes([]byte(tt.value), []byte(tt.aad))
+			if err != nil {
+				t.Fatalf("EncryptBytes() error: %s", err)
+			}
+			if !IsEncryptedBytes(data) {
+				t.Fatalf("EncryptBytes() is not encrypted")
+			}
+			gotData, err := c.DecryptBytes(data, []byte(tt.aad))
+			if err != nil {
+				t.Fatalf("DecryptBytes() error: %s", err)
+			}
+			if !bytes.Equal(gotData, []byte(tt.value)) {
+				t.Errorf("DecryptBytes() = %q, want %q", gotData, tt.value)
+			}
+		})
+	}
+}
+
+func TestCipherRewrap(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	c, path := createTestCipher(t, dir)
+	aad := []byte("cob-1/passport")
+	s, err := c.EncryptString("1234 567890", aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.EncryptBytes([]byte("image"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, changed, err := c.RewrapString(s, aad); (err != nil) || changed {
+		t.Fatalf("RewrapString() with active key = %v, %v, want false, nil", changed, err)
+	}
+	if err := AddKeyFileKey(path, "k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, changed, err := c.RewrapString(s, aad)
+	if (err != nil) || !changed {
+		t.Fatalf("RewrapString() = %v, %v, want true, nil", changed, err)
+	}
+	if !strings.HasPrefix(rewrapped, stringPrefix+"k2:") {
+		t.Errorf("RewrapString() = %q is not wrapped by new key", rewrapped)
+	}
+	if got, err := c.DecryptString(rewrapped, aad); (err != nil) || (got != "1234 567890") {
+		t.Errorf("DecryptString() = %q, %v, want %q", got, err, "1234 567890")
+	}
+	if _, changed, err := c.RewrapString(rewrapped, aad); (err != nil) || changed {
+		t.Errorf("RewrapString() of rewrapped = %v, %v, want false, nil", changed, err)
+	}
+
+	rewrappedData, changed, err := c.RewrapBytes(data, aad)
+	if (err != nil) || !changed {
+		t.Fatalf("RewrapBytes() = %v, %v, want true, nil", changed, err)
+	}
+	if got, err := c.DecryptBytes(rewrappedData, aad); (err != nil) || (string(got) != "image") {
+		t.Errorf("DecryptBytes() = %q, %v, want %q", got, err, "image")
+	}
+	// Values, wrapped by old key, are still decrypted.
+	if got, err := c.DecryptString(s, aad); (err != nil) || (got != "1234 567890") {
+		t.Errorf("DecryptString() of old value = %q, %v, want %q", got, err, "1234 567890")
+	}
+}
+
+func TestCipherRejectsTampered(t *testing.T) {
+	dir := createTempDir(t)
+	defer os.RemoveAll(dir)
+	c, _ := createTestCipher(t, dir)
+	aad := []byte("cob-1/passport")
+	s, err := c.EncryptString("1234 567890", aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.EncryptBytes([]byte("image"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := parseStringEnvelope(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.sealed[len(env.sealed)-1] ^= 1
+	flipped := env.string()
+	tamperedData := append([]byte{}, data...)
+	tamperedData[len(tamperedData)-1] ^= 1
+
+	stringTests := []struct {
+		name  string
+		value string
+		aad   string
+	}{
+		{"other aad", s, "cob-2/passport"},
+		{"flipped ciphertext", flipped, string(aad)},
+		{"unknown key", strings.Replace(s, stringPrefix+"k1:", stringPrefix+"k9:", 1), string(aad)},
+		{"truncated", s[:len(stringPrefix)+3], string(aad)},
+		{"plaintext", "1234 567890", string(aad)},
+	}
+	for _, tt := range stringTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := c.DecryptString(tt.value, []byte(tt.aad)); err == nil {
+				t.Errorf("DecryptString() = %q, want error", got)
+			}
+		})
+	}
+
+	bytesTests := []struct {
+		name  string
+		value []byte
+		aad   string
+	}{
+		{"bytes other aad", data, "cob-2/img"},
+		{"bytes flipped ciphertext", tamperedData, string(aad)},
+		{"bytes truncated", data[:len(bytesMagic)+2], string(aad)},
+		{"bytes plaintext", []byte("image"), string(aad)},
+	}
+	for _, tt := range bytesTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := c.DecryptBytes(tt.value, []byte(tt.aad)); err == nil {
+				t.Errorf("DecryptBytes() = %q, want error", got)
+			}
+		})
+	}
+
+	if _, _, err := c.RewrapString("1234 567890", aad); err != ErrPlaintext {
+		t.Errorf("RewrapString() of plaintext error = %v, want %v", err, ErrPlaintext)
+	}
+	c.AllowPlaintext()
+	if got, err := c.DecryptString("1234 567890", aad); (err != nil) || (got != "1234 567890") {
+		t.Errorf("DecryptString() of allowed plaintext = %q, %v", got, err)
+	}
+}
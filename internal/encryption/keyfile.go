@@ -0,0 +1,309 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+/*
+Keyfile is YAML file with base64-encoded 256-bit keys:
+
+	active_key: "2026-10"
+	keys:
+	  "2026-09": "..."
+	  "2026-10": "..."
+	index_key: "..."
+
+New data keys are wrapped by active key, other keys only unwrap data keys, which
+were wrapped by them before rotation. Keyfile is reloaded, when it was changed,
+so running servers get new keys without restart.
+*/
+
+const keySize = 32
+
+// keyFile is YAML representation of keyfile.
+type keyFile struct {
+	ActiveKey string            `yaml:"active_key"`
+	Keys      map[string]string `yaml:"keys"`
+	IndexKey  string            `yaml:"index_key"`
+}
+
+// keyRing is parsed keyfile.
+type keyRing struct {
+	activeKey string
+	keys      map[string]cipher.AEAD
+	indexKey  []byte
+}
+
+// KeyFileProvider keeps key encryption keys in local keyfile.
+type KeyFileProvider struct {
+	path           string
+	reloadInterval time.Duration
+	mu             sync.Mutex
+	ring           *keyRing
+	data           []byte
+	checkedAt      time.Time
+}
+
+// CreateKeyFileProvider loads keyfile.
+func CreateKeyFileProvider(path string, reloadInterval time.Duration) (*KeyFileProvider, error) {
+	if path == "" {
+		return nil, errors.New("keyfile is not specified")
+	}
+	p := &KeyFileProvider{
+		path:           path,
+		reloadInterval: reloadInterval,
+		mu:             sync.Mutex{},
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func readKeyFile(path string) (*keyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read keyfile")
+	}
+	return parseKeyFile(data)
+}
+
+func parseKeyFile(data []byte) (*keyFile, error) {
+	kf := &keyFile{}
+	if err := yaml.Unmarshal(data, kf); err != nil {
+		return nil, errors.Wrap(err, "unable to parse keyfile")
+	}
+	return kf, nil
+}
+
+func decodeKey(name, s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", name)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid %s: expected %d bytes, got %d", name, keySize, len(key))
+	}
+	return key, nil
+}
+
+func createKeyRing(kf *keyFile) (*keyRing, error) {
+	ring := &keyRing{
+		activeKey: kf.ActiveKey,
+		keys:      make(map[string]cipher.AEAD, len(kf.Keys)),
+	}
+	for keyID, s := range kf.Keys {
+		if err := validateKeyID(keyID); err != nil {
+			return nil, err
+		}
+		key, err := decodeKey(fmt.Sprintf("key \"%s\"", keyID), s)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := createAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[keyID] = aead
+	}
+	if _, ok := ring.keys[ring.activeKey]; !ok {
+		return nil, fmt.Errorf("there is no active key \"%s\" in keyfile", ring.activeKey)
+	}
+	indexKey, err := decodeKey("index key", kf.IndexKey)
+	if err != nil {
+		return nil, err
+	}
+	ring.indexKey = indexKey
+	return ring, nil
+}
+
+// load reads keyfile and parses it, if it was changed. It should be called
+// under p.mu (or before p is shared).
+func (p *KeyFileProvider) load() error {
+	p.checkedAt = time.Now()
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return errors.Wrap(err, "unable to read keyfile")
+	}
+	if (p.ring != nil) && bytes.Equal(data, p.data) {
+		return nil
+	}
+	kf, err := parseKeyFile(data)
+	if err != nil {
+		return err
+	}
+	ring, err := createKeyRing(kf)
+	if err != nil {
+		return errors.Wrapf(err, "invalid keyfile \"%s\"", p.path)
+	}
+	p.ring = ring
+	p.data = data
+	return nil
+}
+
+// keyRing returns current keys, reloading keyfile, if it was checked
+// at least reloadInterval ago or if force is set. Keys, which were loaded
+// before, are used, if keyfile can't be reloaded periodically.
+func (p *KeyFileProvider) keyRing(force bool) (*keyRing, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if force || (time.Since(p.checkedAt) >= p.reloadInterval) {
+		if err := p.load(); (err != nil) && force {
+			return nil, err
+		}
+	}
+	return p.ring, nil
+}
+
+// ActiveKeyID ...
+func (p *KeyFileProvider) ActiveKeyID() (string, error) {
+	ring, err := p.keyRing(false)
+	if err != nil {
+		return "", err
+	}
+	return ring.activeKey, nil
+}
+
+// WrapKey ...
+func (p *KeyFileProvider) WrapKey(keyID string, dek []byte) ([]byte, error) {
+	aead, err := p.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, dek, nil)
+}
+
+// UnwrapKey ...
+func (p *KeyFileProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	aead, err := p.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	dek, err := open(aead, wrapped, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to unwrap data key by key \"%s\"", keyID)
+	}
+	return dek, nil
+}
+
+// key returns key encryption key; keyfile is reloaded at once, if there is no such key,
+// because it may be just added by rotation.
+func (p *KeyFileProvider) key(keyID string) (cipher.AEAD, error) {
+	ring, err := p.keyRing(false)
+	if err != nil {
+		return nil, err
+	}
+	if aead, ok := ring.keys[keyID]; ok {
+		return aead, nil
+	}
+	if ring, err = p.keyRing(true); err != nil {
+		return nil, err
+	}
+	if aead, ok := ring.keys[keyID]; ok {
+		return aead, nil
+	}
+	return nil, fmt.Errorf("there is no key \"%s\" in keyfile", keyID)
+}
+
+// IndexKey ...
+func (p *KeyFileProvider) IndexKey() ([]byte, error) {
+	ring, err := p.keyRing(false)
+	if err != nil {
+		return nil, err
+	}
+	return ring.indexKey, nil
+}
+
+func validateKeyID(keyID string) error {
+	if (len(keyID) == 0) || (len(keyID) > 64) {
+		return fmt.Errorf("invalid key ID \"%s\": it should have from 1 to 64 characters", keyID)
+	}
+	for _, c := range keyID {
+		if !(((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) ||
+			((c >= '0') && (c <= '9')) || (c == '_') || (c == '-') || (c == '.')) {
+			return fmt.Errorf("invalid key ID \"%s\": it may contain only latin letters, digits, \"_\", \"-\" and \".\"", keyID)
+		}
+	}
+	return nil
+}
+
+func generateKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", errors.Wrap(err, "unable to generate key")
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// AddKeyFileKey generates new key with given ID and makes it active; keyfile with
+// new index key is created, if it doesn't exist. Keyfile is replaced atomically.
+func AddKeyFileKey(path, keyID string) error {
+	if err := validateKeyID(keyID); err != nil {
+		return err
+	}
+	kf := &keyFile{}
+	if _, err := os.Stat(path); err == nil {
+		if kf, err = readKeyFile(path); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to read keyfile")
+	}
+	if _, ok := kf.Keys[keyID]; ok {
+		return fmt.Errorf("key \"%s\" already exists", keyID)
+	}
+	if kf.Keys == nil {
+		kf.Keys = make(map[string]string)
+	}
+	key, err := generateKey()
+	if err != nil {
+		return err
+	}
+	kf.Keys[keyID] = key
+	kf.ActiveKey = keyID
+	if kf.IndexKey == "" {
+		if kf.IndexKey, err = generateKey(); err != nil {
+			return err
+		}
+	}
+	if _, err := createKeyRing(kf); err != nil {
+		return errors.Wrapf(err, "invalid keyfile \"%s\"", path)
+	}
+
+	data, err := yaml.Marshal(kf)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal keyfile")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temporary keyfile")
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "unable to write keyfile")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package encryption
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/pkg/errors"
+)
+
+/*
+Personal data and images are protected by envelope encryption: every value is
+encrypted by its own random data key, which is wrapped (encrypted) by key encryption
+key of key provider and is stored with value. Key encryption keys never leave
+provider, so provider may be local keyfile or KMS-like service, which implements
+KeyProvider. Rotation of key encryption key only rewraps data keys, values are
+not encrypted again.
+*/
+
+const (
+	// KeyFileProviderType keeps key encryption keys in local keyfile.
+	KeyFileProviderType = "keyfile"
+
+	defaultReloadIntervalMS = 10000
+)
+
+// KeyProvider wraps and unwraps data keys by key encryption keys.
+type KeyProvider interface {
+	// ActiveKeyID returns ID of key encryption key, with which new data keys are wrapped.
+	ActiveKeyID() (string, error)
+	// WrapKey encrypts data key by key encryption key with given ID.
+	WrapKey(keyID string, dek []byte) ([]byte, error)
+	// UnwrapKey decrypts data key, wrapped by key encryption key with given ID.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+	// IndexKey returns key of blind indexes. It is never rotated, because
+	// all blind indexes would become invalid.
+	IndexKey() ([]byte, error)
+}
+
+// CreateKeyProvider creates KeyProvider of type, specified in config,
+// or returns nil, if encryption is disabled.
+func CreateKeyProvider(cfg *cfgparser.EncryptionCFG) (KeyProvider, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case KeyFileProviderType:
+		reloadIntervalMS := cfg.ReloadIntervalMS
+		if reloadIntervalMS <= 0 {
+			reloadIntervalMS = defaultReloadIntervalMS
+		}
+		return CreateKeyFileProvider(cfg.KeyFile, time.Duration(reloadIntervalMS)*time.Millisecond)
+	}
+	return nil, errors.Wrap(fmt.Errorf("unknown key provider \"%s\"", cfg.Provider),
+		"unable to create key provider")
+}
+
+// CreateCipher creates Cipher with key provider, specified in config,
+// or returns nil, if encryption is disabled.
+func CreateCipher(cfg *cfgparser.EncryptionCFG) (*Cipher, error) {
+	provider, err := CreateKeyProvider(cfg)
+	if (err != nil) || (provider == nil) {
+		return nil, err
+	}
+	return CreateProviderCipher(provider), nil
+}
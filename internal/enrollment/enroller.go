@@ -0,0 +1,389 @@
+package enrollment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/h2non/filetype"
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/schedulers"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/nofacedb/facedb/internal/validation"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Enroller sends photos of every person to facerecognizers itself (without running
+server) and receives their results on its own listener, which serves the same
+"put_faces_data" API, as server. Photo is enrolled, if exactly one valid face was
+found on it; photos without faces, with several faces or with recognition errors
+are reported as warnings. Person is enrolled by one commit (as through
+"add_control_object"): new control object (or existing one with the same passport)
+with all its enrolled photos and faces. IDs of control object, images and facial
+features vectors are derived from passport and photos data, so repeated enrollment
+of the same person (e.g. after interruption between commit and progress record)
+doesn't duplicate them.
+*/
+
+const (
+	apiPutFacesData  = "/api/v1/put_faces_data"
+	defaultTimeoutMS = 60000
+	defaultWorkers   = 4
+)
+
+// idsNamespace is a namespace of derived IDs.
+var idsNamespace = uuid.Must(uuid.FromString("4c9f2a61-5d0e-4b8e-9a57-3e0f1d6b7c22"))
+
+// Enroller enrolls persons.
+type Enroller struct {
+	photosDir   string
+	srcAddr     string
+	timeout     time.Duration
+	workers     int
+	fs          storages.FaceStorage
+	committer   *storages.Committer
+	frScheduler *schedulers.FaceRecognitionScheduler
+	validator   *validation.Validator
+	serv        *http.Server
+	mu          sync.Mutex
+	awaiting    map[string]chan *proto.PutFacesDataReq
+	logger      *log.Logger
+}
+
+// CreateEnroller starts listener for facerecognizers results and creates Enroller.
+func CreateEnroller(cfg *cfgparser.CFG, enrollmentCFG *cfgparser.EnrollmentCFG, photosDir string,
+	fs storages.FaceStorage, committer *storages.Committer,
+	client *http.Client, logger *log.Logger) (*Enroller, error) {
+	if len(cfg.FaceRecognizersCFG.FaceRecognizers) == 0 {
+		return nil, fmt.Errorf("no facerecognizers are configured")
+	}
+	ln, err := net.Listen("tcp", enrollmentCFG.Listen)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to listen for facerecognizers results")
+	}
+	srcAddr := enrollmentCFG.SrcAddr
+	if srcAddr == "" {
+		srcAddr = "http://" + ln.Addr().String()
+	}
+	timeoutMS := enrollmentCFG.TimeoutMS
+	if timeoutMS <= 0 {
+		timeoutMS = defaultTimeoutMS
+	}
+	workers := enrollmentCFG.Workers
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+
+	e := &Enroller{
+		photosDir: photosDir,
+		srcAddr:   srcAddr,
+		timeout:   time.Duration(timeoutMS) * time.Millisecond,
+		workers:   workers,
+		fs:        fs,
+		committer: committer,
+		frScheduler: schedulers.CreateFaceRecognitionScheduler(&(cfg.FaceRecognizersCFG),
+			srcAddr, client, logger),
+		validator: validation.CreateValidator(&(cfg.ValidationCFG)),
+		awaiting:  make(map[string]chan *proto.PutFacesDataReq),
+		logger:    logger,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPutFacesData, e.putFacesDataHandler)
+	e.serv = &http.Server{Handler: mux}
+	go func() {
+		if err := e.serv.Serve(ln); err != http.ErrServerClosed {
+			logger.Error(errors.Wrap(err, "unable to serve facerecognizers results"))
+		}
+	}()
+	logger.Debugf("waiting for facerecognizers results on \"%s\" (src_addr \"%s\")", ln.Addr(), srcAddr)
+
+	return e, nil
+}
+
+// Close stops listener.
+func (e *Enroller) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.serv.Shutdown(ctx); err != nil {
+		e.logger.Warn(errors.Wrap(err, "unable to stop listener"))
+	}
+}
+
+func (e *Enroller) writeResp(resp http.ResponseWriter, status int, k string, errorData *proto.ErrorData) {
+	data, _ := json.Marshal(&proto.ImmedResp{
+		Header: proto.Header{
+			SrcAddr: e.srcAddr,
+			UUID:    k,
+		},
+		ErrorData: errorData,
+	})
+	resp.WriteHeader(status)
+	resp.Write(data)
+}
+
+func (e *Enroller) putFacesDataHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		e.writeResp(resp, http.StatusBadRequest, "", &proto.ErrorData{
+			Code: proto.InvalidRequestMethodCode,
+			Info: "invalid request method",
+			Text: fmt.Sprintf("expected \"%s\", got \"%s\"", http.MethodPut, req.Method),
+		})
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	putFacesDataReq := &proto.PutFacesDataReq{}
+	if err == nil {
+		err = json.Unmarshal(data, putFacesDataReq)
+	}
+	if err != nil {
+		e.writeResp(resp, http.StatusBadRequest, "", &proto.ErrorData{
+			Code: proto.CorruptedBodyCode,
+			Info: "corrupted request body",
+			Text: err.Error(),
+		})
+		return
+	}
+
+	k := putFacesDataReq.Header.UUID
+	e.mu.Lock()
+	ch, ok := e.awaiting[k]
+	delete(e.awaiting, k)
+	e.mu.Unlock()
+	if ok {
+		ch <- putFacesDataReq
+	} else {
+		e.logger.Warnf("got unknown \"FacesData\" with UUID \"%s\" (photo timed out?)", k)
+	}
+	e.writeResp(resp, http.StatusOK, k, nil)
+}
+
+// recognize sends photo to facerecognizer and waits for its results.
+func (e *Enroller) recognize(imgBuff string) (*proto.PutFacesDataReq, error) {
+	k := uuid.Must(uuid.NewV4()).String()
+	ch := make(chan *proto.PutFacesDataReq, 1)
+	e.mu.Lock()
+	e.awaiting[k] = ch
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.awaiting, k)
+		e.mu.Unlock()
+	}()
+
+	if err := e.frScheduler.SendProcessImageReq(&proto.ProcessImageReq{
+		Header: proto.Header{
+			SrcAddr: e.srcAddr,
+			UUID:    k,
+		},
+		ImgBuff:   imgBuff,
+		FaceBoxes: []proto.FaceBox{},
+	}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case putFacesDataReq := <-ch:
+		if putFacesDataReq.ErrorData != nil {
+			return nil, fmt.Errorf("facerecognizer \"%s\" couldn't process photo: [%d] %s",
+				putFacesDataReq.Header.SrcAddr, putFacesDataReq.ErrorData.Code, putFacesDataReq.ErrorData.Text)
+		}
+		return putFacesDataReq, nil
+	case <-time.After(e.timeout):
+		return nil, fmt.Errorf("facerecognizer didn't answer in %s", e.timeout)
+	}
+}
+
+// enrolledPhoto is a photo with its only face.
+type enrolledPhoto struct {
+	data  []byte
+	sum   string
+	model string
+	face  proto.FaceData
+}
+
+// recognizePhoto reads photo and returns its only face.
+func (e *Enroller) recognizePhoto(path string) (*enrolledPhoto, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read photo")
+	}
+	if !filetype.IsImage(data) {
+		return nil, fmt.Errorf("not an image")
+	}
+	width, height, errorData := validation.ImgSize(data)
+	if errorData != nil {
+		return nil, fmt.Errorf("%s", errorData.Text)
+	}
+
+	putFacesDataReq, err := e.recognize(base64.StdEncoding.EncodeToString(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(putFacesDataReq.FacesData) != 1 {
+		return nil, fmt.Errorf("%d faces were found, expected one", len(putFacesDataReq.FacesData))
+	}
+	if errorData := e.validator.FacesData(putFacesDataReq.Model, putFacesDataReq.FacesData,
+		width, height); errorData != nil {
+		return nil, fmt.Errorf("invalid face: %s", errorData.Text)
+	}
+	sum := sha256.Sum256(data)
+	return &enrolledPhoto{
+		data:  data,
+		sum:   hex.EncodeToString(sum[:]),
+		model: putFacesDataReq.Model,
+		face:  putFacesDataReq.FacesData[0],
+	}, nil
+}
+
+// enroll enrolls one person.
+func (e *Enroller) enroll(p *Person) *Result {
+	res := &Result{
+		Passport: p.Passport,
+		Status:   FailedStatus,
+		Warnings: []string{},
+	}
+	paths, err := p.photos(e.photosDir)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.PhotosNum = len(paths)
+
+	photos := make([]*enrolledPhoto, 0, len(paths))
+	seen := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		photo, err := e.recognizePhoto(path)
+		if err != nil {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%s: %s", filepath.Base(path), err))
+			continue
+		}
+		if _, ok := seen[photo.sum]; ok {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("%s: duplicate photo", filepath.Base(path)))
+			continue
+		}
+		seen[photo.sum] = struct{}{}
+		photos = append(photos, photo)
+	}
+	if len(photos) == 0 {
+		res.Error = "no photos with one face"
+		return res
+	}
+
+	commit := &storages.Commit{
+		ID:             uuid.Must(uuid.NewV4()).String(),
+		TS:             time.Now(),
+		ControlObjects: make([]proto.ControlObject, 0, 1),
+		Imgs:           make([]storages.CommitImg, 0, len(photos)),
+		FFVs:           make([]storages.FFV, 0, len(photos)),
+	}
+	cob := p.controlObject()
+	defer storages.LockPassports(cob.Passport)()
+	dbCob, err := e.fs.SelectControlObjectByPassport(cob.Passport)
+	if err != nil {
+		res.Error = errors.Wrap(err, "unable to select control object by passport").Error()
+		return res
+	}
+	if dbCob.ID == proto.DefaultStringField {
+		cob.ID = uuid.NewV5(idsNamespace, cob.Passport).String()
+		commit.ControlObjects = append(commit.ControlObjects, cob)
+	} else {
+		cob.ID = dbCob.ID
+	}
+
+	for _, photo := range photos {
+		img := storages.Img{
+			ID:      uuid.NewV5(idsNamespace, cob.ID+"/"+photo.sum).String(),
+			TS:      commit.TS,
+			FaceIDs: []string{cob.ID},
+		}
+		commit.Imgs = append(commit.Imgs, storages.CommitImg{
+			Img:  img,
+			Data: photo.data,
+		})
+		commit.FFVs = append(commit.FFVs, storages.FFV{
+			ID:                   uuid.NewV5(idsNamespace, img.ID+"/"+photo.model).String(),
+			CobID:                cob.ID,
+			ImgID:                img.ID,
+			FaceBox:              photo.face.FaceBox,
+			Model:                photo.model,
+			FacialFeaturesVector: photo.face.FacialFeaturesVector,
+		})
+	}
+	if err := e.committer.Commit(commit); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	res.Status = EnrolledStatus
+	res.CobID = cob.ID
+	res.FacesNum = len(photos)
+	return res
+}
+
+// Enroll enrolls all persons, which are not enrolled yet by progress, and returns
+// their results in the same order. Result of every person is saved to progress.
+func (e *Enroller) Enroll(persons []Person, progress *Progress) ([]Result, error) {
+	results := make([]Result, len(persons))
+	idxs := make(chan int)
+	errs := make(chan error, e.workers)
+	wg := sync.WaitGroup{}
+	for w := 0; w < e.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idxs {
+				res := e.enroll(&(persons[i]))
+				res.TS = time.Now()
+				results[i] = *res
+				if res.Status == EnrolledStatus {
+					e.logger.Infof("enrolled person with passport \"%s\" (%d/%d faces)",
+						res.Passport, res.FacesNum, res.PhotosNum)
+				} else {
+					e.logger.Warnf("unable to enroll person with passport \"%s\": %s", res.Passport, res.Error)
+				}
+				if err := progress.Save(res); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+loop:
+	for i := range persons {
+		if res, ok := progress.Enrolled(persons[i].Passport); ok {
+			res.Status = SkippedStatus
+			res.Warnings = nil
+			results[i] = res
+			continue
+		}
+		select {
+		case idxs <- i:
+		case err = <-errs:
+			break loop
+		}
+	}
+	close(idxs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return results, err
+}
@@ -0,0 +1,247 @@
+package enrollment
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/validation"
+	"github.com/pkg/errors"
+)
+
+/*
+Manifest lists persons to enroll. It is either CSV file with header row, or JSON
+array of objects, with the same fields: passport (required, it identifies person
+on resume and existing control object), surname, name, patronymic, sex, birthdate,
+phone_num, email, address, attributes (object in JSON, "attr.{key}" columns in CSV)
+and photos: directory with photos of person, relative to photos root directory
+(passport, if empty). Without manifest every subdirectory of photos root directory
+is a person, named by passport.
+*/
+
+const attributeColumnPrefix = "attr."
+
+// Person is a manifest record.
+type Person struct {
+	Passport   string            `json:"passport"`
+	Surname    string            `json:"surname"`
+	Name       string            `json:"name"`
+	Patronymic string            `json:"patronymic"`
+	Sex        string            `json:"sex"`
+	BirthDate  string            `json:"birthdate"`
+	PhoneNum   string            `json:"phone_num"`
+	Email      string            `json:"email"`
+	Address    string            `json:"address"`
+	Attributes map[string]string `json:"attributes"`
+	Photos     string            `json:"photos"`
+}
+
+// controlObject returns control object with fields of person; empty fields are default.
+func (p *Person) controlObject() proto.ControlObject {
+	cob := proto.CreateDefaultControlObject()
+	fields := []struct {
+		dst *string
+		src string
+	}{
+		{&(cob.Passport), p.Passport},
+		{&(cob.Surname), p.Surname},
+		{&(cob.Name), p.Name},
+		{&(cob.Patronymic), p.Patronymic},
+		{&(cob.Sex), p.Sex},
+		{&(cob.BirthDate), p.BirthDate},
+		{&(cob.PhoneNum), p.PhoneNum},
+		{&(cob.Email), p.Email},
+		{&(cob.Address), p.Address},
+	}
+	for _, f := range fields {
+		if f.src != "" {
+			*(f.dst) = f.src
+		}
+	}
+	for k, v := range p.Attributes {
+		if v != "" {
+			if cob.Attributes == nil {
+				cob.Attributes = make(map[string]string)
+			}
+			cob.Attributes[k] = v
+		}
+	}
+	return *cob
+}
+
+func (p *Person) validate() error {
+	if p.Passport == "" {
+		return fmt.Errorf("passport is required")
+	}
+	switch p.Sex {
+	case "", proto.MaleSex, proto.FemaleSex, proto.UnknowSex:
+	default:
+		return fmt.Errorf("invalid sex \"%s\", expected \"%s\", \"%s\" or \"%s\"",
+			p.Sex, proto.MaleSex, proto.FemaleSex, proto.UnknowSex)
+	}
+	if errorData := validation.Attributes(p.Attributes); errorData != nil {
+		return fmt.Errorf("%s", errorData.Text)
+	}
+	if filepath.IsAbs(p.Photos) || strings.HasPrefix(filepath.Clean(p.Photos), "..") {
+		return fmt.Errorf("photos directory \"%s\" is out of photos root directory", p.Photos)
+	}
+	return nil
+}
+
+// ReadManifest reads persons from CSV or JSON (by extension) manifest.
+func ReadManifest(path string) ([]Person, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open manifest")
+	}
+	defer f.Close()
+
+	var persons []Person
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		persons, err = readJSONManifest(f)
+	} else {
+		persons, err = readCSVManifest(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return persons, checkPersons(persons)
+}
+
+func readJSONManifest(r io.Reader) ([]Person, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read manifest")
+	}
+	persons := []Person{}
+	if err := json.Unmarshal(data, &persons); err != nil {
+		return nil, errors.Wrap(err, "unable to parse manifest")
+	}
+	return persons, nil
+}
+
+// attributeColumn returns setter of attribute k of person.
+func attributeColumn(k string) func(p *Person, v string) {
+	return func(p *Person, v string) {
+		if p.Attributes == nil {
+			p.Attributes = make(map[string]string)
+		}
+		p.Attributes[k] = v
+	}
+}
+
+func readCSVManifest(r io.Reader) ([]Person, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read manifest header")
+	}
+	columns := make([]func(p *Person, v string), len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if strings.HasPrefix(name, attributeColumnPrefix) {
+			columns[i] = attributeColumn(strings.TrimPrefix(name, attributeColumnPrefix))
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "passport":
+			columns[i] = func(p *Person, v string) { p.Passport = v }
+		case "surname":
+			columns[i] = func(p *Person, v string) { p.Surname = v }
+		case "name":
+			columns[i] = func(p *Person, v string) { p.Name = v }
+		case "patronymic":
+			columns[i] = func(p *Person, v string) { p.Patronymic = v }
+		case "sex":
+			columns[i] = func(p *Person, v string) { p.Sex = v }
+		case "birthdate":
+			columns[i] = func(p *Person, v string) { p.BirthDate = v }
+		case "phone_num":
+			columns[i] = func(p *Person, v string) { p.PhoneNum = v }
+		case "email":
+			columns[i] = func(p *Person, v string) { p.Email = v }
+		case "address":
+			columns[i] = func(p *Person, v string) { p.Address = v }
+		case "photos":
+			columns[i] = func(p *Person, v string) { p.Photos = v }
+		default:
+			return nil, fmt.Errorf("unknown manifest column \"%s\"", name)
+		}
+	}
+
+	persons := []Person{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return persons, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read manifest")
+		}
+		p := Person{}
+		for i, v := range record {
+			columns[i](&p, strings.TrimSpace(v))
+		}
+		persons = append(persons, p)
+	}
+}
+
+// ReadPhotosDir returns person for every subdirectory of photos root directory.
+func ReadPhotosDir(dir string) ([]Person, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read photos directory")
+	}
+	persons := make([]Person, 0, len(fis))
+	for _, fi := range fis {
+		if fi.IsDir() {
+			persons = append(persons, Person{Passport: fi.Name()})
+		}
+	}
+	return persons, checkPersons(persons)
+}
+
+// checkPersons validates persons and checks, that passports are unique.
+func checkPersons(persons []Person) error {
+	seen := make(map[string]int, len(persons))
+	for i := range persons {
+		if err := persons[i].validate(); err != nil {
+			return errors.Wrapf(err, "invalid %d-th person", i+1)
+		}
+		if j, ok := seen[persons[i].Passport]; ok {
+			return fmt.Errorf("%d-th and %d-th persons have the same passport \"%s\"",
+				j+1, i+1, persons[i].Passport)
+		}
+		seen[persons[i].Passport] = i
+	}
+	return nil
+}
+
+// photos returns sorted paths of all files in photos directory of person.
+func (p *Person) photos(root string) ([]string, error) {
+	dir := p.Photos
+	if dir == "" {
+		dir = p.Passport
+	}
+	dir = filepath.Join(root, dir)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read photos directory")
+	}
+	paths := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+			paths = append(paths, filepath.Join(dir, fi.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
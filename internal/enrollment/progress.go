@@ -0,0 +1,105 @@
+package enrollment
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Result statuses of person.
+const (
+	EnrolledStatus = "enrolled"
+	FailedStatus   = "failed"
+	SkippedStatus  = "skipped"
+)
+
+// Result is a result of person enrollment.
+type Result struct {
+	TS       time.Time `json:"ts"`
+	Passport string    `json:"passport"`
+	Status   string    `json:"status"`
+	CobID    string    `json:"cob_id,omitempty"`
+	// PhotosNum is a number of photos in directory of person, FacesNum is a number
+	// of enrolled faces (one per photo).
+	PhotosNum int      `json:"photos_num"`
+	FacesNum  int      `json:"faces_num"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+// Progress is an append-only JSON lines file with results of processed persons,
+// so interrupted enrollment is resumed from the first not enrolled person.
+type Progress struct {
+	f        *os.File
+	mu       sync.Mutex
+	enrolled map[string]Result
+}
+
+// OpenProgress reads results from progress file (it is created, if missing)
+// and opens it for appending.
+func OpenProgress(path string) (*Progress, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open progress file")
+	}
+	p := &Progress{
+		f:        f,
+		enrolled: make(map[string]Result),
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		res := Result{}
+		// Last line may be torn by crash.
+		if err := json.Unmarshal(sc.Bytes(), &res); err != nil {
+			continue
+		}
+		if res.Status == EnrolledStatus {
+			p.enrolled[res.Passport] = res
+		} else {
+			delete(p.enrolled, res.Passport)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "unable to read progress file")
+	}
+	return p, nil
+}
+
+// Enrolled returns result of person, if it was already enrolled.
+func (p *Progress) Enrolled(passport string) (Result, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res, ok := p.enrolled[passport]
+	return res, ok
+}
+
+// Save durably appends result to progress file.
+func (p *Progress) Save(res *Result) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal result")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.f.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "unable to write progress file")
+	}
+	if err := p.f.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync progress file")
+	}
+	if res.Status == EnrolledStatus {
+		p.enrolled[res.Passport] = *res
+	}
+	return nil
+}
+
+// Close closes progress file.
+func (p *Progress) Close() error {
+	return p.f.Close()
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/h2non/filetype"
 	"github.com/nofacedb/facedb/internal/proto"
 	"github.com/nofacedb/facedb/internal/schedulers"
+	"github.com/nofacedb/facedb/internal/validation"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -42,6 +43,12 @@ func validateAddControlObjectReq(req *http.Request) (*proto.AddControlObjectReq,
 		}
 	}
 
+	if addControlObjectReq.ControlObjectPart != nil {
+		if errorData := validateNewAttributes(&(addControlObjectReq.ControlObjectPart.ControlObject)); errorData != nil {
+			return nil, errorData
+		}
+	}
+
 	if addControlObjectReq.ImagePart != nil {
 		imgBuffStr, err := base64.StdEncoding.DecodeString(addControlObjectReq.ImagePart.ImgBuff)
 		if err != nil {
@@ -67,6 +74,13 @@ func validateAddControlObjectReq(req *http.Request) (*proto.AddControlObjectReq,
 				Text: "unable to recognize image type",
 			}
 		}
+		fbs := []proto.FaceBox{}
+		if addControlObjectReq.ImagePart.FaceBox != nil {
+			fbs = append(fbs, addControlObjectReq.ImagePart.FaceBox)
+		}
+		if errorData := validation.FaceBoxesInImg(fbs, imgBuff); errorData != nil {
+			return nil, errorData
+		}
 	}
 
 	return addControlObjectReq, nil
@@ -97,6 +111,7 @@ func (rest *restAPI) addControlObjectHandler(resp http.ResponseWriter, req *http
 		UUID:      k,
 		Images:    make(map[string]proto.ImagePart),
 		FacesData: make(map[string]proto.FaceData),
+		Models:    make(map[string]string),
 	}
 	if _, err := rest.cpScheduler.ACOQ.PushWithCheck(k, v); err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
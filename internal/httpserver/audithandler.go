@@ -0,0 +1,137 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+)
+
+/*
+Audit REST API:
+  - GET /api/v1/audit?src_addr=&command=&img_uuid=&from=&to=&offset=&limit=
+    lists records of control panels decisions, matching all specified params,
+    newest first; from and to are RFC 3339 timestamps (to is exclusive);
+  - GET /api/v1/audit/verify verifies hash chain of all records.
+*/
+
+const apiAuditVerify = `verify`
+
+func parseAuditFilter(query url.Values) (*storages.AuditFilter, *proto.ErrorData) {
+	filter := &storages.AuditFilter{
+		SrcAddr: query.Get("src_addr"),
+		Command: query.Get("command"),
+		ImgUUID: query.Get("img_uuid"),
+	}
+	var errorData *proto.ErrorData
+	filter.From, errorData = parseTimeParam(query, "from")
+	if errorData != nil {
+		return nil, errorData
+	}
+	filter.To, errorData = parseTimeParam(query, "to")
+	if errorData != nil {
+		return nil, errorData
+	}
+	return filter, nil
+}
+
+func (rest *restAPI) writeAuditResp(resp http.ResponseWriter, status int, errorData *proto.ErrorData) {
+	if errorData != nil {
+		if errorData.Code == proto.InternalServerError {
+			rest.logger.Error(errorData.Text)
+		} else {
+			rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+				errorData.Code, errorData.Text)
+		}
+	}
+	rest.writeResp(resp, status, &proto.AuditResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+	})
+}
+
+func (rest *restAPI) auditHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiAudit)
+	if req.Method != httpGetMethod {
+		rest.writeAuditResp(resp, http.StatusBadRequest,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	filter, errorData := parseAuditFilter(query)
+	offset := uint64(0)
+	if errorData == nil {
+		offset, errorData = parseUintParam(query, "offset", 0)
+	}
+	limit := uint64(0)
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultControlObjectsLimit)
+	}
+	if errorData != nil {
+		rest.writeAuditResp(resp, http.StatusBadRequest, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxControlObjectsLimit) {
+		limit = maxControlObjectsLimit
+	}
+
+	recs, err := rest.fStorage.SelectAuditRecords(filter, offset, limit)
+	if err != nil {
+		rest.writeAuditResp(resp, http.StatusInternalServerError, internalErrorData(err))
+		return
+	}
+
+	auditResp := &proto.AuditResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		Records: recs,
+	}
+	if uint64(len(recs)) == limit {
+		nextOffset := offset + limit
+		auditResp.NextOffset = &nextOffset
+	}
+	rest.writeResp(resp, http.StatusOK, auditResp)
+}
+
+func (rest *restAPI) writeAuditVerificationResp(resp http.ResponseWriter, status int,
+	v *proto.AuditVerification, errorData *proto.ErrorData) {
+	if errorData != nil {
+		if errorData.Code == proto.InternalServerError {
+			rest.logger.Error(errorData.Text)
+		} else {
+			rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+				errorData.Code, errorData.Text)
+		}
+	}
+	rest.writeResp(resp, status, &proto.AuditVerificationResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData:    errorData,
+		Verification: v,
+	})
+}
+
+func (rest *restAPI) auditVerifyHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s/%s\"", apiAudit, apiAuditVerify)
+	if req.Method != httpGetMethod {
+		rest.writeAuditVerificationResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	v, err := rest.auditLog.Verify()
+	if err != nil {
+		rest.writeAuditVerificationResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	if !v.Valid {
+		rest.logger.Warnf("audit log hash chain is broken at record %d: %s", *(v.BrokenSeq), v.Reason)
+	}
+	rest.writeAuditVerificationResp(resp, http.StatusOK, v, nil)
+}
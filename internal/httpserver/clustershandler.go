@@ -0,0 +1,245 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+)
+
+/*
+Clusters REST API:
+  - GET  /api/v1/clusters?offset=&limit= lists not promoted clusters of unmatched
+    faces (anonymous identities), the largest first, with their representative faces;
+  - GET  /api/v1/clusters/{id} returns cluster with all its faces;
+  - POST /api/v1/clusters/{id}/promote creates control object from cluster with
+    all its faces and returns it.
+Clusters are built by "cluster_faces" command.
+*/
+
+const apiClusterPromote = `/promote`
+
+func clusterNotFoundErrorData(id string) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.NotFoundCode,
+		Info: "cluster not found",
+		Text: fmt.Sprintf("there is no cluster \"%s\"", id),
+	}
+}
+
+func (rest *restAPI) writeClustersResp(resp http.ResponseWriter, status int,
+	clusters []proto.Cluster, errorData *proto.ErrorData) {
+	if errorData != nil {
+		if errorData.Code == proto.InternalServerError {
+			rest.logger.Error(errorData.Text)
+		} else {
+			rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+				errorData.Code, errorData.Text)
+		}
+	}
+	rest.writeResp(resp, status, &proto.ClustersResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+		Clusters:  clusters,
+	})
+}
+
+// protoClusters returns clusters with their representative faces (and all
+// faces, if withFaces is set).
+func (rest *restAPI) protoClusters(clusters []storages.Cluster, withFaces bool) ([]proto.Cluster, error) {
+	ids := make([]string, 0, 16)
+	for _, c := range clusters {
+		if withFaces {
+			ids = append(ids, c.SightingIDs...)
+		} else {
+			ids = append(ids, c.RepresentativeIDs...)
+		}
+	}
+	sightings, err := rest.fStorage.SelectSightingsByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	sightingsByID := make(map[string]*storages.Sighting, len(sightings))
+	for i := range sightings {
+		sightingsByID[sightings[i].ID] = &(sightings[i])
+	}
+
+	protoClusters := make([]proto.Cluster, 0, len(clusters))
+	for _, c := range clusters {
+		pc := proto.Cluster{
+			ID:              c.ID,
+			TS:              c.TS,
+			Model:           c.Model,
+			Size:            len(c.SightingIDs),
+			CobID:           c.CobID,
+			Representatives: make([]proto.Sighting, 0, len(c.RepresentativeIDs)),
+		}
+		for _, id := range c.RepresentativeIDs {
+			if s, ok := sightingsByID[id]; ok {
+				pc.Representatives = append(pc.Representatives, protoSighting(s))
+			}
+		}
+		if withFaces {
+			pc.Faces = make([]proto.Sighting, 0, len(c.SightingIDs))
+			for _, id := range c.SightingIDs {
+				if s, ok := sightingsByID[id]; ok {
+					pc.Faces = append(pc.Faces, protoSighting(s))
+				}
+			}
+		}
+		protoClusters = append(protoClusters, pc)
+	}
+	return protoClusters, nil
+}
+
+func (rest *restAPI) clustersHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiClusters)
+	if req.Method != httpGetMethod {
+		rest.writeClustersResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	offset, errorData := parseUintParam(query, "offset", 0)
+	limit := uint64(0)
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultControlObjectsLimit)
+	}
+	if errorData != nil {
+		rest.writeClustersResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxControlObjectsLimit) {
+		limit = maxControlObjectsLimit
+	}
+
+	clusters, err := rest.fStorage.SelectClusters(offset, limit)
+	if err != nil {
+		rest.writeClustersResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	protoClusters, err := rest.protoClusters(clusters, false)
+	if err != nil {
+		rest.writeClustersResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+
+	clustersResp := &proto.ClustersResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		Clusters: protoClusters,
+	}
+	if uint64(len(clusters)) == limit {
+		nextOffset := offset + limit
+		clustersResp.NextOffset = &nextOffset
+	}
+	rest.writeResp(resp, http.StatusOK, clustersResp)
+}
+
+func (rest *restAPI) clusterHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", req.URL.Path)
+	id := strings.TrimPrefix(req.URL.Path, apiClusters+"/")
+	if strings.HasSuffix(id, apiClusterPromote) {
+		if req.Method != httpPostMethod {
+			rest.writeControlObjectResp(resp, http.StatusBadRequest, nil,
+				invalidMethodErrorData([]string{httpPostMethod}, req.Method))
+			return
+		}
+		rest.promoteCluster(resp, req, strings.TrimSuffix(id, apiClusterPromote))
+		return
+	}
+
+	if req.Method != httpGetMethod {
+		rest.writeClustersResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+	cluster, err := rest.fStorage.SelectCluster(id)
+	if err != nil {
+		rest.writeClustersResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	if cluster == nil {
+		rest.writeClustersResp(resp, http.StatusNotFound, nil, clusterNotFoundErrorData(id))
+		return
+	}
+	protoClusters, err := rest.protoClusters([]storages.Cluster{*cluster}, true)
+	if err != nil {
+		rest.writeClustersResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	rest.writeClustersResp(resp, http.StatusOK, protoClusters, nil)
+}
+
+func validatePromoteClusterReq(req *http.Request) (*proto.PromoteClusterReq, *proto.ErrorData) {
+	promoteClusterReq := &proto.PromoteClusterReq{}
+	if errorData := unmarshalReqBody(req, promoteClusterReq); errorData != nil {
+		return nil, errorData
+	}
+	if promoteClusterReq.ControlObject.Passport == "" {
+		return nil, &proto.ErrorData{
+			Code: proto.InvalidRequestParamsCode,
+			Info: "invalid request params",
+			Text: "\"passport\" of control object should be set",
+		}
+	}
+	if errorData := validateSex(promoteClusterReq.ControlObject.Sex); errorData != nil {
+		return nil, errorData
+	}
+	if errorData := validateNewAttributes(&(promoteClusterReq.ControlObject)); errorData != nil {
+		return nil, errorData
+	}
+	return promoteClusterReq, nil
+}
+
+func (rest *restAPI) promoteCluster(resp http.ResponseWriter, req *http.Request, id string) {
+	promoteClusterReq, errorData := validatePromoteClusterReq(req)
+	if errorData != nil {
+		rest.writeControlObjectResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+
+	cob := &(promoteClusterReq.ControlObject)
+	defer storages.LockPassports(cob.Passport)()
+	dbCob, err := rest.fStorage.SelectControlObjectByPassport(cob.Passport)
+	if err != nil {
+		rest.writeInternalError(resp, err)
+		return
+	}
+	// Control object with cluster ID remains after failed promotion.
+	if (dbCob.ID != proto.DefaultStringField) && (dbCob.ID != id) {
+		rest.writeControlObjectResp(resp, http.StatusConflict, nil, &proto.ErrorData{
+			Code: proto.ConflictCode,
+			Info: "passport is already used",
+			Text: fmt.Sprintf("passport \"%s\" belongs to control object \"%s\"",
+				cob.Passport, dbCob.ID),
+		})
+		return
+	}
+
+	cob, err = storages.PromoteCluster(rest.fStorage, rest.identities, id, cob, rest.logger)
+	if err == storages.ErrClusterPromoted {
+		rest.writeControlObjectResp(resp, http.StatusConflict, nil, &proto.ErrorData{
+			Code: proto.ConflictCode,
+			Info: "cluster is already promoted",
+			Text: fmt.Sprintf("cluster \"%s\" is already promoted", id),
+		})
+		return
+	}
+	if err != nil {
+		rest.writeInternalError(resp, err)
+		return
+	}
+	if cob == nil {
+		rest.writeControlObjectResp(resp, http.StatusNotFound, nil, clusterNotFoundErrorData(id))
+		return
+	}
+	rest.names.Put([]proto.ControlObject{*cob})
+	rest.writeControlObjectResp(resp, http.StatusOK, cob, nil)
+}
@@ -0,0 +1,481 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nofacedb/facedb/internal/namesearch"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/nofacedb/facedb/internal/validation"
+	"github.com/pkg/errors"
+)
+
+/*
+Control objects REST API:
+  - GET    /api/v1/control_objects?passport=&surname=&name=&patronymic=&sex=&birthdate=&attr.{key}=&offset=&limit=
+    lists control objects, matching all specified fields and attributes, ordered by ID;
+  - GET    /api/v1/control_objects/by_passport/{passport} returns control object by passport;
+  - GET    /api/v1/control_objects/search?q=&limit= returns control objects, which surname, name,
+    patronymic or passport match words of query (in Cyrillic or Latin, typed partially or with typos),
+    the most relevant first;
+  - GET    /api/v1/control_objects/{id} returns control object by ID;
+  - PUT    /api/v1/control_objects/{id} updates control object business fields and attributes;
+  - DELETE /api/v1/control_objects/{id} deletes control object.
+Updates and deletes insert new versions of control object, so its previous
+versions are replaced by ClickHouse DB (ReplacingMergeTree by db_ts).
+*/
+
+const (
+	apiControlObjectsByPassport = `by_passport/`
+	apiControlObjectsSearch     = `search`
+	attributeParamPrefix        = `attr.`
+	defaultControlObjectsLimit  = 100
+	maxControlObjectsLimit      = 1000
+	defaultSearchLimit          = 20
+)
+
+func parseUintParam(query url.Values, name string, defaultValue uint64) (uint64, *proto.ErrorData) {
+	v := query.Get(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, &proto.ErrorData{
+			Code: proto.InvalidRequestParamsCode,
+			Info: "invalid request params",
+			Text: fmt.Sprintf("invalid \"%s\" value: %s", name, err),
+		}
+	}
+	return n, nil
+}
+
+func validateSex(sex string) *proto.ErrorData {
+	switch sex {
+	case "", proto.MaleSex, proto.FemaleSex, proto.UnknowSex:
+		return nil
+	}
+	return &proto.ErrorData{
+		Code: proto.InvalidRequestParamsCode,
+		Info: "invalid request params",
+		Text: fmt.Sprintf("invalid sex \"%s\", expected \"%s\", \"%s\" or \"%s\"",
+			sex, proto.MaleSex, proto.FemaleSex, proto.UnknowSex),
+	}
+}
+
+// validateNewAttributes checks attributes of new control object and removes empty ones.
+func validateNewAttributes(cob *proto.ControlObject) *proto.ErrorData {
+	if errorData := validation.Attributes(cob.Attributes); errorData != nil {
+		return errorData
+	}
+	for k, v := range cob.Attributes {
+		if v == "" {
+			delete(cob.Attributes, k)
+		}
+	}
+	return nil
+}
+
+// parseAttributesParams returns attributes filter from "attr.{key}" params.
+func parseAttributesParams(query url.Values) (map[string]string, *proto.ErrorData) {
+	var attrs map[string]string
+	for name, values := range query {
+		if !strings.HasPrefix(name, attributeParamPrefix) {
+			continue
+		}
+		k := strings.TrimPrefix(name, attributeParamPrefix)
+		if errorData := validation.AttributeKey(k); errorData != nil {
+			return nil, errorData
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[k] = values[0]
+	}
+	return attrs, nil
+}
+
+func invalidMethodErrorData(expected []string, got string) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.InvalidRequestMethodCode,
+		Info: "invalid request method",
+		Text: fmt.Sprintf("expected \"%s\", got \"%s\"",
+			strings.Join(expected, "\", \""), got),
+	}
+}
+
+func (rest *restAPI) writeControlObjectResp(resp http.ResponseWriter, status int,
+	cob *proto.ControlObject, errorData *proto.ErrorData) {
+	if errorData != nil {
+		rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+			errorData.Code, errorData.Text)
+	}
+	rest.writeResp(resp, status, &proto.ControlObjectResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData:     errorData,
+		ControlObject: cob,
+	})
+}
+
+func (rest *restAPI) writeInternalError(resp http.ResponseWriter, err error) {
+	rest.logger.Error(err)
+	rest.writeControlObjectResp(resp, http.StatusInternalServerError, nil, &proto.ErrorData{
+		Code: proto.InternalServerError,
+		Info: "internal server error",
+		Text: err.Error(),
+	})
+}
+
+func (rest *restAPI) controlObjectsHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiControlObjects)
+	if req.Method != httpGetMethod {
+		rest.writeControlObjectResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	filter := &storages.ControlObjectsFilter{
+		Passport:   query.Get("passport"),
+		Surname:    query.Get("surname"),
+		Name:       query.Get("name"),
+		Patronymic: query.Get("patronymic"),
+		Sex:        query.Get("sex"),
+		BirthDate:  query.Get("birthdate"),
+	}
+	errorData := validateSex(filter.Sex)
+	if errorData == nil {
+		filter.Attributes, errorData = parseAttributesParams(query)
+	}
+	offset := uint64(0)
+	limit := uint64(0)
+	if errorData == nil {
+		offset, errorData = parseUintParam(query, "offset", 0)
+	}
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultControlObjectsLimit)
+	}
+	if errorData != nil {
+		rest.writeControlObjectResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxControlObjectsLimit) {
+		limit = maxControlObjectsLimit
+	}
+
+	cobs, err := rest.fStorage.SelectControlObjects(filter, offset, limit)
+	if err != nil {
+		rest.writeInternalError(resp, err)
+		return
+	}
+
+	cobsResp := &proto.ControlObjectsResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ControlObjects: cobs,
+	}
+	if uint64(len(cobs)) == limit {
+		nextOffset := offset + limit
+		cobsResp.NextOffset = &nextOffset
+	}
+	rest.writeResp(resp, http.StatusOK, cobsResp)
+}
+
+func (rest *restAPI) controlObjectHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", req.URL.Path)
+	key := strings.TrimPrefix(req.URL.Path, apiControlObjects+"/")
+	if strings.HasPrefix(key, apiControlObjectsByPassport) {
+		if req.Method != httpGetMethod {
+			rest.writeControlObjectResp(resp, http.StatusBadRequest, nil,
+				invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+			return
+		}
+		rest.getControlObjectByPassport(resp, strings.TrimPrefix(key, apiControlObjectsByPassport))
+		return
+	}
+	if key == apiControlObjectsSearch {
+		if req.Method != httpGetMethod {
+			rest.writeSearchControlObjectsResp(resp, http.StatusBadRequest, nil,
+				invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+			return
+		}
+		rest.searchControlObjects(resp, req)
+		return
+	}
+
+	switch req.Method {
+	case httpGetMethod:
+		rest.getControlObject(resp, key)
+	case httpPutMethod:
+		rest.updateControlObject(resp, req, key)
+	case httpDeleteMethod:
+		rest.deleteControlObject(resp, key)
+	default:
+		rest.writeControlObjectResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod, httpPutMethod, httpDeleteMethod}, req.Method))
+	}
+}
+
+func notFoundErrorData(id string) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.NotFoundCode,
+		Info: "control object not found",
+		Text: fmt.Sprintf("there is no control object \"%s\"", id),
+	}
+}
+
+func (rest *restAPI) selectControlObject(id string) (*proto.ControlObject, error) {
+	cobs, err := rest.fStorage.SelectControlObjectsByIDs([]string{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(cobs) == 0 {
+		return nil, nil
+	}
+	return &(cobs[0]), nil
+}
+
+func (rest *restAPI) getControlObject(resp http.ResponseWriter, id string) {
+	cob, err := rest.selectControlObject(id)
+	if err != nil {
+		rest.writeInternalError(resp, err)
+		return
+	}
+	if cob == nil {
+		rest.writeControlObjectResp(resp, http.StatusNotFound, nil, notFoundErrorData(id))
+		return
+	}
+	rest.writeControlObjectResp(resp, http.StatusOK, cob, nil)
+}
+
+func (rest *restAPI) getControlObjectByPassport(resp http.ResponseWriter, passport string) {
+	passport, err := url.PathUnescape(passport)
+	if err != nil {
+		rest.writeControlObjectResp(resp, http.StatusBadRequest, nil, &proto.ErrorData{
+			Code: proto.InvalidRequestParamsCode,
+			Info: "invalid request params",
+			Text: err.Error(),
+		})
+		return
+	}
+	cob, err := rest.fStorage.SelectControlObjectByPassport(passport)
+	if err != nil {
+		rest.writeInternalError(resp, err)
+		return
+	}
+	if cob.ID == proto.DefaultStringField {
+		rest.writeControlObjectResp(resp, http.StatusNotFound, nil, &proto.ErrorData{
+			Code: proto.NotFoundCode,
+			Info: "control object not found",
+			Text: fmt.Sprintf("there is no control object with passport \"%s\"", passport),
+		})
+		return
+	}
+	rest.writeControlObjectResp(resp, http.StatusOK, cob, nil)
+}
+
+func validateUpdateControlObjectReq(req *http.Request) (*proto.UpdateControlObjectReq, *proto.ErrorData) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, &proto.ErrorData{
+			Code: proto.CorruptedBodyCode,
+			Info: "corrupted request body",
+			Text: err.Error(),
+		}
+	}
+
+	updateControlObjectReq := &proto.UpdateControlObjectReq{}
+	if err := json.Unmarshal(data, updateControlObjectReq); err != nil {
+		return nil, &proto.ErrorData{
+			Code: proto.CorruptedBodyCode,
+			Info: "corrupted request body",
+			Text: err.Error(),
+		}
+	}
+
+	if errorData := validateSex(updateControlObjectReq.ControlObject.Sex); errorData != nil {
+		return nil, errorData
+	}
+	if errorData := validation.Attributes(updateControlObjectReq.ControlObject.Attributes); errorData != nil {
+		return nil, errorData
+	}
+
+	return updateControlObjectReq, nil
+}
+
+func updateField(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
+// updateAttributes sets attributes, and removes ones with empty values.
+func updateAttributes(cob *proto.ControlObject, attrs map[string]string) {
+	for k, v := range attrs {
+		if v == "" {
+			delete(cob.Attributes, k)
+			continue
+		}
+		if cob.Attributes == nil {
+			cob.Attributes = make(map[string]string)
+		}
+		cob.Attributes[k] = v
+	}
+}
+
+func (rest *restAPI) updateControlObject(resp http.ResponseWriter, req *http.Request, id string) {
+	updateControlObjectReq, errorData := validateUpdateControlObjectReq(req)
+	if errorData != nil {
+		rest.writeControlObjectResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+
+	// Concurrent updates of control object are applied one after another.
+	defer storages.LockControlObjects(id)()
+	cob, err := rest.selectControlObject(id)
+	if err != nil {
+		rest.writeInternalError(resp, err)
+		return
+	}
+	if cob == nil {
+		rest.writeControlObjectResp(resp, http.StatusNotFound, nil, notFoundErrorData(id))
+		return
+	}
+
+	upd := &(updateControlObjectReq.ControlObject)
+	passportChanged := (upd.Passport != "") && (upd.Passport != cob.Passport)
+	if passportChanged {
+		defer storages.LockPassports(upd.Passport)()
+		dbCob, err := rest.fStorage.SelectControlObjectByPassport(upd.Passport)
+		if err != nil {
+			rest.writeInternalError(resp, err)
+			return
+		}
+		if dbCob.ID != proto.DefaultStringField {
+			rest.writeControlObjectResp(resp, http.StatusConflict, nil, &proto.ErrorData{
+				Code: proto.ConflictCode,
+				Info: "passport is already used",
+				Text: fmt.Sprintf("passport \"%s\" belongs to control object \"%s\"",
+					upd.Passport, dbCob.ID),
+			})
+			return
+		}
+	}
+	oldCob := *cob
+	updateField(&(cob.Passport), upd.Passport)
+	updateField(&(cob.Surname), upd.Surname)
+	updateField(&(cob.Name), upd.Name)
+	updateField(&(cob.Patronymic), upd.Patronymic)
+	updateField(&(cob.Sex), upd.Sex)
+	updateField(&(cob.BirthDate), upd.BirthDate)
+	updateField(&(cob.PhoneNum), upd.PhoneNum)
+	updateField(&(cob.Email), upd.Email)
+	updateField(&(cob.Address), upd.Address)
+	updateAttributes(cob, upd.Attributes)
+
+	if err := rest.fStorage.InsertControlObjects([]proto.ControlObject{*cob}); err != nil {
+		rest.writeInternalError(resp, err)
+		return
+	}
+	if passportChanged {
+		// Passport may be taken by other server or command after check.
+		dbCobs, err := rest.fStorage.SelectControlObjects(&storages.ControlObjectsFilter{
+			Passport: upd.Passport,
+		}, 0, 2)
+		if err != nil {
+			rest.writeInternalError(resp, err)
+			return
+		}
+		for _, dbCob := range dbCobs {
+			if dbCob.ID == cob.ID {
+				continue
+			}
+			if err := rest.fStorage.InsertControlObjects([]proto.ControlObject{oldCob}); err != nil {
+				rest.writeInternalError(resp, errors.Wrapf(err,
+					"unable to restore control object \"%s\" with conflicting passport", id))
+				return
+			}
+			rest.writeControlObjectResp(resp, http.StatusConflict, nil, &proto.ErrorData{
+				Code: proto.ConflictCode,
+				Info: "passport is already used",
+				Text: fmt.Sprintf("passport \"%s\" belongs to control object \"%s\"",
+					upd.Passport, dbCob.ID),
+			})
+			return
+		}
+	}
+	rest.names.Put([]proto.ControlObject{*cob})
+	rest.logger.Debugf("updated control object \"%s\"", id)
+	rest.writeControlObjectResp(resp, http.StatusOK, cob, nil)
+}
+
+func (rest *restAPI) deleteControlObject(resp http.ResponseWriter, id string) {
+	ok, err := rest.fStorage.DeleteControlObject(id)
+	if err != nil {
+		rest.writeInternalError(resp, err)
+		return
+	}
+	if !ok {
+		rest.writeControlObjectResp(resp, http.StatusNotFound, nil, notFoundErrorData(id))
+		return
+	}
+	rest.logger.Debugf("deleted control object \"%s\"", id)
+	rest.writeControlObjectResp(resp, http.StatusOK, nil, nil)
+}
+
+func (rest *restAPI) writeSearchControlObjectsResp(resp http.ResponseWriter, status int,
+	matches []proto.ControlObjectMatch, errorData *proto.ErrorData) {
+	if errorData != nil {
+		rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+			errorData.Code, errorData.Text)
+	}
+	rest.writeResp(resp, status, &proto.SearchControlObjectsResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+		Matches:   matches,
+	})
+}
+
+func (rest *restAPI) searchControlObjects(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	q := query.Get("q")
+	if len(namesearch.Words(q)) == 0 {
+		rest.writeSearchControlObjectsResp(resp, http.StatusBadRequest, nil, &proto.ErrorData{
+			Code: proto.InvalidRequestParamsCode,
+			Info: "invalid request params",
+			Text: "\"q\" should contain at least one letter or digit",
+		})
+		return
+	}
+	limit, errorData := parseUintParam(query, "limit", defaultSearchLimit)
+	if errorData != nil {
+		rest.writeSearchControlObjectsResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxControlObjectsLimit) {
+		limit = maxControlObjectsLimit
+	}
+
+	matches, err := rest.names.Search(q, int(limit))
+	if err != nil {
+		rest.logger.Error(err)
+		rest.writeSearchControlObjectsResp(resp, http.StatusInternalServerError, nil, &proto.ErrorData{
+			Code: proto.InternalServerError,
+			Info: "internal server error",
+			Text: err.Error(),
+		})
+		return
+	}
+	rest.writeSearchControlObjectsResp(resp, http.StatusOK, matches, nil)
+}
@@ -0,0 +1,143 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+)
+
+/*
+Erasures REST API:
+  - POST /api/v1/erase_control_object erases control object with all its
+    facial features vectors and images and returns its tombstone;
+  - GET  /api/v1/erasures?offset=&limit= lists tombstones, newest first.
+*/
+
+func (rest *restAPI) writeErasuresResp(resp http.ResponseWriter, status int,
+	erasures []proto.Erasure, errorData *proto.ErrorData) {
+	if errorData != nil {
+		rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+			errorData.Code, errorData.Text)
+	}
+	rest.writeResp(resp, status, &proto.ErasuresResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+		Erasures:  erasures,
+	})
+}
+
+func validateEraseControlObjectReq(req *http.Request) (*proto.EraseControlObjectReq, *proto.ErrorData) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, &proto.ErrorData{
+			Code: proto.CorruptedBodyCode,
+			Info: "corrupted request body",
+			Text: err.Error(),
+		}
+	}
+
+	eraseControlObjectReq := &proto.EraseControlObjectReq{}
+	if err := json.Unmarshal(data, eraseControlObjectReq); err != nil {
+		return nil, &proto.ErrorData{
+			Code: proto.CorruptedBodyCode,
+			Info: "corrupted request body",
+			Text: err.Error(),
+		}
+	}
+
+	if (eraseControlObjectReq.ID == "") ||
+		(eraseControlObjectReq.Reason == "") ||
+		(eraseControlObjectReq.RequestedBy == "") {
+		return nil, &proto.ErrorData{
+			Code: proto.InvalidRequestParamsCode,
+			Info: "invalid request params",
+			Text: "\"id\", \"reason\" and \"requested_by\" should be set",
+		}
+	}
+
+	return eraseControlObjectReq, nil
+}
+
+func (rest *restAPI) eraseControlObjectHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiEraseControlObject)
+	if req.Method != httpPostMethod {
+		rest.writeErasuresResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpPostMethod}, req.Method))
+		return
+	}
+
+	eraseControlObjectReq, errorData := validateEraseControlObjectReq(req)
+	if errorData != nil {
+		rest.writeErasuresResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+
+	erasure, err := storages.EraseControlObject(rest.fStorage, rest.imgStore, eraseControlObjectReq.ID,
+		eraseControlObjectReq.Reason, eraseControlObjectReq.RequestedBy, rest.logger)
+	if err != nil {
+		rest.logger.Error(err)
+		rest.writeErasuresResp(resp, http.StatusInternalServerError, nil, &proto.ErrorData{
+			Code: proto.InternalServerError,
+			Info: "internal server error",
+			Text: err.Error(),
+		})
+		return
+	}
+	if erasure == nil {
+		rest.writeErasuresResp(resp, http.StatusNotFound, nil,
+			notFoundErrorData(eraseControlObjectReq.ID))
+		return
+	}
+	rest.writeErasuresResp(resp, http.StatusOK, []proto.Erasure{*erasure}, nil)
+}
+
+func (rest *restAPI) erasuresHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiErasures)
+	if req.Method != httpGetMethod {
+		rest.writeErasuresResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	offset, errorData := parseUintParam(query, "offset", 0)
+	limit := uint64(0)
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultControlObjectsLimit)
+	}
+	if errorData != nil {
+		rest.writeErasuresResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxControlObjectsLimit) {
+		limit = maxControlObjectsLimit
+	}
+
+	erasures, err := rest.fStorage.SelectErasures(offset, limit)
+	if err != nil {
+		rest.logger.Error(err)
+		rest.writeErasuresResp(resp, http.StatusInternalServerError, nil, &proto.ErrorData{
+			Code: proto.InternalServerError,
+			Info: "internal server error",
+			Text: err.Error(),
+		})
+		return
+	}
+
+	erasuresResp := &proto.ErasuresResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		Erasures: erasures,
+	}
+	if uint64(len(erasures)) == limit {
+		nextOffset := offset + limit
+		erasuresResp.NextOffset = &nextOffset
+	}
+	rest.writeResp(resp, http.StatusOK, erasuresResp)
+}
@@ -13,15 +13,20 @@ import (
 	"time"
 
 	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/namesearch"
 	"github.com/nofacedb/facedb/internal/schedulers"
 	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/nofacedb/facedb/internal/watchlists"
 	"github.com/pkg/errors"
 )
 
 const (
-	httpGetMethod  = "GET"
-	httpPostMethod = "POST"
-	httpPutMethod  = "PUT"
+	httpGetMethod    = "GET"
+	httpPostMethod   = "POST"
+	httpPutMethod    = "PUT"
+	httpDeleteMethod = "DELETE"
 )
 
 // HTTPServer struct contains all server configuration and work.
@@ -38,11 +43,16 @@ func CreateHTTPServer(
 	cfg *cfgparser.CFG, srcAddr string,
 	frScheduler *schedulers.FaceRecognitionScheduler,
 	cpScheduler *schedulers.ControlPanelScheduler,
-	fStorage *storages.FaceStorage,
+	fStorage storages.FaceStorage,
+	imgStore imgstores.ImgStore,
+	identitiesModel *identities.Model,
+	committer *storages.Committer,
+	watcher *watchlists.Watcher,
+	names *namesearch.Index,
 	client *http.Client, logger *log.Logger) *HTTPServer {
 	rest := createRestAPI(
-		cfg, srcAddr, cfg.StorageCFG.ImgPath,
-		frScheduler, cpScheduler, fStorage,
+		cfg, srcAddr,
+		frScheduler, cpScheduler, fStorage, imgStore, identitiesModel, committer, watcher, names,
 		client, logger)
 	return &HTTPServer{
 		rest: rest,
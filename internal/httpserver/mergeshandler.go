@@ -0,0 +1,192 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+)
+
+/*
+Duplicates REST API:
+  - GET  /api/v1/duplicates?threshold=&k= lists pairs of control objects with
+    near-identical centroids, most similar first (it compares all centroids, so it is slow);
+  - POST /api/v1/merge_control_objects merges duplicate control object into survivor
+    and returns merge record;
+  - GET  /api/v1/merges?offset=&limit= lists merge records, newest first.
+*/
+
+const defaultDuplicatesK = 5
+
+func (rest *restAPI) writeMergesResp(resp http.ResponseWriter, status int,
+	merges []proto.Merge, errorData *proto.ErrorData) {
+	if errorData != nil {
+		if errorData.Code == proto.InternalServerError {
+			rest.logger.Error(errorData.Text)
+		} else {
+			rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+				errorData.Code, errorData.Text)
+		}
+	}
+	rest.writeResp(resp, status, &proto.MergesResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+		Merges:    merges,
+	})
+}
+
+func (rest *restAPI) writeDuplicatesResp(resp http.ResponseWriter, status int,
+	duplicates []proto.Duplicate, errorData *proto.ErrorData) {
+	if errorData != nil {
+		if errorData.Code == proto.InternalServerError {
+			rest.logger.Error(errorData.Text)
+		} else {
+			rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+				errorData.Code, errorData.Text)
+		}
+	}
+	rest.writeResp(resp, status, &proto.DuplicatesResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData:  errorData,
+		Duplicates: duplicates,
+	})
+}
+
+func (rest *restAPI) duplicatesHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiDuplicates)
+	if req.Method != httpGetMethod {
+		rest.writeDuplicatesResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	threshold := rest.identities.DuplicateThreshold()
+	if v := query.Get("threshold"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			rest.writeDuplicatesResp(resp, http.StatusBadRequest, nil, invalidParamErrorData("threshold", err))
+			return
+		}
+		threshold = t
+	}
+	k, errorData := parseUintParam(query, "k", defaultDuplicatesK)
+	if errorData != nil {
+		rest.writeDuplicatesResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+	if k == 0 {
+		k = defaultDuplicatesK
+	}
+
+	duplicates, err := storages.FindDuplicates(rest.fStorage, threshold, int(k))
+	if err != nil {
+		rest.writeDuplicatesResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	rest.writeDuplicatesResp(resp, http.StatusOK, duplicates, nil)
+}
+
+func validateMergeControlObjectsReq(req *http.Request) (*proto.MergeControlObjectsReq, *proto.ErrorData) {
+	mergeControlObjectsReq := &proto.MergeControlObjectsReq{}
+	if errorData := unmarshalReqBody(req, mergeControlObjectsReq); errorData != nil {
+		return nil, errorData
+	}
+	if (mergeControlObjectsReq.SurvivorID == "") ||
+		(mergeControlObjectsReq.DuplicateID == "") ||
+		(mergeControlObjectsReq.RequestedBy == "") {
+		return nil, &proto.ErrorData{
+			Code: proto.InvalidRequestParamsCode,
+			Info: "invalid request params",
+			Text: "\"survivor_id\", \"duplicate_id\" and \"requested_by\" should be set",
+		}
+	}
+	if mergeControlObjectsReq.SurvivorID == mergeControlObjectsReq.DuplicateID {
+		return nil, &proto.ErrorData{
+			Code: proto.InvalidRequestParamsCode,
+			Info: "invalid request params",
+			Text: storages.ErrSelfMerge.Error(),
+		}
+	}
+	return mergeControlObjectsReq, nil
+}
+
+func (rest *restAPI) mergeControlObjectsHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiMergeControlObjects)
+	if req.Method != httpPostMethod {
+		rest.writeMergesResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpPostMethod}, req.Method))
+		return
+	}
+
+	mergeControlObjectsReq, errorData := validateMergeControlObjectsReq(req)
+	if errorData != nil {
+		rest.writeMergesResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+
+	merge, err := storages.MergeControlObjects(rest.fStorage, rest.identities,
+		mergeControlObjectsReq.SurvivorID, mergeControlObjectsReq.DuplicateID,
+		mergeControlObjectsReq.RequestedBy, rest.logger)
+	if err != nil {
+		rest.writeMergesResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	if merge == nil {
+		rest.writeMergesResp(resp, http.StatusNotFound, nil, &proto.ErrorData{
+			Code: proto.NotFoundCode,
+			Info: "control object not found",
+			Text: fmt.Sprintf("there is no control object \"%s\" or \"%s\"",
+				mergeControlObjectsReq.SurvivorID, mergeControlObjectsReq.DuplicateID),
+		})
+		return
+	}
+	rest.writeMergesResp(resp, http.StatusOK, []proto.Merge{*merge}, nil)
+}
+
+func (rest *restAPI) mergesHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiMerges)
+	if req.Method != httpGetMethod {
+		rest.writeMergesResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	offset, errorData := parseUintParam(query, "offset", 0)
+	limit := uint64(0)
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultControlObjectsLimit)
+	}
+	if errorData != nil {
+		rest.writeMergesResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxControlObjectsLimit) {
+		limit = maxControlObjectsLimit
+	}
+
+	merges, err := rest.fStorage.SelectMerges(offset, limit)
+	if err != nil {
+		rest.writeMergesResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+
+	mergesResp := &proto.MergesResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		Merges: merges,
+	}
+	if uint64(len(merges)) == limit {
+		nextOffset := offset + limit
+		mergesResp.NextOffset = &nextOffset
+	}
+	rest.writeResp(resp, http.StatusOK, mergesResp)
+}
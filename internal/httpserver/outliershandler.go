@@ -0,0 +1,152 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+)
+
+/*
+Outliers REST API:
+  - GET    /api/v1/outliers?offset=&limit= lists outliers of control objects centroids,
+    paginated by centroids, ordered by control object ID and model;
+  - PUT    /api/v1/outliers/{ffv_id} accepts facial features vector, so it is used
+    in centroid of its control object;
+  - DELETE /api/v1/outliers/{ffv_id} deletes facial features vector.
+Centroid of control object is rebuilt after review.
+*/
+
+const (
+	defaultOutliersLimit = 100
+	maxOutliersLimit     = 1000
+)
+
+func (rest *restAPI) writeOutliersResp(resp http.ResponseWriter, status int,
+	outliers []proto.Outlier, nextOffset *uint64, errorData *proto.ErrorData) {
+	if errorData != nil {
+		if errorData.Code == proto.InternalServerError {
+			rest.logger.Error(errorData.Text)
+		} else {
+			rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+				errorData.Code, errorData.Text)
+		}
+	}
+	rest.writeResp(resp, status, &proto.OutliersResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData:  errorData,
+		Outliers:   outliers,
+		NextOffset: nextOffset,
+	})
+}
+
+func (rest *restAPI) outliersHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiOutliers)
+	if req.Method != httpGetMethod {
+		rest.writeOutliersResp(resp, http.StatusBadRequest, nil, nil,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	offset, errorData := parseUintParam(query, "offset", 0)
+	limit := uint64(0)
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultOutliersLimit)
+	}
+	if errorData != nil {
+		rest.writeOutliersResp(resp, http.StatusBadRequest, nil, nil, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxOutliersLimit) {
+		limit = maxOutliersLimit
+	}
+
+	centroids, err := rest.fStorage.SelectCentroidsWithOutliers(offset, limit)
+	if err != nil {
+		rest.writeOutliersResp(resp, http.StatusInternalServerError, nil, nil, internalErrorData(err))
+		return
+	}
+	ids := make([]string, 0, len(centroids))
+	for _, c := range centroids {
+		for _, o := range c.Outliers {
+			ids = append(ids, o.ID)
+		}
+	}
+	ffvs, err := rest.fStorage.SelectFFVs(ids)
+	if err != nil {
+		rest.writeOutliersResp(resp, http.StatusInternalServerError, nil, nil, internalErrorData(err))
+		return
+	}
+	ffvsByIDs := make(map[string]*storages.FFV, len(ffvs))
+	for i := range ffvs {
+		ffvsByIDs[ffvs[i].ID] = &(ffvs[i])
+	}
+
+	outliers := make([]proto.Outlier, 0, len(ids))
+	for _, c := range centroids {
+		for _, o := range c.Outliers {
+			ffv, ok := ffvsByIDs[o.ID]
+			if !ok {
+				// Vector was deleted, but centroid was not rebuilt yet.
+				continue
+			}
+			outliers = append(outliers, proto.Outlier{
+				FFVID:   o.ID,
+				CobID:   c.CobID,
+				Model:   c.Model,
+				ImgID:   ffv.ImgID,
+				FaceBox: ffv.FaceBox,
+				Score:   o.Score,
+			})
+		}
+	}
+	var nextOffset *uint64
+	if uint64(len(centroids)) == limit {
+		n := offset + limit
+		nextOffset = &n
+	}
+	rest.writeOutliersResp(resp, http.StatusOK, outliers, nextOffset, nil)
+}
+
+func (rest *restAPI) outlierHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", req.URL.Path)
+	id := strings.TrimPrefix(req.URL.Path, apiOutliers+"/")
+	if (req.Method != httpPutMethod) && (req.Method != httpDeleteMethod) {
+		rest.writeOutliersResp(resp, http.StatusBadRequest, nil, nil,
+			invalidMethodErrorData([]string{httpPutMethod, httpDeleteMethod}, req.Method))
+		return
+	}
+
+	ffvs, err := rest.fStorage.SelectFFVs([]string{id})
+	if err != nil {
+		rest.writeOutliersResp(resp, http.StatusInternalServerError, nil, nil, internalErrorData(err))
+		return
+	}
+	if len(ffvs) == 0 {
+		rest.writeOutliersResp(resp, http.StatusNotFound, nil, nil, &proto.ErrorData{
+			Code: proto.NotFoundCode,
+			Info: "facial features vector not found",
+			Text: fmt.Sprintf("there is no facial features vector \"%s\"", id),
+		})
+		return
+	}
+	ffv := &(ffvs[0])
+
+	if req.Method == httpPutMethod {
+		err = storages.AcceptFFV(rest.fStorage, rest.identities, ffv)
+	} else {
+		err = storages.RemoveFFV(rest.fStorage, rest.identities, ffv)
+	}
+	if err != nil {
+		rest.writeOutliersResp(resp, http.StatusInternalServerError, nil, nil, internalErrorData(err))
+		return
+	}
+	rest.logger.Debugf("reviewed facial features vector \"%s\" of control object \"%s\" (%s)",
+		id, ffv.CobID, req.Method)
+	rest.writeOutliersResp(resp, http.StatusOK, nil, nil, nil)
+}
@@ -0,0 +1,71 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+/*
+Purges REST API:
+  - GET /api/v1/purges?offset=&limit= lists reports of retention policies
+    enforcement, newest first.
+*/
+
+func (rest *restAPI) writePurgesResp(resp http.ResponseWriter, status int, errorData *proto.ErrorData) {
+	if errorData != nil {
+		if errorData.Code == proto.InternalServerError {
+			rest.logger.Error(errorData.Text)
+		} else {
+			rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+				errorData.Code, errorData.Text)
+		}
+	}
+	rest.writeResp(resp, status, &proto.PurgesResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+	})
+}
+
+func (rest *restAPI) purgesHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiPurges)
+	if req.Method != httpGetMethod {
+		rest.writePurgesResp(resp, http.StatusBadRequest,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	offset, errorData := parseUintParam(query, "offset", 0)
+	limit := uint64(0)
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultControlObjectsLimit)
+	}
+	if errorData != nil {
+		rest.writePurgesResp(resp, http.StatusBadRequest, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxControlObjectsLimit) {
+		limit = maxControlObjectsLimit
+	}
+
+	purges, err := rest.fStorage.SelectPurges(offset, limit)
+	if err != nil {
+		rest.writePurgesResp(resp, http.StatusInternalServerError, internalErrorData(err))
+		return
+	}
+
+	purgesResp := &proto.PurgesResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		Purges: purges,
+	}
+	if uint64(len(purges)) == limit {
+		nextOffset := offset + limit
+		purgesResp.NextOffset = &nextOffset
+	}
+	rest.writeResp(resp, http.StatusOK, purgesResp)
+}
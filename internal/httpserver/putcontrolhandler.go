@@ -1,6 +1,7 @@
 package httpserver
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,9 +9,11 @@ import (
 	"reflect"
 	"time"
 
+	"github.com/nofacedb/facedb/internal/audit"
 	"github.com/nofacedb/facedb/internal/proto"
 	"github.com/nofacedb/facedb/internal/schedulers"
 	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/nofacedb/facedb/internal/validation"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 )
@@ -41,6 +44,17 @@ func validatePutControlReq(req *http.Request) (*proto.PutControlReq, *proto.Erro
 			Text: err.Error(),
 		}
 	}
+	// Image dimensions are checked, when faceboxes are returned by facerecognizer.
+	for i, imgCob := range putControlReq.ImageControlObjects {
+		if errorData := validation.FaceBox(imgCob.FaceBox); errorData != nil {
+			errorData.Text = fmt.Sprintf("%d-th facebox: %s", i, errorData.Text)
+			return nil, errorData
+		}
+		if errorData := validateNewAttributes(&(putControlReq.ImageControlObjects[i].ControlObject)); errorData != nil {
+			errorData.Text = fmt.Sprintf("%d-th control object: %s", i, errorData.Text)
+			return nil, errorData
+		}
+	}
 	return putControlReq, nil
 }
 
@@ -86,27 +100,74 @@ func (rest *restAPI) processPutControlReq(putControlReq *proto.PutControlReq) {
 		return
 	}
 
+	decisions := auditDecisions(awControl, putControlReq)
+	applied := false
 	switch putControlReq.Command {
 	case proto.CancelCommand:
-		processPutControlReqOnCancelCommand(rest, awControl, putControlReq)
+		applied = processPutControlReqOnCancelCommand(rest, awControl, putControlReq)
 	case proto.ProcessAgainCommand:
-		processPutControlReqOnProcessAgainCommand(rest, awControl, putControlReq)
+		applied = processPutControlReqOnProcessAgainCommand(rest, awControl, putControlReq)
 	case proto.SubmitCommand:
-		processPutControlReqOnSubmitCommand(rest, awControl, putControlReq)
+		applied = processPutControlReqOnSubmitCommand(rest, awControl, putControlReq, decisions)
+	}
+	if !applied {
+		return
+	}
+
+	rec, err := rest.auditLog.Append(putControlReq.Header.SrcAddr, putControlReq.Command, k, decisions)
+	if err != nil {
+		rest.logger.Error(errors.Wrapf(err, "unable to audit \"%s\" command for image with UUID \"%s\"",
+			putControlReq.Command, k))
+		return
+	}
+	rest.logger.Debugf("appended audit record %d for image with UUID \"%s\"", rec.Seq, k)
+}
+
+// auditDecisions returns decisions about every facebox of request with control object,
+// suggested for it, and every not sent facebox, suggested by DB server (it has no After).
+// Decisions about request faceboxes are first and have the same order.
+func auditDecisions(awControl *schedulers.AwaitingControl, putControlReq *proto.PutControlReq) []audit.Decision {
+	decisions := make([]audit.Decision, 0, len(putControlReq.ImageControlObjects))
+	sent := make(map[int]struct{}, len(putControlReq.ImageControlObjects))
+	for i := range putControlReq.ImageControlObjects {
+		imgCob := &(putControlReq.ImageControlObjects[i])
+		after := imgCob.ControlObject
+		d := audit.Decision{
+			FaceBox: imgCob.FaceBox,
+			After:   &after,
+		}
+		if idx := isExistingFaceBox(imgCob.FaceBox, awControl); idx != -1 {
+			before := awControl.ImageControlObjects[idx].ControlObject
+			d.Before = &before
+			sent[idx] = struct{}{}
+		}
+		decisions = append(decisions, d)
+	}
+	for i := range awControl.ImageControlObjects {
+		if _, ok := sent[i]; ok {
+			continue
+		}
+		before := awControl.ImageControlObjects[i].ControlObject
+		decisions = append(decisions, audit.Decision{
+			FaceBox: awControl.ImageControlObjects[i].FaceBox,
+			Before:  &before,
+		})
 	}
+	return decisions
 }
 
 func processPutControlReqOnCancelCommand(
 	rest *restAPI,
 	awControl *schedulers.AwaitingControl,
-	putControlReq *proto.PutControlReq) {
+	putControlReq *proto.PutControlReq) bool {
 	rest.logger.Debugf("cancelling request for image: %s\n", putControlReq.Header.UUID)
+	return true
 }
 
 func processPutControlReqOnProcessAgainCommand(
 	rest *restAPI,
 	awControl *schedulers.AwaitingControl,
-	putControlReq *proto.PutControlReq) {
+	putControlReq *proto.PutControlReq) bool {
 	k := awControl.UUID
 	v := &schedulers.AwaitingImage{
 		TS:        time.Now(),
@@ -121,9 +182,9 @@ func processPutControlReqOnProcessAgainCommand(
 
 	if err := rest.frScheduler.AwImgsQ.Push(k, v); err != nil {
 		err = errors.Wrapf(err, "unable to push \"PutImageReq\" with UUID \"%s\"to queue", k)
-		rest.logger.Warnf(err.Error())
+		rest.logger.Warn(err)
 		// TODO.
-		return
+		return false
 	}
 	rest.logger.Debugf("successfully pushed \"PutImageReq\" with UUID \"%s\" to queue", k)
 
@@ -139,9 +200,10 @@ func processPutControlReqOnProcessAgainCommand(
 		rest.logger.Error(err)
 		rest.frScheduler.AwImgsQ.Pop(k)
 		// TODO.
-		return
+		return false
 	}
 	rest.logger.Debugf("successfully sent \"ProcessImageReq\" with UUID \"%s\" to facerecognizer", k)
+	return true
 }
 
 func isExistingFaceBox(facebox proto.FaceBox, awControl *schedulers.AwaitingControl) int {
@@ -156,18 +218,21 @@ func isExistingFaceBox(facebox proto.FaceBox, awControl *schedulers.AwaitingCont
 func processPutControlReqOnSubmitCommand(
 	rest *restAPI,
 	awControl *schedulers.AwaitingControl,
-	putControlReq *proto.PutControlReq) {
+	putControlReq *proto.PutControlReq,
+	decisions []audit.Decision) bool {
 
 	ffvsToInsert := make([]proto.FacialFeaturesVector, 0)
 	fbsToInsert := make([]proto.FaceBox, 0)
 	cobsToInsert := make([]proto.ControlObject, 0)
 	shouldInsert := make([]bool, 0)
+	decisionIdxs := make([]int, 0)
 
-	for _, imgCob := range putControlReq.ImageControlObjects {
+	for i, imgCob := range putControlReq.ImageControlObjects {
 		idx := isExistingFaceBox(imgCob.FaceBox, awControl)
 		if idx == -1 {
 			continue
 		}
+		decisionIdxs = append(decisionIdxs, i)
 
 		ffvsToInsert = append(ffvsToInsert, awControl.FacialFeaturesVectors[idx])
 		fbsToInsert = append(fbsToInsert, imgCob.FaceBox)
@@ -179,9 +244,28 @@ func processPutControlReqOnSubmitCommand(
 		}
 	}
 
+	imgBuff, err := base64.StdEncoding.DecodeString(awControl.ImgBuff)
+	if err != nil {
+		rest.logger.Error(errors.Wrapf(err, "unable to decode image with UUID \"%s\"", awControl.UUID))
+		return false
+	}
+	commit := &storages.Commit{
+		ID:             uuid.Must(uuid.NewV4()).String(),
+		TS:             time.Now(),
+		ControlObjects: make([]proto.ControlObject, 0, len(cobsToInsert)),
+		Imgs:           make([]storages.CommitImg, 0, 1),
+		FFVs:           make([]storages.FFV, 0, len(ffvsToInsert)),
+	}
 	faceIDs := make([]string, 0, len(ffvsToInsert))
 
-	// Inserting new ControlObjects.
+	// New ControlObjects.
+	passports := make([]string, 0, len(cobsToInsert))
+	for i, cob := range cobsToInsert {
+		if shouldInsert[i] {
+			passports = append(passports, cob.Passport)
+		}
+	}
+	defer storages.LockPassports(passports...)()
 	for i, cob := range cobsToInsert {
 		if !shouldInsert[i] {
 			faceIDs = append(faceIDs, cob.ID)
@@ -189,48 +273,52 @@ func processPutControlReqOnSubmitCommand(
 		}
 		dbCob, err := rest.fStorage.SelectControlObjectByPassport(cob.Passport)
 		if err != nil {
-			rest.logger.Error(errors.Wrap(err, "unable to select control object by passport; partial commit possible"))
-			return
+			rest.logger.Error(errors.Wrap(err, "unable to select control object by passport"))
+			return false
 		}
 		if dbCob.ID != proto.DefaultStringField {
 			faceIDs = append(faceIDs, dbCob.ID)
 			continue
 		}
 		cob.ID = uuid.Must(uuid.NewV4()).String()
-		if err = rest.fStorage.InsertControlObjects([]proto.ControlObject{cob}); err != nil {
-			rest.logger.Error(errors.Wrap(err, "unable to insert control object; partial commit possible"))
-			return
-		}
+		commit.ControlObjects = append(commit.ControlObjects, cob)
 		faceIDs = append(faceIDs, cob.ID)
 	}
 
-	// Inserting new image.
+	// New image.
 	img := storages.Img{
 		ID:      uuid.Must(uuid.NewV4()).String(),
 		TS:      time.Now(),
-		Path:    rest.imgPath + "/" + awControl.UUID + ".jpg",
 		FaceIDs: faceIDs,
 	}
-	if err := rest.fStorage.InsertImgs([]storages.Img{img}); err != nil {
-		rest.logger.Error(errors.Wrap(err, "unable to insert image; partial commit possible"))
-		return
-	}
+	commit.Imgs = append(commit.Imgs, storages.CommitImg{
+		Img:  img,
+		Data: imgBuff,
+	})
 
-	// Inserting new facial features vectors.
-	ffvs := make([]storages.FFV, 0, len(ffvsToInsert))
+	// New facial features vectors.
 	for i, ffv := range ffvsToInsert {
-		ffvs = append(ffvs, storages.FFV{
+		commit.FFVs = append(commit.FFVs, storages.FFV{
 			ID:                   uuid.Must(uuid.NewV4()).String(),
 			CobID:                faceIDs[i],
 			ImgID:                img.ID,
 			FaceBox:              fbsToInsert[i],
+			Model:                awControl.Model,
 			FacialFeaturesVector: ffv,
 		})
 	}
-	if err := rest.fStorage.InsertFFVs(ffvs); err != nil {
-		rest.logger.Error(errors.Wrap(err, "unable to insert ffvs; partial commit possible"))
-		return
+
+	if err := rest.committer.Commit(commit); err != nil {
+		rest.logger.Error(err)
+		return false
 	}
+	rest.names.Put(commit.ControlObjects)
 
 	rest.logger.Debugf("successfully inserted image with UUID \"%s\" to DB", awControl.UUID)
+
+	// Submitted control objects are audited with IDs of stored ones.
+	for i, idx := range decisionIdxs {
+		decisions[idx].After.ID = faceIDs[i]
+	}
+	return true
 }
@@ -2,6 +2,7 @@ package httpserver
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"github.com/nofacedb/facedb/internal/proto"
 	"github.com/nofacedb/facedb/internal/schedulers"
 	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/nofacedb/facedb/internal/validation"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 )
@@ -74,6 +76,21 @@ func (rest *restAPI) putFacesDataReqHandler(resp http.ResponseWriter, req *http.
 			putFacesDataReq.Header.SrcAddr, k,
 			putFacesDataReq.ErrorData.Code, putFacesDataReq.ErrorData.Text)
 		rest.frScheduler.AwImgsQ.Pop(k)
+	} else if errorData := rest.validateFacesData(putFacesDataReq); errorData != nil {
+		rest.logger.Warnf("\"%s\" sent invalid faces data for image with UUID \"%s\": [%d] %s; dropping image",
+			putFacesDataReq.Header.SrcAddr, k, errorData.Code, errorData.Text)
+		rest.dropAwaitingImg(putFacesDataReq)
+		resp.WriteHeader(http.StatusBadRequest)
+		e := &proto.ImmedResp{
+			Header: proto.Header{
+				SrcAddr: rest.srcAddr,
+				UUID:    k,
+			},
+			ErrorData: errorData,
+		}
+		re, _ := json.Marshal(e)
+		resp.Write(re)
+		return
 	} else {
 		go rest.processPutFacesDataReq(putFacesDataReq)
 	}
@@ -89,6 +106,43 @@ func (rest *restAPI) putFacesDataReqHandler(resp http.ResponseWriter, req *http.
 	resp.Write(re)
 }
 
+// validateFacesData checks faces data against image, on which they were found.
+func (rest *restAPI) validateFacesData(putFacesDataReq *proto.PutFacesDataReq) *proto.ErrorData {
+	k := putFacesDataReq.Header.UUID
+	imgBuff := ""
+	if awImg := rest.frScheduler.AwImgsQ.Get(k); awImg != nil {
+		imgBuff = awImg.ImgBuff
+	} else if awCob := rest.cpScheduler.ACOQ.GetAwaitingCobByImgID(k); awCob != nil {
+		awCob.Mu.Lock()
+		imgBuff = awCob.Images[k].ImgBuff
+		awCob.Mu.Unlock()
+	} else {
+		// Unknown image is reported on processing.
+		return nil
+	}
+
+	width, height, errorData := validation.Base64ImgSize(imgBuff)
+	if errorData != nil {
+		return errorData
+	}
+	return rest.validator.FacesData(putFacesDataReq.Model, putFacesDataReq.FacesData, width, height)
+}
+
+// dropAwaitingImg drops image with invalid faces data: it is either removed from
+// awaiting images queue, or processed as image without faces of awaiting control object.
+func (rest *restAPI) dropAwaitingImg(putFacesDataReq *proto.PutFacesDataReq) {
+	k := putFacesDataReq.Header.UUID
+	if rest.frScheduler.AwImgsQ.Pop(k) != nil {
+		return
+	}
+	if awCob := rest.cpScheduler.ACOQ.GetAwaitingCobByImgID(k); awCob != nil {
+		go processFacesDataReqOnAwCob(rest, awCob, &proto.PutFacesDataReq{
+			Header:    putFacesDataReq.Header,
+			FacesData: []proto.FaceData{},
+		})
+	}
+}
+
 func (rest *restAPI) processPutFacesDataReq(putFacesDataReq *proto.PutFacesDataReq) {
 	k := putFacesDataReq.Header.UUID
 	awImg := rest.frScheduler.AwImgsQ.Pop(k)
@@ -107,6 +161,7 @@ func (rest *restAPI) processPutFacesDataReq(putFacesDataReq *proto.PutFacesDataR
 }
 
 func processFacesDataReqOnAwImg(rest *restAPI, awImg *schedulers.AwaitingImage, putFacesDataReq *proto.PutFacesDataReq) {
+	awImg.Model = putFacesDataReq.Model
 	awImg.FaceBoxes = make([]proto.FaceBox, 0, len(putFacesDataReq.FacesData))
 	awImg.FacialFeaturesVectors = make([]proto.FacialFeaturesVector, 0, len(putFacesDataReq.FacesData))
 	for _, facesdata := range putFacesDataReq.FacesData {
@@ -114,49 +169,51 @@ func processFacesDataReqOnAwImg(rest *restAPI, awImg *schedulers.AwaitingImage,
 		awImg.FacialFeaturesVectors = append(awImg.FacialFeaturesVectors, facesdata.FacialFeaturesVector)
 	}
 
-	cobs := make([]proto.ControlObject, 0, len(awImg.FaceBoxes))
+	icos := make([]proto.ImageControlObject, 0, len(awImg.FaceBoxes))
 	for i := 0; i < len(awImg.FaceBoxes); i++ {
-		defaultCob := proto.CreateDefaultControlObject()
-		cobs = append(cobs, *defaultCob)
+		icos = append(icos, proto.ImageControlObject{
+			ControlObject: *proto.CreateDefaultControlObject(),
+			FaceBox:       awImg.FaceBoxes[i],
+			Candidates:    []proto.Candidate{},
+		})
 	}
 	for i, ffv := range awImg.FacialFeaturesVectors {
-		cob, err := rest.fStorage.SelectControlObjectByFFV(ffv)
+		candidates, err := rest.fStorage.SelectCandidatesByFFV(awImg.Model, ffv, rest.topK)
 		if err != nil {
 			rest.logger.Warn(errors.Wrapf(err,
 				"unable to retrieve data for %d-th face on image with UUID \"%s\"",
 				i, awImg.UUID))
 			continue
 		}
-		cobs[i] = *cob
+		if (len(candidates) != 0) && candidates[0].Matched {
+			icos[i].ControlObject = candidates[0].ControlObject
+			icos[i].Similarity = candidates[0].Similarity
+		}
+		icos[i].Candidates = candidates
 	}
 
+	go rest.recordSightings(awImg, append([]proto.ImageControlObject(nil), icos...))
+
 	if rest.cpScheduler.GetControlPanelsNum() == 0 {
 		rest.logger.Debug("no controlpanels are available, so all data will be pushed to DB immediately")
-		processFacesDataReqOnAwImgImmedToDB(rest, awImg, cobs)
+		processFacesDataReqOnAwImgImmedToDB(rest, awImg, icos)
 		return
 	}
-	processFacesDataReqOnAwImgDeferred(rest, awImg, cobs)
+	processFacesDataReqOnAwImgDeferred(rest, awImg, icos)
 }
 
-func processFacesDataReqOnAwImgImmedToDB(rest *restAPI, awImg *schedulers.AwaitingImage, cobs []proto.ControlObject) {
+func processFacesDataReqOnAwImgImmedToDB(rest *restAPI, awImg *schedulers.AwaitingImage, icos []proto.ImageControlObject) {
 
 }
 
-func processFacesDataReqOnAwImgDeferred(rest *restAPI, awImg *schedulers.AwaitingImage, cobs []proto.ControlObject) {
+func processFacesDataReqOnAwImgDeferred(rest *restAPI, awImg *schedulers.AwaitingImage, icos []proto.ImageControlObject) {
 	notifyControlReq := &proto.NotifyControlReq{
 		Header: proto.Header{
 			SrcAddr: rest.srcAddr,
 			UUID:    awImg.UUID,
 		},
 		ImgBuff:             awImg.ImgBuff,
-		ImageControlObjects: make([]proto.ImageControlObject, 0, len(awImg.FaceBoxes)),
-	}
-	for i := 0; i < len(awImg.FaceBoxes); i++ {
-		ico := proto.ImageControlObject{
-			ControlObject: cobs[i],
-			FaceBox:       awImg.FaceBoxes[i],
-		}
-		notifyControlReq.ImageControlObjects = append(notifyControlReq.ImageControlObjects, ico)
+		ImageControlObjects: icos,
 	}
 
 	k := awImg.UUID
@@ -166,6 +223,7 @@ func processFacesDataReqOnAwImgDeferred(rest *restAPI, awImg *schedulers.Awaitin
 		UUID:                  notifyControlReq.Header.UUID,
 		ImgBuff:               awImg.ImgBuff,
 		ImageControlObjects:   notifyControlReq.ImageControlObjects,
+		Model:                 awImg.Model,
 		FacialFeaturesVectors: awImg.FacialFeaturesVectors,
 	}
 	if err := rest.cpScheduler.ACQ.Push(k, v); err != nil {
@@ -193,6 +251,7 @@ func processFacesDataReqOnAwCob(rest *restAPI, awCob *schedulers.AwaitingControl
 			putFacesDataReq.Header.SrcAddr, k)
 	} else {
 		awCob.FacesData[k] = putFacesDataReq.FacesData[0]
+		awCob.Models[k] = putFacesDataReq.Model
 	}
 	if len(awCob.FacesData) != int(awCob.ControlObjectPart.ImagesNum) {
 		awCob.Mu.Unlock()
@@ -201,52 +260,59 @@ func processFacesDataReqOnAwCob(rest *restAPI, awCob *schedulers.AwaitingControl
 	awCob.Mu.Unlock()
 	rest.logger.Debugf("got all facial features for \"AwaitingControlObject\" with UUID \"%s\"", awCob.UUID)
 
-	// Inserting new ControlObject.
+	commit := &storages.Commit{
+		ID:             uuid.Must(uuid.NewV4()).String(),
+		TS:             time.Now(),
+		ControlObjects: make([]proto.ControlObject, 0, 1),
+		Imgs:           make([]storages.CommitImg, 0, len(awCob.FacesData)),
+		FFVs:           make([]storages.FFV, 0, len(awCob.FacesData)),
+	}
+
+	// New ControlObject.
 	cob := awCob.ControlObjectPart.ControlObject
+	defer storages.LockPassports(cob.Passport)()
 	dbCob, err := rest.fStorage.SelectControlObjectByPassport(cob.Passport)
 	if err != nil {
-		rest.logger.Error(errors.Wrap(err, "unable to select control object by passport; partial commit possible"))
+		rest.logger.Error(errors.Wrap(err, "unable to select control object by passport"))
 		return
 	}
 	if dbCob.ID == proto.DefaultStringField {
 		cob.ID = uuid.Must(uuid.NewV4()).String()
-		if err = rest.fStorage.InsertControlObjects([]proto.ControlObject{cob}); err != nil {
-			rest.logger.Error(errors.Wrap(err, "unable to insert control object; partial commit possible"))
-		}
+		commit.ControlObjects = append(commit.ControlObjects, cob)
 	} else {
 		cob.ID = dbCob.ID
 	}
 
-	ffvs := make([]storages.FFV, 0, len(awCob.FacesData))
-	imgs := make([]storages.Img, 0, len(awCob.FacesData))
-	for _, v := range awCob.FacesData {
-		UUID := uuid.Must(uuid.NewV4()).String()
+	for k, v := range awCob.FacesData {
+		imgBuff, err := base64.StdEncoding.DecodeString(awCob.Images[k].ImgBuff)
+		if err != nil {
+			rest.logger.Error(errors.Wrapf(err, "unable to decode image with key \"%s\"", k))
+			return
+		}
 		img := storages.Img{
-			ID:      UUID,
+			ID:      uuid.Must(uuid.NewV4()).String(),
 			TS:      time.Now(),
-			Path:    rest.imgPath + "/" + UUID + ".jpg",
 			FaceIDs: []string{cob.ID},
 		}
-		imgs = append(imgs, img)
-		ffv := storages.FFV{
+		commit.Imgs = append(commit.Imgs, storages.CommitImg{
+			Img:  img,
+			Data: imgBuff,
+		})
+		commit.FFVs = append(commit.FFVs, storages.FFV{
 			ID:                   uuid.Must(uuid.NewV4()).String(),
 			CobID:                cob.ID,
 			ImgID:                img.ID,
 			FaceBox:              v.FaceBox,
+			Model:                awCob.Models[k],
 			FacialFeaturesVector: v.FacialFeaturesVector,
-		}
-		ffvs = append(ffvs, ffv)
+		})
 	}
 
-	if err = rest.fStorage.InsertImgs(imgs); err != nil {
-		rest.logger.Error(errors.Wrap(err, "unable to insert images; partial commit possible"))
-		return
-	}
-
-	if err = rest.fStorage.InsertFFVs(ffvs); err != nil {
-		rest.logger.Error(errors.Wrap(err, "unable to insert ffvs; partial commit possible"))
+	if err := rest.committer.Commit(commit); err != nil {
+		rest.logger.Error(err)
 		return
 	}
+	rest.names.Put(commit.ControlObjects)
 
 	rest.logger.Debugf("pushed \"AwaitingControlObject\" with UUID \"%s\" to ClickHouse DB", awCob.UUID)
 
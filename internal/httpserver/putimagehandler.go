@@ -11,6 +11,7 @@ import (
 	"github.com/h2non/filetype"
 	"github.com/nofacedb/facedb/internal/proto"
 	"github.com/nofacedb/facedb/internal/schedulers"
+	"github.com/nofacedb/facedb/internal/validation"
 	"github.com/pkg/errors"
 )
 
@@ -66,6 +67,9 @@ func validatePutImageReq(req *http.Request) (*proto.PutImageReq, *proto.ErrorDat
 			Text: "unable to recognize image type",
 		}
 	}
+	if errorData := validation.FaceBoxesInImg(putImageReq.FaceBoxes, imgBuff); errorData != nil {
+		return nil, errorData
+	}
 
 	return putImageReq, nil
 }
@@ -102,7 +106,7 @@ func (rest *restAPI) putImageHandler(resp http.ResponseWriter, req *http.Request
 	}
 	if err := rest.frScheduler.AwImgsQ.Push(k, v); err != nil {
 		err = errors.Wrapf(err, "unable to push \"PutImageReq\" with UUID \"%s\"to queue", k)
-		rest.logger.Warnf(err.Error())
+		rest.logger.Warn(err)
 		resp.WriteHeader(http.StatusBadRequest)
 		e := &proto.ImmedResp{
 			Header: proto.Header{
@@ -1,41 +1,84 @@
 package httpserver
 
 import (
+	"encoding/json"
 	"net/http"
 
+	"github.com/nofacedb/facedb/internal/audit"
 	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/namesearch"
 	"github.com/nofacedb/facedb/internal/schedulers"
 	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/nofacedb/facedb/internal/validation"
+	"github.com/nofacedb/facedb/internal/watchlists"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	apiBase             = `/api/v1`
-	apiPutImage         = apiBase + `/put_image`
-	apiPutFacesData     = apiBase + `/put_faces_data`
-	apiPutControl       = apiBase + `/put_control`
-	apiAddControlObject = apiBase + `/add_control_object`
+	apiBase                = `/api/v1`
+	apiPutImage            = apiBase + `/put_image`
+	apiPutFacesData        = apiBase + `/put_faces_data`
+	apiPutControl          = apiBase + `/put_control`
+	apiAddControlObject    = apiBase + `/add_control_object`
+	apiControlObjects      = apiBase + `/control_objects`
+	apiEraseControlObject  = apiBase + `/erase_control_object`
+	apiErasures            = apiBase + `/erasures`
+	apiSightings           = apiBase + `/sightings`
+	apiWatchlists          = apiBase + `/watchlists`
+	apiAlerts              = apiBase + `/alerts`
+	apiOutliers            = apiBase + `/outliers`
+	apiDuplicates          = apiBase + `/duplicates`
+	apiMergeControlObjects = apiBase + `/merge_control_objects`
+	apiMerges              = apiBase + `/merges`
+	apiClusters            = apiBase + `/clusters`
+	apiPurges              = apiBase + `/purges`
+	apiAudit               = apiBase + `/audit`
 )
 
 type restAPI struct {
 	srcAddr     string
-	imgPath     string
+	imgStore    imgstores.ImgStore
+	identities  *identities.Model
+	committer   *storages.Committer
+	watcher     *watchlists.Watcher
+	names       *namesearch.Index
+	auditLog    *audit.Log
+	validator   *validation.Validator
+	topK        int
 	frScheduler *schedulers.FaceRecognitionScheduler
 	cpScheduler *schedulers.ControlPanelScheduler
-	fStorage    *storages.FaceStorage
+	fStorage    storages.FaceStorage
 	client      *http.Client
 	logger      *log.Logger
 }
 
 func createRestAPI(cfg *cfgparser.CFG,
-	srcAddr, imgPath string,
+	srcAddr string,
 	frScheduler *schedulers.FaceRecognitionScheduler,
 	cpScheduler *schedulers.ControlPanelScheduler,
-	fStorage *storages.FaceStorage,
+	fStorage storages.FaceStorage,
+	imgStore imgstores.ImgStore,
+	identitiesModel *identities.Model,
+	committer *storages.Committer,
+	watcher *watchlists.Watcher,
+	names *namesearch.Index,
 	client *http.Client, logger *log.Logger) *restAPI {
+	topK := cfg.StorageCFG.TopK
+	if topK < 1 {
+		topK = 1
+	}
 	return &restAPI{
 		srcAddr:     srcAddr,
-		imgPath:     imgPath,
+		imgStore:    imgStore,
+		identities:  identitiesModel,
+		committer:   committer,
+		watcher:     watcher,
+		names:       names,
+		auditLog:    audit.CreateLog(fStorage),
+		validator:   validation.CreateValidator(&(cfg.ValidationCFG)),
+		topK:        topK,
 		frScheduler: frScheduler,
 		cpScheduler: cpScheduler,
 		fStorage:    fStorage,
@@ -50,6 +93,38 @@ func (rest *restAPI) bindHandlers() http.Handler {
 	mux.HandleFunc(apiPutFacesData, rest.putFacesDataReqHandler)
 	mux.HandleFunc(apiPutControl, rest.putControlHandler)
 	mux.HandleFunc(apiAddControlObject, rest.addControlObjectHandler)
+	mux.HandleFunc(apiControlObjects, rest.controlObjectsHandler)
+	mux.HandleFunc(apiControlObjects+"/", rest.controlObjectHandler)
+	mux.HandleFunc(apiEraseControlObject, rest.eraseControlObjectHandler)
+	mux.HandleFunc(apiErasures, rest.erasuresHandler)
+	mux.HandleFunc(apiSightings, rest.sightingsHandler)
+	mux.HandleFunc(apiSightings+"/"+apiSightingsImages, rest.sightingImgHandler)
+	mux.HandleFunc(apiWatchlists, rest.watchlistsHandler)
+	mux.HandleFunc(apiWatchlists+"/", rest.watchlistHandler)
+	mux.HandleFunc(apiAlerts, rest.alertsHandler)
+	mux.HandleFunc(apiOutliers, rest.outliersHandler)
+	mux.HandleFunc(apiOutliers+"/", rest.outlierHandler)
+	mux.HandleFunc(apiDuplicates, rest.duplicatesHandler)
+	mux.HandleFunc(apiMergeControlObjects, rest.mergeControlObjectsHandler)
+	mux.HandleFunc(apiMerges, rest.mergesHandler)
+	mux.HandleFunc(apiClusters, rest.clustersHandler)
+	mux.HandleFunc(apiClusters+"/", rest.clusterHandler)
+	mux.HandleFunc(apiPurges, rest.purgesHandler)
+	mux.HandleFunc(apiAudit, rest.auditHandler)
+	mux.HandleFunc(apiAudit+"/"+apiAuditVerify, rest.auditVerifyHandler)
 
 	return mux
 }
+
+// writeResp writes JSON-marshaled v with given HTTP status code.
+func (rest *restAPI) writeResp(resp http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		rest.logger.Error(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(data)
+}
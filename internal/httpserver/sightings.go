@@ -0,0 +1,62 @@
+package httpserver
+
+import (
+	"encoding/base64"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/schedulers"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// recordSightings stores processed image, raises watchlists alerts and inserts
+// sightings of all faces, found on it, matched or not, regardless of further control.
+func (rest *restAPI) recordSightings(awImg *schedulers.AwaitingImage, icos []proto.ImageControlObject) {
+	if len(icos) == 0 {
+		return
+	}
+
+	imgID := uuid.Must(uuid.NewV4()).String()
+	imgPath := ""
+	imgBuff, err := base64.StdEncoding.DecodeString(awImg.ImgBuff)
+	if err == nil {
+		imgPath, err = rest.imgStore.Put(imgID, imgBuff)
+	}
+	if err != nil {
+		rest.logger.Warn(errors.Wrapf(err, "unable to store image with UUID \"%s\"; sightings will have no image", awImg.UUID))
+	}
+
+	sightings := make([]storages.Sighting, 0, len(icos))
+	for i, ico := range icos {
+		s := storages.Sighting{
+			ID:      uuid.Must(uuid.NewV4()).String(),
+			TS:      awImg.TS,
+			SrcAddr: awImg.SrcAddr,
+			ImgID:   imgID,
+			ImgPath: imgPath,
+			FaceBox: ico.FaceBox,
+			Model:   awImg.Model,
+		}
+		if i < len(awImg.FacialFeaturesVectors) {
+			s.FacialFeaturesVector = awImg.FacialFeaturesVectors[i]
+		}
+		if ico.ControlObject.ID != proto.DefaultStringField {
+			s.CobID = ico.ControlObject.ID
+			s.Score = ico.Similarity
+		}
+		sightings = append(sightings, s)
+	}
+
+	imgURL := sightingImgURL(imgID, imgPath, awImg.TS)
+	if imgURL != "" {
+		imgURL = rest.srcAddr + imgURL
+	}
+	rest.watcher.Check(sightings, icos, awImg.ImgBuff, imgURL)
+
+	if err := rest.fStorage.InsertSightings(sightings); err != nil {
+		rest.logger.Error(errors.Wrapf(err, "unable to insert sightings from image with UUID \"%s\"", awImg.UUID))
+		return
+	}
+	rest.logger.Debugf("inserted %d sightings from image with UUID \"%s\"", len(sightings), awImg.UUID)
+}
@@ -0,0 +1,246 @@
+package httpserver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+/*
+Sightings REST API:
+  - GET /api/v1/sightings?cob_id=&src_addr=&from=&to=&min_score=&cursor=&limit=
+    lists sightings, matching all specified params, newest first; from and to
+    are RFC 3339 timestamps (to is exclusive), next page is requested with
+    cursor, returned in previous response;
+  - GET /api/v1/sightings/images/{img_id}?ts= returns image, on which sightings
+    were found (ts is its UNIX timestamp, so only one partition is read).
+*/
+
+const (
+	apiSightingsImages    = `images/`
+	defaultSightingsLimit = 100
+	maxSightingsLimit     = 1000
+	cursorSplitter        = "_"
+)
+
+func invalidParamErrorData(name string, err error) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.InvalidRequestParamsCode,
+		Info: "invalid request params",
+		Text: fmt.Sprintf("invalid \"%s\" value: %s", name, err),
+	}
+}
+
+func parseTimeParam(query url.Values, name string) (time.Time, *proto.ErrorData) {
+	v := query.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, invalidParamErrorData(name, err)
+	}
+	return t, nil
+}
+
+// encodeCursor returns opaque cursor, pointing to row with given ts and id.
+func encodeCursor(ts time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.FormatInt(ts.UnixNano(), 10) + cursorSplitter + id))
+}
+
+func decodeCursor(cursor string) (*storages.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(data), cursorSplitter, 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed cursor")
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.FromString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &storages.Cursor{
+		TS: time.Unix(0, ts),
+		ID: id.String(),
+	}, nil
+}
+
+func parseSightingsFilter(query url.Values) (*storages.SightingsFilter, *proto.ErrorData) {
+	filter := &storages.SightingsFilter{
+		CobID:   query.Get("cob_id"),
+		SrcAddr: query.Get("src_addr"),
+	}
+	var errorData *proto.ErrorData
+	filter.From, errorData = parseTimeParam(query, "from")
+	if errorData != nil {
+		return nil, errorData
+	}
+	filter.To, errorData = parseTimeParam(query, "to")
+	if errorData != nil {
+		return nil, errorData
+	}
+	if v := query.Get("min_score"); v != "" {
+		minScore, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, invalidParamErrorData("min_score", err)
+		}
+		filter.MinScore = minScore
+	}
+	if v := query.Get("cursor"); v != "" {
+		after, err := decodeCursor(v)
+		if err != nil {
+			return nil, invalidParamErrorData("cursor", err)
+		}
+		filter.After = after
+	}
+	return filter, nil
+}
+
+func (rest *restAPI) writeSightingsResp(resp http.ResponseWriter, status int, errorData *proto.ErrorData) {
+	if errorData != nil {
+		rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+			errorData.Code, errorData.Text)
+	}
+	rest.writeResp(resp, status, &proto.SightingsResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+	})
+}
+
+// sightingImgURL returns link to image, on which sightings were found,
+// or empty string, if image wasn't stored.
+func sightingImgURL(imgID, imgPath string, ts time.Time) string {
+	if imgPath == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s%s?ts=%d", apiSightings, apiSightingsImages, imgID, ts.Unix())
+}
+
+func protoSighting(s *storages.Sighting) proto.Sighting {
+	return proto.Sighting{
+		ID:      s.ID,
+		TS:      s.TS,
+		SrcAddr: s.SrcAddr,
+		ImgID:   s.ImgID,
+		ImgURL:  sightingImgURL(s.ImgID, s.ImgPath, s.TS),
+		FaceBox: s.FaceBox,
+		CobID:   s.CobID,
+		Score:   s.Score,
+	}
+}
+
+func (rest *restAPI) sightingsHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiSightings)
+	if req.Method != httpGetMethod {
+		rest.writeSightingsResp(resp, http.StatusBadRequest,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	filter, errorData := parseSightingsFilter(query)
+	limit := uint64(0)
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultSightingsLimit)
+	}
+	if errorData != nil {
+		rest.writeSightingsResp(resp, http.StatusBadRequest, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxSightingsLimit) {
+		limit = maxSightingsLimit
+	}
+
+	sightings, err := rest.fStorage.SelectSightings(filter, limit)
+	if err != nil {
+		rest.logger.Error(err)
+		rest.writeSightingsResp(resp, http.StatusInternalServerError, &proto.ErrorData{
+			Code: proto.InternalServerError,
+			Info: "internal server error",
+			Text: err.Error(),
+		})
+		return
+	}
+
+	sightingsResp := &proto.SightingsResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		Sightings: make([]proto.Sighting, 0, len(sightings)),
+	}
+	for i := range sightings {
+		sightingsResp.Sightings = append(sightingsResp.Sightings, protoSighting(&(sightings[i])))
+	}
+	if (len(sightings) != 0) && (uint64(len(sightings)) == limit) {
+		last := &(sightings[len(sightings)-1])
+		nextCursor := encodeCursor(last.TS, last.ID)
+		sightingsResp.NextCursor = &nextCursor
+	}
+	rest.writeResp(resp, http.StatusOK, sightingsResp)
+}
+
+func (rest *restAPI) sightingImgHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", req.URL.Path)
+	if req.Method != httpGetMethod {
+		rest.writeSightingsResp(resp, http.StatusBadRequest,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	imgID := strings.TrimPrefix(req.URL.Path, apiSightings+"/"+apiSightingsImages)
+	if _, err := uuid.FromString(imgID); err != nil {
+		rest.writeSightingsResp(resp, http.StatusBadRequest, invalidParamErrorData("img_id", err))
+		return
+	}
+	ts, err := strconv.ParseInt(req.URL.Query().Get("ts"), 10, 64)
+	if err != nil {
+		rest.writeSightingsResp(resp, http.StatusBadRequest, invalidParamErrorData("ts", err))
+		return
+	}
+
+	imgPath, err := rest.fStorage.SelectSightingImgPath(imgID, time.Unix(ts, 0))
+	if (err == nil) && (imgPath == "") {
+		rest.writeSightingsResp(resp, http.StatusNotFound, &proto.ErrorData{
+			Code: proto.NotFoundCode,
+			Info: "image not found",
+			Text: fmt.Sprintf("there is no image \"%s\"", imgID),
+		})
+		return
+	}
+	var img []byte
+	if err == nil {
+		img, err = rest.imgStore.Get(imgPath)
+	}
+	if err != nil {
+		rest.logger.Error(err)
+		rest.writeSightingsResp(resp, http.StatusInternalServerError, &proto.ErrorData{
+			Code: proto.InternalServerError,
+			Info: "internal server error",
+			Text: err.Error(),
+		})
+		return
+	}
+
+	resp.Header().Set("Content-Type", imgstores.ImgMIME(img))
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(img)
+}
@@ -0,0 +1,321 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	uuid "github.com/satori/go.uuid"
+)
+
+/*
+Watchlists REST API:
+  - GET    /api/v1/watchlists lists watchlists, ordered by name;
+  - POST   /api/v1/watchlists creates watchlist;
+  - GET    /api/v1/watchlists/{id} returns watchlist;
+  - PUT    /api/v1/watchlists/{id} replaces watchlist;
+  - DELETE /api/v1/watchlists/{id} deletes watchlist;
+  - POST   /api/v1/watchlists/{id}/members adds control objects to watchlist
+    and removes them from it;
+  - GET    /api/v1/alerts?watchlist_id=&cob_id=&src_addr=&from=&to=&cursor=&limit=
+    lists alerts, matching all specified params, newest first (as sightings).
+*/
+
+const apiWatchlistMembers = `/members`
+
+func watchlistNotFoundErrorData(id string) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.NotFoundCode,
+		Info: "watchlist not found",
+		Text: fmt.Sprintf("there is no watchlist \"%s\"", id),
+	}
+}
+
+func internalErrorData(err error) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.InternalServerError,
+		Info: "internal server error",
+		Text: err.Error(),
+	}
+}
+
+func unmarshalReqBody(req *http.Request, v interface{}) *proto.ErrorData {
+	data, err := ioutil.ReadAll(req.Body)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return &proto.ErrorData{
+			Code: proto.CorruptedBodyCode,
+			Info: "corrupted request body",
+			Text: err.Error(),
+		}
+	}
+	return nil
+}
+
+func (rest *restAPI) writeWatchlistResp(resp http.ResponseWriter, status int,
+	wl *proto.Watchlist, errorData *proto.ErrorData) {
+	if errorData != nil {
+		if errorData.Code == proto.InternalServerError {
+			rest.logger.Error(errorData.Text)
+		} else {
+			rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+				errorData.Code, errorData.Text)
+		}
+	}
+	rest.writeResp(resp, status, &proto.WatchlistResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+		Watchlist: wl,
+	})
+}
+
+func (rest *restAPI) validatePutWatchlistReq(req *http.Request) (*proto.Watchlist, *proto.ErrorData) {
+	putWatchlistReq := &proto.PutWatchlistReq{}
+	if errorData := unmarshalReqBody(req, putWatchlistReq); errorData != nil {
+		return nil, errorData
+	}
+	if err := rest.watcher.Validate(&(putWatchlistReq.Watchlist)); err != nil {
+		return nil, &proto.ErrorData{
+			Code: proto.InvalidRequestParamsCode,
+			Info: "invalid request params",
+			Text: err.Error(),
+		}
+	}
+	return &(putWatchlistReq.Watchlist), nil
+}
+
+func (rest *restAPI) watchlistsHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiWatchlists)
+	switch req.Method {
+	case httpGetMethod:
+		wls, err := rest.watcher.Watchlists()
+		if err != nil {
+			rest.logger.Error(err)
+			rest.writeResp(resp, http.StatusInternalServerError, &proto.WatchlistsResp{
+				Header: proto.Header{
+					SrcAddr: rest.srcAddr,
+				},
+				ErrorData: internalErrorData(err),
+			})
+			return
+		}
+		rest.writeResp(resp, http.StatusOK, &proto.WatchlistsResp{
+			Header: proto.Header{
+				SrcAddr: rest.srcAddr,
+			},
+			Watchlists: wls,
+		})
+	case httpPostMethod:
+		wl, errorData := rest.validatePutWatchlistReq(req)
+		if errorData != nil {
+			rest.writeWatchlistResp(resp, http.StatusBadRequest, nil, errorData)
+			return
+		}
+		wl.ID = ""
+		if err := rest.watcher.Put(wl); err != nil {
+			rest.writeWatchlistResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+			return
+		}
+		rest.logger.Debugf("created watchlist \"%s\"", wl.ID)
+		rest.writeWatchlistResp(resp, http.StatusOK, wl, nil)
+	default:
+		rest.writeWatchlistResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod, httpPostMethod}, req.Method))
+	}
+}
+
+func (rest *restAPI) watchlistHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", req.URL.Path)
+	id := strings.TrimPrefix(req.URL.Path, apiWatchlists+"/")
+	if strings.HasSuffix(id, apiWatchlistMembers) {
+		if req.Method != httpPostMethod {
+			rest.writeWatchlistResp(resp, http.StatusBadRequest, nil,
+				invalidMethodErrorData([]string{httpPostMethod}, req.Method))
+			return
+		}
+		rest.updateWatchlistMembers(resp, req, strings.TrimSuffix(id, apiWatchlistMembers))
+		return
+	}
+
+	switch req.Method {
+	case httpGetMethod:
+		wl, err := rest.watcher.Watchlist(id)
+		if err != nil {
+			rest.writeWatchlistResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+			return
+		}
+		if wl == nil {
+			rest.writeWatchlistResp(resp, http.StatusNotFound, nil, watchlistNotFoundErrorData(id))
+			return
+		}
+		rest.writeWatchlistResp(resp, http.StatusOK, wl, nil)
+	case httpPutMethod:
+		rest.updateWatchlist(resp, req, id)
+	case httpDeleteMethod:
+		ok, err := rest.watcher.Delete(id)
+		if err != nil {
+			rest.writeWatchlistResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+			return
+		}
+		if !ok {
+			rest.writeWatchlistResp(resp, http.StatusNotFound, nil, watchlistNotFoundErrorData(id))
+			return
+		}
+		rest.logger.Debugf("deleted watchlist \"%s\"", id)
+		rest.writeWatchlistResp(resp, http.StatusOK, nil, nil)
+	default:
+		rest.writeWatchlistResp(resp, http.StatusBadRequest, nil,
+			invalidMethodErrorData([]string{httpGetMethod, httpPutMethod, httpDeleteMethod}, req.Method))
+	}
+}
+
+func (rest *restAPI) updateWatchlist(resp http.ResponseWriter, req *http.Request, id string) {
+	wl, errorData := rest.validatePutWatchlistReq(req)
+	if errorData != nil {
+		rest.writeWatchlistResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+	dbWL, err := rest.watcher.Watchlist(id)
+	if err != nil {
+		rest.writeWatchlistResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	if dbWL == nil {
+		rest.writeWatchlistResp(resp, http.StatusNotFound, nil, watchlistNotFoundErrorData(id))
+		return
+	}
+	wl.ID = id
+	if err := rest.watcher.Put(wl); err != nil {
+		rest.writeWatchlistResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	rest.logger.Debugf("updated watchlist \"%s\"", id)
+	rest.writeWatchlistResp(resp, http.StatusOK, wl, nil)
+}
+
+func (rest *restAPI) updateWatchlistMembers(resp http.ResponseWriter, req *http.Request, id string) {
+	updateWatchlistMembersReq := &proto.UpdateWatchlistMembersReq{}
+	if errorData := unmarshalReqBody(req, updateWatchlistMembersReq); errorData != nil {
+		rest.writeWatchlistResp(resp, http.StatusBadRequest, nil, errorData)
+		return
+	}
+	for _, cobID := range updateWatchlistMembersReq.Add {
+		if _, err := uuid.FromString(cobID); err != nil {
+			rest.writeWatchlistResp(resp, http.StatusBadRequest, nil, &proto.ErrorData{
+				Code: proto.InvalidRequestParamsCode,
+				Info: "invalid request params",
+				Text: fmt.Sprintf("invalid control object ID \"%s\"", cobID),
+			})
+			return
+		}
+	}
+
+	wl, err := rest.watcher.UpdateMembers(id,
+		updateWatchlistMembersReq.Add, updateWatchlistMembersReq.Remove)
+	if err != nil {
+		rest.writeWatchlistResp(resp, http.StatusInternalServerError, nil, internalErrorData(err))
+		return
+	}
+	if wl == nil {
+		rest.writeWatchlistResp(resp, http.StatusNotFound, nil, watchlistNotFoundErrorData(id))
+		return
+	}
+	rest.logger.Debugf("updated watchlist \"%s\" members", id)
+	rest.writeWatchlistResp(resp, http.StatusOK, wl, nil)
+}
+
+func (rest *restAPI) writeAlertsResp(resp http.ResponseWriter, status int, errorData *proto.ErrorData) {
+	if errorData != nil {
+		rest.logger.Warnf("unable to process request: [%d] (\"%s\")",
+			errorData.Code, errorData.Text)
+	}
+	rest.writeResp(resp, status, &proto.AlertsResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		ErrorData: errorData,
+	})
+}
+
+func (rest *restAPI) alertsHandler(resp http.ResponseWriter, req *http.Request) {
+	rest.logger.Infof("got request on \"%s\"", apiAlerts)
+	if req.Method != httpGetMethod {
+		rest.writeAlertsResp(resp, http.StatusBadRequest,
+			invalidMethodErrorData([]string{httpGetMethod}, req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	filter := &storages.AlertsFilter{
+		WatchlistID: query.Get("watchlist_id"),
+		CobID:       query.Get("cob_id"),
+		SrcAddr:     query.Get("src_addr"),
+	}
+	var errorData *proto.ErrorData
+	filter.From, errorData = parseTimeParam(query, "from")
+	if errorData == nil {
+		filter.To, errorData = parseTimeParam(query, "to")
+	}
+	if (errorData == nil) && (query.Get("cursor") != "") {
+		after, err := decodeCursor(query.Get("cursor"))
+		if err != nil {
+			errorData = invalidParamErrorData("cursor", err)
+		}
+		filter.After = after
+	}
+	limit := uint64(0)
+	if errorData == nil {
+		limit, errorData = parseUintParam(query, "limit", defaultSightingsLimit)
+	}
+	if errorData != nil {
+		rest.writeAlertsResp(resp, http.StatusBadRequest, errorData)
+		return
+	}
+	if (limit == 0) || (limit > maxSightingsLimit) {
+		limit = maxSightingsLimit
+	}
+
+	alerts, err := rest.fStorage.SelectAlerts(filter, limit)
+	if err != nil {
+		rest.logger.Error(err)
+		rest.writeAlertsResp(resp, http.StatusInternalServerError, internalErrorData(err))
+		return
+	}
+
+	alertsResp := &proto.AlertsResp{
+		Header: proto.Header{
+			SrcAddr: rest.srcAddr,
+		},
+		Alerts: make([]proto.Alert, 0, len(alerts)),
+	}
+	for i := range alerts {
+		a := &(alerts[i])
+		alertsResp.Alerts = append(alertsResp.Alerts, proto.Alert{
+			ID:            a.ID,
+			TS:            a.TS,
+			WatchlistID:   a.WatchlistID,
+			WatchlistName: a.WatchlistName,
+			CobID:         a.CobID,
+			Score:         a.Score,
+			SrcAddr:       a.SrcAddr,
+			SightingID:    a.SightingID,
+			ImgID:         a.ImgID,
+			ImgURL:        sightingImgURL(a.ImgID, a.ImgPath, a.TS),
+			FaceBox:       a.FaceBox,
+		})
+	}
+	if (len(alerts) != 0) && (uint64(len(alerts)) == limit) {
+		last := &(alerts[len(alerts)-1])
+		nextCursor := encodeCursor(last.TS, last.ID)
+		alertsResp.NextCursor = &nextCursor
+	}
+	rest.writeResp(resp, http.StatusOK, alertsResp)
+}
@@ -0,0 +1,254 @@
+package identities
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+/*
+Identity of control object is a robust centroid of all its facial features vectors
+of one model, which is matched instead of their plain arithmetic mean, so a few
+mislabelled vectors can't drag it towards another face. Every vector is scored by
+cosine between it and the mean of all other (normalized) vectors of control object;
+vectors with score below outlier threshold are outliers: they are excluded from
+centroid and exposed for review. Vectors, accepted on review, are never outliers.
+Outliers are not searched among fewer than min_ffvs vectors, since there is no
+majority to compare with. Centroid is computed by method:
+- "mean" is a mean of all vectors except outliers;
+- "trimmed_mean" additionally drops trim_fraction of the least similar vectors;
+- "medoid" is the vector with the maximum total similarity to others.
+*/
+
+const (
+	// MeanMethod ...
+	MeanMethod = "mean"
+	// TrimmedMeanMethod ...
+	TrimmedMeanMethod = "trimmed_mean"
+	// MedoidMethod ...
+	MedoidMethod = "medoid"
+
+	defaultOutlierThreshold   = 0.8
+	defaultMinFFVs            = 3
+	defaultDuplicateThreshold = 0.98
+)
+
+// Vector is facial features vector of control object.
+type Vector struct {
+	ID string
+	FF proto.FacialFeaturesVector
+}
+
+// Outlier is vector, which is not similar to other vectors of control object.
+type Outlier struct {
+	ID    string
+	Score float64
+}
+
+// Identity is robust centroid of control object vectors.
+type Identity struct {
+	Centroid proto.FacialFeaturesVector
+	Outliers []Outlier
+}
+
+// Model builds identities.
+type Model struct {
+	method             string
+	outlierThreshold   float64
+	trimFraction       float64
+	minFFVs            int
+	duplicateThreshold float64
+}
+
+// CreateModel ...
+func CreateModel(cfg *cfgparser.IdentitiesCFG) (*Model, error) {
+	m := &Model{
+		method:             cfg.Method,
+		outlierThreshold:   cfg.OutlierThreshold,
+		trimFraction:       cfg.TrimFraction,
+		minFFVs:            cfg.MinFFVs,
+		duplicateThreshold: cfg.DuplicateThreshold,
+	}
+	switch m.method {
+	case "":
+		m.method = TrimmedMeanMethod
+	case MeanMethod, TrimmedMeanMethod, MedoidMethod:
+	default:
+		return nil, fmt.Errorf("unknown identities method \"%s\"", cfg.Method)
+	}
+	if m.outlierThreshold == 0 {
+		m.outlierThreshold = defaultOutlierThreshold
+	}
+	if (m.outlierThreshold < -1.0) || (m.outlierThreshold > 1.0) {
+		return nil, fmt.Errorf("outlier threshold %g is out of [-1, 1]", m.outlierThreshold)
+	}
+	if (m.trimFraction < 0.0) || (m.trimFraction >= 0.5) {
+		return nil, fmt.Errorf("trim fraction %g is out of [0, 0.5)", m.trimFraction)
+	}
+	if m.minFFVs < 1 {
+		m.minFFVs = defaultMinFFVs
+	}
+	if m.duplicateThreshold == 0 {
+		m.duplicateThreshold = defaultDuplicateThreshold
+	}
+	if (m.duplicateThreshold < -1.0) || (m.duplicateThreshold > 1.0) {
+		return nil, fmt.Errorf("duplicate threshold %g is out of [-1, 1]", m.duplicateThreshold)
+	}
+	return m, nil
+}
+
+// DuplicateThreshold returns min similarity of centroids of duplicate control objects.
+func (m *Model) DuplicateThreshold() float64 {
+	return m.duplicateThreshold
+}
+
+// Build returns identity of vectors (of the same model and dimension). Vectors,
+// which IDs are in accepted, are never outliers and are never trimmed.
+func (m *Model) Build(vectors []Vector, accepted map[string]struct{}) *Identity {
+	identity := &Identity{
+		Outliers: []Outlier{},
+	}
+	if len(vectors) == 0 {
+		return identity
+	}
+	if len(vectors) < m.minFFVs {
+		identity.Centroid = mean(vectors, nil)
+		return identity
+	}
+
+	scores := score(vectors)
+	excluded := make([]bool, len(vectors))
+	kept := 0
+	for i, v := range vectors {
+		if _, ok := accepted[v.ID]; !ok && (scores[i] < m.outlierThreshold) {
+			excluded[i] = true
+			identity.Outliers = append(identity.Outliers, Outlier{
+				ID:    v.ID,
+				Score: scores[i],
+			})
+			continue
+		}
+		kept++
+	}
+	// If majority itself is not consistent, it can't be trusted.
+	if kept == 0 {
+		identity.Centroid = mean(vectors, nil)
+		return identity
+	}
+
+	switch m.method {
+	case TrimmedMeanMethod:
+		m.trim(vectors, scores, accepted, excluded, kept)
+		identity.Centroid = mean(vectors, excluded)
+	case MedoidMethod:
+		identity.Centroid = medoid(vectors, excluded)
+	default:
+		identity.Centroid = mean(vectors, excluded)
+	}
+	return identity
+}
+
+// trim excludes trim fraction of the least similar not excluded vectors.
+func (m *Model) trim(vectors []Vector, scores []float64, accepted map[string]struct{}, excluded []bool, kept int) {
+	trimmed := int(m.trimFraction * float64(kept))
+	if trimmed == 0 {
+		return
+	}
+	idxs := make([]int, 0, kept)
+	for i, v := range vectors {
+		if _, ok := accepted[v.ID]; !ok && !excluded[i] {
+			idxs = append(idxs, i)
+		}
+	}
+	sort.SliceStable(idxs, func(i, j int) bool {
+		return scores[idxs[i]] < scores[idxs[j]]
+	})
+	for i := 0; (i < trimmed) && (i < len(idxs)); i++ {
+		excluded[idxs[i]] = true
+	}
+}
+
+// score returns cosine between every vector and the mean of all other normalized vectors.
+func score(vectors []Vector) []float64 {
+	normalized := make([]proto.FacialFeaturesVector, len(vectors))
+	sum := make([]float64, len(vectors[0].FF))
+	for i, v := range vectors {
+		normalized[i] = normalize(v.FF)
+		for j := 0; (j < len(sum)) && (j < len(normalized[i])); j++ {
+			sum[j] += normalized[i][j]
+		}
+	}
+	scores := make([]float64, len(vectors))
+	others := make(proto.FacialFeaturesVector, len(sum))
+	for i := range vectors {
+		for j := range sum {
+			others[j] = sum[j]
+			if j < len(normalized[i]) {
+				others[j] -= normalized[i][j]
+			}
+		}
+		scores[i] = normalized[i].Cosine(others)
+		if math.IsNaN(scores[i]) {
+			scores[i] = -1.0
+		}
+	}
+	return scores
+}
+
+func mean(vectors []Vector, excluded []bool) proto.FacialFeaturesVector {
+	centroid := make(proto.FacialFeaturesVector, len(vectors[0].FF))
+	num := 0
+	for i, v := range vectors {
+		if (excluded != nil) && excluded[i] {
+			continue
+		}
+		for j := 0; (j < len(centroid)) && (j < len(v.FF)); j++ {
+			centroid[j] += v.FF[j]
+		}
+		num++
+	}
+	for j := range centroid {
+		centroid[j] /= float64(num)
+	}
+	return centroid
+}
+
+func medoid(vectors []Vector, excluded []bool) proto.FacialFeaturesVector {
+	best := -1
+	bestSum := 0.0
+	for i := range vectors {
+		if excluded[i] {
+			continue
+		}
+		sum := 0.0
+		for j := range vectors {
+			if (i != j) && !excluded[j] {
+				sum += vectors[i].FF.Cosine(vectors[j].FF)
+			}
+		}
+		if (best == -1) || (sum > bestSum) {
+			best = i
+			bestSum = sum
+		}
+	}
+	return append(proto.FacialFeaturesVector{}, vectors[best].FF...)
+}
+
+func normalize(ff proto.FacialFeaturesVector) proto.FacialFeaturesVector {
+	norm := 0.0
+	for _, x := range ff {
+		norm += x * x
+	}
+	norm = math.Sqrt(norm)
+	normalized := make(proto.FacialFeaturesVector, len(ff))
+	if norm == 0 {
+		return normalized
+	}
+	for i, x := range ff {
+		normalized[i] = x / norm
+	}
+	return normalized
+}
@@ -1 +1,36 @@
 package imageprocessing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	// Formats, which dimensions can be decoded.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ImgSize returns width and height of image, decoding only its header.
+func ImgSize(img []byte) (uint64, uint64, error) {
+	return imgSize(bytes.NewReader(img))
+}
+
+// Base64ImgSize returns width and height of base64-encoded image.
+func Base64ImgSize(imgBuff string) (uint64, uint64, error) {
+	return imgSize(base64.NewDecoder(base64.StdEncoding, strings.NewReader(imgBuff)))
+}
+
+func imgSize(r io.Reader) (uint64, uint64, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "unable to decode image dimensions")
+	}
+	if (cfg.Width <= 0) || (cfg.Height <= 0) {
+		return 0, 0, errors.Errorf("%s image has invalid dimensions %dx%d", format, cfg.Width, cfg.Height)
+	}
+	return uint64(cfg.Width), uint64(cfg.Height), nil
+}
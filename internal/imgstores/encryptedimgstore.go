@@ -0,0 +1,83 @@
+package imgstores
+
+import (
+	"github.com/nofacedb/facedb/internal/encryption"
+	"github.com/pkg/errors"
+)
+
+// EncryptedImgStore wraps another ImgStore and encrypts images before storing them.
+// Images keys are detected from plaintext, so they keep extensions of real types.
+// Every image is bound to its key, so it can't be read under another key. Images,
+// stored before encryption was enabled, can't be read, until they are rotated
+// with allowed plaintext.
+type EncryptedImgStore struct {
+	ImgStore
+	cipher *encryption.Cipher
+}
+
+// CreateEncryptedImgStore ...
+func CreateEncryptedImgStore(s ImgStore, cipher *encryption.Cipher) *EncryptedImgStore {
+	return &EncryptedImgStore{
+		ImgStore: s,
+		cipher:   cipher,
+	}
+}
+
+// AllowPlaintext makes images, stored before encryption was enabled, readable
+// and rotated (see encryption.Cipher.AllowPlaintext).
+func (s *EncryptedImgStore) AllowPlaintext() {
+	s.cipher.AllowPlaintext()
+}
+
+// imgAAD returns additional data, which binds image to its key.
+func imgAAD(key string) []byte {
+	return []byte("imgs:" + key)
+}
+
+// Put ...
+func (s *EncryptedImgStore) Put(id string, img []byte) (string, error) {
+	key, err := ImgKey(id, img)
+	if err != nil {
+		return "", err
+	}
+	return key, s.PutKey(key, img)
+}
+
+// PutKey encrypts data and stores it under given key.
+func (s *EncryptedImgStore) PutKey(key string, data []byte) error {
+	encrypted, err := s.cipher.EncryptBytes(data, imgAAD(key))
+	if err != nil {
+		return errors.Wrap(err, "unable to encrypt image")
+	}
+	return s.ImgStore.PutKey(key, encrypted)
+}
+
+// Get ...
+func (s *EncryptedImgStore) Get(key string) ([]byte, error) {
+	data, err := s.ImgStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	img, err := s.cipher.DecryptBytes(data, imgAAD(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to decrypt image \"%s\"", key)
+	}
+	return img, nil
+}
+
+// RotateKey encrypts image, stored in plaintext (if plaintext is allowed), or rewraps
+// its data key by active key. It returns false, if image is already encrypted with active key.
+func (s *EncryptedImgStore) RotateKey(key string) (bool, error) {
+	data, err := s.ImgStore.Get(key)
+	if err != nil {
+		return false, err
+	}
+	rewrapped, changed, err := s.cipher.RewrapBytes(data, imgAAD(key))
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to rewrap image \"%s\"", key)
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, s.ImgStore.PutKey(key, rewrapped)
+}
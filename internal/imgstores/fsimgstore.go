@@ -0,0 +1,124 @@
+package imgstores
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FSImgStore stores images in local filesystem directory.
+type FSImgStore struct {
+	root string
+}
+
+// CreateFSImgStore creates root directory, if it doesn't exist.
+func CreateFSImgStore(root string) (*FSImgStore, error) {
+	if root == "" {
+		return nil, errors.New("images path is not specified")
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, errors.Wrap(err, "unable to create images directory")
+	}
+	return &FSImgStore{
+		root: root,
+	}, nil
+}
+
+// path returns image file path. Key must be relative to root directory.
+func (s *FSImgStore) path(key string) (string, error) {
+	p := filepath.Clean(key)
+	if filepath.IsAbs(p) || (p == ".") || (p == "..") || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("invalid image key \"%s\"", key)
+	}
+	return filepath.Join(s.root, p), nil
+}
+
+// legacyPath returns image file path of existing image. Absolute keys are paths of
+// images, which were stored before sharding, and are used as is, so they may be
+// only read and deleted, but never written.
+func (s *FSImgStore) legacyPath(key string) (string, error) {
+	if filepath.IsAbs(key) {
+		return key, nil
+	}
+	return s.path(key)
+}
+
+// Put ...
+func (s *FSImgStore) Put(id string, img []byte) (string, error) {
+	key, err := ImgKey(id, img)
+	if err != nil {
+		return "", err
+	}
+	return key, s.PutKey(key, img)
+}
+
+// PutKey writes data to temporary file and renames it, so image file is either
+// absent or complete.
+func (s *FSImgStore) PutKey(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "unable to create image directory")
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temporary image file")
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "unable to write image file")
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "unable to rename image file")
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// Get ...
+func (s *FSImgStore) Get(key string) ([]byte, error) {
+	path, err := s.legacyPath(key)
+	if err != nil {
+		return nil, err
+	}
+	img, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read image file")
+	}
+	return img, nil
+}
+
+// Delete ...
+func (s *FSImgStore) Delete(key string) error {
+	path, err := s.legacyPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); (err != nil) && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to remove image file")
+	}
+	return nil
+}
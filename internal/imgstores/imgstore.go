@@ -0,0 +1,106 @@
+package imgstores
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/h2non/filetype"
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/encryption"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Images store keeps images files, which are referenced by imgs.path.
+Image is stored under key "ab/cd/abcd...ef.ext", where "ab/cd" are the first
+bytes of image ID (so there are no huge directories or prefixes), and "ext"
+is extension of detected image type.
+*/
+
+const (
+	// FSImgStoreType stores images in local filesystem.
+	FSImgStoreType = "fs"
+	// S3ImgStoreType stores images in S3-compatible object storage.
+	S3ImgStoreType = "s3"
+)
+
+// ImgStore stores images by keys.
+type ImgStore interface {
+	// Put atomically stores image with given ID and returns its key.
+	Put(id string, img []byte) (string, error)
+	// PutKey atomically stores data under given key.
+	PutKey(key string, data []byte) error
+	// Get returns image by key.
+	Get(key string) ([]byte, error)
+	// Delete deletes image by key. Deletion of missing image is not an error.
+	Delete(key string) error
+}
+
+// CreateImgStore creates ImgStore of type, specified in config, which
+// encrypts images, if encryption is enabled.
+func CreateImgStore(cfg *cfgparser.StorageCFG, logger *log.Logger) (ImgStore, error) {
+	s, err := createImgStore(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := encryption.CreateCipher(&(cfg.EncryptionCFG))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create images store")
+	}
+	if cipher != nil {
+		logger.Debug("images are encrypted")
+		return CreateEncryptedImgStore(s, cipher), nil
+	}
+	return s, nil
+}
+
+func createImgStore(cfg *cfgparser.StorageCFG, logger *log.Logger) (ImgStore, error) {
+	switch cfg.ImgStoreCFG.Type {
+	case "", FSImgStoreType:
+		logger.Debugf("using \"%s\" images store in \"%s\"", FSImgStoreType, cfg.ImgPath)
+		s, err := CreateFSImgStore(cfg.ImgPath)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case S3ImgStoreType:
+		s3CFG := &(cfg.ImgStoreCFG.S3CFG)
+		logger.Debugf("using \"%s\" images store in bucket \"%s\" on \"%s\"",
+			S3ImgStoreType, s3CFG.Bucket, s3CFG.Endpoint)
+		s, err := CreateS3ImgStore(s3CFG, &http.Client{
+			Timeout: time.Millisecond * time.Duration(s3CFG.TimeoutMS),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, errors.Wrap(fmt.Errorf("unknown images store type \"%s\"", cfg.ImgStoreCFG.Type),
+		"unable to create images store")
+}
+
+// ImgKey returns key of image with given ID and detected type.
+func ImgKey(id string, img []byte) (string, error) {
+	kind, err := filetype.Match(img)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to detect image type")
+	}
+	if kind == filetype.Unknown {
+		return "", errors.New("unable to recognize image type")
+	}
+	if len(id) < 4 {
+		return "", fmt.Errorf("invalid image ID \"%s\"", id)
+	}
+	return id[0:2] + "/" + id[2:4] + "/" + id + "." + kind.Extension, nil
+}
+
+// ImgMIME returns MIME type of image.
+func ImgMIME(img []byte) string {
+	kind, err := filetype.Match(img)
+	if (err != nil) || (kind == filetype.Unknown) {
+		return "application/octet-stream"
+	}
+	return kind.MIME.Value
+}
@@ -0,0 +1,223 @@
+package imgstores
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/pkg/errors"
+)
+
+/*
+S3ImgStore stores images as objects in bucket of S3-compatible storage, addressed
+in path style ("endpoint/bucket/key"), so any local stand-in (e.g. MinIO) may be used.
+Requests are signed with AWS Signature Version 4. Single PUT is atomic.
+*/
+
+const (
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+	s3Service    = "s3"
+	s3DateFormat = "20060102T150405Z"
+)
+
+// S3ImgStore stores images in S3-compatible object storage.
+type S3ImgStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// CreateS3ImgStore ...
+func CreateS3ImgStore(cfg *cfgparser.S3CFG, client *http.Client) (*S3ImgStore, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid S3 endpoint")
+	}
+	if (endpoint.Scheme == "") || (endpoint.Host == "") {
+		return nil, fmt.Errorf("invalid S3 endpoint \"%s\"", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is not specified")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3ImgStore{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    cfg.Bucket,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		client:    client,
+	}, nil
+}
+
+// Put ...
+func (s *S3ImgStore) Put(id string, img []byte) (string, error) {
+	key, err := ImgKey(id, img)
+	if err != nil {
+		return "", err
+	}
+	return key, s.PutKey(key, img)
+}
+
+// PutKey ...
+func (s *S3ImgStore) PutKey(key string, data []byte) error {
+	resp, err := s.do("PUT", key, data, ImgMIME(data))
+	if err != nil {
+		return errors.Wrap(err, "unable to put image to S3")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to put image to S3: unexpected status \"%s\"", resp.Status)
+	}
+	return nil
+}
+
+// Get ...
+func (s *S3ImgStore) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get image from S3")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to get image from S3: unexpected status \"%s\"", resp.Status)
+	}
+	img, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read image from S3")
+	}
+	return img, nil
+}
+
+// Delete ...
+func (s *S3ImgStore) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, "")
+	if err != nil {
+		return errors.Wrap(err, "unable to delete image from S3")
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("unable to delete image from S3: unexpected status \"%s\"", resp.Status)
+}
+
+func (s *S3ImgStore) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	if strings.HasPrefix(key, "/") {
+		return nil, fmt.Errorf("invalid image key \"%s\"", key)
+	}
+	path := strings.TrimSuffix(s.endpoint.EscapedPath(), "/") +
+		"/" + s3Escape(s.bucket) + "/" + s3EscapePath(key)
+	req, err := http.NewRequest(method, s.endpoint.Scheme+"://"+s.endpoint.Host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, path, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to request with empty query.
+func (s *S3ImgStore) sign(req *http.Request, path string, body []byte, now time.Time) {
+	amzDate := now.Format(s3DateFormat)
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/" + s3Service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes all bytes, except unreserved ones, as SigV4 requires.
+func s3Escape(s string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ((c >= 'A') && (c <= 'Z')) || ((c >= 'a') && (c <= 'z')) ||
+			((c >= '0') && (c <= '9')) || (c == '-') || (c == '.') || (c == '_') || (c == '~') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i := range segments {
+		segments[i] = s3Escape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,68 @@
+package indexes
+
+import (
+	"sort"
+)
+
+// heapItem is a node index with its distance to query.
+type heapItem struct {
+	idx  int
+	dist float64
+}
+
+// minHeap pops the nearest item first.
+type minHeap []heapItem
+
+func (h minHeap) Len() int            { return len(h) }
+func (h minHeap) Less(i, j int) bool  { return h[i].dist < h[j].dist }
+func (h minHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *minHeap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *minHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// maxHeap pops the farthest item first.
+type maxHeap []heapItem
+
+func (h maxHeap) Len() int            { return len(h) }
+func (h maxHeap) Less(i, j int) bool  { return h[i].dist > h[j].dist }
+func (h maxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *maxHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
+
+// top returns the farthest item.
+func (h maxHeap) top() heapItem {
+	return h[0]
+}
+
+// nearest returns index of the nearest item.
+func (h maxHeap) nearest() int {
+	best := h[0]
+	for _, it := range h[1:] {
+		if it.dist < best.dist {
+			best = it
+		}
+	}
+	return best.idx
+}
+
+// sorted returns all items, ordered by distance ascending.
+func (h maxHeap) sorted() []heapItem {
+	items := append([]heapItem{}, h...)
+	sortItems(items)
+	return items
+}
+
+func sortItems(items []heapItem) {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].dist < items[j].dist
+	})
+}
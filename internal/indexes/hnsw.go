@@ -0,0 +1,511 @@
+package indexes
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+HNSW is Hierarchical Navigable Small World graph (Malkov, Yashunin, 2016)
+for approximate nearest neighbour search by cosine similarity.
+All vectors are normalized on insert, so distance between them is 1 - dot product.
+Removed (or replaced) vectors are only marked as deleted: they are still used
+for graph navigation, but never returned. When there are too many deleted
+vectors, graph is rebuilt on insert or erasure. Erased vectors must not be kept
+even in deleted nodes, so their nodes are unlinked from graph (every node, which
+linked to them, is relinked to their neighbours) and become empty tombstones.
+*/
+
+// HNSWCFG contains HNSW graph parameters.
+type HNSWCFG struct {
+	// M is max number of neighbours of node on every layer except 0-th.
+	M int
+	// EfConstruction is size of dynamic candidates list on insert.
+	EfConstruction int
+	// EfSearch is size of dynamic candidates list on search.
+	EfSearch int
+}
+
+const (
+	defaultM              = 16
+	defaultEfConstruction = 200
+	defaultEfSearch       = 64
+	minDeletedToCompact   = 64
+)
+
+// Result is one search result.
+type Result struct {
+	ID         string
+	Similarity float64
+}
+
+// hnswNode is a graph node. Fields are exported for gob snapshots.
+type hnswNode struct {
+	ID      string
+	Vector  []float64
+	Friends [][]int
+	Deleted bool
+}
+
+// HNSW is approximate nearest neighbour index.
+type HNSW struct {
+	cfg      HNSWCFG
+	mMax0    int
+	levelMul float64
+	mu       sync.RWMutex
+	nodes    []*hnswNode
+	ids      map[string]int
+	deleted  int
+	entry    int
+	maxLevel int
+	rnd      *rand.Rand
+}
+
+// CreateHNSW returns new empty HNSW index.
+func CreateHNSW(cfg HNSWCFG) *HNSW {
+	if cfg.M < 2 {
+		cfg.M = defaultM
+	}
+	if cfg.EfConstruction < 1 {
+		cfg.EfConstruction = defaultEfConstruction
+	}
+	if cfg.EfSearch < 1 {
+		cfg.EfSearch = defaultEfSearch
+	}
+	return &HNSW{
+		cfg:      cfg,
+		mMax0:    2 * cfg.M,
+		levelMul: 1.0 / math.Log(float64(cfg.M)),
+		mu:       sync.RWMutex{},
+		nodes:    make([]*hnswNode, 0, 1024),
+		ids:      make(map[string]int),
+		entry:    -1,
+		maxLevel: -1,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// CFG returns index graph parameters.
+func (h *HNSW) CFG() HNSWCFG {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cfg
+}
+
+// Len returns number of alive vectors in index.
+func (h *HNSW) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.ids)
+}
+
+// Insert inserts vector with given ID to index, replacing old one.
+func (h *HNSW) Insert(id string, vector []float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(id)
+	h.insert(id, normalize(vector))
+	h.compactIfNeeded()
+}
+
+// Remove removes vector with given ID from index.
+func (h *HNSW) Remove(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(id)
+}
+
+// Erase removes vector with given ID from index and unlinks all its nodes (including
+// deleted ones) from graph, so vector is not kept even in deleted nodes (and snapshots).
+func (h *HNSW) Erase(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(id)
+	for idx, n := range h.nodes {
+		if (n.ID == id) && (n.Vector != nil) {
+			h.unlink(idx)
+		}
+	}
+	h.compactIfNeeded()
+}
+
+// Search returns up to k most similar to vector alive vectors,
+// ordered by similarity descending.
+func (h *HNSW) Search(vector []float64, k int) []Result {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if (h.entry == -1) || (k < 1) {
+		return []Result{}
+	}
+	q := normalize(vector)
+	ep := h.entry
+	for lc := h.maxLevel; lc > 0; lc-- {
+		ep = h.searchLayer(q, []int{ep}, 1, lc).nearest()
+	}
+	ef := h.cfg.EfSearch
+	if ef < k {
+		ef = k
+	}
+	w := h.searchLayer(q, []int{ep}, ef, 0)
+
+	items := w.sorted()
+	results := make([]Result, 0, k)
+	for _, it := range items {
+		n := h.nodes[it.idx]
+		if n.Deleted {
+			continue
+		}
+		results = append(results, Result{
+			ID:         n.ID,
+			Similarity: 1.0 - it.dist,
+		})
+		if len(results) == k {
+			break
+		}
+	}
+	return results
+}
+
+func (h *HNSW) remove(id string) {
+	idx, ok := h.ids[id]
+	if !ok {
+		return
+	}
+	h.nodes[idx].Deleted = true
+	delete(h.ids, id)
+	h.deleted++
+}
+
+func (h *HNSW) randomLevel() int {
+	return int(math.Floor(-math.Log(1.0-h.rnd.Float64()) * h.levelMul))
+}
+
+func (h *HNSW) maxFriends(lc int) int {
+	if lc == 0 {
+		return h.mMax0
+	}
+	return h.cfg.M
+}
+
+func (h *HNSW) insert(id string, q []float64) {
+	level := h.randomLevel()
+	idx := len(h.nodes)
+	n := &hnswNode{
+		ID:      id,
+		Vector:  q,
+		Friends: make([][]int, level+1),
+	}
+	h.nodes = append(h.nodes, n)
+	h.ids[id] = idx
+
+	if h.entry == -1 {
+		h.entry = idx
+		h.maxLevel = level
+		return
+	}
+
+	ep := []int{h.entry}
+	for lc := h.maxLevel; lc > level; lc-- {
+		ep = []int{h.searchLayer(q, ep, 1, lc).nearest()}
+	}
+	for lc := minInt(h.maxLevel, level); lc >= 0; lc-- {
+		w := h.searchLayer(q, ep, h.cfg.EfConstruction, lc)
+		candidates := w.sorted()
+		neighbours := h.selectNeighbours(candidates, h.cfg.M)
+		n.Friends[lc] = neighbours
+		for _, e := range neighbours {
+			en := h.nodes[e]
+			en.Friends[lc] = append(en.Friends[lc], idx)
+			if len(en.Friends[lc]) > h.maxFriends(lc) {
+				h.shrink(e, lc)
+			}
+		}
+		ep = make([]int, 0, len(candidates))
+		for _, c := range candidates {
+			ep = append(ep, c.idx)
+		}
+	}
+
+	if level > h.maxLevel {
+		h.entry = idx
+		h.maxLevel = level
+	}
+}
+
+// shrink leaves only best maxFriends(lc) neighbours of node on layer lc.
+func (h *HNSW) shrink(idx, lc int) {
+	n := h.nodes[idx]
+	candidates := make([]heapItem, 0, len(n.Friends[lc]))
+	for _, f := range n.Friends[lc] {
+		candidates = append(candidates, heapItem{
+			idx:  f,
+			dist: distance(n.Vector, h.nodes[f].Vector),
+		})
+	}
+	sortItems(candidates)
+	n.Friends[lc] = h.selectNeighbours(candidates, h.maxFriends(lc))
+}
+
+// selectNeighbours selects up to m neighbours from candidates, sorted by distance
+// ascending, using heuristic, which prefers candidates in different directions.
+// If there are not enough such candidates, the nearest pruned ones are used.
+func (h *HNSW) selectNeighbours(candidates []heapItem, m int) []int {
+	selected := make([]int, 0, m)
+	pruned := make([]int, 0, len(candidates))
+	for _, c := range candidates {
+		if len(selected) == m {
+			break
+		}
+		good := true
+		for _, s := range selected {
+			if distance(h.nodes[c.idx].Vector, h.nodes[s].Vector) < c.dist {
+				good = false
+				break
+			}
+		}
+		if good {
+			selected = append(selected, c.idx)
+		} else {
+			pruned = append(pruned, c.idx)
+		}
+	}
+	for i := 0; (len(selected) < m) && (i < len(pruned)); i++ {
+		selected = append(selected, pruned[i])
+	}
+	return selected
+}
+
+// searchLayer returns up to ef nearest to q nodes on layer lc.
+func (h *HNSW) searchLayer(q []float64, ep []int, ef, lc int) *maxHeap {
+	visited := make(map[int]struct{}, ef*4)
+	candidates := &minHeap{}
+	w := &maxHeap{}
+	for _, e := range ep {
+		visited[e] = struct{}{}
+		it := heapItem{idx: e, dist: distance(q, h.nodes[e].Vector)}
+		heap.Push(candidates, it)
+		heap.Push(w, it)
+	}
+	for w.Len() > ef {
+		heap.Pop(w)
+	}
+
+	for candidates.Len() != 0 {
+		c := heap.Pop(candidates).(heapItem)
+		if c.dist > w.top().dist {
+			break
+		}
+		cn := h.nodes[c.idx]
+		if lc >= len(cn.Friends) {
+			continue
+		}
+		for _, e := range cn.Friends[lc] {
+			if _, ok := visited[e]; ok {
+				continue
+			}
+			visited[e] = struct{}{}
+			d := distance(q, h.nodes[e].Vector)
+			if (w.Len() < ef) || (d < w.top().dist) {
+				it := heapItem{idx: e, dist: d}
+				heap.Push(candidates, it)
+				heap.Push(w, it)
+				if w.Len() > ef {
+					heap.Pop(w)
+				}
+			}
+		}
+	}
+
+	return w
+}
+
+// unlink removes node from graph and clears it. Every node, which links to it on some
+// layer, is linked to the best of its other neighbours and neighbours of removed node.
+func (h *HNSW) unlink(idx int) {
+	n := h.nodes[idx]
+	for i, en := range h.nodes {
+		if i == idx {
+			continue
+		}
+		for lc, friends := range en.Friends {
+			pos := -1
+			for j, f := range friends {
+				if f == idx {
+					pos = j
+					break
+				}
+			}
+			if pos == -1 {
+				continue
+			}
+			seen := map[int]struct{}{i: {}, idx: {}}
+			candidates := make([]heapItem, 0, len(friends)+h.maxFriends(lc))
+			addCandidates := func(idxs []int) {
+				for _, c := range idxs {
+					if _, ok := seen[c]; ok {
+						continue
+					}
+					seen[c] = struct{}{}
+					candidates = append(candidates, heapItem{
+						idx:  c,
+						dist: distance(en.Vector, h.nodes[c].Vector),
+					})
+				}
+			}
+			addCandidates(friends)
+			if lc < len(n.Friends) {
+				addCandidates(n.Friends[lc])
+			}
+			sortItems(candidates)
+			en.Friends[lc] = h.selectNeighbours(candidates, h.maxFriends(lc))
+		}
+	}
+	n.ID = ""
+	n.Vector = nil
+	n.Friends = nil
+	n.Deleted = true
+
+	if h.entry != idx {
+		return
+	}
+	// The highest of remaining nodes becomes entry point.
+	h.entry, h.maxLevel = -1, -1
+	for i, en := range h.nodes {
+		if (en.Vector != nil) && (len(en.Friends)-1 > h.maxLevel) {
+			h.entry, h.maxLevel = i, len(en.Friends)-1
+		}
+	}
+}
+
+// compactIfNeeded rebuilds graph, if there are too many deleted nodes.
+func (h *HNSW) compactIfNeeded() {
+	if (h.deleted > minDeletedToCompact) && (2*h.deleted > len(h.nodes)) {
+		h.compact()
+	}
+}
+
+// compact rebuilds graph without deleted nodes.
+func (h *HNSW) compact() {
+	nodes := h.nodes
+	h.nodes = make([]*hnswNode, 0, len(h.ids))
+	h.ids = make(map[string]int, len(h.ids))
+	h.deleted = 0
+	h.entry = -1
+	h.maxLevel = -1
+	for _, n := range nodes {
+		if !n.Deleted {
+			h.insert(n.ID, n.Vector)
+		}
+	}
+}
+
+// hnswSnapshot is gob-encoded HNSW.
+type hnswSnapshot struct {
+	M              int
+	EfConstruction int
+	Nodes          []*hnswNode
+	Entry          int
+	MaxLevel       int
+}
+
+// Snapshot writes index to w.
+func (h *HNSW) Snapshot(w io.Writer) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s := &hnswSnapshot{
+		M:              h.cfg.M,
+		EfConstruction: h.cfg.EfConstruction,
+		Nodes:          h.nodes,
+		Entry:          h.entry,
+		MaxLevel:       h.maxLevel,
+	}
+	if err := gob.NewEncoder(w).Encode(s); err != nil {
+		return errors.Wrap(err, "unable to encode HNSW snapshot")
+	}
+	return nil
+}
+
+// Load replaces index with one, read from r. Graph parameters M and
+// EfConstruction are taken from snapshot, EfSearch is left unchanged.
+func (h *HNSW) Load(r io.Reader) error {
+	s := &hnswSnapshot{}
+	if err := gob.NewDecoder(r).Decode(s); err != nil {
+		return errors.Wrap(err, "unable to decode HNSW snapshot")
+	}
+	if (s.M < 2) || (s.Entry < -1) || (s.Entry >= len(s.Nodes)) {
+		return errors.New("corrupted HNSW snapshot")
+	}
+	for _, n := range s.Nodes {
+		for _, friends := range n.Friends {
+			for _, f := range friends {
+				if (f < 0) || (f >= len(s.Nodes)) {
+					return errors.New("corrupted HNSW snapshot")
+				}
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cfg.M = s.M
+	h.cfg.EfConstruction = s.EfConstruction
+	h.mMax0 = 2 * s.M
+	h.levelMul = 1.0 / math.Log(float64(s.M))
+	h.nodes = s.Nodes
+	h.ids = make(map[string]int, len(s.Nodes))
+	h.deleted = 0
+	for i, n := range s.Nodes {
+		if n.Deleted {
+			h.deleted++
+			continue
+		}
+		h.ids[n.ID] = i
+	}
+	h.entry = s.Entry
+	h.maxLevel = s.MaxLevel
+	return nil
+}
+
+func normalize(v []float64) []float64 {
+	l := 0.0
+	for _, x := range v {
+		l += x * x
+	}
+	l = math.Sqrt(l)
+	n := make([]float64, len(v))
+	if l == 0.0 {
+		return n
+	}
+	for i, x := range v {
+		n[i] = x / l
+	}
+	return n
+}
+
+func distance(v0, v1 []float64) float64 {
+	dot := 0.0
+	for i := 0; (i < len(v0)) && (i < len(v1)); i++ {
+		dot += v0[i] * v1[i]
+	}
+	return 1.0 - dot
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
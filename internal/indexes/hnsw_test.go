@@ -0,0 +1,174 @@
+package indexes
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func randomVectors(rnd *rand.Rand, n, dims int) [][]float64 {
+	vectors := make([][]float64, n)
+	for i := range vectors {
+		vectors[i] = make([]float64, dims)
+		for j := range vectors[i] {
+			vectors[i][j] = rnd.NormFloat64()
+		}
+	}
+	return vectors
+}
+
+// bruteForce returns IDs of k alive vectors, the most similar to q.
+func bruteForce(vectors [][]float64, removed map[int]struct{}, q []float64, k int) []string {
+	nq := normalize(q)
+	items := make([]heapItem, 0, len(vectors))
+	for i, v := range vectors {
+		if _, ok := removed[i]; ok {
+			continue
+		}
+		items = append(items, heapItem{idx: i, dist: distance(nq, normalize(v))})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].dist < items[j].dist })
+	if len(items) > k {
+		items = items[:k]
+	}
+	ids := make([]string, 0, len(items))
+	for _, it := range items {
+		ids = append(ids, fmt.Sprintf("%d", it.idx))
+	}
+	return ids
+}
+
+func TestHNSWRecall(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       HNSWCFG
+		n         int
+		dims      int
+		removeNum int
+		erase     bool
+		k         int
+		minRecall float64
+	}{
+		{"small", HNSWCFG{M: 8, EfConstruction: 100, EfSearch: 64}, 200, 16, 0, false, 5, 0.95},
+		{"default", HNSWCFG{}, 2000, 32, 0, false, 10, 0.9},
+		{"removed", HNSWCFG{}, 2000, 32, 500, false, 10, 0.9},
+		{"erased", HNSWCFG{M: 8, EfConstruction: 50}, 500, 16, 50, true, 10, 0.9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			vectors := randomVectors(rnd, tt.n, tt.dims)
+			h := CreateHNSW(tt.cfg)
+			for i, v := range vectors {
+				h.Insert(fmt.Sprintf("%d", i), v)
+			}
+			removed := make(map[int]struct{}, tt.removeNum)
+			for len(removed) < tt.removeNum {
+				i := rnd.Intn(tt.n)
+				removed[i] = struct{}{}
+				if tt.erase {
+					h.Erase(fmt.Sprintf("%d", i))
+				} else {
+					h.Remove(fmt.Sprintf("%d", i))
+				}
+			}
+			if h.Len() != tt.n-tt.removeNum {
+				t.Fatalf("Len() = %d, want %d", h.Len(), tt.n-tt.removeNum)
+			}
+
+			queries := randomVectors(rnd, 100, tt.dims)
+			found, total := 0, 0
+			for _, q := range queries {
+				want := bruteForce(vectors, removed, q, tt.k)
+				got := h.Search(q, tt.k)
+				gotIDs := make(map[string]struct{}, len(got))
+				for _, r := range got {
+					var i int
+					fmt.Sscanf(r.ID, "%d", &i)
+					if _, ok := removed[i]; ok {
+						t.Fatalf("removed vector \"%s\" is found", r.ID)
+					}
+					gotIDs[r.ID] = struct{}{}
+				}
+				for _, id := range want {
+					if _, ok := gotIDs[id]; ok {
+						found++
+					}
+				}
+				total += len(want)
+			}
+			recall := float64(found) / float64(total)
+			if recall < tt.minRecall {
+				t.Errorf("recall = %.3f, want at least %.3f", recall, tt.minRecall)
+			}
+		})
+	}
+}
+
+func TestHNSWSnapshot(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	vectors := randomVectors(rnd, 300, 8)
+	h := CreateHNSW(HNSWCFG{})
+	for i, v := range vectors {
+		h.Insert(fmt.Sprintf("%d", i), v)
+	}
+	h.Remove("0")
+
+	buf := &bytes.Buffer{}
+	if err := h.Snapshot(buf); err != nil {
+		t.Fatalf("Snapshot() error: %s", err)
+	}
+	loaded := CreateHNSW(HNSWCFG{})
+	if err := loaded.Load(buf); err != nil {
+		t.Fatalf("Load() error: %s", err)
+	}
+	if loaded.Len() != h.Len() {
+		t.Fatalf("Len() = %d, want %d", loaded.Len(), h.Len())
+	}
+	for _, q := range randomVectors(rnd, 20, 8) {
+		want := h.Search(q, 5)
+		got := loaded.Search(q, 5)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("Search() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHNSWErase(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	vectors := randomVectors(rnd, 300, 8)
+	h := CreateHNSW(HNSWCFG{M: 8, EfConstruction: 50})
+	for i, v := range vectors {
+		h.Insert(fmt.Sprintf("%d", i), v)
+	}
+	// The first vector is replaced, so its old node is deleted, but still kept.
+	h.Insert("0", randomVectors(rnd, 1, 8)[0])
+	nodesNum := len(h.nodes)
+	for _, id := range []string{"0", "1", "2"} {
+		h.Erase(id)
+	}
+
+	if len(h.nodes) != nodesNum {
+		t.Errorf("graph has %d nodes, want %d (erasure shouldn't rebuild it)", len(h.nodes), nodesNum)
+	}
+	for idx, n := range h.nodes {
+		if (n.ID == "0") || (n.ID == "1") || (n.ID == "2") || ((n.Vector == nil) != n.Deleted) {
+			t.Errorf("node %d (%q, deleted %v) of erased vector is kept", idx, n.ID, n.Deleted)
+		}
+		for _, friends := range n.Friends {
+			for _, f := range friends {
+				if h.nodes[f].Vector == nil {
+					t.Errorf("node %d links to erased node %d", idx, f)
+				}
+			}
+		}
+	}
+	if (h.entry == -1) || (h.nodes[h.entry].Vector == nil) {
+		t.Errorf("entry point %d is erased", h.entry)
+	}
+	if got := h.Search(vectors[1], 1); (len(got) != 1) || (got[0].ID == "1") {
+		t.Errorf("Search() of erased vector = %v", got)
+	}
+}
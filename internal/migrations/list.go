@@ -0,0 +1,443 @@
+package migrations
+
+/*
+All FACEDB schema migrations in order of versions. Every migration is a list of
+statements (ClickHouse executes only one statement per query), which are run in
+order on "up", and a list of statements, which revert them, on "down".
+Tables are created in database from storage config, so names are not qualified.
+Never change applied migrations: add new ones instead.
+*/
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: []string{
+			// control_objects is a table for people, we are interested in (control objects).
+			`CREATE TABLE IF NOT EXISTS control_objects
+(
+    id         UUID     DEFAULT generateUUIDv4(), -- surrogate key.
+    db_ts      DateTime DEFAULT now(),            -- internal  (database) timestamp.
+    ts         DateTime DEFAULT now(),            -- external  timestamp.
+    passport   String,                            -- natural   key.
+    surname    String   DEFAULT '-',
+    name       String   DEFAULT '-',
+    patronymic String   DEFAULT '-',
+    sex        Enum8('male' = 0, 'female' = 1, '-' = 2) DEFAULT '-',
+    birthdate  String   DEFAULT '-',
+    phone_num  String   DEFAULT '-',
+    email      String   DEFAULT '-',
+    address    String   DEFAULT '-'
+) ENGINE = ReplacingMergeTree(db_ts)
+  ORDER BY id`,
+			// facial_features is a table for all control objects facial features vectors.
+			`CREATE TABLE IF NOT EXISTS facial_features
+(
+    id     UUID DEFAULT generateUUIDv4(), -- surrogate key.
+    cob_id UUID,                          -- control_objects FK.
+    img_id UUID,                          -- imgs FK.
+    fb     Array(UInt64),                 -- facebox.
+    ff     Array(Float64)                 -- facial features.
+) ENGINE = MergeTree()
+  ORDER BY id
+  PARTITION BY (cob_id, img_id)`,
+			// embedded_facial_features is a view for average control objects facial features vectors.
+			// they are counted as the arithmetic mean of all facial features vectors.
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS embedded_facial_features
+ENGINE = AggregatingMergeTree() ORDER BY cob_id
+AS SELECT
+   cob_id,
+   avgForEach(ff) AS eff,
+   toInt8(arraySum(eff) /
+    (sqrt(arraySum(arrayMap(x -> x * x, eff))) *
+    sqrt(128.0)) * 10.0) AS cosine_on_ort
+FROM facial_features
+GROUP BY cob_id
+ORDER BY cosine_on_ort ASC, cob_id ASC`,
+			// imgs is a table for all saved images.
+			`CREATE TABLE IF NOT EXISTS imgs
+(
+    id       UUID        DEFAULT generateUUIDv4(), -- surrogate key.
+    ts       DateTime    DEFAULT now(),
+    path     String,
+    face_ids Array(UUID)                           -- control_objects FKs.
+) ENGINE = MergeTree()
+  ORDER BY id`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS imgs`,
+			`DROP TABLE IF EXISTS embedded_facial_features`,
+			`DROP TABLE IF EXISTS facial_features`,
+			`DROP TABLE IF EXISTS control_objects`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "control objects deletion",
+		Up: []string{
+			// deleted marks the latest version of deleted control object.
+			`ALTER TABLE control_objects ADD COLUMN IF NOT EXISTS deleted UInt8 DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE control_objects DROP COLUMN IF EXISTS deleted`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "erasures",
+		Up: []string{
+			// erasures is a table for tombstones of control objects, erased with all their data.
+			`CREATE TABLE IF NOT EXISTS erasures
+(
+    id               UUID,
+    ts               DateTime DEFAULT now(),
+    cob_id           UUID,   -- erased control_objects id.
+    reason           String,
+    requested_by     String,
+    ffvs_num         UInt64, -- number of erased facial features vectors.
+    imgs_num         UInt64, -- number of images, from which control object was removed.
+    deleted_imgs_num UInt64  -- number of images, which were deleted completely.
+) ENGINE = MergeTree()
+  ORDER BY (ts, id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS erasures`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "sightings",
+		Up: []string{
+			// sightings is a table for all faces, found on processed images, matched or not.
+			`CREATE TABLE IF NOT EXISTS sightings
+(
+    id       UUID,
+    ts       DateTime,      -- image receiving timestamp.
+    src_addr String,        -- image source (camera) address.
+    img_id   UUID,
+    img_path String,        -- images store key ('' if image wasn't stored).
+    fb       Array(UInt64), -- facebox.
+    ff       Array(Float64), -- facial features.
+    cob_id   UUID,          -- matched control_objects FK (zero UUID if none).
+    score    Float64        -- matched control object similarity.
+) ENGINE = MergeTree()
+  PARTITION BY toDate(ts)
+  ORDER BY (ts, id)`,
+			`ALTER TABLE erasures ADD COLUMN IF NOT EXISTS sightings_num UInt64 DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE erasures DROP COLUMN IF EXISTS sightings_num`,
+			`DROP TABLE IF EXISTS sightings`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "watchlists",
+		Up: []string{
+			// watchlists is a table for named groups of control objects, matches of which raise alerts.
+			`CREATE TABLE IF NOT EXISTS watchlists
+(
+    id         UUID,
+    db_ts      DateTime DEFAULT now(), -- internal (database) timestamp.
+    name       String,
+    threshold  Float64,                -- min similarity of matched control object.
+    webhooks   Array(String),          -- alerts are posted to these URLs.
+    cooldown_s UInt64,                 -- repeated alerts suppression interval.
+    cob_ids    Array(UUID),            -- control_objects FKs.
+    deleted    UInt8 DEFAULT 0
+) ENGINE = ReplacingMergeTree(db_ts)
+  ORDER BY id`,
+			// alerts is a table for matches of watchlists control objects.
+			`CREATE TABLE IF NOT EXISTS alerts
+(
+    id             UUID,
+    ts             DateTime,       -- image receiving timestamp.
+    watchlist_id   UUID,           -- watchlists FK.
+    watchlist_name String,
+    cob_id         UUID,           -- control_objects FK.
+    score          Float64,        -- control object similarity.
+    src_addr       String,         -- image source (camera) address.
+    sighting_id    UUID,           -- sightings FK.
+    img_id         UUID,
+    img_path       String,         -- images store key ('' if image wasn't stored).
+    fb             Array(UInt64)   -- facebox.
+) ENGINE = MergeTree()
+  PARTITION BY toDate(ts)
+  ORDER BY (ts, id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS alerts`,
+			`DROP TABLE IF EXISTS watchlists`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "embedding models",
+		Up: []string{
+			// model identifies embedding model, which produced facial features vector
+			// ('' is default model of recognizers, which don't report it), and dim is its dimension.
+			`ALTER TABLE facial_features ADD COLUMN IF NOT EXISTS model String DEFAULT ''`,
+			`ALTER TABLE facial_features ADD COLUMN IF NOT EXISTS dim UInt16 DEFAULT toUInt16(length(ff))`,
+			`ALTER TABLE sightings ADD COLUMN IF NOT EXISTS model String DEFAULT ''`,
+			// embedded_facial_features is rebuilt per model and control object, because only
+			// vectors of the same model may be averaged and compared. Rows, inserted while
+			// view is populated, are lost, so it should be run on stopped servers.
+			`DROP TABLE IF EXISTS embedded_facial_features`,
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS embedded_facial_features
+ENGINE = AggregatingMergeTree() ORDER BY (model, cob_id)
+POPULATE
+AS SELECT
+   model,
+   cob_id,
+   avgForEach(ff) AS eff,
+   toInt8(arraySum(eff) /
+    (sqrt(arraySum(arrayMap(x -> x * x, eff))) *
+    sqrt(length(eff))) * 10.0) AS cosine_on_ort
+FROM facial_features
+GROUP BY model, cob_id
+ORDER BY model ASC, cosine_on_ort ASC, cob_id ASC`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS embedded_facial_features`,
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS embedded_facial_features
+ENGINE = AggregatingMergeTree() ORDER BY cob_id
+POPULATE
+AS SELECT
+   cob_id,
+   avgForEach(ff) AS eff,
+   toInt8(arraySum(eff) /
+    (sqrt(arraySum(arrayMap(x -> x * x, eff))) *
+    sqrt(128.0)) * 10.0) AS cosine_on_ort
+FROM facial_features
+GROUP BY cob_id
+ORDER BY cosine_on_ort ASC, cob_id ASC`,
+			`ALTER TABLE sightings DROP COLUMN IF EXISTS model`,
+			`ALTER TABLE facial_features DROP COLUMN IF EXISTS dim`,
+			`ALTER TABLE facial_features DROP COLUMN IF EXISTS model`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "robust centroids",
+		Up: []string{
+			// centroids is a table for robust centroids of control objects facial features
+			// vectors, which are built by FACEDB and are matched instead of plain means.
+			`CREATE TABLE IF NOT EXISTS centroids
+(
+    model          String,
+    cob_id         UUID,
+    version        UInt64,         -- replacing version (unix nanoseconds).
+    eff            Array(Float64), -- centroid (empty, if control object has no vectors of model).
+    cosine_on_ort  Int8,
+    ffvs_num       UInt64,
+    outlier_ids    Array(UUID),    -- facial_features FKs of outliers.
+    outlier_scores Array(Float64), -- similarities of outliers to other vectors.
+    accepted_ids   Array(UUID)     -- facial_features FKs of vectors, accepted on review.
+) ENGINE = ReplacingMergeTree(version)
+  ORDER BY (model, cob_id)`,
+			// existing control objects are matched by means until "rebuild_centroids" command is run.
+			`INSERT INTO centroids
+    (model, cob_id, version, eff, cosine_on_ort, ffvs_num)
+SELECT
+    model, cob_id, 0, eff, cosine_on_ort, ffvs_num
+FROM
+(
+    SELECT
+        model,
+        cob_id,
+        avgForEach(eff) AS eff,
+        toInt8(avg(cosine_on_ort)) AS cosine_on_ort
+    FROM
+        embedded_facial_features
+    GROUP BY model, cob_id
+) ANY LEFT JOIN
+(
+    SELECT
+        model,
+        cob_id,
+        count() AS ffvs_num
+    FROM
+        facial_features
+    GROUP BY model, cob_id
+) USING (model, cob_id)`,
+			`DROP TABLE IF EXISTS embedded_facial_features`,
+		},
+		Down: []string{
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS embedded_facial_features
+ENGINE = AggregatingMergeTree() ORDER BY (model, cob_id)
+POPULATE
+AS SELECT
+   model,
+   cob_id,
+   avgForEach(ff) AS eff,
+   toInt8(arraySum(eff) /
+    (sqrt(arraySum(arrayMap(x -> x * x, eff))) *
+    sqrt(length(eff))) * 10.0) AS cosine_on_ort
+FROM facial_features
+GROUP BY model, cob_id
+ORDER BY model ASC, cosine_on_ort ASC, cob_id ASC`,
+			`DROP TABLE IF EXISTS centroids`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "merges",
+		Up: []string{
+			// merges is a table for records of duplicate control objects, merged into survivors.
+			`CREATE TABLE IF NOT EXISTS merges
+(
+    id            UUID,
+    ts            DateTime DEFAULT now(),
+    survivor_id   UUID,   -- control_objects FK of control object, which got all data.
+    duplicate_id  UUID,   -- control_objects FK of retired (deleted) duplicate.
+    requested_by  String,
+    ffvs_num      UInt64, -- number of moved facial features vectors.
+    imgs_num      UInt64, -- number of images, where duplicate was replaced.
+    sightings_num UInt64  -- number of moved sightings.
+) ENGINE = MergeTree()
+  ORDER BY (ts, id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS merges`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "clusters",
+		Up: []string{
+			// clusters is a table for anonymous identities: clusters of unmatched sightings.
+			// Previous clusters are replaced by versions, marked as deleted, on every clustering.
+			`CREATE TABLE IF NOT EXISTS clusters
+(
+    id                 UUID,
+    version            UInt64,         -- replacing version (unix nanoseconds).
+    ts                 DateTime DEFAULT now(),
+    model              String,
+    sighting_ids       Array(UUID),    -- sightings FKs of all faces of cluster.
+    representative_ids Array(UUID),    -- sightings FKs of the most central faces.
+    centroid           Array(Float64),
+    cob_id             UUID,           -- control_objects FK, if cluster was promoted, zero UUID otherwise.
+    deleted            UInt8 DEFAULT 0
+) ENGINE = ReplacingMergeTree(version)
+  ORDER BY id`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS clusters`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "purges",
+		Up: []string{
+			// purges is a table for reports of retention policies enforcement.
+			`CREATE TABLE IF NOT EXISTS purges
+(
+    id                  UUID,
+    ts                  DateTime DEFAULT now(),
+    imgs_num            UInt64, -- number of deleted images of sightings.
+    failed_imgs_num     UInt64, -- number of images, which weren't deleted from images store.
+    unmatched_faces_num UInt64, -- number of deleted unmatched sightings.
+    sources_faces_num   UInt64, -- number of deleted matched sightings from sources with own retention.
+    sightings_num       UInt64  -- number of other deleted sightings.
+) ENGINE = MergeTree()
+  ORDER BY (ts, id)`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS purges`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "control objects attributes",
+		Up: []string{
+			// attr_keys and attr_values are parallel arrays (as Nested columns) of
+			// deployment-specific attributes, sorted by keys.
+			`ALTER TABLE control_objects ADD COLUMN IF NOT EXISTS attr_keys Array(String) DEFAULT []`,
+			`ALTER TABLE control_objects ADD COLUMN IF NOT EXISTS attr_values Array(String) DEFAULT []`,
+		},
+		Down: []string{
+			`ALTER TABLE control_objects DROP COLUMN IF EXISTS attr_values`,
+			`ALTER TABLE control_objects DROP COLUMN IF EXISTS attr_keys`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "control objects passport hash",
+		Up: []string{
+			// passport_hash is blind index (HMAC) of encrypted passport, by which
+			// control objects are found instead of passport ciphertext.
+			`ALTER TABLE control_objects ADD COLUMN IF NOT EXISTS passport_hash String DEFAULT ''`,
+		},
+		Down: []string{
+			`ALTER TABLE control_objects DROP COLUMN IF EXISTS passport_hash`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "audit log",
+		Up: []string{
+			// audit_log is an append-only, hash-chained log of operators decisions.
+			`CREATE TABLE IF NOT EXISTS audit_log
+(
+    seq       UInt64, -- position of record in chain, starting from 1.
+    id        UUID,
+    ts        DateTime,
+    src_addr  String, -- control panel address.
+    command   String,
+    img_uuid  String, -- UUID of processed image request.
+    entries   String, -- JSON-marshaled before and after control objects of faceboxes.
+    prev_hash String, -- hash of previous record, empty for the first one.
+    hash      String
+) ENGINE = MergeTree()
+  ORDER BY seq`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS audit_log`,
+		},
+	},
+	{
+		Version: 14,
+		Name:    "purges of control objects images",
+		Up: []string{
+			// cob_imgs_num is number of deleted images of control objects, and ffvs_num
+			// is number of facial features vectors, which were deleted with them.
+			`ALTER TABLE purges ADD COLUMN IF NOT EXISTS cob_imgs_num UInt64 DEFAULT 0`,
+			`ALTER TABLE purges ADD COLUMN IF NOT EXISTS ffvs_num UInt64 DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE purges DROP COLUMN IF EXISTS ffvs_num`,
+			`ALTER TABLE purges DROP COLUMN IF EXISTS cob_imgs_num`,
+		},
+	},
+	{
+		Version: 15,
+		Name:    "audit log chains",
+		Up: []string{
+			// Every server appends records to its own chain, and Seq is position of record in it.
+			`ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS chain String DEFAULT ''`,
+			// salt is key of digests of changed fields, it isn't hashed and is cleared on erasure.
+			`ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS salt String DEFAULT '' AFTER entries`,
+			// Records of previous format keep whole control objects, which can't be erased
+			// without breaking chain, so they are deleted.
+			`ALTER TABLE audit_log DELETE WHERE chain = ''`,
+		},
+		Down: []string{
+			`ALTER TABLE audit_log DROP COLUMN IF EXISTS salt`,
+			`ALTER TABLE audit_log DROP COLUMN IF EXISTS chain`,
+		},
+	},
+	{
+		Version: 16,
+		Name:    "erasures of clusters and audit records",
+		Up: []string{
+			// clusters_num is number of erased clusters, promoted to control object, and
+			// audit_records_num is number of audit records, which salts were cleared.
+			`ALTER TABLE erasures ADD COLUMN IF NOT EXISTS clusters_num UInt64 DEFAULT 0`,
+			`ALTER TABLE erasures ADD COLUMN IF NOT EXISTS audit_records_num UInt64 DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE erasures DROP COLUMN IF EXISTS audit_records_num`,
+			`ALTER TABLE erasures DROP COLUMN IF EXISTS clusters_num`,
+		},
+	},
+}
@@ -0,0 +1,188 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Migration is one versioned schema migration.
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+const (
+	upDirection   = "up"
+	downDirection = "down"
+)
+
+// CreateSchemaVersionQuery creates table with log of all applied migrations.
+// Current schema version is version of the row with the highest seq.
+const CreateSchemaVersionQuery = `
+CREATE TABLE IF NOT EXISTS schema_version
+(
+    seq       UInt64,
+    version   UInt64,
+    name      String,
+    direction Enum8('up' = 1, 'down' = 2),
+    ts        DateTime DEFAULT now()
+) ENGINE = MergeTree()
+  ORDER BY seq;
+`
+
+// SelectSchemaVersionQuery ...
+const SelectSchemaVersionQuery = `
+SELECT
+    max(seq),
+    argMax(version, seq)
+FROM
+    schema_version;
+`
+
+// InsertSchemaVersionQuery ...
+const InsertSchemaVersionQuery = `
+INSERT INTO
+    schema_version
+    (seq, version, name, direction)
+VALUES
+    (?, ?, ?, ?);
+`
+
+// All returns all known migrations.
+func All() []Migration {
+	return migrations
+}
+
+// Latest returns the latest known schema version.
+func Latest() uint64 {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrator applies migrations to ClickHouse DB.
+type Migrator struct {
+	db     *sql.DB
+	logger *log.Logger
+}
+
+// CreateMigrator ...
+func CreateMigrator(db *sql.DB, logger *log.Logger) *Migrator {
+	return &Migrator{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Version returns current schema version (0 for empty DB).
+func (m *Migrator) Version() (uint64, error) {
+	_, version, err := m.state()
+	return version, err
+}
+
+func (m *Migrator) state() (uint64, uint64, error) {
+	if _, err := m.db.Exec(CreateSchemaVersionQuery); err != nil {
+		return 0, 0, errors.Wrap(err, "unable to create schema_version table")
+	}
+	seq := uint64(0)
+	version := uint64(0)
+	if err := m.db.QueryRow(SelectSchemaVersionQuery).Scan(&seq, &version); err != nil {
+		return 0, 0, errors.Wrap(err, "unable to select schema version")
+	}
+	return seq, version, nil
+}
+
+// Check returns error, if schema version is not the latest one.
+func (m *Migrator) Check() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version < Latest() {
+		return fmt.Errorf("schema version %d is behind required version %d; run \"migrate up\"",
+			version, Latest())
+	}
+	if version > Latest() {
+		return fmt.Errorf("schema version %d is ahead of the latest known version %d; update FACEDB",
+			version, Latest())
+	}
+	return nil
+}
+
+// Up applies all migrations up to version to (inclusive).
+func (m *Migrator) Up(to uint64) error {
+	seq, version, err := m.state()
+	if err != nil {
+		return err
+	}
+	for _, mig := range migrations {
+		if (mig.Version <= version) || (mig.Version > to) {
+			continue
+		}
+		m.logger.Infof("applying migration %d (%s)", mig.Version, mig.Name)
+		for i, stmt := range mig.Up {
+			if _, err := m.db.Exec(stmt); err != nil {
+				return errors.Wrapf(err, "unable to execute %d-th statement of migration %d", i+1, mig.Version)
+			}
+		}
+		seq++
+		if err := m.log(seq, mig.Version, mig.Name, upDirection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down reverts all migrations down to version to (exclusive).
+func (m *Migrator) Down(to uint64) error {
+	seq, version, err := m.state()
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		mig := migrations[i]
+		if (mig.Version > version) || (mig.Version <= to) {
+			continue
+		}
+		m.logger.Infof("reverting migration %d (%s)", mig.Version, mig.Name)
+		for j, stmt := range mig.Down {
+			if _, err := m.db.Exec(stmt); err != nil {
+				return errors.Wrapf(err, "unable to execute %d-th statement of migration %d revert", j+1, mig.Version)
+			}
+		}
+		prev := uint64(0)
+		if i > 0 {
+			prev = migrations[i-1].Version
+		}
+		seq++
+		if err := m.log(seq, prev, mig.Name, downDirection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) log(seq, version uint64, name, direction string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin schema version insert")
+	}
+	stmt, err := tx.Prepare(InsertSchemaVersionQuery)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to prepare SQL-statement")
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(seq, version, name, direction); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to insert schema version")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "unable to commit schema version insert")
+	}
+	return nil
+}
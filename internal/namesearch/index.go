@@ -0,0 +1,210 @@
+package namesearch
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Index keeps normalized names and passports of all control objects in memory,
+because transliterated and misspelled names can't be searched by ClickHouse DB.
+It is reloaded from storage periodically (so control objects, created through
+other FACEDB servers and commands, are found after reload), and control objects,
+created or changed through this server, are put to it at once. Found control
+objects are selected from storage and scored again, so deleted, erased, merged
+and renamed ones are never returned.
+*/
+
+const (
+	defaultReloadIntervalMS = 60000
+	reloadBatchSize         = 1000
+	// candidatesFactor is ratio of number of scored candidates to limit, because
+	// some of them may be already deleted or renamed.
+	candidatesFactor = 2
+)
+
+// Index searches control objects by names and passport.
+type Index struct {
+	fs       storages.FaceStorage
+	maxTypos int
+	mu       sync.RWMutex
+	entries  map[string]*entry // control object ID -> entry.
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	logger   *log.Logger
+}
+
+// CreateIndex loads all control objects and runs their periodical reload.
+func CreateIndex(cfg *cfgparser.NameSearchCFG, fs storages.FaceStorage, logger *log.Logger) (*Index, error) {
+	idx := &Index{
+		fs:       fs,
+		maxTypos: cfg.MaxDistance,
+		mu:       sync.RWMutex{},
+		entries:  make(map[string]*entry),
+		stop:     make(chan struct{}),
+		logger:   logger,
+	}
+	if err := idx.Reload(); err != nil {
+		return nil, err
+	}
+
+	reloadIntervalMS := cfg.ReloadIntervalMS
+	if reloadIntervalMS <= 0 {
+		reloadIntervalMS = defaultReloadIntervalMS
+	}
+	idx.runReloader(time.Duration(reloadIntervalMS) * time.Millisecond)
+
+	return idx, nil
+}
+
+// Close stops reloading control objects.
+func (idx *Index) Close() {
+	close(idx.stop)
+	idx.wg.Wait()
+}
+
+func (idx *Index) runReloader(interval time.Duration) {
+	idx.wg.Add(1)
+	go func() {
+		defer idx.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-idx.stop:
+				return
+			case <-ticker.C:
+				if err := idx.Reload(); err != nil {
+					idx.logger.Warn(err)
+				}
+			}
+		}
+	}()
+}
+
+// Reload loads all control objects from storage.
+func (idx *Index) Reload() error {
+	entries := make(map[string]*entry)
+	for offset := uint64(0); ; offset += reloadBatchSize {
+		cobs, err := idx.fs.SelectControlObjects(&storages.ControlObjectsFilter{}, offset, reloadBatchSize)
+		if err != nil {
+			return errors.Wrap(err, "unable to load control objects names")
+		}
+		for i := range cobs {
+			entries[cobs[i].ID] = createControlObjectEntry(&(cobs[i]))
+		}
+		if len(cobs) < reloadBatchSize {
+			break
+		}
+	}
+
+	idx.mu.Lock()
+	idx.entries = entries
+	idx.mu.Unlock()
+
+	return nil
+}
+
+func createControlObjectEntry(cob *proto.ControlObject) *entry {
+	return createEntry(cob.ID, cob.Surname, cob.Name, cob.Patronymic, cob.Passport)
+}
+
+// Put adds new or changed control objects.
+func (idx *Index) Put(cobs []proto.ControlObject) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for i := range cobs {
+		idx.entries[cobs[i].ID] = createControlObjectEntry(&(cobs[i]))
+	}
+}
+
+// Search returns up to limit control objects, matching query, the most relevant first.
+func (idx *Index) Search(s string, limit int) ([]proto.ControlObjectMatch, error) {
+	q := createQuery(s, idx.maxTypos)
+	if (len(q.words) == 0) || (limit <= 0) {
+		return []proto.ControlObjectMatch{}, nil
+	}
+
+	type candidate struct {
+		id    string
+		score float64
+	}
+	candidates := []candidate{}
+	idx.mu.RLock()
+	for id, e := range idx.entries {
+		if score := q.score(e); score > 0.0 {
+			candidates = append(candidates, candidate{id, score})
+		}
+	}
+	idx.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].id < candidates[j].id
+	})
+	if len(candidates) > candidatesFactor*limit {
+		candidates = candidates[:candidatesFactor*limit]
+	}
+	ids := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		ids = append(ids, c.id)
+	}
+
+	cobs, err := idx.fs.SelectControlObjectsByIDs(ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to select found control objects")
+	}
+	entries := idx.refresh(ids, cobs)
+	matches := make([]proto.ControlObjectMatch, 0, len(cobs))
+	for i := range cobs {
+		if score := q.score(entries[i]); score > 0.0 {
+			matches = append(matches, proto.ControlObjectMatch{
+				ControlObject: cobs[i],
+				Score:         score,
+			})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		mi, mj := &(matches[i]), &(matches[j])
+		if mi.Score != mj.Score {
+			return mi.Score > mj.Score
+		}
+		if mi.ControlObject.Surname != mj.ControlObject.Surname {
+			return mi.ControlObject.Surname < mj.ControlObject.Surname
+		}
+		if mi.ControlObject.Name != mj.ControlObject.Name {
+			return mi.ControlObject.Name < mj.ControlObject.Name
+		}
+		return mi.ControlObject.ID < mj.ControlObject.ID
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// refresh replaces entries of control objects with given IDs by ones of cobs,
+// selected from storage, and returns them; missing control objects are removed.
+func (idx *Index) refresh(ids []string, cobs []proto.ControlObject) []*entry {
+	entries := make([]*entry, 0, len(cobs))
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, id := range ids {
+		delete(idx.entries, id)
+	}
+	for i := range cobs {
+		e := createControlObjectEntry(&(cobs[i]))
+		idx.entries[e.id] = e
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,169 @@
+package namesearch
+
+import "strings"
+
+/*
+Every word of query is matched with the best word of control object fields:
+equal word scores 1, word, which starts with query word (typed prefix), scores
+from 0.75 to 0.95 by the share of typed letters, and word (or its prefix), which
+differs by a few typos (insertions, deletions, substitutions and transpositions of
+letters), scores less for every typo. Scores of surname words are weighted by 1,
+of name words - by 0.9, of patronymic words - by 0.8, of passport - by 1 (passport
+is one word without separators, it is also matched with the whole query).
+Control object matches, if every word of query matches, and its relevance is
+the mean score of query words.
+*/
+
+const (
+	surnameField = iota
+	nameField
+	patronymicField
+	passportField
+	fieldsNum
+)
+
+var fieldsWeights = [fieldsNum]float64{1.0, 0.9, 0.8, 1.0}
+
+// entry is control object normalized for search.
+type entry struct {
+	id     string
+	fields [fieldsNum][]string
+}
+
+func createEntry(id, surname, name, patronymic, passport string) *entry {
+	e := &entry{id: id}
+	e.fields[surnameField] = Words(surname)
+	e.fields[nameField] = Words(name)
+	e.fields[patronymicField] = Words(patronymic)
+	if passport := strings.Join(Words(passport), ""); passport != "" {
+		e.fields[passportField] = []string{passport}
+	}
+	return e
+}
+
+// query is normalized search query.
+type query struct {
+	words    []string
+	compact  string
+	maxTypos int
+}
+
+func createQuery(s string, maxTypos int) *query {
+	words := Words(s)
+	return &query{
+		words:    words,
+		compact:  strings.Join(words, ""),
+		maxTypos: maxTypos,
+	}
+}
+
+// score returns relevance of e or 0, if it doesn't match.
+func (q *query) score(e *entry) float64 {
+	passportScore := 0.0
+	for _, w := range e.fields[passportField] {
+		passportScore = q.match(q.compact, w) * fieldsWeights[passportField]
+	}
+
+	sum := 0.0
+	for _, qw := range q.words {
+		best := 0.0
+		for field, words := range e.fields {
+			for _, w := range words {
+				if s := q.match(qw, w) * fieldsWeights[field]; s > best {
+					best = s
+				}
+			}
+		}
+		if best == 0.0 {
+			return passportScore
+		}
+		sum += best
+	}
+	if s := sum / float64(len(q.words)); s > passportScore {
+		return s
+	}
+	return passportScore
+}
+
+// match returns score of word w for query word qw.
+func (q *query) match(qw, w string) float64 {
+	if qw == w {
+		return 1.0
+	}
+	qrs, rs := []rune(qw), []rune(w)
+	if strings.HasPrefix(w, qw) {
+		return 0.75 + 0.2*float64(len(qrs))/float64(len(rs))
+	}
+	maxTypos := q.allowedTypos(len(qrs))
+	if maxTypos == 0 {
+		return 0.0
+	}
+	best := 0.0
+	if abs(len(qrs)-len(rs)) <= maxTypos {
+		if d := distance(qrs, rs); d <= maxTypos {
+			best = 0.7 - 0.15*float64(d)
+		}
+	}
+	if len(rs) > len(qrs) {
+		if d := distance(qrs, rs[:len(qrs)]); d <= maxTypos {
+			if s := 0.6 - 0.15*float64(d); s > best {
+				best = s
+			}
+		}
+	}
+	return best
+}
+
+// allowedTypos returns max number of typos in query word of n letters.
+func (q *query) allowedTypos(n int) int {
+	typos := 2
+	switch {
+	case n <= 2:
+		typos = 0
+	case n <= 5:
+		typos = 1
+	}
+	if typos > q.maxTypos {
+		return q.maxTypos
+	}
+	return typos
+}
+
+// distance returns Damerau-Levenshtein (optimal string alignment) distance.
+func distance(a, b []rune) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+			if (i > 1) && (j > 1) && (a[i-1] == b[j-2]) && (a[i-2] == b[j-1]) {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
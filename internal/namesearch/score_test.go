@@ -0,0 +1,32 @@
+package namesearch
+
+import "testing"
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"ivanov", "ivanov", 0},
+		{"ivanov", "ivamov", 1},
+		{"ivanov", "ivnaov", 1},
+		{"ivanov", "ivanova", 1},
+		{"ivanov", "ivnov", 1},
+		{"petrov", "pterov", 1},
+		{"kitten", "sitting", 3},
+		{"ca", "abc", 3},
+		{"иван", "иавн", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+"/"+tt.b, func(t *testing.T) {
+			if got := distance([]rune(tt.a), []rune(tt.b)); got != tt.want {
+				t.Errorf("distance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := distance([]rune(tt.b), []rune(tt.a)); got != tt.want {
+				t.Errorf("distance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package namesearch
+
+import (
+	"strings"
+	"unicode"
+)
+
+/*
+Names are compared in normalized form: they are lowercased, Cyrillic letters are
+transliterated to Latin, and spelling variants of different transliteration systems
+are folded (e.g. "kh" and "h", "ts" and "c", "y", "j" and "i", "x" and "ks", double
+letters), so "Юрий", "Yuriy", "Iurii" and "Jurij" are the same word. Every non-letter
+and non-digit character separates words.
+*/
+
+var cyrillic = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "",
+	'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	// Ukrainian and Belarusian.
+	'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u",
+}
+
+// variants are replaced by one spelling; longer ones go first.
+var variants = strings.NewReplacer(
+	"shch", "sch",
+	"kh", "h",
+	"ts", "c",
+	"tz", "c",
+	"ph", "f",
+	"ck", "k",
+	"x", "ks",
+	"w", "v",
+	"q", "k",
+	"y", "i",
+	"j", "i",
+)
+
+// Words returns normalized words of s.
+func Words(s string) []string {
+	var words []string
+	var b strings.Builder
+	flush := func() {
+		if b.Len() != 0 {
+			words = append(words, fold(b.String()))
+			b.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(s) {
+		if latin, ok := cyrillic[r]; ok {
+			b.WriteString(latin)
+		} else if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else {
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+// fold replaces spelling variants and collapses double letters.
+func fold(word string) string {
+	word = variants.Replace(word)
+	rs := make([]rune, 0, len(word))
+	for _, r := range word {
+		if (len(rs) == 0) || (rs[len(rs)-1] != r) || unicode.IsDigit(r) {
+			rs = append(rs, r)
+		}
+	}
+	return string(rs)
+}
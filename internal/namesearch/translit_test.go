@@ -0,0 +1,39 @@
+package namesearch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{" -, ", nil},
+		{"Юрий", []string{"iuri"}},
+		{"Yuriy", []string{"iuri"}},
+		{"Iurii", []string{"iuri"}},
+		{"Jurij", []string{"iuri"}},
+		{"Иванов-Петров  Иван", []string{"ivanov", "petrov", "ivan"}},
+		{"Хабаров", []string{"habarov"}},
+		{"Khabarov", []string{"habarov"}},
+		{"Щукин", []string{"schukin"}},
+		{"Цой", []string{"coi"}},
+		{"Tsoi", []string{"coi"}},
+		{"Alexander", []string{"aleksander"}},
+		{"Филиппов", []string{"filipov"}},
+		{"Philippov", []string{"filipov"}},
+		{"Ткаченко Євген", []string{"tkachenko", "ievgen"}},
+		{"AB 1100", []string{"ab", "1100"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got := Words(tt.s)
+			if (len(got) != len(tt.want)) || (strings.Join(got, " ") != strings.Join(tt.want, " ")) {
+				t.Errorf("Words(%q) = %q, want %q", tt.s, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"math"
 	"time"
 )
 
@@ -34,9 +35,35 @@ func (fb FaceBox) Left() uint64 {
 	return fb[3]
 }
 
-// FacialFeaturesVector is tuple of 128 floats in [-1.0, 1.0] diapason.
+// FacialFeaturesVector is tuple of floats in [-1.0, 1.0] diapason. Its dimension
+// depends on model (e.g. 128 or 512), and only vectors of the same model are comparable.
 type FacialFeaturesVector []float64
 
+// Cosine returns cosine of angle between ff0 and ff1.
+func (ff0 FacialFeaturesVector) Cosine(ff1 FacialFeaturesVector) float64 {
+	dot := 0.0
+	len0 := 0.0
+	len1 := 0.0
+	for i := 0; (i < len(ff0)) && (i < len(ff1)); i++ {
+		dot += ff0[i] * ff1[i]
+		len0 += ff0[i] * ff0[i]
+		len1 += ff1[i] * ff1[i]
+	}
+	return dot / (math.Sqrt(len0) * math.Sqrt(len1))
+}
+
+// CosineOnOrt returns cosine of angle between ff and (1, 1, ..., 1) ort,
+// multiplied by 10 and truncated to int8 (so-called "bucket" of ff).
+func (ff FacialFeaturesVector) CosineOnOrt() int8 {
+	ffSum := 0.0
+	ffLen := 0.0
+	for i := 0; i < len(ff); i++ {
+		ffSum += ff[i]
+		ffLen += ff[i] * ff[i]
+	}
+	return int8(ffSum / (math.Sqrt(ffLen) * math.Sqrt(float64(len(ff)))) * 10.0)
+}
+
 // FaceData is a pair of FaceBox and FacialFeaturesVector.
 type FaceData struct {
 	FaceBox              FaceBox              `json:"facebox"`
@@ -54,6 +81,20 @@ const (
 	UnableToSend = -4
 	// InternalServerError ...
 	InternalServerError = -5
+	// NotFoundCode ...
+	NotFoundCode = -6
+	// InvalidRequestParamsCode ...
+	InvalidRequestParamsCode = -7
+	// ConflictCode ...
+	ConflictCode = -8
+	// InvalidFaceBoxCode is returned for facebox with wrong arity, ordering or out of image bounds.
+	InvalidFaceBoxCode = -9
+	// InvalidFFVCode is returned for facial features vector with wrong dimension, not finite elements or norm.
+	InvalidFFVCode = -10
+	// InvalidImageCode is returned for image, which dimensions can't be decoded.
+	InvalidImageCode = -11
+	// InvalidAttributesCode is returned for control object attributes with invalid keys or too long values.
+	InvalidAttributesCode = -12
 )
 
 // ErrorData describes error.
@@ -84,9 +125,12 @@ type ProcessImageReq struct {
 }
 
 // PutFacesDataReq is sent from facerecognition microservices to DB server.
+// Model identifies embedding model, which produced facial features vectors;
+// it is empty for recognizers, which don't report it (default model).
 type PutFacesDataReq struct {
 	Header    Header     `json:"header"`
 	ErrorData *ErrorData `json:"error_data"`
+	Model     string     `json:"model"`
 	FacesData []FaceData `json:"faces_data"`
 }
 
@@ -108,6 +152,8 @@ type ControlObject struct {
 	ID   string `json:"id"`
 	DBTS *time.Time
 	TS   time.Time
+	// PassportHash is blind index of encrypted passport (empty, if it isn't encrypted).
+	PassportHash string `json:"-"`
 	// Business-Logic fields.
 	Passport   string `json:"passport"`
 	Surname    string `json:"surname"`
@@ -118,6 +164,8 @@ type ControlObject struct {
 	PhoneNum   string `json:"phone_num"`
 	Email      string `json:"email"`
 	Address    string `json:"address"`
+	// Attributes are deployment-specific fields (employee number, department, etc.).
+	Attributes map[string]string `json:"attributes,omitempty"`
 }
 
 // CreateDefaultControlObject creates ControlObject with
@@ -160,13 +208,41 @@ func (cob0 *ControlObject) Compare(cob1 *ControlObject) bool {
 		(cob0.Sex == cob1.Sex) &&
 		(cob0.PhoneNum == cob1.PhoneNum) &&
 		(cob0.Email == cob1.Email) &&
-		(cob0.Address == cob1.Address)
+		(cob0.Address == cob1.Address) &&
+		cob0.CompareAttributes(cob1)
+}
+
+// CompareAttributes returns true if ControlObjects Attributes are same.
+func (cob0 *ControlObject) CompareAttributes(cob1 *ControlObject) bool {
+	if len(cob0.Attributes) != len(cob1.Attributes) {
+		return false
+	}
+	for k, v := range cob0.Attributes {
+		if v1, ok := cob1.Attributes[k]; !ok || (v1 != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Candidate is a ControlObject, found by facial features vector,
+// with cosine similarity between them. Matched is true, if similarity
+// is not less than cosine boundary, otherwise candidate is a near miss.
+type Candidate struct {
+	ControlObject ControlObject `json:"control_object"`
+	Similarity    float64       `json:"similarity"`
+	Matched       bool          `json:"matched"`
 }
 
 // ImageControlObject is a pair of ControlObject and FaceData.
+// Similarity is a similarity of ControlObject (the first matched candidate),
+// and Candidates are all found ControlObjects, matched or not, ordered by
+// similarity descending.
 type ImageControlObject struct {
 	ControlObject ControlObject `json:"control_object"`
 	FaceBox       FaceBox       `json:"facebox"`
+	Similarity    float64       `json:"similarity"`
+	Candidates    []Candidate   `json:"candidates"`
 }
 
 // NotifyControlReq is sent from DB server to GUI client.
@@ -217,3 +293,377 @@ type AddControlObjectResp struct {
 	Header    Header     `json:"header"`
 	ErrorData *ErrorData `json:"error_data"`
 }
+
+// ControlObjectResp is sent from DB server to GUI client
+// on control object get, update and delete requests.
+type ControlObjectResp struct {
+	Header        Header         `json:"header"`
+	ErrorData     *ErrorData     `json:"error_data"`
+	ControlObject *ControlObject `json:"control_object"`
+}
+
+// ControlObjectsResp is sent from DB server to GUI client on
+// control objects list requests. NextOffset is nil on the last page.
+type ControlObjectsResp struct {
+	Header         Header          `json:"header"`
+	ErrorData      *ErrorData      `json:"error_data"`
+	ControlObjects []ControlObject `json:"control_objects"`
+	NextOffset     *uint64         `json:"next_offset"`
+}
+
+// ControlObjectMatch is control object, found by search, with its relevance in (0, 1].
+type ControlObjectMatch struct {
+	ControlObject ControlObject `json:"control_object"`
+	Score         float64       `json:"score"`
+}
+
+// SearchControlObjectsResp is sent from DB server to GUI client on
+// control objects search requests. Matches are ordered by score descending.
+type SearchControlObjectsResp struct {
+	Header    Header               `json:"header"`
+	ErrorData *ErrorData           `json:"error_data"`
+	Matches   []ControlObjectMatch `json:"matches"`
+}
+
+// UpdateControlObjectReq is sent from GUI client to DB server.
+// Empty business fields of ControlObject are left unchanged; specified
+// attributes are set, and attributes with empty values are removed.
+type UpdateControlObjectReq struct {
+	Header        Header        `json:"header"`
+	ControlObject ControlObject `json:"control_object"`
+}
+
+// Erasure is a tombstone of control object, erased with all its data.
+// It contains numbers of erased facial features vectors, images, from which
+// control object was removed, images, which were deleted completely, sightings,
+// clusters, promoted to control object, and audit records, which salts were cleared.
+type Erasure struct {
+	ID              string    `json:"id"`
+	TS              time.Time `json:"ts"`
+	CobID           string    `json:"cob_id"`
+	Reason          string    `json:"reason"`
+	RequestedBy     string    `json:"requested_by"`
+	FFVsNum         uint64    `json:"ffvs_num"`
+	ImgsNum         uint64    `json:"imgs_num"`
+	DeletedImgsNum  uint64    `json:"deleted_imgs_num"`
+	SightingsNum    uint64    `json:"sightings_num"`
+	ClustersNum     uint64    `json:"clusters_num"`
+	AuditRecordsNum uint64    `json:"audit_records_num"`
+}
+
+// EraseControlObjectReq is sent from GUI client to DB server.
+type EraseControlObjectReq struct {
+	Header      Header `json:"header"`
+	ID          string `json:"id"`
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requested_by"`
+}
+
+// ErasuresResp is sent from DB server to GUI client on erasure
+// and erasures list requests. NextOffset is nil on the last page.
+type ErasuresResp struct {
+	Header     Header     `json:"header"`
+	ErrorData  *ErrorData `json:"error_data"`
+	Erasures   []Erasure  `json:"erasures"`
+	NextOffset *uint64    `json:"next_offset"`
+}
+
+// Merge is a record of duplicate control object, merged into survivor: all facial
+// features vectors, images and sightings of duplicate were moved to survivor,
+// and duplicate was deleted.
+type Merge struct {
+	ID           string    `json:"id"`
+	TS           time.Time `json:"ts"`
+	SurvivorID   string    `json:"survivor_id"`
+	DuplicateID  string    `json:"duplicate_id"`
+	RequestedBy  string    `json:"requested_by"`
+	FFVsNum      uint64    `json:"ffvs_num"`
+	ImgsNum      uint64    `json:"imgs_num"`
+	SightingsNum uint64    `json:"sightings_num"`
+}
+
+// MergeControlObjectsReq is sent from GUI client to DB server.
+type MergeControlObjectsReq struct {
+	Header      Header `json:"header"`
+	SurvivorID  string `json:"survivor_id"`
+	DuplicateID string `json:"duplicate_id"`
+	RequestedBy string `json:"requested_by"`
+}
+
+// MergesResp is sent from DB server to GUI client on merge
+// and merges list requests. NextOffset is nil on the last page.
+type MergesResp struct {
+	Header     Header     `json:"header"`
+	ErrorData  *ErrorData `json:"error_data"`
+	Merges     []Merge    `json:"merges"`
+	NextOffset *uint64    `json:"next_offset"`
+}
+
+// Duplicate is a pair of control objects, which centroids of facial features
+// vectors of model are near-identical, so they are probably the same person.
+type Duplicate struct {
+	First      ControlObject `json:"first"`
+	Second     ControlObject `json:"second"`
+	Model      string        `json:"model"`
+	Similarity float64       `json:"similarity"`
+}
+
+// DuplicatesResp is sent from DB server to GUI client on duplicates requests.
+type DuplicatesResp struct {
+	Header     Header      `json:"header"`
+	ErrorData  *ErrorData  `json:"error_data"`
+	Duplicates []Duplicate `json:"duplicates"`
+}
+
+// Sighting is a face, found on processed image, with best matched control object
+// (CobID is empty, if face wasn't matched). ImgURL is a link to the image
+// (empty, if image wasn't stored).
+type Sighting struct {
+	ID      string    `json:"id"`
+	TS      time.Time `json:"ts"`
+	SrcAddr string    `json:"src_addr"`
+	ImgID   string    `json:"img_id"`
+	ImgURL  string    `json:"img_url"`
+	FaceBox FaceBox   `json:"facebox"`
+	CobID   string    `json:"cob_id"`
+	Score   float64   `json:"score"`
+}
+
+// SightingsResp is sent from DB server to GUI client on sightings
+// list requests. NextCursor is nil on the last page.
+type SightingsResp struct {
+	Header     Header     `json:"header"`
+	ErrorData  *ErrorData `json:"error_data"`
+	Sightings  []Sighting `json:"sightings"`
+	NextCursor *string    `json:"next_cursor"`
+}
+
+// Purge is a report of retention policies enforcement: numbers of deleted images
+// of sightings (and of those, which couldn't be deleted from images store) and of
+// deleted unmatched faces, matched faces from sources with own retention and other
+// sightings.
+type Purge struct {
+	ID                string    `json:"id"`
+	TS                time.Time `json:"ts"`
+	ImgsNum           uint64    `json:"imgs_num"`
+	FailedImgsNum     uint64    `json:"failed_imgs_num"`
+	UnmatchedFacesNum uint64    `json:"unmatched_faces_num"`
+	SourcesFacesNum   uint64    `json:"sources_faces_num"`
+	SightingsNum      uint64    `json:"sightings_num"`
+	CobImgsNum        uint64    `json:"cob_imgs_num"`
+	FFVsNum           uint64    `json:"ffvs_num"`
+}
+
+// PurgesResp is sent from DB server to GUI client on purges list
+// requests. NextOffset is nil on the last page.
+type PurgesResp struct {
+	Header     Header     `json:"header"`
+	ErrorData  *ErrorData `json:"error_data"`
+	Purges     []Purge    `json:"purges"`
+	NextOffset *uint64    `json:"next_offset"`
+}
+
+// Audit decisions about faceboxes.
+const (
+	// AuditConfirmed is decision, where operator sent suggested control object unchanged.
+	AuditConfirmed = "confirmed"
+	// AuditCorrected is decision, where operator changed fields of suggested control object.
+	AuditCorrected = "corrected"
+	// AuditAdded is decision about facebox, marked by operator.
+	AuditAdded = "added"
+	// AuditRejected is decision about suggested facebox, which operator didn't send.
+	AuditRejected = "rejected"
+)
+
+// AuditEntry is operator decision about one facebox. SuggestedID is ID of control
+// object, suggested by DB server (empty for added facebox), CobID is ID of control
+// object, sent by operator (empty for rejected facebox; on submit it is ID of stored
+// control object). Changed are names of fields, changed by operator, and Digest is
+// HMAC-SHA256 of their new values, keyed by Salt of record, so entry doesn't keep
+// personal data.
+type AuditEntry struct {
+	FaceBox     FaceBox  `json:"facebox"`
+	Decision    string   `json:"decision"`
+	SuggestedID string   `json:"suggested_id"`
+	CobID       string   `json:"cob_id"`
+	Changed     []string `json:"changed"`
+	Digest      string   `json:"digest"`
+}
+
+// AuditRecord is a record of operator decision on image with ImgUUID, sent
+// from control panel SrcAddr. Records are hash-chained: Hash is computed
+// from PrevHash (hash of record with previous Seq of the same Chain) and all
+// other fields except Salt, which is cleared, when control object of record
+// is erased.
+type AuditRecord struct {
+	Chain    string       `json:"chain"`
+	Seq      uint64       `json:"seq"`
+	ID       string       `json:"id"`
+	TS       time.Time    `json:"ts"`
+	SrcAddr  string       `json:"src_addr"`
+	Command  string       `json:"command"`
+	ImgUUID  string       `json:"img_uuid"`
+	Entries  []AuditEntry `json:"entries"`
+	Salt     string       `json:"salt"`
+	PrevHash string       `json:"prev_hash"`
+	Hash     string       `json:"hash"`
+}
+
+// AuditResp is sent from DB server to GUI client on audit log
+// requests. NextOffset is nil on the last page.
+type AuditResp struct {
+	Header     Header        `json:"header"`
+	ErrorData  *ErrorData    `json:"error_data"`
+	Records    []AuditRecord `json:"records"`
+	NextOffset *uint64       `json:"next_offset"`
+}
+
+// AuditVerification is a result of audit log hash chains verification. If chain
+// is broken, BrokenChain and BrokenSeq are Chain and Seq of the first invalid record
+// and Reason describes it. LastHashes are hashes of the last valid records of chains,
+// which may be saved elsewhere to detect later removal of records from their ends.
+type AuditVerification struct {
+	ChainsNum   uint64            `json:"chains_num"`
+	RecordsNum  uint64            `json:"records_num"`
+	Valid       bool              `json:"valid"`
+	BrokenChain string            `json:"broken_chain"`
+	BrokenSeq   *uint64           `json:"broken_seq"`
+	Reason      string            `json:"reason"`
+	LastHashes  map[string]string `json:"last_hashes"`
+}
+
+// AuditVerificationResp is sent from DB server to GUI client on audit log verification requests.
+type AuditVerificationResp struct {
+	Header       Header             `json:"header"`
+	ErrorData    *ErrorData         `json:"error_data"`
+	Verification *AuditVerification `json:"verification"`
+}
+
+// Cluster is an anonymous identity: a group of similar faces, which weren't matched
+// with any control object. Representatives are its most central faces, Faces are
+// all its faces (only in single cluster response). CobID is set, if cluster was
+// promoted to control object.
+type Cluster struct {
+	ID              string     `json:"id"`
+	TS              time.Time  `json:"ts"`
+	Model           string     `json:"model"`
+	Size            int        `json:"size"`
+	CobID           string     `json:"cob_id"`
+	Representatives []Sighting `json:"representatives"`
+	Faces           []Sighting `json:"faces,omitempty"`
+}
+
+// ClustersResp is sent from DB server to GUI client on clusters
+// requests. NextOffset is nil on the last page.
+type ClustersResp struct {
+	Header     Header     `json:"header"`
+	ErrorData  *ErrorData `json:"error_data"`
+	Clusters   []Cluster  `json:"clusters"`
+	NextOffset *uint64    `json:"next_offset"`
+}
+
+// PromoteClusterReq is sent from GUI client to DB server to create control
+// object from cluster with all its faces.
+type PromoteClusterReq struct {
+	Header        Header        `json:"header"`
+	ControlObject ControlObject `json:"control_object"`
+}
+
+// AlertPolicy defines, how alerts of watchlist are raised: they are posted to
+// all webhooks, and repeated alerts about the same control object from the same
+// source are suppressed for CooldownS seconds.
+type AlertPolicy struct {
+	Webhooks  []string `json:"webhooks"`
+	CooldownS uint64   `json:"cooldown_s"`
+}
+
+// Watchlist is a named group of control objects. Match of its control object
+// with similarity, not less than Threshold, raises alert.
+type Watchlist struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Threshold   float64     `json:"threshold"`
+	AlertPolicy AlertPolicy `json:"alert_policy"`
+	CobIDs      []string    `json:"cob_ids"`
+}
+
+// WatchlistResp is sent from DB server to GUI client on watchlist requests.
+type WatchlistResp struct {
+	Header    Header     `json:"header"`
+	ErrorData *ErrorData `json:"error_data"`
+	Watchlist *Watchlist `json:"watchlist"`
+}
+
+// WatchlistsResp is sent from DB server to GUI client on watchlists list requests.
+type WatchlistsResp struct {
+	Header     Header      `json:"header"`
+	ErrorData  *ErrorData  `json:"error_data"`
+	Watchlists []Watchlist `json:"watchlists"`
+}
+
+// PutWatchlistReq is sent from GUI client to DB server to create or update watchlist.
+type PutWatchlistReq struct {
+	Header    Header    `json:"header"`
+	Watchlist Watchlist `json:"watchlist"`
+}
+
+// UpdateWatchlistMembersReq is sent from GUI client to DB server
+// to add control objects to watchlist and remove them from it.
+type UpdateWatchlistMembersReq struct {
+	Header Header   `json:"header"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// Alert is raised, when control object of watchlist is matched on processed image.
+// ControlObject and ImgBuff (base64-encoded image) are sent only to webhooks.
+type Alert struct {
+	ID            string         `json:"id"`
+	TS            time.Time      `json:"ts"`
+	WatchlistID   string         `json:"watchlist_id"`
+	WatchlistName string         `json:"watchlist_name"`
+	CobID         string         `json:"cob_id"`
+	ControlObject *ControlObject `json:"control_object,omitempty"`
+	Score         float64        `json:"score"`
+	SrcAddr       string         `json:"src_addr"`
+	SightingID    string         `json:"sighting_id"`
+	ImgID         string         `json:"img_id"`
+	ImgURL        string         `json:"img_url"`
+	ImgBuff       string         `json:"img_buff,omitempty"`
+	FaceBox       FaceBox        `json:"facebox"`
+}
+
+// NotifyAlertReq is sent from DB server to alert policy webhooks.
+type NotifyAlertReq struct {
+	Header Header `json:"header"`
+	Alert  Alert  `json:"alert"`
+}
+
+// AlertsResp is sent from DB server to GUI client on alerts
+// list requests. NextCursor is nil on the last page.
+type AlertsResp struct {
+	Header     Header     `json:"header"`
+	ErrorData  *ErrorData `json:"error_data"`
+	Alerts     []Alert    `json:"alerts"`
+	NextCursor *string    `json:"next_cursor"`
+}
+
+// Outlier is facial features vector of control object, which is not similar
+// to its other vectors and is excluded from its centroid until review.
+type Outlier struct {
+	FFVID   string  `json:"ffv_id"`
+	CobID   string  `json:"cob_id"`
+	Model   string  `json:"model"`
+	ImgID   string  `json:"img_id"`
+	FaceBox FaceBox `json:"facebox"`
+	Score   float64 `json:"score"`
+}
+
+// OutliersResp is sent from DB server to GUI client on outliers list
+// and review requests. NextOffset is nil on the last page.
+type OutliersResp struct {
+	Header     Header     `json:"header"`
+	ErrorData  *ErrorData `json:"error_data"`
+	Outliers   []Outlier  `json:"outliers"`
+	NextOffset *uint64    `json:"next_offset"`
+}
@@ -0,0 +1,232 @@
+package retention
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Retention policies expire data of sightings and images of control objects, while
+control objects themselves are kept. Every rule is a number of days, after which
+data class is deleted: matched faces from specific sources, unmatched faces, all
+sightings, images of sightings and images of control objects. Rules are enforced
+by explicit deletes (not by ClickHouse DB TTL), so they may be changed without
+migrations and images store is cleaned at the same time: images, on which only
+deleted sightings were found, are deleted with them, and expired images are deleted
+from store and removed from sightings and alerts. Expired images of control objects
+are deleted from store with their records and facial features vectors, found on
+them, and then centroids of their control objects are rebuilt, so control objects
+without other images are no longer recognized. Every enforcement is reported by
+purge record.
+Enforcement is idempotent, but it should be scheduled on one server only, otherwise
+every server writes its own purge records.
+*/
+
+const (
+	defaultBatchSize = 10000
+	day              = 24 * time.Hour
+)
+
+// Enforcer deletes expired data.
+type Enforcer struct {
+	cfg      cfgparser.RetentionCFG
+	fs       storages.FaceStorage
+	imgStore imgstores.ImgStore
+	im       *identities.Model
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	logger   *log.Logger
+}
+
+// CreateEnforcer creates Enforcer and runs periodical enforcement, if interval is set.
+func CreateEnforcer(cfg *cfgparser.RetentionCFG, fs storages.FaceStorage,
+	imgStore imgstores.ImgStore, im *identities.Model, logger *log.Logger) (*Enforcer, error) {
+	if (cfg.SightingsImagesDays < 0) || (cfg.ControlObjectsImagesDays < 0) ||
+		(cfg.UnmatchedFacesDays < 0) || (cfg.SightingsDays < 0) {
+		return nil, fmt.Errorf("retention days can't be negative")
+	}
+	for _, src := range cfg.Sources {
+		if src.Days < 0 {
+			return nil, fmt.Errorf("retention days of source \"%s\" can't be negative", src.SrcAddr)
+		}
+	}
+	e := &Enforcer{
+		cfg:      *cfg,
+		fs:       fs,
+		imgStore: imgStore,
+		im:       im,
+		stop:     make(chan struct{}),
+		logger:   logger,
+	}
+	if e.cfg.BatchSize == 0 {
+		e.cfg.BatchSize = defaultBatchSize
+	}
+	if e.cfg.IntervalMS > 0 {
+		e.runScheduler(time.Duration(e.cfg.IntervalMS) * time.Millisecond)
+	}
+	return e, nil
+}
+
+// Close stops periodical enforcement.
+func (e *Enforcer) Close() {
+	close(e.stop)
+	e.wg.Wait()
+}
+
+func (e *Enforcer) runScheduler(interval time.Duration) {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				if _, err := e.Enforce(); err != nil {
+					e.logger.Error(errors.Wrap(err, "unable to enforce retention policies"))
+				}
+			}
+		}
+	}()
+}
+
+// Enforce deletes all expired data and returns purge record.
+func (e *Enforcer) Enforce() (*proto.Purge, error) {
+	now := time.Now()
+	purge := &proto.Purge{
+		ID: uuid.Must(uuid.NewV4()).String(),
+		TS: now,
+	}
+
+	for _, src := range e.cfg.Sources {
+		if (src.Days == 0) || (src.SrcAddr == "") {
+			continue
+		}
+		n, err := e.deleteSightings(purge, &storages.SightingsExpiry{
+			Before:  now.Add(-time.Duration(src.Days) * day),
+			SrcAddr: src.SrcAddr,
+		})
+		if err != nil {
+			return nil, err
+		}
+		purge.SourcesFacesNum += n
+	}
+	if e.cfg.UnmatchedFacesDays != 0 {
+		n, err := e.deleteSightings(purge, &storages.SightingsExpiry{
+			Before:    now.Add(-time.Duration(e.cfg.UnmatchedFacesDays) * day),
+			Unmatched: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		purge.UnmatchedFacesNum = n
+	}
+	if e.cfg.SightingsDays != 0 {
+		n, err := e.deleteSightings(purge, &storages.SightingsExpiry{
+			Before: now.Add(-time.Duration(e.cfg.SightingsDays) * day),
+		})
+		if err != nil {
+			return nil, err
+		}
+		purge.SightingsNum = n
+	}
+	if e.cfg.SightingsImagesDays != 0 {
+		imgs, err := e.fs.SelectExpiredSightingsImgs(
+			now.Add(-time.Duration(e.cfg.SightingsImagesDays)*day), e.cfg.BatchSize)
+		if err != nil {
+			return nil, err
+		}
+		// Images, which weren't deleted from store, remain in sightings and are deleted next time.
+		if err := e.fs.ClearSightingsImgs(e.deleteImgs(purge, imgs)); err != nil {
+			return nil, err
+		}
+	}
+	if e.cfg.ControlObjectsImagesDays != 0 {
+		if err := e.deleteControlObjectsImgs(purge,
+			now.Add(-time.Duration(e.cfg.ControlObjectsImagesDays)*day)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.fs.InsertPurge(purge); err != nil {
+		return nil, err
+	}
+	e.logger.Infof("enforced retention policies (%d deleted images, %d failed images, %d images of control objects, "+
+		"%d facial features vectors, %d unmatched faces, %d faces from sources, %d sightings)",
+		purge.ImgsNum, purge.FailedImgsNum, purge.CobImgsNum,
+		purge.FFVsNum, purge.UnmatchedFacesNum, purge.SourcesFacesNum, purge.SightingsNum)
+	return purge, nil
+}
+
+func (e *Enforcer) deleteSightings(purge *proto.Purge, expiry *storages.SightingsExpiry) (uint64, error) {
+	n, imgs, err := e.fs.DeleteSightings(expiry)
+	if err != nil {
+		return 0, err
+	}
+	e.deleteImgs(purge, imgs)
+	return n, nil
+}
+
+// deleteControlObjectsImgs deletes expired images of control objects from store, and then
+// their facial features vectors and records. Images, which weren't deleted from store,
+// are kept with their vectors and are deleted next time.
+func (e *Enforcer) deleteControlObjectsImgs(purge *proto.Purge, before time.Time) error {
+	imgs, err := e.fs.SelectExpiredImgs(before, e.cfg.BatchSize)
+	if err != nil {
+		return err
+	}
+	storedImgs := make([]storages.Img, 0, len(imgs))
+	ids := make([]string, 0, len(imgs))
+	for _, img := range imgs {
+		if img.Path == "" {
+			ids = append(ids, img.ID)
+		} else {
+			storedImgs = append(storedImgs, img)
+		}
+	}
+	ids = append(ids, e.deleteImgs(purge, storedImgs)...)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ffvs, err := e.fs.SelectFFVsByImgs(ids)
+	if err != nil {
+		return err
+	}
+	if err := storages.RemoveFFVs(e.fs, e.im, ffvs); err != nil {
+		return err
+	}
+	if err := e.fs.DeleteImgs(ids); err != nil {
+		return err
+	}
+	purge.CobImgsNum += uint64(len(ids))
+	purge.FFVsNum += uint64(len(ffvs))
+	return nil
+}
+
+// deleteImgs deletes images from store and returns IDs of deleted ones.
+func (e *Enforcer) deleteImgs(purge *proto.Purge, imgs []storages.Img) []string {
+	ids := make([]string, 0, len(imgs))
+	for _, img := range imgs {
+		if err := e.imgStore.Delete(img.Path); err != nil {
+			e.logger.Warnf("unable to delete expired image \"%s\": %s", img.Path, err)
+			purge.FailedImgsNum++
+			continue
+		}
+		purge.ImgsNum++
+		ids = append(ids, img.ID)
+	}
+	return ids
+}
@@ -25,6 +25,7 @@ type AwaitingControlObject struct {
 	Mu                sync.Mutex
 	Images            map[string]proto.ImagePart
 	FacesData         map[string]proto.FaceData
+	Models            map[string]string // embedding models of FacesData.
 }
 
 // CreateAwaitingControlObject ...
@@ -164,6 +165,7 @@ type AwaitingControl struct {
 	UUID                  string
 	ImgBuff               string
 	ImageControlObjects   []proto.ImageControlObject
+	Model                 string // embedding model of FacialFeaturesVectors.
 	FacialFeaturesVectors []proto.FacialFeaturesVector
 }
 
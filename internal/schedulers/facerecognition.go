@@ -21,6 +21,7 @@ type AwaitingImage struct {
 	SrcAddr               string
 	UUID                  string
 	ImgBuff               string
+	Model                 string // embedding model of FacialFeaturesVectors.
 	FaceBoxes             []proto.FaceBox
 	FacialFeaturesVectors []proto.FacialFeaturesVector
 }
@@ -105,6 +106,14 @@ func (q *AwaitingImagesQueue) Pop(k string) *AwaitingImage {
 	return v
 }
 
+// Get returns element without removing it from queue.
+func (q *AwaitingImagesQueue) Get(k string) *AwaitingImage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.queue[k]
+}
+
 // FaceRecognitionScheduler handles all image processing tasks.
 type FaceRecognitionScheduler struct {
 	srcAddr         string
@@ -0,0 +1,312 @@
+package storages
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+batchWriter groups rows, inserted to one ClickHouse DB table by many callers, into
+large blocks, because every INSERT creates new MergeTree part, and many small parts
+slow down both inserts and merges. Block is flushed, when it has max rows or when
+flush interval has elapsed, and larger writes are split into blocks of max rows.
+Callers wait until their rows are flushed, so they get insert error, if any. Number
+of buffered rows is bounded: when it is reached, callers wait until previous blocks
+are flushed (backpressure). On close all rows are flushed.
+
+Rows may be written with keys (IDs) by writeNew, which skips rows with keys, which
+already exist in table or are buffered or being flushed. Keys are reserved before
+table is queried and are kept until their block is inserted, so row is always seen
+either in table or in reserved keys, and concurrent or replayed inserts don't duplicate
+it. Table is queried outside of lock, and reserved keys, which are found in it, are
+released.
+*/
+
+const (
+	defaultBatchMaxRows         = 10000
+	defaultBatchMaxPendingRows  = 100000
+	defaultBatchFlushIntervalMS = 200
+)
+
+// batch is a block of rows, which are flushed together.
+type batch struct {
+	rows [][]interface{}
+	keys []string
+	done chan struct{}
+	err  error
+}
+
+func createBatch(maxRows int) *batch {
+	return &batch{
+		rows: make([][]interface{}, 0, maxRows),
+		done: make(chan struct{}),
+	}
+}
+
+type batchWriter struct {
+	table          string
+	query          string
+	db             *sql.DB
+	maxRows        int
+	maxPendingRows int
+	mu             sync.Mutex
+	notFull        *sync.Cond
+	cur            *batch
+	full           []*batch // batches with max rows, which weren't flushed yet.
+	pendingRows    int
+	closed         bool
+	keysMu         sync.Mutex
+	keys           map[string]struct{}
+	kick           chan struct{}
+	stop           chan struct{}
+	wg             sync.WaitGroup
+	logger         *log.Logger
+}
+
+func createBatchWriter(db *sql.DB, table, query string, cfg *cfgparser.BatchCFG, logger *log.Logger) *batchWriter {
+	maxRows := cfg.MaxRows
+	if maxRows < 1 {
+		maxRows = defaultBatchMaxRows
+	}
+	maxPendingRows := cfg.MaxPendingRows
+	if maxPendingRows < maxRows {
+		maxPendingRows = defaultBatchMaxPendingRows
+		if maxPendingRows < maxRows {
+			maxPendingRows = maxRows
+		}
+	}
+	flushIntervalMS := cfg.FlushIntervalMS
+	if flushIntervalMS < 1 {
+		flushIntervalMS = defaultBatchFlushIntervalMS
+	}
+
+	w := &batchWriter{
+		table:          table,
+		query:          query,
+		db:             db,
+		maxRows:        maxRows,
+		maxPendingRows: maxPendingRows,
+		mu:             sync.Mutex{},
+		cur:            createBatch(maxRows),
+		keysMu:         sync.Mutex{},
+		keys:           make(map[string]struct{}),
+		kick:           make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		logger:         logger,
+	}
+	w.notFull = sync.NewCond(&(w.mu))
+	w.run(time.Duration(flushIntervalMS) * time.Millisecond)
+	return w
+}
+
+// write buffers rows and waits until they are flushed.
+func (w *batchWriter) write(rows [][]interface{}) error {
+	return w.writeKeys(nil, rows)
+}
+
+// writeNew buffers rows, which keys are neither returned by selectExisting nor buffered,
+// and waits until they are flushed. It returns indexes of written rows.
+func (w *batchWriter) writeNew(keys []string, rows [][]interface{},
+	selectExisting func(keys []string) (map[string]struct{}, error)) ([]int, error) {
+	if len(rows) == 0 {
+		return []int{}, nil
+	}
+
+	// Keys, which are buffered by other writes, are skipped at once.
+	w.keysMu.Lock()
+	reserved := make([]int, 0, len(rows))
+	reservedKeys := make([]string, 0, len(rows))
+	for i, key := range keys {
+		if _, ok := w.keys[key]; ok {
+			continue
+		}
+		w.keys[key] = struct{}{}
+		reserved = append(reserved, i)
+		reservedKeys = append(reservedKeys, key)
+	}
+	w.keysMu.Unlock()
+	if len(reserved) == 0 {
+		return []int{}, nil
+	}
+
+	existingKeys, err := selectExisting(reservedKeys)
+	if err != nil {
+		w.releaseKeys(reservedKeys)
+		return nil, err
+	}
+	written := make([]int, 0, len(reserved))
+	newKeys := make([]string, 0, len(reserved))
+	newRows := make([][]interface{}, 0, len(reserved))
+	oldKeys := make([]string, 0, len(existingKeys))
+	for _, i := range reserved {
+		if _, ok := existingKeys[keys[i]]; ok {
+			oldKeys = append(oldKeys, keys[i])
+			continue
+		}
+		written = append(written, i)
+		newKeys = append(newKeys, keys[i])
+		newRows = append(newRows, rows[i])
+	}
+	w.releaseKeys(oldKeys)
+
+	if len(newRows) == 0 {
+		return written, nil
+	}
+	return written, w.writeKeys(newKeys, newRows)
+}
+
+// releaseKeys forgets keys of flushed (or rejected) rows.
+func (w *batchWriter) releaseKeys(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	w.keysMu.Lock()
+	for _, key := range keys {
+		delete(w.keys, key)
+	}
+	w.keysMu.Unlock()
+}
+
+// writeKeys buffers rows with their keys (if any) and waits until they are flushed.
+func (w *batchWriter) writeKeys(keys []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	for !w.closed && (w.pendingRows != 0) && (w.pendingRows+len(rows) > w.maxPendingRows) {
+		w.notFull.Wait()
+	}
+	if w.closed {
+		w.mu.Unlock()
+		w.releaseKeys(keys)
+		return errors.Errorf("unable to insert into \"%s\": storage is closed", w.table)
+	}
+	batches := make([]*batch, 0, 1)
+	for len(rows) != 0 {
+		b := w.cur
+		n := w.maxRows - len(b.rows)
+		if n > len(rows) {
+			n = len(rows)
+		}
+		b.rows = append(b.rows, rows[:n]...)
+		rows = rows[n:]
+		if len(keys) != 0 {
+			b.keys = append(b.keys, keys[:n]...)
+			keys = keys[n:]
+		}
+		w.pendingRows += n
+		batches = append(batches, b)
+		if len(b.rows) >= w.maxRows {
+			w.full = append(w.full, b)
+			w.cur = createBatch(w.maxRows)
+			select {
+			case w.kick <- struct{}{}:
+			default:
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	var err error
+	for _, b := range batches {
+		<-b.done
+		if (err == nil) && (b.err != nil) {
+			err = b.err
+		}
+	}
+	return err
+}
+
+func (w *batchWriter) run(interval time.Duration) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				w.flush()
+				return
+			case <-ticker.C:
+				w.flush()
+			case <-w.kick:
+				w.flush()
+			}
+		}
+	}()
+}
+
+// flush inserts full batches and current one, if it is not empty. It is called only
+// by writer goroutine.
+func (w *batchWriter) flush() {
+	w.mu.Lock()
+	batches := w.full
+	w.full = nil
+	if len(w.cur.rows) != 0 {
+		batches = append(batches, w.cur)
+		w.cur = createBatch(w.maxRows)
+	}
+	w.mu.Unlock()
+
+	for _, b := range batches {
+		w.flushBatch(b)
+	}
+}
+
+func (w *batchWriter) flushBatch(b *batch) {
+	b.err = w.insert(b.rows)
+	if b.err != nil {
+		w.logger.Warnf("unable to flush %d rows to \"%s\": %s", len(b.rows), w.table, b.err)
+	}
+	w.releaseKeys(b.keys)
+	close(b.done)
+
+	w.mu.Lock()
+	w.pendingRows -= len(b.rows)
+	w.notFull.Broadcast()
+	w.mu.Unlock()
+}
+
+func (w *batchWriter) insert(rows [][]interface{}) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin bulk insert")
+	}
+	stmt, err := tx.Prepare(w.query)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to prepare SQL-statement")
+	}
+	defer stmt.Close()
+
+	for i, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "unable to execute %d-th part of bulk insert", i+1)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "unable to commit bulk insert")
+	}
+
+	return nil
+}
+
+// close rejects new rows and flushes all buffered ones.
+func (w *batchWriter) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.notFull.Broadcast()
+	w.mu.Unlock()
+
+	close(w.stop)
+	w.wg.Wait()
+}
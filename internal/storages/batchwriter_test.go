@@ -0,0 +1,160 @@
+package storages
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordingDriver records sizes of committed bulk inserts.
+type recordingDriver struct {
+	mu      sync.Mutex
+	inserts []int
+}
+
+type recordingConn struct {
+	d    *recordingDriver
+	rows int
+}
+
+type recordingStmt struct {
+	c *recordingConn
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d: d}, nil
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c: c}, nil
+}
+
+func (c *recordingConn) Close() error { return nil }
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	c.rows = 0
+	return c, nil
+}
+
+func (c *recordingConn) Commit() error {
+	c.d.mu.Lock()
+	c.d.inserts = append(c.d.inserts, c.rows)
+	c.d.mu.Unlock()
+	return nil
+}
+
+func (c *recordingConn) Rollback() error { return errors.New("unexpected rollback") }
+
+func (s *recordingStmt) Close() error { return nil }
+
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.rows++
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("unexpected query")
+}
+
+var (
+	recordingDriverOnce sync.Once
+	testRecordingDriver = &recordingDriver{}
+)
+
+func createTestBatchWriter(t *testing.T, maxRows int) (*batchWriter, *recordingDriver) {
+	recordingDriverOnce.Do(func() {
+		sql.Register("recording", testRecordingDriver)
+	})
+	testRecordingDriver.mu.Lock()
+	testRecordingDriver.inserts = nil
+	testRecordingDriver.mu.Unlock()
+	db, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	return createBatchWriter(db, "test", "INSERT", &cfgparser.BatchCFG{
+		MaxRows:         maxRows,
+		FlushIntervalMS: 10,
+	}, logger), testRecordingDriver
+}
+
+func createTestRows(n int) [][]interface{} {
+	rows := make([][]interface{}, n)
+	for i := range rows {
+		rows[i] = []interface{}{i}
+	}
+	return rows
+}
+
+func TestBatchWriterSplitsWrites(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxRows     int
+		rowsNum     int
+		wantInserts []int
+	}{
+		{"one block", 10, 10, []int{10}},
+		{"two blocks", 10, 20, []int{10, 10}},
+		{"tail", 10, 25, []int{10, 10, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, d := createTestBatchWriter(t, tt.maxRows)
+			defer w.close()
+			if err := w.write(createTestRows(tt.rowsNum)); err != nil {
+				t.Fatalf("write() error: %s", err)
+			}
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if len(d.inserts) != len(tt.wantInserts) {
+				t.Fatalf("inserts = %v, want %v", d.inserts, tt.wantInserts)
+			}
+			for i := range d.inserts {
+				if d.inserts[i] != tt.wantInserts[i] {
+					t.Errorf("inserts = %v, want %v", d.inserts, tt.wantInserts)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestBatchWriterWriteNew(t *testing.T) {
+	w, _ := createTestBatchWriter(t, 2)
+	defer w.close()
+	existing := map[string]struct{}{"b": {}}
+	selectExisting := func(keys []string) (map[string]struct{}, error) {
+		found := make(map[string]struct{})
+		for _, key := range keys {
+			if _, ok := existing[key]; ok {
+				found[key] = struct{}{}
+			}
+		}
+		return found, nil
+	}
+
+	written, err := w.writeNew([]string{"a", "b", "c", "a"}, createTestRows(4), selectExisting)
+	if err != nil {
+		t.Fatalf("writeNew() error: %s", err)
+	}
+	if (len(written) != 2) || (written[0] != 0) || (written[1] != 2) {
+		t.Errorf("writeNew() = %v, want [0 2]", written)
+	}
+	w.keysMu.Lock()
+	keysNum := len(w.keys)
+	w.keysMu.Unlock()
+	if keysNum != 0 {
+		t.Errorf("%d keys are kept after flush, want 0", keysNum)
+	}
+}
@@ -0,0 +1,157 @@
+package storages
+
+import (
+	"sort"
+
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+)
+
+/*
+Control objects are matched by their centroids: robust centroids of all their facial
+features vectors of every model (see identities package). Centroids are rebuilt from
+vectors after every commit and after review of outliers, and are stored with outliers
+and vectors, accepted on review. Centroids must be rebuilt through the outermost
+FaceStorage (e.g. IndexedFaceStorage), so it sees new ones. Rebuilds of centroids
+of the same control object are serialized in process, otherwise centroid, built
+from older vectors, may be inserted after centroid, built from newer ones.
+*/
+
+// Centroid is robust centroid of control object facial features vectors of model.
+// EFF is empty, if control object has no vectors of model anymore.
+type Centroid struct {
+	Model       string
+	CobID       string
+	EFF         proto.FacialFeaturesVector
+	FFVsNum     uint64
+	Outliers    []identities.Outlier
+	AcceptedIDs []string
+}
+
+// CentroidsVersion identifies content of centroids: it is changed by every insert
+// (MaxVersion) and deletion (Num) of centroids.
+type CentroidsVersion struct {
+	MaxVersion uint64
+	Num        uint64
+}
+
+// RefreshCentroids rebuilds centroids of control objects from all their facial features vectors.
+func RefreshCentroids(fs FaceStorage, im *identities.Model, cobIDs []string) error {
+	return refreshCentroids(fs, im, cobIDs, nil, nil)
+}
+
+// AcceptFFV marks (outlier) facial features vector as reviewed one, so it is never
+// considered an outlier and is always used in centroid of its control object.
+func AcceptFFV(fs FaceStorage, im *identities.Model, ffv *FFV) error {
+	return refreshCentroids(fs, im, []string{ffv.CobID}, map[string]struct{}{ffv.ID: {}}, nil)
+}
+
+// RemoveFFV deletes (outlier) facial features vector and rebuilds centroid of its control object.
+func RemoveFFV(fs FaceStorage, im *identities.Model, ffv *FFV) error {
+	return RemoveFFVs(fs, im, []FFV{*ffv})
+}
+
+// RemoveFFVs deletes facial features vectors and rebuilds centroids of their control objects.
+func RemoveFFVs(fs FaceStorage, im *identities.Model, ffvs []FFV) error {
+	if len(ffvs) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(ffvs))
+	cobIDs := make([]string, 0, len(ffvs))
+	removed := make(map[string]struct{}, len(ffvs))
+	for _, ffv := range ffvs {
+		ids = append(ids, ffv.ID)
+		cobIDs = append(cobIDs, ffv.CobID)
+		removed[ffv.ID] = struct{}{}
+	}
+	if err := fs.DeleteFFVs(ids); err != nil {
+		return errors.Wrap(err, "unable to delete facial features vectors")
+	}
+	// Deletion may be not applied yet, so vectors are skipped explicitly.
+	return refreshCentroids(fs, im, cobIDs, nil, removed)
+}
+
+func refreshCentroids(fs FaceStorage, im *identities.Model, cobIDs []string,
+	accepted, removed map[string]struct{}) error {
+	seen := make(map[string]struct{}, len(cobIDs))
+	uniqueCobIDs := make([]string, 0, len(cobIDs))
+	for _, cobID := range cobIDs {
+		if _, ok := seen[cobID]; !ok {
+			seen[cobID] = struct{}{}
+			uniqueCobIDs = append(uniqueCobIDs, cobID)
+		}
+	}
+	sort.Strings(uniqueCobIDs)
+	// Centroids are inserted under locks, so they are never replaced by older ones.
+	defer centroidsLocks.lockAll(uniqueCobIDs)()
+
+	centroids := make([]Centroid, 0, len(uniqueCobIDs))
+	for _, cobID := range uniqueCobIDs {
+		ffvs, err := fs.SelectFFVsByControlObject(cobID)
+		if err != nil {
+			return errors.Wrapf(err, "unable to select facial features vectors of control object \"%s\"", cobID)
+		}
+		oldCentroids, err := fs.SelectCentroids(cobID)
+		if err != nil {
+			return errors.Wrapf(err, "unable to select centroids of control object \"%s\"", cobID)
+		}
+
+		vectors := make(map[string][]identities.Vector)
+		for _, ffv := range ffvs {
+			if _, ok := removed[ffv.ID]; ok {
+				continue
+			}
+			vectors[ffv.Model] = append(vectors[ffv.Model], identities.Vector{
+				ID: ffv.ID,
+				FF: ffv.FacialFeaturesVector,
+			})
+		}
+		modelsAccepted := make(map[string]map[string]struct{})
+		for _, c := range oldCentroids {
+			modelsAccepted[c.Model] = make(map[string]struct{}, len(c.AcceptedIDs))
+			for _, id := range c.AcceptedIDs {
+				modelsAccepted[c.Model][id] = struct{}{}
+			}
+			// Centroid of model without vectors is replaced by empty one.
+			if _, ok := vectors[c.Model]; !ok {
+				vectors[c.Model] = []identities.Vector{}
+			}
+		}
+
+		models := make([]string, 0, len(vectors))
+		for model := range vectors {
+			models = append(models, model)
+		}
+		sort.Strings(models)
+		for _, model := range models {
+			modelAccepted := modelsAccepted[model]
+			if modelAccepted == nil {
+				modelAccepted = make(map[string]struct{})
+			}
+			acceptedIDs := make([]string, 0, len(modelAccepted))
+			for _, v := range vectors[model] {
+				if _, ok := accepted[v.ID]; ok {
+					modelAccepted[v.ID] = struct{}{}
+				}
+				if _, ok := modelAccepted[v.ID]; ok {
+					acceptedIDs = append(acceptedIDs, v.ID)
+				}
+			}
+			identity := im.Build(vectors[model], modelAccepted)
+			centroids = append(centroids, Centroid{
+				Model:       model,
+				CobID:       cobID,
+				EFF:         identity.Centroid,
+				FFVsNum:     uint64(len(vectors[model])),
+				Outliers:    identity.Outliers,
+				AcceptedIDs: acceptedIDs,
+			})
+		}
+	}
+	if len(centroids) == 0 {
+		return nil
+	}
+
+	return fs.InsertCentroids(centroids)
+}
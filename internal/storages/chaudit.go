@@ -0,0 +1,196 @@
+package storages
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+
+	"github.com/kshvakov/clickhouse"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+)
+
+// InsertAuditRecordQuery ...
+const InsertAuditRecordQuery = `
+INSERT INTO
+    audit_log
+    (chain, seq, id, ts,
+     src_addr, command, img_uuid,
+     entries, salt,
+     prev_hash, hash)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// InsertAuditRecord ...
+func (fs *ClickHouseFaceStorage) InsertAuditRecord(rec *proto.AuditRecord) error {
+	entries, err := json.Marshal(rec.Entries)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal audit record entries")
+	}
+
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin insert")
+	}
+	stmt, err := tx.Prepare(InsertAuditRecordQuery)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to prepare SQL-statement")
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(
+		rec.Chain,
+		rec.Seq,
+		clickhouse.UUID(rec.ID),
+		rec.TS,
+		rec.SrcAddr,
+		rec.Command,
+		rec.ImgUUID,
+		string(entries),
+		rec.Salt,
+		rec.PrevHash,
+		rec.Hash,
+	); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to execute insert")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "unable to commit insert")
+	}
+
+	return nil
+}
+
+// scanAuditRecord scans row, selected with auditRecordColumns.
+func scanAuditRecord(rows *sql.Rows) (*proto.AuditRecord, error) {
+	rec := &proto.AuditRecord{}
+	entries := ""
+	if err := rows.Scan(
+		&(rec.Chain), &(rec.Seq), &(rec.ID), &(rec.TS),
+		&(rec.SrcAddr), &(rec.Command), &(rec.ImgUUID),
+		&entries, &(rec.Salt),
+		&(rec.PrevHash), &(rec.Hash),
+	); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal query result")
+	}
+	if err := json.Unmarshal([]byte(entries), &(rec.Entries)); err != nil {
+		return nil, errors.Wrapf(err, "unable to unmarshal entries of audit record %d", rec.Seq)
+	}
+	return rec, nil
+}
+
+const auditRecordColumns = `
+    chain, seq, toString(id), ts,
+    src_addr, command, img_uuid,
+    entries, salt,
+    prev_hash, hash`
+
+// SelectAuditRecordsQuery ...
+const SelectAuditRecordsQuery = `
+SELECT` + auditRecordColumns + `
+FROM
+    audit_log
+WHERE
+    (ts >= toDateTime(?)) AND
+    (ts < toDateTime(?)) AND
+    ((? = '') OR (src_addr = ?)) AND
+    ((? = '') OR (command = ?)) AND
+    ((? = '') OR (img_uuid = ?))
+ORDER BY ts DESC, seq DESC
+LIMIT ?, ?;
+`
+
+// SelectAuditRecords ...
+func (fs *ClickHouseFaceStorage) SelectAuditRecords(filter *AuditFilter, offset, limit uint64) ([]proto.AuditRecord, error) {
+	rows, err := fs.db.Query(SelectAuditRecordsQuery,
+		dateTime(filter.From, 0), dateTime(filter.To, math.MaxUint32),
+		filter.SrcAddr, filter.SrcAddr,
+		filter.Command, filter.Command,
+		filter.ImgUUID, filter.ImgUUID,
+		offset, limit,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	recs := make([]proto.AuditRecord, 0, limit)
+	for rows.Next() {
+		rec, err := scanAuditRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, *rec)
+	}
+
+	return recs, rows.Err()
+}
+
+// ScanAuditRecordsQuery ...
+const ScanAuditRecordsQuery = `
+SELECT` + auditRecordColumns + `
+FROM
+    audit_log
+ORDER BY chain, seq ASC;
+`
+
+// ScanAuditRecords ...
+func (fs *ClickHouseFaceStorage) ScanAuditRecords(fn func(rec *proto.AuditRecord) error) error {
+	rows, err := fs.db.Query(ScanAuditRecordsQuery)
+	if err != nil {
+		return errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec, err := scanAuditRecord(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// CountControlObjectAuditRecordsQuery ...
+const CountControlObjectAuditRecordsQuery = `
+SELECT
+    count()
+FROM
+    audit_log
+WHERE
+    (salt != '') AND
+    (position(entries, ?) > 0);
+`
+
+// ShredAuditRecordsQuery clears salts of records, which entries contain control object ID.
+const ShredAuditRecordsQuery = `
+ALTER TABLE
+    audit_log
+UPDATE
+    salt = ''
+WHERE
+    (salt != '') AND
+    (position(entries, ?) > 0);
+`
+
+// shredAuditRecords clears salts of audit records of control object, so digests
+// of its fields can't be compared with personal data anymore.
+func (fs *ClickHouseFaceStorage) shredAuditRecords(cobID string) (uint64, error) {
+	recsNum := uint64(0)
+	if err := fs.db.QueryRow(CountControlObjectAuditRecordsQuery, cobID).Scan(&recsNum); err != nil {
+		return 0, errors.Wrap(err, "unable to count audit records")
+	}
+	if recsNum == 0 {
+		return 0, nil
+	}
+	if _, err := fs.db.Exec(ShredAuditRecordsQuery, cobID); err != nil {
+		return 0, errors.Wrap(err, "unable to shred audit records")
+	}
+	return recsNum, nil
+}
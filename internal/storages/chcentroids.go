@@ -0,0 +1,233 @@
+package storages
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/kshvakov/clickhouse"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/pkg/errors"
+)
+
+// SelectFFVsByControlObjectQuery ...
+const SelectFFVsByControlObjectQuery = `
+SELECT
+    toString(id), toString(cob_id), toString(img_id),
+    fb, model, ff
+FROM
+    facial_features
+WHERE
+    cob_id = toUUID(?)
+ORDER BY id;
+`
+
+// SelectFFVsByControlObject ...
+func (fs *ClickHouseFaceStorage) SelectFFVsByControlObject(cobID string) ([]FFV, error) {
+	rows, err := fs.db.Query(SelectFFVsByControlObjectQuery, cobID)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanFFVs(rows)
+}
+
+// SelectFFVsQuery ...
+const SelectFFVsQuery = `
+SELECT
+    toString(id), toString(cob_id), toString(img_id),
+    fb, model, ff
+FROM
+    facial_features
+WHERE
+    toString(id) IN (?)
+ORDER BY id;
+`
+
+// SelectFFVs ...
+func (fs *ClickHouseFaceStorage) SelectFFVs(ids []string) ([]FFV, error) {
+	if len(ids) == 0 {
+		return []FFV{}, nil
+	}
+	rows, err := fs.db.Query(SelectFFVsQuery, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanFFVs(rows)
+}
+
+func scanFFVs(rows *sql.Rows) ([]FFV, error) {
+	defer rows.Close()
+
+	ffvs := make([]FFV, 0, 16)
+	for rows.Next() {
+		ffv := FFV{}
+		if err := rows.Scan(
+			&(ffv.ID), &(ffv.CobID), &(ffv.ImgID),
+			&(ffv.FaceBox), &(ffv.Model), &(ffv.FacialFeaturesVector),
+		); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		ffvs = append(ffvs, ffv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select facial features vectors")
+	}
+
+	return ffvs, nil
+}
+
+// DeleteFFVsQuery ...
+const DeleteFFVsQuery = `
+ALTER TABLE
+    facial_features
+DELETE WHERE
+    toString(id) IN (?);
+`
+
+// DeleteFFVs deletes facial features vectors. ClickHouse DB applies this mutation asynchronously.
+func (fs *ClickHouseFaceStorage) DeleteFFVs(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := fs.db.Exec(DeleteFFVsQuery, ids); err != nil {
+		return errors.Wrap(err, "unable to execute query")
+	}
+	return nil
+}
+
+// InsertCentroidsQuery ...
+const InsertCentroidsQuery = `
+INSERT INTO
+    centroids
+    (model, cob_id, version,
+     eff, cosine_on_ort, ffvs_num,
+     outlier_ids, outlier_scores,
+     accepted_ids)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// InsertCentroids inserts new versions of centroids.
+func (fs *ClickHouseFaceStorage) InsertCentroids(centroids []Centroid) error {
+	rows := make([][]interface{}, 0, len(centroids))
+	for _, c := range centroids {
+		cosineOnOrt := int8(0)
+		if len(c.EFF) != 0 {
+			cosineOnOrt = c.EFF.CosineOnOrt()
+		}
+		outlierIDs := make([]string, 0, len(c.Outliers))
+		outlierScores := make([]float64, 0, len(c.Outliers))
+		for _, o := range c.Outliers {
+			outlierIDs = append(outlierIDs, o.ID)
+			outlierScores = append(outlierScores, o.Score)
+		}
+		rows = append(rows, []interface{}{
+			c.Model,
+			clickhouse.UUID(c.CobID),
+			uint64(time.Now().UnixNano()),
+			clickhouse.Array([]float64(c.EFF)),
+			cosineOnOrt,
+			c.FFVsNum,
+			clickhouse.Array(outlierIDs),
+			clickhouse.Array(outlierScores),
+			clickhouse.Array(c.AcceptedIDs),
+		})
+	}
+	return fs.centroidsWriter.write(rows)
+}
+
+// SelectCentroidsVersionQuery ...
+const SelectCentroidsVersionQuery = `
+SELECT
+    max(version),
+    count()
+FROM
+    centroids FINAL;
+`
+
+// SelectCentroidsVersion ...
+func (fs *ClickHouseFaceStorage) SelectCentroidsVersion() (CentroidsVersion, error) {
+	v := CentroidsVersion{}
+	if err := fs.db.QueryRow(SelectCentroidsVersionQuery).Scan(&(v.MaxVersion), &(v.Num)); err != nil {
+		return v, errors.Wrap(err, "unable to select centroids version")
+	}
+	return v, nil
+}
+
+// SelectCentroidsQuery ...
+const SelectCentroidsQuery = `
+SELECT
+    model, toString(cob_id),
+    eff, ffvs_num,
+    outlier_ids, outlier_scores,
+    accepted_ids
+FROM
+    centroids FINAL
+WHERE
+    cob_id = toUUID(?)
+ORDER BY model;
+`
+
+// SelectCentroids ...
+func (fs *ClickHouseFaceStorage) SelectCentroids(cobID string) ([]Centroid, error) {
+	rows, err := fs.db.Query(SelectCentroidsQuery, cobID)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanCentroids(rows)
+}
+
+// SelectCentroidsWithOutliersQuery ...
+const SelectCentroidsWithOutliersQuery = `
+SELECT
+    model, toString(cob_id),
+    eff, ffvs_num,
+    outlier_ids, outlier_scores,
+    accepted_ids
+FROM
+    centroids FINAL
+WHERE
+    notEmpty(outlier_ids)
+ORDER BY cob_id, model
+LIMIT ?, ?;
+`
+
+// SelectCentroidsWithOutliers ...
+func (fs *ClickHouseFaceStorage) SelectCentroidsWithOutliers(offset, limit uint64) ([]Centroid, error) {
+	rows, err := fs.db.Query(SelectCentroidsWithOutliersQuery, offset, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanCentroids(rows)
+}
+
+func scanCentroids(rows *sql.Rows) ([]Centroid, error) {
+	defer rows.Close()
+
+	centroids := make([]Centroid, 0, 16)
+	for rows.Next() {
+		c := Centroid{}
+		outlierIDs := []string{}
+		outlierScores := []float64{}
+		if err := rows.Scan(
+			&(c.Model), &(c.CobID),
+			&(c.EFF), &(c.FFVsNum),
+			&outlierIDs, &outlierScores,
+			&(c.AcceptedIDs),
+		); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		c.Outliers = make([]identities.Outlier, 0, len(outlierIDs))
+		for i := 0; (i < len(outlierIDs)) && (i < len(outlierScores)); i++ {
+			c.Outliers = append(c.Outliers, identities.Outlier{
+				ID:    outlierIDs[i],
+				Score: outlierScores[i],
+			})
+		}
+		centroids = append(centroids, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select centroids")
+	}
+
+	return centroids, nil
+}
@@ -0,0 +1,306 @@
+package storages
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/kshvakov/clickhouse"
+	"github.com/pkg/errors"
+)
+
+// SelectUnmatchedSightingsQuery ...
+const SelectUnmatchedSightingsQuery = `
+SELECT
+    toString(id), ts, src_addr,
+    toString(img_id), img_path,
+    fb, model, ff,
+    toString(cob_id), score
+FROM
+    sightings
+WHERE
+    (ts >= toDateTime(?)) AND
+    (ts < toDateTime(?)) AND
+    (cob_id = toUUID(?)) AND
+    notEmpty(ff)
+ORDER BY ts DESC, id DESC
+LIMIT ?;
+`
+
+// SelectUnmatchedSightings ...
+func (fs *ClickHouseFaceStorage) SelectUnmatchedSightings(from, to time.Time, limit uint64) ([]Sighting, error) {
+	rows, err := fs.db.Query(SelectUnmatchedSightingsQuery,
+		dateTime(from, 0), dateTime(to, math.MaxUint32), zeroUUID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanSightingsWithFFVs(rows)
+}
+
+// SelectSightingsByIDsQuery ...
+const SelectSightingsByIDsQuery = `
+SELECT
+    toString(id), ts, src_addr,
+    toString(img_id), img_path,
+    fb, model, ff,
+    toString(cob_id), score
+FROM
+    sightings
+WHERE
+    toString(id) IN (?)
+ORDER BY ts DESC, id DESC;
+`
+
+// SelectSightingsByIDs ...
+func (fs *ClickHouseFaceStorage) SelectSightingsByIDs(ids []string) ([]Sighting, error) {
+	if len(ids) == 0 {
+		return []Sighting{}, nil
+	}
+	rows, err := fs.db.Query(SelectSightingsByIDsQuery, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanSightingsWithFFVs(rows)
+}
+
+func scanSightingsWithFFVs(rows *sql.Rows) ([]Sighting, error) {
+	defer rows.Close()
+
+	sightings := make([]Sighting, 0, 128)
+	for rows.Next() {
+		s := Sighting{}
+		if err := rows.Scan(&(s.ID), &(s.TS), &(s.SrcAddr),
+			&(s.ImgID), &(s.ImgPath), &(s.FaceBox), &(s.Model),
+			&(s.FacialFeaturesVector), &(s.CobID), &(s.Score)); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		if s.CobID == zeroUUID {
+			s.CobID = ""
+		}
+		sightings = append(sightings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select sightings")
+	}
+
+	return sightings, nil
+}
+
+// AssignSightingsQuery ...
+const AssignSightingsQuery = `
+ALTER TABLE
+    sightings
+UPDATE
+    cob_id = toUUID(?)
+WHERE
+    toString(id) IN (?);
+`
+
+// AssignSightings sets control object of sightings. ClickHouse DB applies this mutation asynchronously.
+func (fs *ClickHouseFaceStorage) AssignSightings(ids []string, cobID string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := fs.db.Exec(AssignSightingsQuery, cobID, ids); err != nil {
+		return errors.Wrap(err, "unable to execute query")
+	}
+	return nil
+}
+
+// InsertClustersQuery ...
+const InsertClustersQuery = `
+INSERT INTO
+    clusters
+    (id, version, ts, model,
+     sighting_ids, representative_ids,
+     centroid, cob_id, deleted)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+func clusterRow(c *Cluster, version uint64, deleted uint8) []interface{} {
+	cobID := c.CobID
+	if cobID == "" {
+		cobID = zeroUUID
+	}
+	return []interface{}{
+		clickhouse.UUID(c.ID),
+		version,
+		c.TS,
+		c.Model,
+		clickhouse.Array(c.SightingIDs),
+		clickhouse.Array(c.RepresentativeIDs),
+		clickhouse.Array([]float64(c.Centroid)),
+		clickhouse.UUID(cobID),
+		deleted,
+	}
+}
+
+// SelectNotPromotedClustersIDsQuery ...
+const SelectNotPromotedClustersIDsQuery = `
+SELECT
+    toString(id)
+FROM
+    clusters FINAL
+WHERE
+    (deleted = 0) AND
+    (cob_id = toUUID(?));
+`
+
+// ReplaceClusters inserts versions of not promoted clusters, marked as deleted, and new clusters.
+func (fs *ClickHouseFaceStorage) ReplaceClusters(clusters []Cluster) error {
+	rows, err := fs.db.Query(SelectNotPromotedClustersIDsQuery, zeroUUID)
+	if err != nil {
+		return errors.Wrap(err, "unable to execute query")
+	}
+	ids := make([]string, 0, 16)
+	for rows.Next() {
+		id := ""
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "unable to unmarshal query result")
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "unable to select clusters")
+	}
+
+	version := uint64(time.Now().UnixNano())
+	clustersRows := make([][]interface{}, 0, len(ids)+len(clusters))
+	for _, id := range ids {
+		clustersRows = append(clustersRows, clusterRow(&Cluster{ID: id, TS: time.Now()}, version, 1))
+	}
+	for i := range clusters {
+		clustersRows = append(clustersRows, clusterRow(&(clusters[i]), version, 0))
+	}
+	if len(clustersRows) == 0 {
+		return nil
+	}
+	return fs.clustersWriter.write(clustersRows)
+}
+
+// SelectClustersQuery ...
+const SelectClustersQuery = `
+SELECT
+    toString(id), ts, model,
+    sighting_ids, representative_ids,
+    centroid, toString(cob_id)
+FROM
+    clusters FINAL
+WHERE
+    (deleted = 0) AND
+    (cob_id = toUUID(?))
+ORDER BY length(sighting_ids) DESC, id
+LIMIT ?, ?;
+`
+
+// SelectClusters ...
+func (fs *ClickHouseFaceStorage) SelectClusters(offset, limit uint64) ([]Cluster, error) {
+	rows, err := fs.db.Query(SelectClustersQuery, zeroUUID, offset, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanClusters(rows)
+}
+
+// SelectClusterQuery ...
+const SelectClusterQuery = `
+SELECT
+    toString(id), ts, model,
+    sighting_ids, representative_ids,
+    centroid, toString(cob_id)
+FROM
+    clusters FINAL
+WHERE
+    (deleted = 0) AND
+    (id = toUUID(?));
+`
+
+// SelectCluster ...
+func (fs *ClickHouseFaceStorage) SelectCluster(id string) (*Cluster, error) {
+	rows, err := fs.db.Query(SelectClusterQuery, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	clusters, err := scanClusters(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(clusters) == 0 {
+		return nil, nil
+	}
+	return &(clusters[0]), nil
+}
+
+func scanClusters(rows *sql.Rows) ([]Cluster, error) {
+	defer rows.Close()
+
+	clusters := make([]Cluster, 0, 16)
+	for rows.Next() {
+		c := Cluster{}
+		if err := rows.Scan(
+			&(c.ID), &(c.TS), &(c.Model),
+			&(c.SightingIDs), &(c.RepresentativeIDs),
+			&(c.Centroid), &(c.CobID),
+		); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		if c.CobID == zeroUUID {
+			c.CobID = ""
+		}
+		clusters = append(clusters, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select clusters")
+	}
+
+	return clusters, nil
+}
+
+// PromoteCluster inserts new version of cluster with control object ID.
+func (fs *ClickHouseFaceStorage) PromoteCluster(id, cobID string) error {
+	c, err := fs.SelectCluster(id)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return nil
+	}
+	c.CobID = cobID
+	return fs.clustersWriter.write([][]interface{}{clusterRow(c, uint64(time.Now().UnixNano()), 0)})
+}
+
+// CountControlObjectClustersQuery ...
+const CountControlObjectClustersQuery = `
+SELECT
+    uniqExact(id)
+FROM
+    clusters
+WHERE
+    cob_id = toUUID(?);
+`
+
+// EraseClustersQuery deletes all versions of clusters, promoted to control object.
+const EraseClustersQuery = `
+ALTER TABLE
+    clusters
+DELETE WHERE
+    cob_id = toUUID(?);
+`
+
+// eraseClusters deletes clusters, promoted to control object, with their centroids.
+func (fs *ClickHouseFaceStorage) eraseClusters(cobID string) (uint64, error) {
+	clustersNum := uint64(0)
+	if err := fs.db.QueryRow(CountControlObjectClustersQuery, cobID).Scan(&clustersNum); err != nil {
+		return 0, errors.Wrap(err, "unable to count clusters")
+	}
+	if clustersNum == 0 {
+		return 0, nil
+	}
+	if _, err := fs.db.Exec(EraseClustersQuery, cobID); err != nil {
+		return 0, errors.Wrap(err, "unable to erase clusters")
+	}
+	return clustersNum, nil
+}
@@ -0,0 +1,994 @@
+package storages
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/kshvakov/clickhouse"
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ClickHouseFaceStorage is FaceStorage over ClickHouse DB.
+// All rows are inserted by batch writers.
+type ClickHouseFaceStorage struct {
+	db               *sql.DB
+	cosineBoundary   float64
+	bucketRadius     int
+	cobsWriter       *batchWriter
+	imgsWriter       *batchWriter
+	ffvsWriter       *batchWriter
+	sightingsWriter  *batchWriter
+	watchlistsWriter *batchWriter
+	alertsWriter     *batchWriter
+	centroidsWriter  *batchWriter
+	clustersWriter   *batchWriter
+}
+
+// CreateClickHouseFaceStorage ...
+func CreateClickHouseFaceStorage(db *sql.DB, cosineBoundary float64, bucketRadius int,
+	batchCFG *cfgparser.BatchCFG, logger *log.Logger) *ClickHouseFaceStorage {
+	return &ClickHouseFaceStorage{
+		db:               db,
+		cosineBoundary:   cosineBoundary,
+		bucketRadius:     bucketRadius,
+		cobsWriter:       createBatchWriter(db, "control_objects", InsertControlObjectsQuery, batchCFG, logger),
+		imgsWriter:       createBatchWriter(db, "imgs", InsertImgsQuery, batchCFG, logger),
+		ffvsWriter:       createBatchWriter(db, "facial_features", InsertFFVsQuery, batchCFG, logger),
+		sightingsWriter:  createBatchWriter(db, "sightings", InsertSightingsQuery, batchCFG, logger),
+		watchlistsWriter: createBatchWriter(db, "watchlists", InsertWatchlistsQuery, batchCFG, logger),
+		alertsWriter:     createBatchWriter(db, "alerts", InsertAlertsQuery, batchCFG, logger),
+		centroidsWriter:  createBatchWriter(db, "centroids", InsertCentroidsQuery, batchCFG, logger),
+		clustersWriter:   createBatchWriter(db, "clusters", InsertClustersQuery, batchCFG, logger),
+	}
+}
+
+// Close flushes all buffered rows and closes ClickHouse DB connection.
+func (fs *ClickHouseFaceStorage) Close() error {
+	fs.cobsWriter.close()
+	fs.imgsWriter.close()
+	fs.ffvsWriter.close()
+	fs.sightingsWriter.close()
+	fs.watchlistsWriter.close()
+	fs.alertsWriter.close()
+	fs.centroidsWriter.close()
+	fs.clustersWriter.close()
+	return fs.db.Close()
+}
+
+// InsertControlObjectsQuery ...
+const InsertControlObjectsQuery = `
+INSERT INTO
+    control_objects
+    (id, ts, passport,
+     surname, name, patronymic,
+     sex, birthdate,
+     phone_num, email, address,
+     attr_keys, attr_values,
+     passport_hash, deleted)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// attributesArrays returns parallel arrays of attributes keys and values, sorted by keys.
+func attributesArrays(attrs map[string]string) ([]string, []string) {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, attrs[k])
+	}
+	return keys, values
+}
+
+// attributesMap returns attributes from parallel arrays of keys and values.
+func attributesMap(keys, values []string) map[string]string {
+	if len(keys) == 0 {
+		return nil
+	}
+	attrs := make(map[string]string, len(keys))
+	for i, k := range keys {
+		if i < len(values) {
+			attrs[k] = values[i]
+		}
+	}
+	return attrs
+}
+
+func controlObjectRow(cob *proto.ControlObject, deleted uint8) []interface{} {
+	keys, values := attributesArrays(cob.Attributes)
+	return []interface{}{
+		clickhouse.UUID(cob.ID),
+		cob.TS,
+		cob.Passport,
+		cob.Surname,
+		cob.Name,
+		cob.Patronymic,
+		cob.Sex,
+		cob.BirthDate,
+		cob.PhoneNum,
+		cob.Email,
+		cob.Address,
+		clickhouse.Array(keys),
+		clickhouse.Array(values),
+		cob.PassportHash,
+		deleted,
+	}
+}
+
+// InsertControlObjects ...
+func (fs *ClickHouseFaceStorage) InsertControlObjects(cobs []proto.ControlObject) error {
+	rows := make([][]interface{}, 0, len(cobs))
+	for i := range cobs {
+		rows = append(rows, controlObjectRow(&(cobs[i]), 0))
+	}
+	return fs.cobsWriter.write(rows)
+}
+
+// RewriteControlObjectsQuery inserts control objects with given versions (db_ts).
+const RewriteControlObjectsQuery = `
+INSERT INTO
+    control_objects
+    (id, db_ts, ts, passport,
+     surname, name, patronymic,
+     sex, birthdate,
+     phone_num, email, address,
+     attr_keys, attr_values,
+     passport_hash, deleted)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// RewriteControlObjects inserts control objects with their db_ts, so ReplacingMergeTree
+// keeps versions, which were inserted after they were selected.
+func (fs *ClickHouseFaceStorage) RewriteControlObjects(cobs []proto.ControlObject) error {
+	if len(cobs) == 0 {
+		return nil
+	}
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin insert")
+	}
+	stmt, err := tx.Prepare(RewriteControlObjectsQuery)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to prepare SQL-statement")
+	}
+	defer stmt.Close()
+
+	for i := range cobs {
+		if cobs[i].DBTS == nil {
+			tx.Rollback()
+			return errors.Errorf("control object \"%s\" has no version", cobs[i].ID)
+		}
+		row := controlObjectRow(&(cobs[i]), 0)
+		// db_ts follows id.
+		row = append([]interface{}{row[0], *(cobs[i].DBTS)}, row[1:]...)
+		if _, err := stmt.Exec(row...); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "unable to execute insert")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "unable to commit insert")
+	}
+
+	return nil
+}
+
+// SelectControlObjectByPassportQuery ...
+const SelectControlObjectByPassportQuery = `
+SELECT
+    id, ts, passport,
+    surname, name, patronymic,
+    sex, birthdate,
+    phone_num, email, address,
+    attr_keys, attr_values, passport_hash,
+    db_ts
+FROM
+    control_objects FINAL
+WHERE
+    (passport = ?) AND
+    (deleted = 0);
+`
+
+// SelectControlObjectByPassport ...
+func (fs *ClickHouseFaceStorage) SelectControlObjectByPassport(passport string) (*proto.ControlObject, error) {
+	rows, err := fs.db.Query(SelectControlObjectByPassportQuery, passport)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		return scanControlObject(rows)
+	}
+
+	return proto.CreateDefaultControlObject(), nil
+}
+
+// SelectControlObjectsByIDsQuery ...
+const SelectControlObjectsByIDsQuery = `
+SELECT
+    id, ts, passport,
+    surname, name, patronymic,
+    sex, birthdate,
+    phone_num, email, address,
+    attr_keys, attr_values, passport_hash,
+    db_ts
+FROM
+    control_objects FINAL
+WHERE
+    (toString(id) IN (?)) AND
+    (deleted = 0);
+`
+
+// SelectControlObjectsByIDs ...
+func (fs *ClickHouseFaceStorage) SelectControlObjectsByIDs(ids []string) ([]proto.ControlObject, error) {
+	if len(ids) == 0 {
+		return []proto.ControlObject{}, nil
+	}
+	rows, err := fs.db.Query(SelectControlObjectsByIDsQuery, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	cobs := make([]proto.ControlObject, 0, len(ids))
+	for rows.Next() {
+		cob, err := scanControlObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		cobs = append(cobs, *cob)
+	}
+
+	return cobs, nil
+}
+
+// SelectControlObjectsQuery ...
+const SelectControlObjectsQuery = `
+SELECT
+    id, ts, passport,
+    surname, name, patronymic,
+    sex, birthdate,
+    phone_num, email, address,
+    attr_keys, attr_values, passport_hash,
+    db_ts
+FROM
+    control_objects FINAL
+WHERE
+    (deleted = 0) AND
+    ((? = '') OR (passport = ?)) AND
+    ((? = '') OR (passport_hash = ?)) AND
+    ((? = '') OR (surname = ?)) AND
+    ((? = '') OR (name = ?)) AND
+    ((? = '') OR (patronymic = ?)) AND
+    ((? = '') OR (sex = ?)) AND
+    ((? = '') OR (birthdate = ?)) AND
+    hasAll(arrayMap((k, v) -> concat(k, '=', v), attr_keys, attr_values), ?)
+ORDER BY id
+LIMIT ?, ?;
+`
+
+// SelectControlObjects ...
+func (fs *ClickHouseFaceStorage) SelectControlObjects(filter *ControlObjectsFilter, offset, limit uint64) ([]proto.ControlObject, error) {
+	rows, err := fs.db.Query(SelectControlObjectsQuery,
+		filter.Passport, filter.Passport,
+		filter.PassportHash, filter.PassportHash,
+		filter.Surname, filter.Surname,
+		filter.Name, filter.Name,
+		filter.Patronymic, filter.Patronymic,
+		filter.Sex, filter.Sex,
+		filter.BirthDate, filter.BirthDate,
+		clickhouse.Array(attributesPairs(filter.Attributes)),
+		offset, limit,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	cobs := make([]proto.ControlObject, 0, limit)
+	for rows.Next() {
+		cob, err := scanControlObject(rows)
+		if err != nil {
+			return nil, err
+		}
+		cobs = append(cobs, *cob)
+	}
+
+	return cobs, nil
+}
+
+// DeleteControlObject inserts new version of control object, marked as deleted.
+func (fs *ClickHouseFaceStorage) DeleteControlObject(id string) (bool, error) {
+	cobs, err := fs.SelectControlObjectsByIDs([]string{id})
+	if err != nil {
+		return false, err
+	}
+	if len(cobs) == 0 {
+		return false, nil
+	}
+
+	if err := fs.cobsWriter.write([][]interface{}{controlObjectRow(&(cobs[0]), 1)}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func scanControlObject(rows *sql.Rows) (*proto.ControlObject, error) {
+	cob := proto.CreateDefaultControlObject()
+	keys, values := []string{}, []string{}
+	dbTS := time.Time{}
+	if err := rows.Scan(
+		&(cob.ID), &(cob.TS), &(cob.Passport),
+		&(cob.Surname), &(cob.Name), &(cob.Patronymic),
+		&(cob.Sex), &(cob.BirthDate),
+		&(cob.PhoneNum), &(cob.Email), &(cob.Address),
+		&keys, &values, &(cob.PassportHash),
+		&dbTS); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal query result")
+	}
+	cob.Attributes = attributesMap(keys, values)
+	cob.DBTS = &dbTS
+	return cob, nil
+}
+
+// InsertFFVsQuery ...
+const InsertFFVsQuery = `
+INSERT INTO
+    facial_features
+    (id, cob_id, img_id, fb, ff, model, dim)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?);
+`
+
+// SelectExistingFFVsIDsQuery ...
+const SelectExistingFFVsIDsQuery = `
+SELECT
+    toString(id)
+FROM
+    facial_features
+WHERE
+    toString(id) IN (?);
+`
+
+// InsertFFVs ...
+func (fs *ClickHouseFaceStorage) InsertFFVs(ffvs []FFV) ([]FFV, error) {
+	ids := make([]string, 0, len(ffvs))
+	rows := make([][]interface{}, 0, len(ffvs))
+	for _, ffv := range ffvs {
+		ids = append(ids, ffv.ID)
+		rows = append(rows, []interface{}{
+			clickhouse.UUID(ffv.ID),
+			clickhouse.UUID(ffv.CobID),
+			clickhouse.UUID(ffv.ImgID),
+			clickhouse.Array(ffv.FaceBox),
+			clickhouse.Array(ffv.FacialFeaturesVector),
+			ffv.Model,
+			uint16(len(ffv.FacialFeaturesVector)),
+		})
+	}
+	written, err := fs.ffvsWriter.writeNew(ids, rows, func(ids []string) (map[string]struct{}, error) {
+		return fs.selectExistingIDs(SelectExistingFFVsIDsQuery, ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	newFFVs := make([]FFV, 0, len(written))
+	for _, i := range written {
+		newFFVs = append(newFFVs, ffvs[i])
+	}
+
+	return newFFVs, nil
+}
+
+// selectExistingIDs returns those of ids, which are returned by query.
+func (fs *ClickHouseFaceStorage) selectExistingIDs(query string, ids []string) (map[string]struct{}, error) {
+	existingIDs := make(map[string]struct{}, len(ids))
+	if len(ids) == 0 {
+		return existingIDs, nil
+	}
+	rows, err := fs.db.Query(query, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		id := ""
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		existingIDs[id] = struct{}{}
+	}
+
+	return existingIDs, rows.Err()
+}
+
+// InsertImgsQuery ...
+const InsertImgsQuery = `
+INSERT INTO imgs
+    (id, ts, path, face_ids)
+VALUES
+    (?, ?, ?, ?);`
+
+// SelectExistingImgsIDsQuery ...
+const SelectExistingImgsIDsQuery = `
+SELECT
+    toString(id)
+FROM
+    imgs
+WHERE
+    toString(id) IN (?);
+`
+
+// InsertImgs ...
+func (fs *ClickHouseFaceStorage) InsertImgs(imgs []Img) error {
+	ids := make([]string, 0, len(imgs))
+	rows := make([][]interface{}, 0, len(imgs))
+	for _, img := range imgs {
+		ids = append(ids, img.ID)
+		rows = append(rows, []interface{}{
+			clickhouse.UUID(img.ID),
+			img.TS,
+			img.Path,
+			clickhouse.Array(img.FaceIDs),
+		})
+	}
+	_, err := fs.imgsWriter.writeNew(ids, rows, func(ids []string) (map[string]struct{}, error) {
+		return fs.selectExistingIDs(SelectExistingImgsIDsQuery, ids)
+	})
+	return err
+}
+
+// SelectImgsQuery ...
+const SelectImgsQuery = `
+SELECT
+    toString(id), ts, path, face_ids
+FROM
+    imgs
+WHERE
+    toString(id) IN (?);
+`
+
+// SelectImgs ...
+func (fs *ClickHouseFaceStorage) SelectImgs(ids []string) ([]Img, error) {
+	if len(ids) == 0 {
+		return []Img{}, nil
+	}
+	rows, err := fs.db.Query(SelectImgsQuery, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	imgs := make([]Img, 0, len(ids))
+	for rows.Next() {
+		img := Img{}
+		if err := rows.Scan(&(img.ID), &(img.TS), &(img.Path), &(img.FaceIDs)); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		imgs = append(imgs, img)
+	}
+
+	return imgs, rows.Err()
+}
+
+// SelectImgsByControlObjectQuery ...
+const SelectImgsByControlObjectQuery = `
+SELECT
+    *
+FROM
+    imgs
+WHERE
+    has(face_ids, ?);
+`
+
+// SelectImgsByControlObject ...
+func (fs *ClickHouseFaceStorage) SelectImgsByControlObject(cob *proto.ControlObject) ([]Img, error) {
+	rows, err := fs.db.Query(SelectImgsByControlObjectQuery, cob.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	imgs := make([]Img, 0, 128)
+	i := 0
+	for rows.Next() {
+		imgs = append(imgs, Img{})
+		if err := rows.Scan(
+			&(imgs[i].ID), &(imgs[i].TS),
+			&(imgs[i].Path), &(imgs[i].FaceIDs),
+		); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		i++
+	}
+
+	return imgs, nil
+}
+
+/*
+To find the most suitable object of control, we can use the cosine:
+the more similar the vectors, the closer the cosine of the angle between them to one.
+Only centroids of the same model and dimension are compared.
+*/
+
+// SelectCandidatesByFFVQuery ...
+const SelectCandidatesByFFVQuery = `
+SELECT
+     cob_id, ts, passport,
+     surname, name, patronymic,
+     sex, birthdate,
+     phone_num, email, address,
+     attr_keys, attr_values,
+     similarity
+FROM
+(
+    SELECT
+        control_objects.id AS cob_id,
+        control_objects.ts AS ts,
+        control_objects.passport AS passport,
+        control_objects.surname AS surname,
+        control_objects.name AS name,
+        control_objects.patronymic AS patronymic,
+        control_objects.sex AS sex,
+        control_objects.birthdate AS birthdate,
+        control_objects.phone_num AS phone_num,
+        control_objects.email AS email,
+        control_objects.address AS address,
+        control_objects.attr_keys AS attr_keys,
+        control_objects.attr_values AS attr_values
+    FROM
+       control_objects FINAL
+    WHERE
+       control_objects.deleted = 0
+) JOIN
+(
+    SELECT
+        cob_id,
+        cosine_on_ort,
+        (arraySum(arrayMap((x, y) -> (x * y), eff, array(?))) /
+         (sqrt(arraySum(arrayMap(x -> x * x, array(?)))) *
+          sqrt(arraySum(arrayMap(x -> x * x, eff))))) AS similarity
+    FROM
+        centroids FINAL
+    WHERE
+        (model = ?) AND
+        (length(eff) = ?)
+) USING cob_id
+WHERE
+    abs(? - cosine_on_ort) <= ?
+ORDER BY similarity DESC
+LIMIT ?
+`
+
+// SelectCandidatesByFFV ...
+func (fs *ClickHouseFaceStorage) SelectCandidatesByFFV(model string, ff proto.FacialFeaturesVector, k int) ([]proto.Candidate, error) {
+	rows, err := fs.db.Query(SelectCandidatesByFFVQuery,
+		clickhouse.Array(ff), clickhouse.Array(ff),
+		model, len(ff),
+		ff.CosineOnOrt(), fs.bucketRadius,
+		k,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	candidates := make([]proto.Candidate, 0, k)
+	for rows.Next() {
+		candidate := proto.Candidate{
+			ControlObject: *proto.CreateDefaultControlObject(),
+		}
+		cob := &(candidate.ControlObject)
+		keys, values := []string{}, []string{}
+		if err := rows.Scan(
+			&(cob.ID), &(cob.TS), &(cob.Passport),
+			&(cob.Surname), &(cob.Name), &(cob.Patronymic),
+			&(cob.Sex), &(cob.BirthDate),
+			&(cob.PhoneNum), &(cob.Email), &(cob.Address),
+			&keys, &values,
+			&(candidate.Similarity),
+		); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		cob.Attributes = attributesMap(keys, values)
+		candidate.Matched = candidate.Similarity >= fs.cosineBoundary
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, nil
+}
+
+// SelectControlObjectByFFV ...
+func (fs *ClickHouseFaceStorage) SelectControlObjectByFFV(model string, ff proto.FacialFeaturesVector) (*proto.ControlObject, error) {
+	return selectControlObjectByFFV(fs, model, ff)
+}
+
+// SelectEmbeddedFFVsQuery ...
+const SelectEmbeddedFFVsQuery = `
+SELECT
+    model,
+    toString(cob_id),
+    toFloat64(cosine_on_ort),
+    eff,
+    ffvs_num
+FROM
+    centroids FINAL
+WHERE
+    notEmpty(eff);
+`
+
+// SelectEmbeddedFFVs ...
+func (fs *ClickHouseFaceStorage) SelectEmbeddedFFVs() ([]EmbeddedFFV, error) {
+	rows, err := fs.db.Query(SelectEmbeddedFFVsQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanEmbeddedFFVs(rows)
+}
+
+// SelectEmbeddedFFVsByControlObjectsQuery ...
+const SelectEmbeddedFFVsByControlObjectsQuery = `
+SELECT
+    model,
+    toString(cob_id),
+    toFloat64(cosine_on_ort),
+    eff,
+    ffvs_num
+FROM
+    centroids FINAL
+WHERE
+    notEmpty(eff) AND
+    (toString(cob_id) IN (?));
+`
+
+// SelectEmbeddedFFVsByControlObjects ...
+func (fs *ClickHouseFaceStorage) SelectEmbeddedFFVsByControlObjects(cobIDs []string) ([]EmbeddedFFV, error) {
+	if len(cobIDs) == 0 {
+		return []EmbeddedFFV{}, nil
+	}
+	rows, err := fs.db.Query(SelectEmbeddedFFVsByControlObjectsQuery, cobIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanEmbeddedFFVs(rows)
+}
+
+func scanEmbeddedFFVs(rows *sql.Rows) ([]EmbeddedFFV, error) {
+	defer rows.Close()
+
+	effs := make([]EmbeddedFFV, 0, 128)
+	for rows.Next() {
+		eff := EmbeddedFFV{}
+		if err := rows.Scan(&(eff.Model), &(eff.CobID), &(eff.CosineOnOrt), &(eff.EFF), &(eff.FFVsNum)); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		effs = append(effs, eff)
+	}
+
+	return effs, rows.Err()
+}
+
+// ScanFFVsQuery ...
+const ScanFFVsQuery = `
+SELECT
+    id, cob_id, img_id, fb, model, ff
+FROM
+    facial_features;
+`
+
+// ScanFFVs ...
+func (fs *ClickHouseFaceStorage) ScanFFVs(fn func(ffv *FFV) error) error {
+	rows, err := fs.db.Query(ScanFFVsQuery)
+	if err != nil {
+		return errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ffv := &FFV{}
+		if err := rows.Scan(
+			&(ffv.ID), &(ffv.CobID), &(ffv.ImgID),
+			&(ffv.FaceBox), &(ffv.Model), &(ffv.FacialFeaturesVector),
+		); err != nil {
+			return errors.Wrap(err, "unable to unmarshal query result")
+		}
+		if err := fn(ffv); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ScanImgsQuery ...
+const ScanImgsQuery = `
+SELECT
+    toString(id), ts, path, face_ids
+FROM
+    imgs;
+`
+
+// ScanImgs ...
+func (fs *ClickHouseFaceStorage) ScanImgs(fn func(img *Img) error) error {
+	rows, err := fs.db.Query(ScanImgsQuery)
+	if err != nil {
+		return errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		img := &Img{}
+		if err := rows.Scan(&(img.ID), &(img.TS), &(img.Path), &(img.FaceIDs)); err != nil {
+			return errors.Wrap(err, "unable to unmarshal query result")
+		}
+		if err := fn(img); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// CountFFVsQuery ...
+const CountFFVsQuery = `
+SELECT
+    count()
+FROM
+    facial_features;
+`
+
+// CountFFVs ...
+func (fs *ClickHouseFaceStorage) CountFFVs() (uint64, error) {
+	n := uint64(0)
+	if err := fs.db.QueryRow(CountFFVsQuery).Scan(&n); err != nil {
+		return 0, errors.Wrap(err, "unable to execute query")
+	}
+	return n, nil
+}
+
+// CountControlObjectVersionsQuery counts all versions of control object, including deleted ones.
+const CountControlObjectVersionsQuery = `
+SELECT
+    count()
+FROM
+    control_objects
+WHERE
+    id = toUUID(?);
+`
+
+// CountControlObjectFFVsQuery ...
+const CountControlObjectFFVsQuery = `
+SELECT
+    count()
+FROM
+    facial_features
+WHERE
+    cob_id = toUUID(?);
+`
+
+// EraseFFVsQuery ...
+const EraseFFVsQuery = `
+ALTER TABLE
+    facial_features
+DELETE WHERE
+    cob_id = toUUID(?);
+`
+
+// EraseCentroidsQuery ...
+const EraseCentroidsQuery = `
+ALTER TABLE
+    centroids
+DELETE WHERE
+    cob_id = toUUID(?);
+`
+
+// DeleteImgsQuery ...
+const DeleteImgsQuery = `
+ALTER TABLE
+    imgs
+DELETE WHERE
+    toString(id) IN (?);
+`
+
+// EraseControlObjectFromImgsQuery ...
+const EraseControlObjectFromImgsQuery = `
+ALTER TABLE
+    imgs
+UPDATE
+    face_ids = arrayFilter(x -> (x != toUUID(?)), face_ids)
+WHERE
+    has(face_ids, toUUID(?));
+`
+
+// EraseControlObjectVersionsQuery ...
+const EraseControlObjectVersionsQuery = `
+ALTER TABLE
+    control_objects
+DELETE WHERE
+    id = toUUID(?);
+`
+
+// InsertErasureQuery ...
+const InsertErasureQuery = `
+INSERT INTO
+    erasures
+    (id, ts, cob_id,
+     reason, requested_by,
+     ffvs_num, imgs_num, deleted_imgs_num,
+     sightings_num, clusters_num, audit_records_num)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// EraseControlObject deletes all versions of control object, its facial features vectors,
+// sightings, promoted clusters and images, containing only it, removes it from other images
+// and shreds its audit records. ClickHouse DB applies
+// these mutations asynchronously. Tombstone is written after all mutations were accepted,
+// so erasure may be safely retried on error.
+func (fs *ClickHouseFaceStorage) EraseControlObject(id, reason, requestedBy string) (*proto.Erasure, []Img, error) {
+	cobsNum := uint64(0)
+	if err := fs.db.QueryRow(CountControlObjectVersionsQuery, id).Scan(&cobsNum); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to count control object versions")
+	}
+	ffvsNum := uint64(0)
+	if err := fs.db.QueryRow(CountControlObjectFFVsQuery, id).Scan(&ffvsNum); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to count control object facial features vectors")
+	}
+	if (cobsNum == 0) && (ffvsNum == 0) {
+		return nil, nil, nil
+	}
+
+	imgs, err := fs.SelectImgsByControlObject(&proto.ControlObject{ID: id})
+	if err != nil {
+		return nil, nil, err
+	}
+	orphanImgs, orphanImgsIDs := splitOrphanImgs(imgs, id)
+
+	if _, err := fs.db.Exec(EraseFFVsQuery, id); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to erase facial features vectors")
+	}
+	if _, err := fs.db.Exec(EraseCentroidsQuery, id); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to erase centroids")
+	}
+	if len(orphanImgsIDs) != 0 {
+		if _, err := fs.db.Exec(DeleteImgsQuery, orphanImgsIDs); err != nil {
+			return nil, nil, errors.Wrap(err, "unable to delete images")
+		}
+	}
+	if len(imgs) != len(orphanImgs) {
+		if _, err := fs.db.Exec(EraseControlObjectFromImgsQuery, id, id); err != nil {
+			return nil, nil, errors.Wrap(err, "unable to erase control object from images")
+		}
+	}
+	if _, err := fs.db.Exec(EraseControlObjectVersionsQuery, id); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to erase control object")
+	}
+	sightingsNum, sightingsImgs, err := fs.eraseSightings(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fs.eraseFromWatchlists(id); err != nil {
+		return nil, nil, err
+	}
+	clustersNum, err := fs.eraseClusters(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	auditRecordsNum, err := fs.shredAuditRecords(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	erasure := createErasure(id, reason, requestedBy, ffvsNum, sightingsNum, imgs, orphanImgs)
+	erasure.ClustersNum, erasure.AuditRecordsNum = clustersNum, auditRecordsNum
+	orphanImgs = append(orphanImgs, sightingsImgs...)
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to begin insert")
+	}
+	stmt, err := tx.Prepare(InsertErasureQuery)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, errors.Wrap(err, "unable to prepare SQL-statement")
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(
+		clickhouse.UUID(erasure.ID),
+		erasure.TS,
+		clickhouse.UUID(erasure.CobID),
+		erasure.Reason,
+		erasure.RequestedBy,
+		erasure.FFVsNum,
+		erasure.ImgsNum,
+		erasure.DeletedImgsNum,
+		erasure.SightingsNum,
+		erasure.ClustersNum,
+		erasure.AuditRecordsNum,
+	); err != nil {
+		tx.Rollback()
+		return nil, nil, errors.Wrap(err, "unable to execute insert")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to commit insert")
+	}
+
+	return erasure, orphanImgs, nil
+}
+
+// SelectErasuresQuery ...
+const SelectErasuresQuery = `
+SELECT
+    id, ts, cob_id,
+    reason, requested_by,
+    ffvs_num, imgs_num, deleted_imgs_num,
+    sightings_num, clusters_num, audit_records_num
+FROM
+    erasures
+ORDER BY ts DESC, id ASC
+LIMIT ?, ?;
+`
+
+// SelectErasures ...
+func (fs *ClickHouseFaceStorage) SelectErasures(offset, limit uint64) ([]proto.Erasure, error) {
+	rows, err := fs.db.Query(SelectErasuresQuery, offset, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	erasures := make([]proto.Erasure, 0, limit)
+	for rows.Next() {
+		erasure := proto.Erasure{}
+		if err := rows.Scan(
+			&(erasure.ID), &(erasure.TS), &(erasure.CobID),
+			&(erasure.Reason), &(erasure.RequestedBy),
+			&(erasure.FFVsNum), &(erasure.ImgsNum), &(erasure.DeletedImgsNum),
+			&(erasure.SightingsNum), &(erasure.ClustersNum), &(erasure.AuditRecordsNum),
+		); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		erasures = append(erasures, erasure)
+	}
+
+	return erasures, rows.Err()
+}
+
+// RevertControlObjectsQuery deletes control objects, which have no facial features vectors.
+// Deletion of facial features vectors may be not applied yet, so they are skipped explicitly.
+const RevertControlObjectsQuery = `
+ALTER TABLE
+    control_objects
+DELETE WHERE
+    (toString(id) IN (?)) AND
+    (id NOT IN (SELECT cob_id FROM facial_features WHERE NOT has(?, toString(id))));
+`
+
+// RevertInserts ...
+func (fs *ClickHouseFaceStorage) RevertInserts(cobIDs, imgIDs, ffvIDs []string) error {
+	if err := fs.DeleteFFVs(ffvIDs); err != nil {
+		return errors.Wrap(err, "unable to delete facial features vectors")
+	}
+	if len(imgIDs) != 0 {
+		if _, err := fs.db.Exec(DeleteImgsQuery, imgIDs); err != nil {
+			return errors.Wrap(err, "unable to delete images")
+		}
+	}
+	if len(cobIDs) != 0 {
+		if _, err := fs.db.Exec(RevertControlObjectsQuery, cobIDs, clickhouse.Array(ffvIDs)); err != nil {
+			return errors.Wrap(err, "unable to delete control objects")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package storages
+
+import (
+	"github.com/kshvakov/clickhouse"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+)
+
+// MergeControlObjectInImgsQuery replaces duplicate by survivor in images.
+const MergeControlObjectInImgsQuery = `
+ALTER TABLE
+    imgs
+UPDATE
+    face_ids = arrayMap(x -> if(x = toUUID(?), toUUID(?), x), face_ids)
+WHERE
+    has(face_ids, toUUID(?));
+`
+
+// MergeSightingsQuery ...
+const MergeSightingsQuery = `
+ALTER TABLE
+    sightings
+UPDATE
+    cob_id = toUUID(?)
+WHERE
+    cob_id = toUUID(?);
+`
+
+// MergeAlertsQuery ...
+const MergeAlertsQuery = `
+ALTER TABLE
+    alerts
+UPDATE
+    cob_id = toUUID(?)
+WHERE
+    cob_id = toUUID(?);
+`
+
+// MergeControlObjectInWatchlistsQuery replaces duplicate by survivor in all watchlists versions.
+const MergeControlObjectInWatchlistsQuery = `
+ALTER TABLE
+    watchlists
+UPDATE
+    cob_ids = arrayDistinct(arrayMap(x -> if(x = toUUID(?), toUUID(?), x), cob_ids))
+WHERE
+    has(cob_ids, toUUID(?));
+`
+
+// InsertMergeQuery ...
+const InsertMergeQuery = `
+INSERT INTO
+    merges
+    (id, ts,
+     survivor_id, duplicate_id,
+     requested_by,
+     ffvs_num, imgs_num, sightings_num)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// MergeControlObjects re-inserts facial features vectors of duplicate with survivor ID, replaces
+// duplicate by survivor in other tables and deletes it. ClickHouse DB applies these mutations
+// asynchronously. Vectors, which were already re-inserted, are skipped, and merge record is
+// written after all mutations were accepted, so merge may be safely retried on error.
+func (fs *ClickHouseFaceStorage) MergeControlObjects(survivorID, duplicateID, requestedBy string) (*proto.Merge, error) {
+	ffvs, err := fs.SelectFFVsByControlObject(duplicateID)
+	if err != nil {
+		return nil, err
+	}
+	survivorFFVs, err := fs.SelectFFVsByControlObject(survivorID)
+	if err != nil {
+		return nil, err
+	}
+	movedIDs := make(map[string]struct{}, len(survivorFFVs))
+	for _, ffv := range survivorFFVs {
+		movedIDs[ffv.ID] = struct{}{}
+	}
+	rows := make([][]interface{}, 0, len(ffvs))
+	for _, ffv := range ffvs {
+		if _, ok := movedIDs[ffv.ID]; ok {
+			continue
+		}
+		rows = append(rows, []interface{}{
+			clickhouse.UUID(ffv.ID),
+			clickhouse.UUID(survivorID),
+			clickhouse.UUID(ffv.ImgID),
+			clickhouse.Array(ffv.FaceBox),
+			clickhouse.Array(ffv.FacialFeaturesVector),
+			ffv.Model,
+			uint16(len(ffv.FacialFeaturesVector)),
+		})
+	}
+	if len(rows) != 0 {
+		if err := fs.ffvsWriter.write(rows); err != nil {
+			return nil, errors.Wrap(err, "unable to move facial features vectors")
+		}
+	}
+
+	imgs, err := fs.SelectImgsByControlObject(&proto.ControlObject{ID: duplicateID})
+	if err != nil {
+		return nil, err
+	}
+	sightingsNum := uint64(0)
+	if err := fs.db.QueryRow(CountControlObjectSightingsQuery, duplicateID).Scan(&sightingsNum); err != nil {
+		return nil, errors.Wrap(err, "unable to count control object sightings")
+	}
+
+	if len(imgs) != 0 {
+		if _, err := fs.db.Exec(MergeControlObjectInImgsQuery, duplicateID, survivorID, duplicateID); err != nil {
+			return nil, errors.Wrap(err, "unable to replace control object in images")
+		}
+	}
+	if sightingsNum != 0 {
+		if _, err := fs.db.Exec(MergeSightingsQuery, survivorID, duplicateID); err != nil {
+			return nil, errors.Wrap(err, "unable to move sightings")
+		}
+	}
+	if _, err := fs.db.Exec(MergeAlertsQuery, survivorID, duplicateID); err != nil {
+		return nil, errors.Wrap(err, "unable to move alerts")
+	}
+	if _, err := fs.db.Exec(MergeControlObjectInWatchlistsQuery, duplicateID, survivorID, duplicateID); err != nil {
+		return nil, errors.Wrap(err, "unable to replace control object in watchlists")
+	}
+	if _, err := fs.db.Exec(EraseFFVsQuery, duplicateID); err != nil {
+		return nil, errors.Wrap(err, "unable to delete moved facial features vectors")
+	}
+	if _, err := fs.DeleteControlObject(duplicateID); err != nil {
+		return nil, errors.Wrap(err, "unable to delete duplicate control object")
+	}
+
+	merge := createMerge(survivorID, duplicateID, requestedBy,
+		uint64(len(ffvs)), uint64(len(imgs)), sightingsNum)
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to begin insert")
+	}
+	stmt, err := tx.Prepare(InsertMergeQuery)
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "unable to prepare SQL-statement")
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(
+		clickhouse.UUID(merge.ID),
+		merge.TS,
+		clickhouse.UUID(merge.SurvivorID),
+		clickhouse.UUID(merge.DuplicateID),
+		merge.RequestedBy,
+		merge.FFVsNum,
+		merge.ImgsNum,
+		merge.SightingsNum,
+	); err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "unable to execute insert")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "unable to commit insert")
+	}
+
+	return merge, nil
+}
+
+// SelectMergesQuery ...
+const SelectMergesQuery = `
+SELECT
+    toString(id), ts,
+    toString(survivor_id), toString(duplicate_id),
+    requested_by,
+    ffvs_num, imgs_num, sightings_num
+FROM
+    merges
+ORDER BY ts DESC, id ASC
+LIMIT ?, ?;
+`
+
+// SelectMerges ...
+func (fs *ClickHouseFaceStorage) SelectMerges(offset, limit uint64) ([]proto.Merge, error) {
+	rows, err := fs.db.Query(SelectMergesQuery, offset, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	merges := make([]proto.Merge, 0, limit)
+	for rows.Next() {
+		merge := proto.Merge{}
+		if err := rows.Scan(
+			&(merge.ID), &(merge.TS),
+			&(merge.SurvivorID), &(merge.DuplicateID),
+			&(merge.RequestedBy),
+			&(merge.FFVsNum), &(merge.ImgsNum), &(merge.SightingsNum),
+		); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		merges = append(merges, merge)
+	}
+
+	return merges, rows.Err()
+}
@@ -0,0 +1,321 @@
+package storages
+
+import (
+	"time"
+
+	"github.com/kshvakov/clickhouse"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+)
+
+// SelectExpiredSightingsImgsQuery ...
+const SelectExpiredSightingsImgsQuery = `
+SELECT
+    toString(img_id), any(img_path)
+FROM
+    sightings
+WHERE
+    (ts < toDateTime(?)) AND
+    (img_path != '') AND
+    (img_id NOT IN (SELECT id FROM imgs))
+GROUP BY img_id
+LIMIT ?;
+`
+
+// SelectExpiredSightingsImgs ...
+func (fs *ClickHouseFaceStorage) SelectExpiredSightingsImgs(before time.Time, limit uint64) ([]Img, error) {
+	rows, err := fs.db.Query(SelectExpiredSightingsImgsQuery, dateTime(before, 0), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	imgs := make([]Img, 0, 128)
+	for rows.Next() {
+		img := Img{}
+		if err := rows.Scan(&(img.ID), &(img.Path)); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		imgs = append(imgs, img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select sightings images")
+	}
+
+	return imgs, nil
+}
+
+// ClearSightingsImgsQuery ...
+const ClearSightingsImgsQuery = `
+ALTER TABLE
+    sightings
+UPDATE
+    img_path = ''
+WHERE
+    toString(img_id) IN (?);
+`
+
+// ClearAlertsImgsQuery ...
+const ClearAlertsImgsQuery = `
+ALTER TABLE
+    alerts
+UPDATE
+    img_path = ''
+WHERE
+    toString(img_id) IN (?);
+`
+
+// ClearSightingsImgs clears images paths. ClickHouse DB applies these mutations asynchronously,
+// so images may be selected as expired once again until they are applied.
+func (fs *ClickHouseFaceStorage) ClearSightingsImgs(imgIDs []string) error {
+	if len(imgIDs) == 0 {
+		return nil
+	}
+	if _, err := fs.db.Exec(ClearSightingsImgsQuery, imgIDs); err != nil {
+		return errors.Wrap(err, "unable to clear sightings images")
+	}
+	if _, err := fs.db.Exec(ClearAlertsImgsQuery, imgIDs); err != nil {
+		return errors.Wrap(err, "unable to clear alerts images")
+	}
+	return nil
+}
+
+// CountExpiredSightingsQuery ...
+const CountExpiredSightingsQuery = `
+SELECT
+    count()
+FROM
+    sightings
+WHERE
+    (ts < toDateTime(?)) AND
+    ((? = 0) OR (cob_id = toUUID(?))) AND
+    ((? = '') OR ((src_addr = ?) AND (cob_id != toUUID(?))));
+`
+
+// SelectExpiredSightingsOrphanImgsQuery selects images, on which only expired sightings were found.
+// All sightings of image have the same ts.
+const SelectExpiredSightingsOrphanImgsQuery = `
+SELECT
+    toString(img_id), any(img_path)
+FROM
+    sightings
+WHERE
+    (ts < toDateTime(?)) AND
+    (img_path != '') AND
+    (img_id NOT IN (SELECT id FROM imgs))
+GROUP BY img_id
+HAVING countIf(NOT (
+    ((? = 0) OR (cob_id = toUUID(?))) AND
+    ((? = '') OR ((src_addr = ?) AND (cob_id != toUUID(?)))))) = 0;
+`
+
+// DeleteExpiredSightingsQuery ...
+const DeleteExpiredSightingsQuery = `
+ALTER TABLE
+    sightings
+DELETE WHERE
+    (ts < toDateTime(?)) AND
+    ((? = 0) OR (cob_id = toUUID(?))) AND
+    ((? = '') OR ((src_addr = ?) AND (cob_id != toUUID(?))));
+`
+
+// DeleteSightings deletes expired sightings. ClickHouse DB applies this mutation asynchronously.
+func (fs *ClickHouseFaceStorage) DeleteSightings(expiry *SightingsExpiry) (uint64, []Img, error) {
+	unmatched := uint8(0)
+	if expiry.Unmatched {
+		unmatched = 1
+	}
+	before := dateTime(expiry.Before, 0)
+
+	sightingsNum := uint64(0)
+	if err := fs.db.QueryRow(CountExpiredSightingsQuery, before,
+		unmatched, zeroUUID, expiry.SrcAddr, expiry.SrcAddr, zeroUUID).Scan(&sightingsNum); err != nil {
+		return 0, nil, errors.Wrap(err, "unable to count expired sightings")
+	}
+	if sightingsNum == 0 {
+		return 0, []Img{}, nil
+	}
+
+	rows, err := fs.db.Query(SelectExpiredSightingsOrphanImgsQuery, before,
+		unmatched, zeroUUID, expiry.SrcAddr, expiry.SrcAddr, zeroUUID)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "unable to execute query")
+	}
+	imgs := make([]Img, 0, 128)
+	for rows.Next() {
+		img := Img{}
+		if err := rows.Scan(&(img.ID), &(img.Path)); err != nil {
+			rows.Close()
+			return 0, nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		imgs = append(imgs, img)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, errors.Wrap(err, "unable to select sightings images")
+	}
+
+	if _, err := fs.db.Exec(DeleteExpiredSightingsQuery, before,
+		unmatched, zeroUUID, expiry.SrcAddr, expiry.SrcAddr, zeroUUID); err != nil {
+		return 0, nil, errors.Wrap(err, "unable to delete expired sightings")
+	}
+
+	return sightingsNum, imgs, nil
+}
+
+// SelectExpiredImgsQuery ...
+const SelectExpiredImgsQuery = `
+SELECT
+    toString(id), ts, path, face_ids
+FROM
+    imgs
+WHERE
+    ts < toDateTime(?)
+LIMIT ?;
+`
+
+// SelectExpiredImgs returns images, which deletion may be not applied yet,
+// so they may be selected as expired once again until it is applied.
+func (fs *ClickHouseFaceStorage) SelectExpiredImgs(before time.Time, limit uint64) ([]Img, error) {
+	rows, err := fs.db.Query(SelectExpiredImgsQuery, dateTime(before, 0), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	imgs := make([]Img, 0, 128)
+	for rows.Next() {
+		img := Img{}
+		if err := rows.Scan(&(img.ID), &(img.TS), &(img.Path), &(img.FaceIDs)); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		imgs = append(imgs, img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select expired images")
+	}
+
+	return imgs, nil
+}
+
+// SelectFFVsByImgsQuery ...
+const SelectFFVsByImgsQuery = `
+SELECT
+    toString(id), toString(cob_id), toString(img_id),
+    fb, model, ff
+FROM
+    facial_features
+WHERE
+    toString(img_id) IN (?)
+ORDER BY id;
+`
+
+// SelectFFVsByImgs ...
+func (fs *ClickHouseFaceStorage) SelectFFVsByImgs(imgIDs []string) ([]FFV, error) {
+	if len(imgIDs) == 0 {
+		return []FFV{}, nil
+	}
+	rows, err := fs.db.Query(SelectFFVsByImgsQuery, imgIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	return scanFFVs(rows)
+}
+
+// DeleteImgs deletes images records. ClickHouse DB applies this mutation asynchronously.
+func (fs *ClickHouseFaceStorage) DeleteImgs(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := fs.db.Exec(DeleteImgsQuery, ids); err != nil {
+		return errors.Wrap(err, "unable to delete images")
+	}
+	return nil
+}
+
+// InsertPurgeQuery ...
+const InsertPurgeQuery = `
+INSERT INTO
+    purges
+    (id, ts,
+     imgs_num, failed_imgs_num,
+     unmatched_faces_num, sources_faces_num,
+     sightings_num,
+     cob_imgs_num, ffvs_num)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// InsertPurge ...
+func (fs *ClickHouseFaceStorage) InsertPurge(purge *proto.Purge) error {
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin insert")
+	}
+	stmt, err := tx.Prepare(InsertPurgeQuery)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to prepare SQL-statement")
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(
+		clickhouse.UUID(purge.ID),
+		purge.TS,
+		purge.ImgsNum,
+		purge.FailedImgsNum,
+		purge.UnmatchedFacesNum,
+		purge.SourcesFacesNum,
+		purge.SightingsNum,
+		purge.CobImgsNum,
+		purge.FFVsNum,
+	); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "unable to execute insert")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "unable to commit insert")
+	}
+
+	return nil
+}
+
+// SelectPurgesQuery ...
+const SelectPurgesQuery = `
+SELECT
+    toString(id), ts,
+    imgs_num, failed_imgs_num,
+    unmatched_faces_num, sources_faces_num,
+    sightings_num,
+    cob_imgs_num, ffvs_num
+FROM
+    purges
+ORDER BY ts DESC, id ASC
+LIMIT ?, ?;
+`
+
+// SelectPurges ...
+func (fs *ClickHouseFaceStorage) SelectPurges(offset, limit uint64) ([]proto.Purge, error) {
+	rows, err := fs.db.Query(SelectPurgesQuery, offset, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	purges := make([]proto.Purge, 0, limit)
+	for rows.Next() {
+		purge := proto.Purge{}
+		if err := rows.Scan(
+			&(purge.ID), &(purge.TS),
+			&(purge.ImgsNum), &(purge.FailedImgsNum),
+			&(purge.UnmatchedFacesNum), &(purge.SourcesFacesNum),
+			&(purge.SightingsNum),
+			&(purge.CobImgsNum), &(purge.FFVsNum),
+		); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		purges = append(purges, purge)
+	}
+
+	return purges, rows.Err()
+}
@@ -0,0 +1,260 @@
+package storages
+
+import (
+	"math"
+	"time"
+
+	"github.com/kshvakov/clickhouse"
+	"github.com/pkg/errors"
+)
+
+/*
+Sightings are partitioned by day and ordered by (ts, id), so queries by time range
+read only needed partitions and parts of primary index, and pages are selected by
+cursor (ts and id of the last sighting of previous page) instead of offset, which
+would make ClickHouse DB read and skip all previous pages.
+*/
+
+const (
+	// zeroUUID is stored as sightings cob_id, if face wasn't matched.
+	zeroUUID = "00000000-0000-0000-0000-000000000000"
+	maxUUID  = "ffffffff-ffff-ffff-ffff-ffffffffffff"
+)
+
+// InsertSightingsQuery ...
+const InsertSightingsQuery = `
+INSERT INTO
+    sightings
+    (id, ts, src_addr,
+     img_id, img_path,
+     fb, model, ff,
+     cob_id, score)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// InsertSightings ...
+func (fs *ClickHouseFaceStorage) InsertSightings(sightings []Sighting) error {
+	rows := make([][]interface{}, 0, len(sightings))
+	for _, s := range sightings {
+		cobID := s.CobID
+		if cobID == "" {
+			cobID = zeroUUID
+		}
+		rows = append(rows, []interface{}{
+			clickhouse.UUID(s.ID),
+			s.TS,
+			s.SrcAddr,
+			clickhouse.UUID(s.ImgID),
+			s.ImgPath,
+			clickhouse.Array(s.FaceBox),
+			s.Model,
+			clickhouse.Array(s.FacialFeaturesVector),
+			clickhouse.UUID(cobID),
+			s.Score,
+		})
+	}
+	return fs.sightingsWriter.write(rows)
+}
+
+// CountControlObjectSightingsQuery ...
+const CountControlObjectSightingsQuery = `
+SELECT
+    count()
+FROM
+    sightings
+WHERE
+    cob_id = toUUID(?);
+`
+
+// SelectOrphanSightingsImgsQuery selects images, on which only control object was sighted.
+const SelectOrphanSightingsImgsQuery = `
+SELECT
+    toString(img_id), any(img_path)
+FROM
+    sightings
+WHERE
+    (img_path != '') AND
+    (img_id IN (SELECT img_id FROM sightings WHERE cob_id = toUUID(?)))
+GROUP BY img_id
+HAVING countIf(cob_id != toUUID(?)) = 0;
+`
+
+// EraseSightingsQuery ...
+const EraseSightingsQuery = `
+ALTER TABLE
+    sightings
+DELETE WHERE
+    cob_id = toUUID(?);
+`
+
+// eraseSightings deletes all sightings of control object and returns their number
+// and images, on which only it was sighted.
+func (fs *ClickHouseFaceStorage) eraseSightings(cobID string) (uint64, []Img, error) {
+	sightingsNum := uint64(0)
+	if err := fs.db.QueryRow(CountControlObjectSightingsQuery, cobID).Scan(&sightingsNum); err != nil {
+		return 0, nil, errors.Wrap(err, "unable to count control object sightings")
+	}
+	if sightingsNum == 0 {
+		return 0, []Img{}, nil
+	}
+
+	rows, err := fs.db.Query(SelectOrphanSightingsImgsQuery, cobID, cobID)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "unable to execute query")
+	}
+	imgs := make([]Img, 0, 16)
+	for rows.Next() {
+		img := Img{}
+		if err := rows.Scan(&(img.ID), &(img.Path)); err != nil {
+			rows.Close()
+			return 0, nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		imgs = append(imgs, img)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, errors.Wrap(err, "unable to select sightings images")
+	}
+
+	if _, err := fs.db.Exec(EraseSightingsQuery, cobID); err != nil {
+		return 0, nil, errors.Wrap(err, "unable to erase sightings")
+	}
+
+	return sightingsNum, imgs, nil
+}
+
+// SelectSightingsQuery ...
+const SelectSightingsQuery = `
+SELECT
+    toString(id), ts, src_addr,
+    toString(img_id), img_path,
+    fb, model,
+    toString(cob_id), score
+FROM
+    sightings
+WHERE
+    (ts >= toDateTime(?)) AND
+    (ts < toDateTime(?)) AND
+    ((ts < toDateTime(?)) OR ((ts = toDateTime(?)) AND (id < toUUID(?)))) AND
+    ((? = '') OR (toString(cob_id) = ?)) AND
+    ((? = '') OR (src_addr = ?)) AND
+    (score >= ?)
+ORDER BY ts DESC, id DESC
+LIMIT ?;
+`
+
+// dateTime returns ClickHouse DB DateTime value of t, or def, if t is zero.
+func dateTime(t time.Time, def uint32) uint32 {
+	if t.IsZero() || (t.Unix() < 0) {
+		return def
+	}
+	if t.Unix() > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(t.Unix())
+}
+
+// SelectSightings ...
+func (fs *ClickHouseFaceStorage) SelectSightings(filter *SightingsFilter, limit uint64) ([]Sighting, error) {
+	afterTS := uint32(math.MaxUint32)
+	afterID := maxUUID
+	if filter.After != nil {
+		afterTS = dateTime(filter.After.TS, math.MaxUint32)
+		afterID = filter.After.ID
+	}
+	rows, err := fs.db.Query(SelectSightingsQuery,
+		dateTime(filter.From, 0), dateTime(filter.To, math.MaxUint32),
+		afterTS, afterTS, afterID,
+		filter.CobID, filter.CobID,
+		filter.SrcAddr, filter.SrcAddr,
+		filter.MinScore,
+		limit,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	sightings := make([]Sighting, 0, limit)
+	for rows.Next() {
+		s := Sighting{}
+		if err := rows.Scan(&(s.ID), &(s.TS), &(s.SrcAddr),
+			&(s.ImgID), &(s.ImgPath), &(s.FaceBox), &(s.Model),
+			&(s.CobID), &(s.Score)); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		if s.CobID == zeroUUID {
+			s.CobID = ""
+		}
+		sightings = append(sightings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select sightings")
+	}
+
+	return sightings, nil
+}
+
+// SelectSightingImgPathQuery ...
+const SelectSightingImgPathQuery = `
+SELECT
+    img_path
+FROM
+    sightings
+WHERE
+    (ts = toDateTime(?)) AND
+    (img_id = toUUID(?)) AND
+    (img_path != '')
+LIMIT 1;
+`
+
+// SelectSightingImgPath ...
+func (fs *ClickHouseFaceStorage) SelectSightingImgPath(imgID string, ts time.Time) (string, error) {
+	rows, err := fs.db.Query(SelectSightingImgPathQuery, dateTime(ts, 0), imgID)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	imgPath := ""
+	if rows.Next() {
+		if err := rows.Scan(&imgPath); err != nil {
+			return "", errors.Wrap(err, "unable to unmarshal query result")
+		}
+	}
+
+	return imgPath, nil
+}
+
+// ScanSightingsImgsQuery ...
+const ScanSightingsImgsQuery = `
+SELECT
+    toString(img_id), min(ts), any(img_path)
+FROM
+    sightings
+WHERE
+    img_path != ''
+GROUP BY img_id;
+`
+
+// ScanSightingsImgs ...
+func (fs *ClickHouseFaceStorage) ScanSightingsImgs(fn func(img *Img) error) error {
+	rows, err := fs.db.Query(ScanSightingsImgsQuery)
+	if err != nil {
+		return errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		img := &Img{}
+		if err := rows.Scan(&(img.ID), &(img.TS), &(img.Path)); err != nil {
+			return errors.Wrap(err, "unable to unmarshal query result")
+		}
+		if err := fn(img); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,214 @@
+package storages
+
+import (
+	"math"
+
+	"github.com/kshvakov/clickhouse"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+)
+
+// InsertWatchlistsQuery ...
+const InsertWatchlistsQuery = `
+INSERT INTO
+    watchlists
+    (id, name, threshold,
+     webhooks, cooldown_s,
+     cob_ids, deleted)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?);
+`
+
+func watchlistRow(wl *proto.Watchlist, deleted uint8) []interface{} {
+	return []interface{}{
+		clickhouse.UUID(wl.ID),
+		wl.Name,
+		wl.Threshold,
+		clickhouse.Array(wl.AlertPolicy.Webhooks),
+		wl.AlertPolicy.CooldownS,
+		clickhouse.Array(wl.CobIDs),
+		deleted,
+	}
+}
+
+// InsertWatchlist inserts new version of watchlist.
+func (fs *ClickHouseFaceStorage) InsertWatchlist(wl *proto.Watchlist) error {
+	return fs.watchlistsWriter.write([][]interface{}{watchlistRow(wl, 0)})
+}
+
+// SelectWatchlistsQuery ...
+const SelectWatchlistsQuery = `
+SELECT
+    toString(id), name, threshold,
+    webhooks, cooldown_s,
+    cob_ids
+FROM
+    watchlists FINAL
+WHERE
+    deleted = 0
+ORDER BY name, id;
+`
+
+// SelectWatchlists ...
+func (fs *ClickHouseFaceStorage) SelectWatchlists() ([]proto.Watchlist, error) {
+	rows, err := fs.db.Query(SelectWatchlistsQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	wls := make([]proto.Watchlist, 0, 16)
+	for rows.Next() {
+		wl := proto.Watchlist{}
+		if err := rows.Scan(
+			&(wl.ID), &(wl.Name), &(wl.Threshold),
+			&(wl.AlertPolicy.Webhooks), &(wl.AlertPolicy.CooldownS),
+			&(wl.CobIDs)); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		wls = append(wls, wl)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select watchlists")
+	}
+
+	return wls, nil
+}
+
+// DeleteWatchlist inserts new version of watchlist, marked as deleted.
+func (fs *ClickHouseFaceStorage) DeleteWatchlist(id string) (bool, error) {
+	wls, err := fs.SelectWatchlists()
+	if err != nil {
+		return false, err
+	}
+	for i := range wls {
+		if wls[i].ID == id {
+			return true, fs.watchlistsWriter.write([][]interface{}{watchlistRow(&(wls[i]), 1)})
+		}
+	}
+	return false, nil
+}
+
+// InsertAlertsQuery ...
+const InsertAlertsQuery = `
+INSERT INTO
+    alerts
+    (id, ts,
+     watchlist_id, watchlist_name,
+     cob_id, score, src_addr,
+     sighting_id, img_id, img_path,
+     fb)
+VALUES
+    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+
+// InsertAlerts ...
+func (fs *ClickHouseFaceStorage) InsertAlerts(alerts []Alert) error {
+	rows := make([][]interface{}, 0, len(alerts))
+	for _, a := range alerts {
+		rows = append(rows, []interface{}{
+			clickhouse.UUID(a.ID),
+			a.TS,
+			clickhouse.UUID(a.WatchlistID),
+			a.WatchlistName,
+			clickhouse.UUID(a.CobID),
+			a.Score,
+			a.SrcAddr,
+			clickhouse.UUID(a.SightingID),
+			clickhouse.UUID(a.ImgID),
+			a.ImgPath,
+			clickhouse.Array(a.FaceBox),
+		})
+	}
+	return fs.alertsWriter.write(rows)
+}
+
+// SelectAlertsQuery ...
+const SelectAlertsQuery = `
+SELECT
+    toString(id), ts,
+    toString(watchlist_id), watchlist_name,
+    toString(cob_id), score, src_addr,
+    toString(sighting_id), toString(img_id), img_path,
+    fb
+FROM
+    alerts
+WHERE
+    (ts >= toDateTime(?)) AND
+    (ts < toDateTime(?)) AND
+    ((ts < toDateTime(?)) OR ((ts = toDateTime(?)) AND (id < toUUID(?)))) AND
+    ((? = '') OR (toString(watchlist_id) = ?)) AND
+    ((? = '') OR (toString(cob_id) = ?)) AND
+    ((? = '') OR (src_addr = ?))
+ORDER BY ts DESC, id DESC
+LIMIT ?;
+`
+
+// SelectAlerts ...
+func (fs *ClickHouseFaceStorage) SelectAlerts(filter *AlertsFilter, limit uint64) ([]Alert, error) {
+	afterTS := uint32(math.MaxUint32)
+	afterID := maxUUID
+	if filter.After != nil {
+		afterTS = dateTime(filter.After.TS, math.MaxUint32)
+		afterID = filter.After.ID
+	}
+	rows, err := fs.db.Query(SelectAlertsQuery,
+		dateTime(filter.From, 0), dateTime(filter.To, math.MaxUint32),
+		afterTS, afterTS, afterID,
+		filter.WatchlistID, filter.WatchlistID,
+		filter.CobID, filter.CobID,
+		filter.SrcAddr, filter.SrcAddr,
+		limit,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to execute query")
+	}
+	defer rows.Close()
+
+	alerts := make([]Alert, 0, limit)
+	for rows.Next() {
+		a := Alert{}
+		if err := rows.Scan(&(a.ID), &(a.TS),
+			&(a.WatchlistID), &(a.WatchlistName),
+			&(a.CobID), &(a.Score), &(a.SrcAddr),
+			&(a.SightingID), &(a.ImgID), &(a.ImgPath),
+			&(a.FaceBox)); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal query result")
+		}
+		alerts = append(alerts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to select alerts")
+	}
+
+	return alerts, nil
+}
+
+// EraseControlObjectFromWatchlistsQuery removes control object from all watchlists versions.
+const EraseControlObjectFromWatchlistsQuery = `
+ALTER TABLE
+    watchlists
+UPDATE
+    cob_ids = arrayFilter(x -> (x != toUUID(?)), cob_ids)
+WHERE
+    has(cob_ids, toUUID(?));
+`
+
+// EraseAlertsQuery ...
+const EraseAlertsQuery = `
+ALTER TABLE
+    alerts
+DELETE WHERE
+    cob_id = toUUID(?);
+`
+
+// eraseFromWatchlists removes control object from watchlists and deletes its alerts.
+func (fs *ClickHouseFaceStorage) eraseFromWatchlists(cobID string) error {
+	if _, err := fs.db.Exec(EraseControlObjectFromWatchlistsQuery, cobID, cobID); err != nil {
+		return errors.Wrap(err, "unable to erase control object from watchlists")
+	}
+	if _, err := fs.db.Exec(EraseAlertsQuery, cobID); err != nil {
+		return errors.Wrap(err, "unable to erase alerts")
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package storages
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/kshvakov/clickhouse"
 	"github.com/nofacedb/facedb/internal/cfgparser"
@@ -20,6 +21,24 @@ func CreateClickHouseDBConn(cfg *cfgparser.StorageCFG, logger *log.Logger) (*sql
 	return db, nil
 }
 
+// CreateClickHouseDB creates database from config, if it doesn't exist.
+func CreateClickHouseDB(cfg *cfgparser.StorageCFG, logger *log.Logger) error {
+	defaultCFG := *cfg
+	defaultCFG.DefaultDB = "default"
+	db, err := CreateClickHouseDBConn(&defaultCFG, logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	query := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`;",
+		strings.Replace(cfg.DefaultDB, "`", "\\`", -1))
+	if _, err := db.Exec(query); err != nil {
+		return errors.Wrapf(err, "unable to create database \"%s\"", cfg.DefaultDB)
+	}
+	return nil
+}
+
 func createConnStr(cfg *cfgparser.StorageCFG) string {
 	connStr := fmt.Sprintf("tcp://%s:%d?username=%s&password=%s&database=%s&read_timeout=%d&write_timeout=%d&debug=%v",
 		cfg.Addr, cfg.Port, cfg.User, cfg.Password, cfg.DefaultDB, cfg.ReadTimeoutMS/1000, cfg.WriteTimeoutMS/1000, cfg.Debug)
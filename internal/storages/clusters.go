@@ -0,0 +1,151 @@
+package storages
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/clustering"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Faces, which weren't matched with any control object, are kept only as sightings.
+Clustering job groups the newest of them into anonymous identities (see clustering
+package) separately for every model and dimension and replaces all not promoted
+clusters with new ones, so clusters always reflect the latest job. Operator names
+cluster and promotes it: control object is created with cluster ID (so failed
+promotion may be safely retried), faces become its facial features vectors (with
+sightings IDs), images of sightings become its images, and sightings are assigned
+to it.
+*/
+
+// ErrClusterPromoted is returned on attempt to promote already promoted cluster.
+var ErrClusterPromoted = errors.New("cluster is already promoted")
+
+// ClusterSightings clusters up to limit newest unmatched sightings with from <= ts < to,
+// replaces stored not promoted clusters with found ones and returns them, the largest first.
+func ClusterSightings(fs FaceStorage, d *clustering.DBSCAN, from, to time.Time, limit uint64) ([]Cluster, error) {
+	sightings, err := fs.SelectUnmatchedSightings(from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	type groupKey struct {
+		model string
+		dim   int
+	}
+	groups := make(map[groupKey][]clustering.Point)
+	keys := make([]groupKey, 0, 4)
+	for _, s := range sightings {
+		if len(s.FacialFeaturesVector) == 0 {
+			continue
+		}
+		k := groupKey{s.Model, len(s.FacialFeaturesVector)}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], clustering.Point{
+			ID: s.ID,
+			FF: s.FacialFeaturesVector,
+		})
+	}
+
+	ts := time.Now()
+	clusters := make([]Cluster, 0, 16)
+	for _, k := range keys {
+		for _, c := range d.Cluster(groups[k]) {
+			clusters = append(clusters, Cluster{
+				ID:                uuid.Must(uuid.NewV4()).String(),
+				TS:                ts,
+				Model:             k.model,
+				SightingIDs:       c.IDs,
+				RepresentativeIDs: c.RepresentativeIDs,
+				Centroid:          c.Centroid,
+			})
+		}
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i].SightingIDs) > len(clusters[j].SightingIDs)
+	})
+
+	if err := fs.ReplaceClusters(clusters); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// PromoteCluster creates control object from cluster with all its faces and returns it.
+// It returns nil control object, if there is no such cluster.
+func PromoteCluster(fs FaceStorage, im *identities.Model, id string,
+	cob *proto.ControlObject, logger *log.Logger) (*proto.ControlObject, error) {
+	cluster, err := fs.SelectCluster(id)
+	if err != nil {
+		return nil, err
+	}
+	if cluster == nil {
+		return nil, nil
+	}
+	if cluster.CobID != "" {
+		return nil, ErrClusterPromoted
+	}
+	sightings, err := fs.SelectSightingsByIDs(cluster.SightingIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	cob.ID = cluster.ID
+	if cob.TS.IsZero() {
+		cob.TS = time.Now()
+	}
+	if err := fs.InsertControlObjects([]proto.ControlObject{*cob}); err != nil {
+		return nil, err
+	}
+
+	imgs := make([]Img, 0, len(sightings))
+	imgIDs := make(map[string]struct{}, len(sightings))
+	ffvs := make([]FFV, 0, len(sightings))
+	sightingIDs := make([]string, 0, len(sightings))
+	for _, s := range sightings {
+		if _, ok := imgIDs[s.ImgID]; !ok && (s.ImgPath != "") {
+			imgIDs[s.ImgID] = struct{}{}
+			imgs = append(imgs, Img{
+				ID:      s.ImgID,
+				TS:      s.TS,
+				Path:    s.ImgPath,
+				FaceIDs: []string{cob.ID},
+			})
+		}
+		ffvs = append(ffvs, FFV{
+			ID:                   s.ID,
+			CobID:                cob.ID,
+			ImgID:                s.ImgID,
+			FaceBox:              s.FaceBox,
+			Model:                s.Model,
+			FacialFeaturesVector: s.FacialFeaturesVector,
+		})
+		sightingIDs = append(sightingIDs, s.ID)
+	}
+	if err := fs.InsertImgs(imgs); err != nil {
+		return nil, err
+	}
+	if _, err := fs.InsertFFVs(ffvs); err != nil {
+		return nil, err
+	}
+	if err := fs.AssignSightings(sightingIDs, cob.ID); err != nil {
+		return nil, err
+	}
+	if err := RefreshCentroids(fs, im, []string{cob.ID}); err != nil {
+		return nil, err
+	}
+	if err := fs.PromoteCluster(cluster.ID, cob.ID); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("promoted cluster \"%s\" to control object (%d faces, %d images)",
+		cluster.ID, len(ffvs), len(imgs))
+	return cob, nil
+}
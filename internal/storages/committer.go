@@ -0,0 +1,538 @@
+package storages
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/encryption"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Committer writes all rows of one commit (new control objects, images and facial
+features vectors, found on them) to several tables, which can't be written in one
+transaction. Before writing, commit intent (with images data) is saved to write-ahead
+log directory, and it is removed only after the whole commit was applied, so after
+ClickHouse DB error or crash commit is replayed. All steps are idempotent:
+  - images are put to images store under keys, which depend only on their IDs and data;
+  - only not existing control objects are inserted;
+  - images records and facial features vectors with existing IDs are skipped.
+Facial features vectors are written last in one block, and then centroids of their
+control objects are rebuilt, so centroids are never updated by partially applied
+commit (and are rebuilt again on replay). Before the first write, IDs of rows, which
+don't exist yet, are saved to intent, because IDs are deterministic and commit may
+contain rows of earlier commits. Commit, which was not applied after max attempts,
+is compensated: only its created facial features vectors, images records, images and
+control objects, which have no other facial features vectors, are deleted, and then
+centroids are rebuilt. If face storage is encrypted,
+intents are encrypted by its cipher, because they contain images and personal data;
+not encrypted intents aren't replayed then.
+*/
+
+const (
+	walFileExt                = ".intent"
+	walCorruptedFileExt       = ".corrupted"
+	defaultWALRetryIntervalMS = 10000
+	defaultWALMaxAttempts     = 30
+)
+
+// CommitImg is an image with its record.
+type CommitImg struct {
+	Img  Img    `json:"img"`
+	Data []byte `json:"data"`
+}
+
+// CommitCreated contains IDs of rows of commit, which didn't exist before it.
+type CommitCreated struct {
+	CobIDs []string `json:"cob_ids"`
+	ImgIDs []string `json:"img_ids"`
+	FFVIDs []string `json:"ffv_ids"`
+}
+
+// Commit is a set of rows, which should be written all together.
+type Commit struct {
+	ID             string                `json:"id"`
+	TS             time.Time             `json:"ts"`
+	ControlObjects []proto.ControlObject `json:"control_objects"`
+	Imgs           []CommitImg           `json:"imgs"`
+	FFVs           []FFV                 `json:"ffvs"`
+	Created        *CommitCreated        `json:"created,omitempty"`
+	Attempts       int                   `json:"attempts"`
+	Compensate     bool                  `json:"compensate"`
+}
+
+// Committer applies commits through write-ahead log.
+type Committer struct {
+	fs          FaceStorage
+	imgStore    imgstores.ImgStore
+	im          *identities.Model
+	cipher      *encryption.Cipher
+	dir         string
+	maxAttempts int
+	mu          sync.Mutex
+	inflight    map[string]struct{}
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	logger      *log.Logger
+}
+
+// CreateCommitter creates write-ahead log directory, replays all pending commits
+// and runs their periodical replay.
+func CreateCommitter(fs FaceStorage, imgStore imgstores.ImgStore, im *identities.Model,
+	cfg *cfgparser.WALCFG, logger *log.Logger) (*Committer, error) {
+	maxAttempts := cfg.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = defaultWALMaxAttempts
+	}
+	c := &Committer{
+		fs:          fs,
+		imgStore:    imgStore,
+		im:          im,
+		dir:         cfg.Path,
+		maxAttempts: maxAttempts,
+		mu:          sync.Mutex{},
+		inflight:    make(map[string]struct{}),
+		stop:        make(chan struct{}),
+		logger:      logger,
+	}
+	if efs := FindEncryptedFaceStorage(fs); efs != nil {
+		c.cipher = efs.cipher
+	}
+	if c.dir == "" {
+		logger.Warn("write-ahead log path is not specified, partially applied commits won't be replayed")
+		return c, nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "unable to create write-ahead log directory")
+	}
+
+	c.Replay()
+	retryIntervalMS := cfg.RetryIntervalMS
+	if retryIntervalMS <= 0 {
+		retryIntervalMS = defaultWALRetryIntervalMS
+	}
+	c.runReplayer(time.Duration(retryIntervalMS) * time.Millisecond)
+
+	return c, nil
+}
+
+// Commit saves commit intent and applies it. If commit was not applied,
+// it is left in write-ahead log to be replayed later.
+func (c *Committer) Commit(commit *Commit) error {
+	if !c.acquire(commit.ID) {
+		return errors.Errorf("commit \"%s\" is already being applied", commit.ID)
+	}
+	defer c.release(commit.ID)
+
+	commit.Created = nil
+	commit.Attempts = 0
+	commit.Compensate = false
+	if err := c.save(commit); err != nil {
+		return err
+	}
+	return c.attempt(commit)
+}
+
+// Replay applies or compensates all pending commits.
+func (c *Committer) Replay() {
+	if c.dir == "" {
+		return
+	}
+	names, err := c.pending()
+	if err != nil {
+		c.logger.Error(err)
+		return
+	}
+	for _, name := range names {
+		id := strings.TrimSuffix(name, walFileExt)
+		if !c.acquire(id) {
+			continue
+		}
+		commit, err := c.load(name)
+		if err != nil {
+			c.logger.Error(err)
+			path := filepath.Join(c.dir, name)
+			if err := os.Rename(path, path+walCorruptedFileExt); err != nil {
+				c.logger.Error(errors.Wrap(err, "unable to move aside corrupted commit intent file"))
+			}
+		} else if err := c.attempt(commit); err != nil {
+			c.logger.Warn(err)
+		}
+		c.release(id)
+	}
+}
+
+// Close stops replaying pending commits.
+func (c *Committer) Close() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+func (c *Committer) runReplayer(interval time.Duration) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.Replay()
+			}
+		}
+	}()
+}
+
+func (c *Committer) acquire(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.inflight[id]; ok {
+		return false
+	}
+	c.inflight[id] = struct{}{}
+	return true
+}
+
+func (c *Committer) release(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, id)
+}
+
+// attempt applies (or compensates) commit once and removes it from log on success.
+func (c *Committer) attempt(commit *Commit) error {
+	commit.Attempts++
+	var err error
+	if commit.Compensate {
+		err = c.compensate(commit)
+	} else {
+		err = c.apply(commit)
+	}
+	if err == nil {
+		if commit.Compensate {
+			c.logger.Warnf("commit \"%s\" was compensated after %d attempts", commit.ID, commit.Attempts)
+		} else if commit.Attempts > 1 {
+			c.logger.Infof("commit \"%s\" was replayed after %d attempts", commit.ID, commit.Attempts)
+		}
+		return c.remove(commit.ID)
+	}
+
+	if !commit.Compensate && (commit.Attempts >= c.maxAttempts) {
+		commit.Compensate = true
+		commit.Attempts = 0
+	}
+	if serr := c.save(commit); serr != nil {
+		c.logger.Error(serr)
+	}
+	if c.dir == "" {
+		return errors.Wrapf(err, "unable to apply commit \"%s\"; partial commit possible", commit.ID)
+	}
+	if commit.Compensate {
+		return errors.Wrapf(err, "unable to apply commit \"%s\"; it will be compensated", commit.ID)
+	}
+	return errors.Wrapf(err, "unable to apply commit \"%s\"; it will be replayed", commit.ID)
+}
+
+// created selects IDs of rows of commit, which don't exist yet.
+func (c *Committer) created(commit *Commit) (*CommitCreated, error) {
+	created := &CommitCreated{
+		CobIDs: make([]string, 0, len(commit.ControlObjects)),
+		ImgIDs: make([]string, 0, len(commit.Imgs)),
+		FFVIDs: make([]string, 0, len(commit.FFVs)),
+	}
+
+	existingIDs := make(map[string]struct{})
+	ids := make([]string, 0, len(commit.ControlObjects))
+	for _, cob := range commit.ControlObjects {
+		ids = append(ids, cob.ID)
+	}
+	if len(ids) != 0 {
+		cobs, err := c.fs.SelectControlObjectsByIDs(ids)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to select control objects")
+		}
+		for _, cob := range cobs {
+			existingIDs[cob.ID] = struct{}{}
+		}
+	}
+	for _, id := range ids {
+		if _, ok := existingIDs[id]; !ok {
+			created.CobIDs = append(created.CobIDs, id)
+		}
+	}
+
+	ids = make([]string, 0, len(commit.Imgs))
+	for _, ci := range commit.Imgs {
+		ids = append(ids, ci.Img.ID)
+	}
+	if len(ids) != 0 {
+		imgs, err := c.fs.SelectImgs(ids)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to select images")
+		}
+		for _, img := range imgs {
+			existingIDs[img.ID] = struct{}{}
+		}
+	}
+	for _, id := range ids {
+		if _, ok := existingIDs[id]; !ok {
+			created.ImgIDs = append(created.ImgIDs, id)
+		}
+	}
+
+	ids = make([]string, 0, len(commit.FFVs))
+	for _, ffv := range commit.FFVs {
+		ids = append(ids, ffv.ID)
+	}
+	if len(ids) != 0 {
+		ffvs, err := c.fs.SelectFFVs(ids)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to select ffvs")
+		}
+		for _, ffv := range ffvs {
+			existingIDs[ffv.ID] = struct{}{}
+		}
+	}
+	for _, id := range ids {
+		if _, ok := existingIDs[id]; !ok {
+			created.FFVIDs = append(created.FFVIDs, id)
+		}
+	}
+
+	return created, nil
+}
+
+func (c *Committer) apply(commit *Commit) error {
+	if commit.Created == nil {
+		created, err := c.created(commit)
+		if err != nil {
+			return err
+		}
+		commit.Created = created
+		if err := c.save(commit); err != nil {
+			commit.Created = nil
+			return err
+		}
+	}
+
+	imgs := make([]Img, 0, len(commit.Imgs))
+	for i := range commit.Imgs {
+		ci := &(commit.Imgs[i])
+		key, err := c.imgStore.Put(ci.Img.ID, ci.Data)
+		if err != nil {
+			return errors.Wrapf(err, "unable to store image \"%s\"", ci.Img.ID)
+		}
+		ci.Img.Path = key
+		imgs = append(imgs, ci.Img)
+	}
+
+	if len(commit.ControlObjects) != 0 {
+		ids := make([]string, 0, len(commit.ControlObjects))
+		for _, cob := range commit.ControlObjects {
+			ids = append(ids, cob.ID)
+		}
+		existingCobs, err := c.fs.SelectControlObjectsByIDs(ids)
+		if err != nil {
+			return errors.Wrap(err, "unable to select control objects")
+		}
+		existingIDs := make(map[string]struct{}, len(existingCobs))
+		for _, cob := range existingCobs {
+			existingIDs[cob.ID] = struct{}{}
+		}
+		cobs := make([]proto.ControlObject, 0, len(commit.ControlObjects))
+		for _, cob := range commit.ControlObjects {
+			if _, ok := existingIDs[cob.ID]; !ok {
+				cobs = append(cobs, cob)
+			}
+		}
+		if len(cobs) != 0 {
+			if err := c.fs.InsertControlObjects(cobs); err != nil {
+				return errors.Wrap(err, "unable to insert control objects")
+			}
+		}
+	}
+
+	if len(imgs) != 0 {
+		if err := c.fs.InsertImgs(imgs); err != nil {
+			return errors.Wrap(err, "unable to insert images")
+		}
+	}
+
+	if len(commit.FFVs) != 0 {
+		if _, err := c.fs.InsertFFVs(commit.FFVs); err != nil {
+			return errors.Wrap(err, "unable to insert ffvs")
+		}
+		cobIDs := make([]string, 0, len(commit.FFVs))
+		for _, ffv := range commit.FFVs {
+			cobIDs = append(cobIDs, ffv.CobID)
+		}
+		if err := RefreshCentroids(c.fs, c.im, cobIDs); err != nil {
+			return errors.Wrap(err, "unable to refresh centroids")
+		}
+	}
+
+	return nil
+}
+
+func (c *Committer) compensate(commit *Commit) error {
+	created := commit.Created
+	if created == nil {
+		// Nothing was written.
+		return nil
+	}
+	if err := c.fs.RevertInserts(created.CobIDs, created.ImgIDs, created.FFVIDs); err != nil {
+		return errors.Wrap(err, "unable to revert inserts")
+	}
+
+	if len(created.FFVIDs) != 0 {
+		removed := make(map[string]struct{}, len(created.FFVIDs))
+		for _, id := range created.FFVIDs {
+			removed[id] = struct{}{}
+		}
+		cobIDs := make([]string, 0, len(created.FFVIDs))
+		for _, ffv := range commit.FFVs {
+			if _, ok := removed[ffv.ID]; ok {
+				cobIDs = append(cobIDs, ffv.CobID)
+			}
+		}
+		// Deletion may be not applied yet, so vectors are skipped explicitly.
+		if err := refreshCentroids(c.fs, c.im, cobIDs, nil, removed); err != nil {
+			return errors.Wrap(err, "unable to refresh centroids")
+		}
+	}
+
+	createdImgs := make(map[string]struct{}, len(created.ImgIDs))
+	for _, id := range created.ImgIDs {
+		createdImgs[id] = struct{}{}
+	}
+	for _, ci := range commit.Imgs {
+		if _, ok := createdImgs[ci.Img.ID]; !ok {
+			continue
+		}
+		key, err := imgstores.ImgKey(ci.Img.ID, ci.Data)
+		if err != nil {
+			// Image was never stored.
+			continue
+		}
+		if err := c.imgStore.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walAAD returns additional data, which binds intent to commit ID.
+func walAAD(id string) []byte {
+	return []byte("wal:" + id)
+}
+
+func (c *Committer) path(id string) string {
+	return filepath.Join(c.dir, id+walFileExt)
+}
+
+// pending returns names of intents files, oldest first.
+func (c *Committer) pending() ([]string, error) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read write-ahead log directory")
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), walFileExt) {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// save atomically writes commit intent file.
+func (c *Committer) save(commit *Commit) error {
+	if c.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(commit)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal commit intent")
+	}
+	if c.cipher != nil {
+		if data, err = c.cipher.EncryptBytes(data, walAAD(commit.ID)); err != nil {
+			return errors.Wrap(err, "unable to encrypt commit intent")
+		}
+	}
+	f, err := ioutil.TempFile(c.dir, "."+commit.ID+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "unable to create commit intent file")
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(commit.ID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "unable to write commit intent file")
+	}
+	return c.syncDir()
+}
+
+func (c *Committer) load(name string) (*Commit, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read commit intent file")
+	}
+	if c.cipher != nil {
+		if data, err = c.cipher.DecryptBytes(data, walAAD(strings.TrimSuffix(name, walFileExt))); err != nil {
+			return nil, errors.Wrapf(err, "unable to decrypt commit intent file \"%s\"", name)
+		}
+	} else if encryption.IsEncryptedBytes(data) {
+		return nil, errors.Errorf("commit intent file \"%s\" is encrypted, but encryption is disabled", name)
+	}
+	commit := &Commit{}
+	if err := json.Unmarshal(data, commit); err != nil {
+		return nil, errors.Wrapf(err, "corrupted commit intent file \"%s\"", name)
+	}
+	return commit, nil
+}
+
+func (c *Committer) remove(id string) error {
+	if c.dir == "" {
+		return nil
+	}
+	if err := os.Remove(c.path(id)); (err != nil) && !os.IsNotExist(err) {
+		return errors.Wrap(err, "unable to remove commit intent file")
+	}
+	return c.syncDir()
+}
+
+func (c *Committer) syncDir() error {
+	d, err := os.Open(c.dir)
+	if err != nil {
+		return errors.Wrap(err, "unable to open write-ahead log directory")
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync write-ahead log directory")
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package storages
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+// failingFaceStorage fails inserts of facial features vectors failsNum times.
+type failingFaceStorage struct {
+	*MemoryFaceStorage
+	failsNum int
+}
+
+func (fs *failingFaceStorage) InsertFFVs(ffvs []FFV) ([]FFV, error) {
+	if fs.failsNum != 0 {
+		fs.failsNum--
+		return nil, errors.New("storage is unavailable")
+	}
+	return fs.MemoryFaceStorage.InsertFFVs(ffvs)
+}
+
+type committerTest struct {
+	dir      string
+	fs       *failingFaceStorage
+	imgStore *imgstores.FSImgStore
+	imgsDir  string
+	walDir   string
+	im       *identities.Model
+	logger   *log.Logger
+}
+
+func createCommitterTest(t *testing.T) *committerTest {
+	dir, err := ioutil.TempDir("", "facedb-committer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgsDir := filepath.Join(dir, "imgs")
+	imgStore, err := imgstores.CreateFSImgStore(imgsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := identities.CreateModel(&cfgparser.IdentitiesCFG{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	return &committerTest{
+		dir:      dir,
+		fs:       &failingFaceStorage{MemoryFaceStorage: CreateMemoryFaceStorage(0.95, -1)},
+		imgStore: imgStore,
+		imgsDir:  imgsDir,
+		walDir:   filepath.Join(dir, "wal"),
+		im:       im,
+		logger:   logger,
+	}
+}
+
+func (ct *committerTest) createCommitter(t *testing.T, maxAttempts int) *Committer {
+	c, err := CreateCommitter(ct.fs, ct.imgStore, ct.im, &cfgparser.WALCFG{
+		Path:            ct.walDir,
+		RetryIntervalMS: int(time.Hour / time.Millisecond),
+		MaxAttempts:     maxAttempts,
+	}, ct.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (ct *committerTest) pendingNum(t *testing.T) int {
+	infos, err := ioutil.ReadDir(ct.walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	num := 0
+	for _, info := range infos {
+		if filepath.Ext(info.Name()) == walFileExt {
+			num++
+		}
+	}
+	return num
+}
+
+func (ct *committerTest) imgFilesNum(t *testing.T) int {
+	num := 0
+	err := filepath.Walk(ct.imgsDir, func(path string, info os.FileInfo, err error) error {
+		if (err == nil) && !info.IsDir() {
+			num++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return num
+}
+
+func createTestCommit(id, cobID, imgID, ffvID string) *Commit {
+	return &Commit{
+		ID: id,
+		TS: time.Now(),
+		ControlObjects: []proto.ControlObject{{
+			ID:       cobID,
+			Passport: "passport-" + cobID,
+			Surname:  "Ivanov",
+		}},
+		Imgs: []CommitImg{{
+			Img: Img{
+				ID:      imgID,
+				TS:      time.Now(),
+				FaceIDs: []string{cobID},
+			},
+			Data: append([]byte("\x89PNG\r\n\x1a\n"), imgID...),
+		}},
+		FFVs: []FFV{{
+			ID:                   ffvID,
+			CobID:                cobID,
+			ImgID:                imgID,
+			Model:                "",
+			FacialFeaturesVector: proto.FacialFeaturesVector{1.0, 0.0, 0.0},
+		}},
+	}
+}
+
+func TestCommitter(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		failsNum    int
+		// existing commit is applied before commit, which shares its control object.
+		existing      bool
+		wantCommitErr bool
+		replaysNum    int
+		wantCobs      []string
+		wantFFVs      []string
+		wantImg       bool
+		wantImgFiles  int
+	}{
+		{
+			name:         "applied",
+			maxAttempts:  3,
+			wantCobs:     []string{"cob-1"},
+			wantFFVs:     []string{"ffv-1"},
+			wantImg:      true,
+			wantImgFiles: 1,
+		},
+		{
+			name:          "replayed",
+			maxAttempts:   3,
+			failsNum:      2,
+			wantCommitErr: true,
+			replaysNum:    2,
+			wantCobs:      []string{"cob-1"},
+			wantFFVs:      []string{"ffv-1"},
+			wantImg:       true,
+			wantImgFiles:  1,
+		},
+		{
+			name:          "compensated",
+			maxAttempts:   2,
+			failsNum:      100,
+			wantCommitErr: true,
+			replaysNum:    2,
+			wantCobs:      []string{},
+			wantFFVs:      []string{},
+			wantImgFiles:  0,
+		},
+		{
+			name:          "compensated with existing control object",
+			maxAttempts:   2,
+			failsNum:      100,
+			existing:      true,
+			wantCommitErr: true,
+			replaysNum:    2,
+			wantCobs:      []string{"cob-1"},
+			wantFFVs:      []string{"ffv-0"},
+			wantImgFiles:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct := createCommitterTest(t)
+			defer os.RemoveAll(ct.dir)
+			c := ct.createCommitter(t, tt.maxAttempts)
+			defer c.Close()
+			if tt.existing {
+				if err := c.Commit(createTestCommit("commit-0", "cob-1", "img-0", "ffv-0")); err != nil {
+					t.Fatalf("Commit() of existing error: %s", err)
+				}
+			}
+
+			ct.fs.failsNum = tt.failsNum
+			err := c.Commit(createTestCommit("commit-1", "cob-1", "img-1", "ffv-1"))
+			if (err != nil) != tt.wantCommitErr {
+				t.Fatalf("Commit() error = %v, want error %v", err, tt.wantCommitErr)
+			}
+			for i := 0; i < tt.replaysNum; i++ {
+				c.Replay()
+			}
+			if num := ct.pendingNum(t); num != 0 {
+				t.Errorf("%d commits are pending, want 0", num)
+			}
+
+			cobs, err := ct.fs.SelectControlObjectsByIDs([]string{"cob-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cobs) != len(tt.wantCobs) {
+				t.Errorf("control objects = %v, want %v", cobs, tt.wantCobs)
+			}
+			ffvs, err := ct.fs.SelectFFVsByControlObject("cob-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFFVs := make([]string, 0, len(ffvs))
+			for _, ffv := range ffvs {
+				gotFFVs = append(gotFFVs, ffv.ID)
+			}
+			if (len(gotFFVs) != len(tt.wantFFVs)) ||
+				((len(gotFFVs) != 0) && (gotFFVs[0] != tt.wantFFVs[0])) {
+				t.Errorf("ffvs = %v, want %v", gotFFVs, tt.wantFFVs)
+			}
+			imgs, err := ct.fs.SelectImgs([]string{"img-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(imgs) != 0) != tt.wantImg {
+				t.Errorf("image \"img-1\" exists: %v, want %v", len(imgs) != 0, tt.wantImg)
+			}
+			if num := ct.imgFilesNum(t); num != tt.wantImgFiles {
+				t.Errorf("%d images files, want %d", num, tt.wantImgFiles)
+			}
+
+			centroids, err := ct.fs.SelectCentroids("cob-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantFFVsNum := uint64(len(tt.wantFFVs))
+			if (len(centroids) == 0) && (wantFFVsNum != 0) {
+				t.Fatalf("there are no centroids, want centroid of %d ffvs", wantFFVsNum)
+			}
+			for _, centroid := range centroids {
+				if centroid.FFVsNum != wantFFVsNum {
+					t.Errorf("centroid of %d ffvs, want %d", centroid.FFVsNum, wantFFVsNum)
+				}
+			}
+		})
+	}
+}
+
+func TestCommitterReplaysOnStart(t *testing.T) {
+	ct := createCommitterTest(t)
+	defer os.RemoveAll(ct.dir)
+	// Intent is saved, but committer crashed before applying it.
+	c := ct.createCommitter(t, 3)
+	if err := c.save(createTestCommit("commit-1", "cob-1", "img-1", "ffv-1")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c = ct.createCommitter(t, 3)
+	defer c.Close()
+	if num := ct.pendingNum(t); num != 0 {
+		t.Errorf("%d commits are pending, want 0", num)
+	}
+	ffvs, err := ct.fs.SelectFFVsByControlObject("cob-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (len(ffvs) != 1) || (ffvs[0].ID != "ffv-1") {
+		t.Errorf("ffvs = %v, want [ffv-1]", ffvs)
+	}
+	if num := ct.imgFilesNum(t); num != 1 {
+		t.Errorf("%d images files, want 1", num)
+	}
+}
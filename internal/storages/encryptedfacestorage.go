@@ -0,0 +1,326 @@
+package storages
+
+import (
+	"github.com/nofacedb/facedb/internal/encryption"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+)
+
+/*
+EncryptedFaceStorage wraps another FaceStorage and encrypts personal data of control
+objects (passport, phone number, email and address) before insert and decrypts it
+after select, so wrapped storage keeps only ciphertexts. Default ("-") values are
+not encrypted. Every value is bound to control object ID and field name, so it can't
+be moved to another row or field. Control objects are found by passport with its blind
+index (passport_hash). Control objects, stored before encryption was enabled, can't be
+read, until RotateKeys with allowed plaintext encrypts them. Audit log doesn't keep
+personal data, so it isn't encrypted.
+*/
+
+// EncryptedFaceStorage is FaceStorage with encryption of personal data.
+type EncryptedFaceStorage struct {
+	FaceStorage
+	cipher *encryption.Cipher
+}
+
+// CreateEncryptedFaceStorage ...
+func CreateEncryptedFaceStorage(fs FaceStorage, cipher *encryption.Cipher) *EncryptedFaceStorage {
+	return &EncryptedFaceStorage{
+		FaceStorage: fs,
+		cipher:      cipher,
+	}
+}
+
+// FindEncryptedFaceStorage returns EncryptedFaceStorage, which is fs or is wrapped by it,
+// or nil, if encryption is disabled.
+func FindEncryptedFaceStorage(fs FaceStorage) *EncryptedFaceStorage {
+	if ifs, ok := fs.(*IndexedFaceStorage); ok {
+		fs = ifs.FaceStorage
+	}
+	efs, _ := fs.(*EncryptedFaceStorage)
+	return efs
+}
+
+// AllowPlaintext makes control objects, stored before encryption was enabled, readable
+// and rotated (see encryption.Cipher.AllowPlaintext).
+func (efs *EncryptedFaceStorage) AllowPlaintext() {
+	efs.cipher.AllowPlaintext()
+}
+
+// encryptedField is encrypted field of control object.
+type encryptedField struct {
+	name  string
+	value *string
+}
+
+// encryptedFields returns encrypted fields of cob.
+func encryptedFields(cob *proto.ControlObject) []encryptedField {
+	return []encryptedField{
+		{"passport", &(cob.Passport)},
+		{"phone_num", &(cob.PhoneNum)},
+		{"email", &(cob.Email)},
+		{"address", &(cob.Address)},
+	}
+}
+
+// fieldAAD returns additional data, which binds value to field of control object.
+func fieldAAD(prefix, cobID, field string) []byte {
+	return []byte(prefix + ":" + cobID + ":" + field)
+}
+
+const controlObjectsAADPrefix = "control_objects"
+
+func isDefaultField(v string) bool {
+	return (v == "") || (v == proto.DefaultStringField)
+}
+
+// passportHash returns blind index of passport or empty string for default passport.
+func (efs *EncryptedFaceStorage) passportHash(passport string) (string, error) {
+	if isDefaultField(passport) {
+		return "", nil
+	}
+	hash, err := efs.cipher.BlindIndex(passport)
+	return hash, errors.Wrap(err, "unable to compute passport blind index")
+}
+
+// encryptControlObject encrypts fields of cob, binding them to prefix, cob ID and field names.
+func (efs *EncryptedFaceStorage) encryptControlObject(cob *proto.ControlObject, prefix string) error {
+	hash, err := efs.passportHash(cob.Passport)
+	if err != nil {
+		return err
+	}
+	cob.PassportHash = hash
+	for _, f := range encryptedFields(cob) {
+		if isDefaultField(*(f.value)) {
+			continue
+		}
+		if *(f.value), err = efs.cipher.EncryptString(*(f.value), fieldAAD(prefix, cob.ID, f.name)); err != nil {
+			return errors.Wrapf(err, "unable to encrypt control object \"%s\"", cob.ID)
+		}
+	}
+	return nil
+}
+
+func (efs *EncryptedFaceStorage) decryptControlObject(cob *proto.ControlObject, prefix string) error {
+	var err error
+	for _, f := range encryptedFields(cob) {
+		if isDefaultField(*(f.value)) {
+			continue
+		}
+		if *(f.value), err = efs.cipher.DecryptString(*(f.value), fieldAAD(prefix, cob.ID, f.name)); err != nil {
+			return errors.Wrapf(err, "unable to decrypt %s of control object \"%s\"", f.name, cob.ID)
+		}
+	}
+	return nil
+}
+
+func (efs *EncryptedFaceStorage) decryptControlObjects(cobs []proto.ControlObject) ([]proto.ControlObject, error) {
+	for i := range cobs {
+		if err := efs.decryptControlObject(&(cobs[i]), controlObjectsAADPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return cobs, nil
+}
+
+func (efs *EncryptedFaceStorage) encryptControlObjects(cobs []proto.ControlObject) ([]proto.ControlObject, error) {
+	encrypted := make([]proto.ControlObject, len(cobs))
+	copy(encrypted, cobs)
+	for i := range encrypted {
+		if err := efs.encryptControlObject(&(encrypted[i]), controlObjectsAADPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// InsertControlObjects ...
+func (efs *EncryptedFaceStorage) InsertControlObjects(cobs []proto.ControlObject) error {
+	encrypted, err := efs.encryptControlObjects(cobs)
+	if err != nil {
+		return err
+	}
+	return efs.FaceStorage.InsertControlObjects(encrypted)
+}
+
+// RewriteControlObjects ...
+func (efs *EncryptedFaceStorage) RewriteControlObjects(cobs []proto.ControlObject) error {
+	encrypted, err := efs.encryptControlObjects(cobs)
+	if err != nil {
+		return err
+	}
+	return efs.FaceStorage.RewriteControlObjects(encrypted)
+}
+
+// SelectControlObjectByPassport ...
+func (efs *EncryptedFaceStorage) SelectControlObjectByPassport(passport string) (*proto.ControlObject, error) {
+	hash, err := efs.passportHash(passport)
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" {
+		// Default passport isn't encrypted.
+		cob, err := efs.FaceStorage.SelectControlObjectByPassport(passport)
+		if err != nil {
+			return nil, err
+		}
+		return cob, efs.decryptControlObject(cob, controlObjectsAADPrefix)
+	}
+	cobs, err := efs.FaceStorage.SelectControlObjects(&ControlObjectsFilter{PassportHash: hash}, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(cobs) == 0 {
+		return proto.CreateDefaultControlObject(), nil
+	}
+	cob := &(cobs[0])
+	return cob, efs.decryptControlObject(cob, controlObjectsAADPrefix)
+}
+
+// SelectControlObjectsByIDs ...
+func (efs *EncryptedFaceStorage) SelectControlObjectsByIDs(ids []string) ([]proto.ControlObject, error) {
+	cobs, err := efs.FaceStorage.SelectControlObjectsByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	return efs.decryptControlObjects(cobs)
+}
+
+// SelectControlObjects ...
+func (efs *EncryptedFaceStorage) SelectControlObjects(filter *ControlObjectsFilter, offset, limit uint64) ([]proto.ControlObject, error) {
+	if filter.Passport != "" {
+		hash, err := efs.passportHash(filter.Passport)
+		if err != nil {
+			return nil, err
+		}
+		if hash != "" {
+			hashFilter := *filter
+			hashFilter.Passport = ""
+			hashFilter.PassportHash = hash
+			filter = &hashFilter
+		}
+	}
+	cobs, err := efs.FaceStorage.SelectControlObjects(filter, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	return efs.decryptControlObjects(cobs)
+}
+
+// SelectControlObjectByFFV ...
+func (efs *EncryptedFaceStorage) SelectControlObjectByFFV(model string, ff proto.FacialFeaturesVector) (*proto.ControlObject, error) {
+	cob, err := efs.FaceStorage.SelectControlObjectByFFV(model, ff)
+	if err != nil {
+		return nil, err
+	}
+	return cob, efs.decryptControlObject(cob, controlObjectsAADPrefix)
+}
+
+// SelectCandidatesByFFV ...
+func (efs *EncryptedFaceStorage) SelectCandidatesByFFV(model string, ff proto.FacialFeaturesVector, k int) ([]proto.Candidate, error) {
+	candidates, err := efs.FaceStorage.SelectCandidatesByFFV(model, ff, k)
+	if err != nil {
+		return nil, err
+	}
+	for i := range candidates {
+		if err := efs.decryptControlObject(&(candidates[i].ControlObject), controlObjectsAADPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return candidates, nil
+}
+
+// rotateControlObject encrypts plaintext fields of cob (if plaintext is allowed), rewraps
+// data keys of encrypted ones by active key and sets blind index of passport. It returns
+// false, if cob wasn't changed.
+func (efs *EncryptedFaceStorage) rotateControlObject(cob *proto.ControlObject) (bool, error) {
+	passport := cob.Passport
+	if !isDefaultField(passport) {
+		var err error
+		passport, err = efs.cipher.DecryptString(passport, fieldAAD(controlObjectsAADPrefix, cob.ID, "passport"))
+		if err != nil {
+			return false, errors.Wrapf(err, "unable to decrypt passport of control object \"%s\"", cob.ID)
+		}
+	}
+	hash, err := efs.passportHash(passport)
+	if err != nil {
+		return false, err
+	}
+	changed := hash != cob.PassportHash
+	cob.PassportHash = hash
+	for _, f := range encryptedFields(cob) {
+		if isDefaultField(*(f.value)) {
+			continue
+		}
+		rewrapped, ok, err := efs.cipher.RewrapString(*(f.value), fieldAAD(controlObjectsAADPrefix, cob.ID, f.name))
+		if err != nil {
+			return false, errors.Wrapf(err, "unable to rewrap %s of control object \"%s\"", f.name, cob.ID)
+		}
+		*(f.value) = rewrapped
+		changed = changed || ok
+	}
+	return changed, nil
+}
+
+// unchangedControlObjects returns control objects of cobs, which weren't changed or deleted
+// since they were selected.
+func (efs *EncryptedFaceStorage) unchangedControlObjects(cobs []proto.ControlObject) ([]proto.ControlObject, error) {
+	ids := make([]string, 0, len(cobs))
+	for _, cob := range cobs {
+		ids = append(ids, cob.ID)
+	}
+	current, err := efs.FaceStorage.SelectControlObjectsByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]proto.ControlObject, len(current))
+	for _, cob := range current {
+		versions[cob.ID] = cob
+	}
+	unchanged := make([]proto.ControlObject, 0, len(cobs))
+	for _, cob := range cobs {
+		cur, ok := versions[cob.ID]
+		if ok && (cur.DBTS != nil) && (cob.DBTS != nil) && cur.DBTS.Equal(*(cob.DBTS)) {
+			unchanged = append(unchanged, cob)
+		}
+	}
+	return unchanged, nil
+}
+
+// RotateKeys encrypts personal data of all control objects, which were stored in plaintext
+// (if plaintext is allowed), and rewraps data keys, which were wrapped by not active key,
+// by batches of batchSize. It returns numbers of all and changed control objects. Rotated
+// control objects are written with versions, they were selected with, and those, which
+// were changed or deleted meanwhile, are skipped (they are rotated by the next run).
+func (efs *EncryptedFaceStorage) RotateKeys(batchSize uint64) (uint64, uint64, error) {
+	cobsNum, rotatedNum := uint64(0), uint64(0)
+	for offset := uint64(0); ; offset += batchSize {
+		cobs, err := efs.FaceStorage.SelectControlObjects(&ControlObjectsFilter{}, offset, batchSize)
+		if err != nil {
+			return cobsNum, rotatedNum, err
+		}
+		rotated := make([]proto.ControlObject, 0, len(cobs))
+		for i := range cobs {
+			changed, err := efs.rotateControlObject(&(cobs[i]))
+			if err != nil {
+				return cobsNum, rotatedNum, err
+			}
+			if changed {
+				rotated = append(rotated, cobs[i])
+			}
+		}
+		if len(rotated) != 0 {
+			if rotated, err = efs.unchangedControlObjects(rotated); err != nil {
+				return cobsNum, rotatedNum, err
+			}
+			if err := efs.FaceStorage.RewriteControlObjects(rotated); err != nil {
+				return cobsNum, rotatedNum, err
+			}
+		}
+		cobsNum += uint64(len(cobs))
+		rotatedNum += uint64(len(rotated))
+		if uint64(len(cobs)) < batchSize {
+			return cobsNum, rotatedNum, nil
+		}
+	}
+}
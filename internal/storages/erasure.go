@@ -0,0 +1,78 @@
+package storages
+
+import (
+	"time"
+
+	"github.com/nofacedb/facedb/internal/imgstores"
+	"github.com/nofacedb/facedb/internal/proto"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Erasure (right to be forgotten) removes control object with all its facial features
+vectors, sightings and clusters, promoted to it, from storage and from all images, where
+it was found. Images, which contain no other control objects (or faces, for sightings
+images), are deleted from images store. Audit records of control object can't be
+changed without breaking hash chain, but they keep only IDs and digests of changed
+fields, so their salts are cleared (crypto-shredded). Only tombstone is left:
+it contains no personal data, but control object ID, reason, requester and numbers
+of erased records, so erasure may be audited.
+*/
+
+// EraseControlObject erases control object from fs and removes its deleted images from imgStore.
+// It returns nil tombstone, if there is no such control object.
+func EraseControlObject(fs FaceStorage, imgStore imgstores.ImgStore,
+	id, reason, requestedBy string, logger *log.Logger) (*proto.Erasure, error) {
+	erasure, orphanImgs, err := fs.EraseControlObject(id, reason, requestedBy)
+	if err != nil {
+		return nil, err
+	}
+	if erasure == nil {
+		return nil, nil
+	}
+	for _, img := range orphanImgs {
+		if err := imgStore.Delete(img.Path); err != nil {
+			logger.Warnf("unable to delete image \"%s\" of erased control object \"%s\": %s",
+				img.Path, id, err)
+		}
+	}
+	logger.Infof("erased control object \"%s\" (%d facial features vectors, %d images, %d deleted images, %d sightings, %d clusters, %d audit records), requested by \"%s\"",
+		id, erasure.FFVsNum, erasure.ImgsNum, erasure.DeletedImgsNum, erasure.SightingsNum,
+		erasure.ClustersNum, erasure.AuditRecordsNum, requestedBy)
+	return erasure, nil
+}
+
+// splitOrphanImgs returns images, which contain only control object with given ID, and their IDs.
+func splitOrphanImgs(imgs []Img, cobID string) ([]Img, []string) {
+	orphanImgs := make([]Img, 0, len(imgs))
+	orphanImgsIDs := make([]string, 0, len(imgs))
+	for _, img := range imgs {
+		orphan := true
+		for _, faceID := range img.FaceIDs {
+			if faceID != cobID {
+				orphan = false
+				break
+			}
+		}
+		if orphan {
+			orphanImgs = append(orphanImgs, img)
+			orphanImgsIDs = append(orphanImgsIDs, img.ID)
+		}
+	}
+	return orphanImgs, orphanImgsIDs
+}
+
+func createErasure(cobID, reason, requestedBy string, ffvsNum, sightingsNum uint64, imgs, orphanImgs []Img) *proto.Erasure {
+	return &proto.Erasure{
+		ID:             uuid.Must(uuid.NewV4()).String(),
+		TS:             time.Now(),
+		CobID:          cobID,
+		Reason:         reason,
+		RequestedBy:    requestedBy,
+		FFVsNum:        ffvsNum,
+		ImgsNum:        uint64(len(imgs)),
+		DeletedImgsNum: uint64(len(orphanImgs)),
+		SightingsNum:   sightingsNum,
+	}
+}
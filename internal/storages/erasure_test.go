@@ -0,0 +1,78 @@
+package storages
+
+import (
+	"testing"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+func TestMemoryEraseControlObject(t *testing.T) {
+	fs := CreateMemoryFaceStorage(0.95, -1)
+	cobs := []proto.ControlObject{
+		{ID: "cob-1", Passport: "4510 123456", Surname: "Ivanov"},
+		{ID: "cob-2", Passport: "4510 654321", Surname: "Petrov"},
+	}
+	if err := fs.InsertControlObjects(cobs); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ReplaceClusters([]Cluster{
+		{ID: "cluster-1", Centroid: proto.FacialFeaturesVector{1.0, 0.0}},
+		{ID: "cluster-2", Centroid: proto.FacialFeaturesVector{0.0, 1.0}},
+		{ID: "cluster-3", Centroid: proto.FacialFeaturesVector{1.0, 1.0}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PromoteCluster("cluster-1", "cob-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PromoteCluster("cluster-2", "cob-2"); err != nil {
+		t.Fatal(err)
+	}
+	recs := []proto.AuditRecord{
+		{Seq: 1, Salt: "salt-1", Entries: []proto.AuditEntry{{Decision: proto.AuditCorrected, SuggestedID: "cob-1", CobID: "cob-1"}}},
+		{Seq: 2, Salt: "salt-2", Entries: []proto.AuditEntry{{Decision: proto.AuditAdded, CobID: "cob-2"}}},
+		{Seq: 3, Salt: "salt-3", Entries: []proto.AuditEntry{{Decision: proto.AuditRejected, SuggestedID: "cob-1"}}},
+	}
+	for i := range recs {
+		if err := fs.InsertAuditRecord(&(recs[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	erasure, _, err := fs.EraseControlObject("cob-1", "request", "operator")
+	if err != nil {
+		t.Fatalf("EraseControlObject() error: %s", err)
+	}
+	if (erasure.ClustersNum != 1) || (erasure.AuditRecordsNum != 2) {
+		t.Errorf("EraseControlObject() = %+v, want 1 cluster and 2 audit records", erasure)
+	}
+
+	tests := []struct {
+		clusterID string
+		wantFound bool
+	}{
+		{"cluster-1", false},
+		{"cluster-2", true},
+		{"cluster-3", true},
+	}
+	for _, tt := range tests {
+		c, err := fs.SelectCluster(tt.clusterID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (c != nil) != tt.wantFound {
+			t.Errorf("cluster \"%s\" found: %v, want %v", tt.clusterID, c != nil, tt.wantFound)
+		}
+	}
+
+	wantSalts := map[uint64]string{1: "", 2: "salt-2", 3: ""}
+	err = fs.ScanAuditRecords(func(rec *proto.AuditRecord) error {
+		if rec.Salt != wantSalts[rec.Seq] {
+			t.Errorf("salt of audit record %d = %q, want %q", rec.Seq, rec.Salt, wantSalts[rec.Seq])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,167 +4,223 @@ import (
 	"database/sql"
 	"fmt"
 	"math"
+	"sort"
 	"time"
 
-	"github.com/kshvakov/clickhouse"
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/encryption"
+	"github.com/nofacedb/facedb/internal/migrations"
 	"github.com/nofacedb/facedb/internal/proto"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
-// FaceStorage ...
-type FaceStorage struct {
-	db           *sql.DB
-	sineBoundary float64
-}
+const (
+	// ClickHouseStorageType is ClickHouse DB based FaceStorage.
+	ClickHouseStorageType = "clickhouse"
+	// MemoryStorageType is in-memory FaceStorage.
+	MemoryStorageType = "memory"
+)
 
-// CreateFaceStorage ...
-func CreateFaceStorage(db *sql.DB, sineBoundary float64) *FaceStorage {
-	return &FaceStorage{
-		db:           db,
-		sineBoundary: sineBoundary,
-	}
+// FaceStorage stores control objects, their images and facial features vectors.
+type FaceStorage interface {
+	// InsertControlObjects inserts new versions of control objects.
+	InsertControlObjects(cobs []proto.ControlObject) error
+	// RewriteControlObjects inserts control objects with their versions (DBTS), which they
+	// had, when they were selected, so versions, inserted or deleted after it, are kept.
+	RewriteControlObjects(cobs []proto.ControlObject) error
+	// SelectControlObjectByPassport returns control object with given passport
+	// or default control object, if there is no such one.
+	SelectControlObjectByPassport(passport string) (*proto.ControlObject, error)
+	// SelectControlObjectsByIDs returns all existing control objects with given IDs.
+	SelectControlObjectsByIDs(ids []string) ([]proto.ControlObject, error)
+	// SelectControlObjects returns up to limit control objects, matching filter,
+	// ordered by ID, skipping first offset ones.
+	SelectControlObjects(filter *ControlObjectsFilter, offset, limit uint64) ([]proto.ControlObject, error)
+	// DeleteControlObject marks control object as deleted and returns false,
+	// if there is no such control object.
+	DeleteControlObject(id string) (bool, error)
+	// EraseControlObject erases control object with all its versions and facial features
+	// vectors, removes it from images and deletes images, which contain only it.
+	// It returns tombstone and deleted images or nil tombstone, if there is no such control object.
+	EraseControlObject(id, reason, requestedBy string) (*proto.Erasure, []Img, error)
+	// SelectErasures returns up to limit tombstones, newest first, skipping first offset ones.
+	SelectErasures(offset, limit uint64) ([]proto.Erasure, error)
+	// MergeControlObjects moves all facial features vectors, images, sightings, alerts and
+	// watchlists memberships of duplicate control object to survivor, deletes duplicate
+	// and returns merge record. Centroids of both should be rebuilt after it.
+	MergeControlObjects(survivorID, duplicateID, requestedBy string) (*proto.Merge, error)
+	// SelectMerges returns up to limit merge records, newest first, skipping first offset ones.
+	SelectMerges(offset, limit uint64) ([]proto.Merge, error)
+	// SelectControlObjectByFFV returns control object, which centroid of facial features
+	// vectors of model is the same as ff, or default control object, if there is no such one.
+	SelectControlObjectByFFV(model string, ff proto.FacialFeaturesVector) (*proto.ControlObject, error)
+	// SelectCandidatesByFFV returns up to k control objects, which centroids of facial
+	// features vectors of model are the most similar to ff, ordered by similarity descending,
+	// and marks ones with similarity not less than cosine boundary as matched.
+	// Only control objects within bucket radius from ff are compared.
+	SelectCandidatesByFFV(model string, ff proto.FacialFeaturesVector, k int) ([]proto.Candidate, error)
+	// InsertImgs inserts images records, skipping ones with already existing IDs.
+	InsertImgs(imgs []Img) error
+	// SelectImgs returns all existing images records with given IDs.
+	SelectImgs(ids []string) ([]Img, error)
+	// InsertFFVs inserts facial features vectors, skipping ones with already
+	// existing IDs, and returns inserted ones.
+	InsertFFVs(ffvs []FFV) ([]FFV, error)
+	// SelectFFVsByControlObject returns all facial features vectors of control object.
+	SelectFFVsByControlObject(cobID string) ([]FFV, error)
+	// SelectFFVs returns all existing facial features vectors with given IDs.
+	SelectFFVs(ids []string) ([]FFV, error)
+	// DeleteFFVs deletes facial features vectors by IDs. Centroids of their
+	// control objects should be rebuilt after it.
+	DeleteFFVs(ids []string) error
+	// InsertCentroids inserts centroids, replacing ones of the same models and control objects.
+	InsertCentroids(centroids []Centroid) error
+	// SelectCentroids returns centroids of control object for all models.
+	SelectCentroids(cobID string) ([]Centroid, error)
+	// SelectCentroidsWithOutliers returns up to limit centroids, which have outliers,
+	// ordered by control object ID and model, skipping first offset ones.
+	SelectCentroidsWithOutliers(offset, limit uint64) ([]Centroid, error)
+	// RevertInserts deletes facial features vectors, images records and those of control
+	// objects, which have no other facial features vectors, by IDs. Centroids of control
+	// objects of deleted vectors should be rebuilt after it.
+	RevertInserts(cobIDs, imgIDs, ffvIDs []string) error
+	// InsertSightings inserts sightings.
+	InsertSightings(sightings []Sighting) error
+	// SelectSightings returns up to limit sightings, matching filter, newest first.
+	// Facial features vectors of sightings are not returned.
+	SelectSightings(filter *SightingsFilter, limit uint64) ([]Sighting, error)
+	// SelectSightingImgPath returns images store key of image, received at ts,
+	// on which sightings were found, or empty string, if there is no such image.
+	SelectSightingImgPath(imgID string, ts time.Time) (string, error)
+	// ScanSightingsImgs calls fn for every stored image of sightings (only ID, TS and Path
+	// are set) until fn returns error.
+	ScanSightingsImgs(fn func(img *Img) error) error
+	// SelectUnmatchedSightings returns up to limit sightings with from <= ts < to, which weren't
+	// matched with any control object, newest first, with their facial features vectors.
+	// Zero from and to are not used.
+	SelectUnmatchedSightings(from, to time.Time, limit uint64) ([]Sighting, error)
+	// SelectSightingsByIDs returns all existing sightings with given IDs with their facial features vectors.
+	SelectSightingsByIDs(ids []string) ([]Sighting, error)
+	// AssignSightings sets control object of sightings with given IDs.
+	AssignSightings(ids []string, cobID string) error
+	// SelectExpiredSightingsImgs returns up to limit stored images of sightings, received
+	// before given time, which aren't images of control objects.
+	SelectExpiredSightingsImgs(before time.Time, limit uint64) ([]Img, error)
+	// ClearSightingsImgs removes images with given IDs from sightings and alerts.
+	ClearSightingsImgs(imgIDs []string) error
+	// DeleteSightings deletes sightings, matching expiry, and returns their number and
+	// stored images, on which only they were found, except images of control objects.
+	DeleteSightings(expiry *SightingsExpiry) (uint64, []Img, error)
+	// SelectExpiredImgs returns up to limit images records of control objects with ts before given time.
+	SelectExpiredImgs(before time.Time, limit uint64) ([]Img, error)
+	// SelectFFVsByImgs returns all facial features vectors, found on images with given IDs.
+	SelectFFVsByImgs(imgIDs []string) ([]FFV, error)
+	// DeleteImgs deletes images records by IDs. Their facial features vectors should be deleted before it.
+	DeleteImgs(ids []string) error
+	// InsertPurge inserts retention policies enforcement report.
+	InsertPurge(purge *proto.Purge) error
+	// SelectPurges returns up to limit purge reports, newest first, skipping first offset ones.
+	SelectPurges(offset, limit uint64) ([]proto.Purge, error)
+	// InsertAuditRecord appends record to audit log.
+	InsertAuditRecord(rec *proto.AuditRecord) error
+	// SelectAuditRecords returns up to limit audit records, matching filter,
+	// newest first, skipping first offset ones.
+	SelectAuditRecords(filter *AuditFilter, offset, limit uint64) ([]proto.AuditRecord, error)
+	// ScanAuditRecords calls fn for every audit record in Seq order of its chain until fn returns error.
+	ScanAuditRecords(fn func(rec *proto.AuditRecord) error) error
+	// ReplaceClusters deletes all not promoted clusters and inserts new ones.
+	ReplaceClusters(clusters []Cluster) error
+	// SelectClusters returns up to limit not promoted clusters, the largest first,
+	// skipping first offset ones.
+	SelectClusters(offset, limit uint64) ([]Cluster, error)
+	// SelectCluster returns cluster or nil, if there is no such cluster.
+	SelectCluster(id string) (*Cluster, error)
+	// PromoteCluster marks cluster as promoted to control object.
+	PromoteCluster(id, cobID string) error
+	// InsertWatchlist inserts watchlist or replaces existing one with the same ID.
+	InsertWatchlist(wl *proto.Watchlist) error
+	// SelectWatchlists returns all watchlists.
+	SelectWatchlists() ([]proto.Watchlist, error)
+	// DeleteWatchlist deletes watchlist and returns false, if there is no such watchlist.
+	DeleteWatchlist(id string) (bool, error)
+	// InsertAlerts inserts alerts.
+	InsertAlerts(alerts []Alert) error
+	// SelectAlerts returns up to limit alerts, matching filter, newest first.
+	SelectAlerts(filter *AlertsFilter, limit uint64) ([]Alert, error)
+	// SelectImgsByControlObject returns all images, containing control object.
+	SelectImgsByControlObject(cob *proto.ControlObject) ([]Img, error)
+	// SelectEmbeddedFFVs returns not empty centroids of all control objects.
+	SelectEmbeddedFFVs() ([]EmbeddedFFV, error)
+	// SelectEmbeddedFFVsByControlObjects returns not empty centroids of control objects with given IDs.
+	SelectEmbeddedFFVsByControlObjects(cobIDs []string) ([]EmbeddedFFV, error)
+	// ScanFFVs calls fn for every stored facial features vector until fn returns error.
+	ScanFFVs(fn func(ffv *FFV) error) error
+	// ScanImgs calls fn for every stored image record until fn returns error.
+	ScanImgs(fn func(img *Img) error) error
+	// CountFFVs returns number of stored facial features vectors.
+	CountFFVs() (uint64, error)
+	// SelectCentroidsVersion returns version of all stored centroids.
+	SelectCentroidsVersion() (CentroidsVersion, error)
+	// Close releases all storage resources.
+	Close() error
 }
 
-// InsertControlObjectsQuery ...
-const InsertControlObjectsQuery = `
-INSERT INTO
-    control_objects
-    (id, ts, passport,
-     surname, name, patronymic,
-     sex, birthdate,
-     phone_num, email, address)
-VALUES
-    (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
-`
-
-// InsertControlObjects ...
-func (fs *FaceStorage) InsertControlObjects(cobs []proto.ControlObject) error {
-	tx, err := fs.db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "unable to begin bulk insert")
-	}
-	stmt, err := tx.Prepare(InsertControlObjectsQuery)
-	if err != nil {
-		return errors.Wrap(err, "unable to prepare SQL-statement")
-	}
-	defer stmt.Close()
-
-	for i, cob := range cobs {
-		if _, err := stmt.Exec(
-			clickhouse.UUID(cob.ID),
-			cob.TS,
-			cob.Passport,
-			cob.Surname,
-			cob.Name,
-			cob.Patronymic,
-			cob.Sex,
-			cob.BirthDate,
-			cob.PhoneNum,
-			cob.Email,
-			cob.Address,
-		); err != nil {
-			return errors.Wrapf(err, "unable to execute %d-th part of bulk insert", i+1)
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return errors.Wrap(err, "unable to commit bulk insert")
-	}
+// ControlObjectsFilter contains control objects fields values to filter by.
+// Empty fields are not used. Control object should have all Attributes.
+type ControlObjectsFilter struct {
+	Passport     string
+	PassportHash string
+	Surname      string
+	Name         string
+	Patronymic   string
+	Sex          string
+	BirthDate    string
+	Attributes   map[string]string
+}
 
-	return nil
+// Match returns true if cob matches filter.
+func (f *ControlObjectsFilter) Match(cob *proto.ControlObject) bool {
+	return ((f.Passport == "") || (f.Passport == cob.Passport)) &&
+		((f.PassportHash == "") || (f.PassportHash == cob.PassportHash)) &&
+		((f.Surname == "") || (f.Surname == cob.Surname)) &&
+		((f.Name == "") || (f.Name == cob.Name)) &&
+		((f.Patronymic == "") || (f.Patronymic == cob.Patronymic)) &&
+		((f.Sex == "") || (f.Sex == cob.Sex)) &&
+		((f.BirthDate == "") || (f.BirthDate == cob.BirthDate)) &&
+		f.matchAttributes(cob)
 }
 
-// SelectControlObjectByPassportQuery ...
-const SelectControlObjectByPassportQuery = `
-SELECT
-    id, ts, passport,
-    surname, name, patronymic,
-    sex, birthdate,
-    phone_num, email, address
-FROM
-    control_objects FINAL
-WHERE
-    (passport = ?);
-`
-
-// SelectControlObjectByPassport ...
-func (fs *FaceStorage) SelectControlObjectByPassport(passport string) (*proto.ControlObject, error) {
-	rows, err := fs.db.Query(SelectControlObjectByPassportQuery, passport)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to execute query")
-	}
-	defer rows.Close()
-
-	if rows.Next() {
-		cob := proto.CreateDefaultControlObject()
-		if err := rows.Scan(
-			&(cob.ID), &(cob.TS), &(cob.Passport),
-			&(cob.Surname), &(cob.Name), &(cob.Patronymic),
-			&(cob.Sex), &(cob.BirthDate),
-			&(cob.PhoneNum), &(cob.Email), &(cob.Address)); err != nil {
-			return nil, errors.Wrap(err, "unable to unmarshal query result")
+func (f *ControlObjectsFilter) matchAttributes(cob *proto.ControlObject) bool {
+	for k, v := range f.Attributes {
+		if cobV, ok := cob.Attributes[k]; !ok || (cobV != v) {
+			return false
 		}
-		return cob, nil
 	}
-
-	return proto.CreateDefaultControlObject(), nil
+	return true
 }
 
-// InsertFFVsQuery ...
-const InsertFFVsQuery = `
-INSERT INTO
-    facial_features
-    (id, cob_id, img_id, fb, ff)
-VALUES
-    (?, ?, ?, ?, ?);
-`
+// attributesPairs returns sorted "key=value" pairs of attributes
+// (keys can't contain "=", see validation.AttributeKey).
+func attributesPairs(attrs map[string]string) []string {
+	pairs := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
 
-// FFV ...
+// FFV is a facial features vector, produced by model.
 type FFV struct {
 	ID                   string
 	CobID                string
 	ImgID                string
 	FaceBox              proto.FaceBox
+	Model                string
 	FacialFeaturesVector proto.FacialFeaturesVector
 }
 
-// InsertFFVs ...
-func (fs *FaceStorage) InsertFFVs(ffvs []FFV) error {
-	tx, err := fs.db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "unable to begin bulk write transaction")
-	}
-	stmt, err := tx.Prepare(InsertFFVsQuery)
-	if err != nil {
-		return errors.Wrap(err, "unable to prepare InsertFFQuery statemet")
-	}
-	defer stmt.Close()
-	for _, ffv := range ffvs {
-		if _, err := stmt.Exec(
-			clickhouse.UUID(ffv.ID),
-			clickhouse.UUID(ffv.CobID),
-			clickhouse.UUID(ffv.ImgID),
-			clickhouse.Array(ffv.FaceBox),
-			clickhouse.Array(ffv.FacialFeaturesVector),
-		); err != nil {
-			return errors.Wrap(err, "unable to execute part of bulk write transaction. Rollbacking")
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return errors.Wrap(err, "unable to commit bulk write transaction. Rollbacking")
-	}
-
-	return nil
-}
-
-// InsertImgsQuery ...
-const InsertImgsQuery = `
-INSERT INTO imgs
-    (id, ts, path, face_ids)
-VALUES
-    (?, ?, ?, ?);`
-
 // Img ...
 type Img struct {
 	ID      string
@@ -173,148 +229,282 @@ type Img struct {
 	FaceIDs []string
 }
 
-// InsertImgs ...
-func (fs *FaceStorage) InsertImgs(imgs []Img) error {
-	tx, err := fs.db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "unable to begin bulk write transaction")
-	}
-	stmt, err := tx.Prepare(InsertImgsQuery)
+// Sighting is a face, found on processed image. CobID is empty, if face
+// wasn't matched with any control object.
+type Sighting struct {
+	ID                   string
+	TS                   time.Time
+	SrcAddr              string
+	ImgID                string
+	ImgPath              string
+	FaceBox              proto.FaceBox
+	Model                string
+	FacialFeaturesVector proto.FacialFeaturesVector
+	CobID                string
+	Score                float64
+}
+
+// SightingsExpiry selects sightings, received before Before: only unmatched ones,
+// if Unmatched is set, only matched ones from SrcAddr, if it is not empty, or all.
+type SightingsExpiry struct {
+	Before    time.Time
+	Unmatched bool
+	SrcAddr   string
+}
+
+// Match returns true if s matches expiry.
+func (e *SightingsExpiry) Match(s *Sighting) bool {
+	return s.TS.Before(e.Before) &&
+		(!e.Unmatched || (s.CobID == "")) &&
+		((e.SrcAddr == "") || ((s.SrcAddr == e.SrcAddr) && (s.CobID != "")))
+}
+
+// Cluster is a group of similar unmatched sightings of the same model (anonymous identity).
+// CobID is empty, if cluster wasn't promoted to control object.
+type Cluster struct {
+	ID                string
+	TS                time.Time
+	Model             string
+	SightingIDs       []string
+	RepresentativeIDs []string
+	Centroid          proto.FacialFeaturesVector
+	CobID             string
+}
+
+// Cursor is a position of row (sighting or alert) in rows, ordered by (ts, id) descending.
+type Cursor struct {
+	TS time.Time
+	ID string
+}
+
+// SightingsFilter contains sightings fields values to filter by.
+// Zero fields are not used. To is exclusive. If After is set,
+// only sightings after it (i.e. older) are selected.
+type SightingsFilter struct {
+	CobID    string
+	SrcAddr  string
+	From     time.Time
+	To       time.Time
+	MinScore float64
+	After    *Cursor
+}
+
+// Match returns true if s matches filter.
+func (f *SightingsFilter) Match(s *Sighting) bool {
+	return ((f.CobID == "") || (f.CobID == s.CobID)) &&
+		((f.SrcAddr == "") || (f.SrcAddr == s.SrcAddr)) &&
+		(f.From.IsZero() || !s.TS.Before(f.From)) &&
+		(f.To.IsZero() || s.TS.Before(f.To)) &&
+		(s.Score >= f.MinScore) &&
+		((f.After == nil) || s.TS.Before(f.After.TS) ||
+			(s.TS.Equal(f.After.TS) && (s.ID < f.After.ID)))
+}
+
+// AuditFilter contains audit records fields values to filter by.
+// Zero fields are not used. To is exclusive.
+type AuditFilter struct {
+	SrcAddr string
+	Command string
+	ImgUUID string
+	From    time.Time
+	To      time.Time
+}
+
+// Match returns true if rec matches filter.
+func (f *AuditFilter) Match(rec *proto.AuditRecord) bool {
+	return ((f.SrcAddr == "") || (f.SrcAddr == rec.SrcAddr)) &&
+		((f.Command == "") || (f.Command == rec.Command)) &&
+		((f.ImgUUID == "") || (f.ImgUUID == rec.ImgUUID)) &&
+		(f.From.IsZero() || !rec.TS.Before(f.From)) &&
+		(f.To.IsZero() || rec.TS.Before(f.To))
+}
+
+// Alert is a match of watchlist control object on processed image.
+type Alert struct {
+	ID            string
+	TS            time.Time
+	WatchlistID   string
+	WatchlistName string
+	CobID         string
+	Score         float64
+	SrcAddr       string
+	SightingID    string
+	ImgID         string
+	ImgPath       string
+	FaceBox       proto.FaceBox
+}
+
+// AlertsFilter contains alerts fields values to filter by.
+// Zero fields are not used. To is exclusive. If After is set,
+// only alerts after it (i.e. older) are selected.
+type AlertsFilter struct {
+	WatchlistID string
+	CobID       string
+	SrcAddr     string
+	From        time.Time
+	To          time.Time
+	After       *Cursor
+}
+
+// Match returns true if a matches filter.
+func (f *AlertsFilter) Match(a *Alert) bool {
+	return ((f.WatchlistID == "") || (f.WatchlistID == a.WatchlistID)) &&
+		((f.CobID == "") || (f.CobID == a.CobID)) &&
+		((f.SrcAddr == "") || (f.SrcAddr == a.SrcAddr)) &&
+		(f.From.IsZero() || !a.TS.Before(f.From)) &&
+		(f.To.IsZero() || a.TS.Before(f.To)) &&
+		((f.After == nil) || a.TS.Before(f.After.TS) ||
+			(a.TS.Equal(f.After.TS) && (a.ID < f.After.ID)))
+}
+
+// EmbeddedFFV is an embedded facial features vector (centroid) of control object,
+// produced by model.
+type EmbeddedFFV struct {
+	Model       string
+	CobID       string
+	CosineOnOrt float64
+	EFF         proto.FacialFeaturesVector
+	FFVsNum     uint64
+}
+
+// CreateFaceStorage creates FaceStorage of type, specified in config.
+func CreateFaceStorage(cfg *cfgparser.StorageCFG, logger *log.Logger) (FaceStorage, error) {
+	bucketRadius, err := GetBucketRadius(cfg)
 	if err != nil {
-		return errors.Wrap(err, "unable to prepare InsertImgQuery statemet")
+		return nil, errors.Wrap(err, "unable to create face storage")
 	}
-	defer stmt.Close()
-
-	for _, img := range imgs {
-		if _, err := stmt.Exec(
-			clickhouse.UUID(img.ID),
-			img.TS,
-			img.Path,
-			clickhouse.Array(img.FaceIDs),
-		); err != nil {
-			return errors.Wrap(err, "unable to execute part of bulk write transaction. Rollbacking")
+	logger.Debugf("using \"%s\" match mode with bucket radius %d", cfg.MatchMode, bucketRadius)
+
+	var fs FaceStorage
+	switch cfg.Type {
+	case "", ClickHouseStorageType:
+		if cfg.AutoMigrate {
+			if err := CreateClickHouseDB(cfg, logger); err != nil {
+				return nil, err
+			}
+		}
+		logger.Debug("connecting to CLICKHOUSE DB...")
+		db, err := CreateClickHouseDBConn(cfg, logger)
+		if err != nil {
+			return nil, err
 		}
+		logger.Debug("successfully connected to CLICKHOUSE DB")
+		if err := checkClickHouseSchema(db, cfg.AutoMigrate, logger); err != nil {
+			db.Close()
+			return nil, err
+		}
+		fs = CreateClickHouseFaceStorage(db, cfg.CosineBoundary, bucketRadius, &(cfg.BatchCFG), logger)
+	case MemoryStorageType:
+		fs = CreateMemoryFaceStorage(cfg.CosineBoundary, bucketRadius)
+	default:
+		return nil, errors.Wrap(fmt.Errorf("unknown storage type \"%s\"", cfg.Type),
+			"unable to create face storage")
 	}
 
-	if err := tx.Commit(); err != nil {
-		return errors.Wrap(err, "unable to commit bulk write transaction. Rollbacking")
+	cipher, err := encryption.CreateCipher(&(cfg.EncryptionCFG))
+	if err != nil {
+		fs.Close()
+		return nil, errors.Wrap(err, "unable to create face storage")
+	}
+	if cipher != nil {
+		logger.Debug("personal data of control objects is encrypted")
+		fs = CreateEncryptedFaceStorage(fs, cipher)
 	}
 
-	return nil
+	if cfg.MatchMode != ANNMatchMode {
+		return fs, nil
+	}
+	logger.Debug("initializing ANN INDEX...")
+	ifs, err := CreateIndexedFaceStorage(fs, cfg, logger)
+	if err != nil {
+		fs.Close()
+		return nil, err
+	}
+	logger.Debug("ANN INDEX was successfully initialized")
+	return ifs, nil
 }
 
-// SelectImgsByControlObjectQuery ...
-const SelectImgsByControlObjectQuery = `
-SELECT
-    *
-FROM
-    imgs
-WHERE
-    has(face_ids, ?);
-`
-
-// SelectImgsByControlObject ...
-func (fs *FaceStorage) SelectImgsByControlObject(cob *proto.ControlObject) ([]Img, error) {
-	rows, err := fs.db.Query(SelectImgsByControlObjectQuery, cob.ID)
+// checkClickHouseSchema checks, that schema version is the latest one,
+// and applies all new migrations, if autoMigrate is set.
+func checkClickHouseSchema(db *sql.DB, autoMigrate bool, logger *log.Logger) error {
+	migrator := migrations.CreateMigrator(db, logger)
+	version, err := migrator.Version()
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to execute query")
+		return errors.Wrap(err, "unable to check schema version")
 	}
-	defer rows.Close()
-
-	imgs := make([]Img, 0, 128)
-	i := 0
-	for rows.Next() {
-		imgs = append(imgs, Img{})
-		if err := rows.Scan(
-			&(imgs[i].ID), &(imgs[i].TS),
-			&(imgs[i].Path), &(imgs[i].FaceIDs),
-		); err != nil {
-			return nil, errors.Wrap(err, "unable to unmarshal query result")
+	if autoMigrate && (version < migrations.Latest()) {
+		logger.Infof("schema version %d is behind %d, migrating...", version, migrations.Latest())
+		if err := migrator.Up(migrations.Latest()); err != nil {
+			return errors.Wrap(err, "unable to migrate schema")
 		}
-		i++
 	}
+	if err := migrator.Check(); err != nil {
+		return errors.Wrap(err, "unable to use ClickHouse DB")
+	}
+	return nil
+}
 
-	return imgs, nil
+func selectControlObjectByFFV(fs FaceStorage, model string, ff proto.FacialFeaturesVector) (*proto.ControlObject, error) {
+	candidates, err := fs.SelectCandidatesByFFV(model, ff, 1)
+	if err != nil {
+		return nil, err
+	}
+	if (len(candidates) == 0) || !candidates[0].Matched {
+		return proto.CreateDefaultControlObject(), nil
+	}
+	return &(candidates[0].ControlObject), nil
 }
 
 /*
-To find the most suitable object of control, we can use the sine:
-the more similar the vectors, the closer the sine of the angle between them to zero.
+cosine_on_ort (bucket) is a cosine between facial features vector and (1, 1, ..., 1) ort,
+multiplied by 10 and truncated to int8, so it lies in [-10, 10]. Only vectors
+which buckets differ by no more than bucket radius are compared.
+
+If cosine between vectors is not less than B, the angle between them is not greater
+than arccos(B), and, since cosine is 1-Lipschitz function of angle, their cosines on ort
+differ by no more than arccos(B). After multiplication and truncation buckets
+differ by no more than floor(10 * arccos(B)) + 1, which is a safe bucket radius:
+no matching vectors are lost with it.
 */
 
-// SelectControlObjectByFFVQuery ...
-const SelectControlObjectByFFVQuery = `
-SELECT
-     cob_id, ts, passport,
-     surname, name, patronymic,
-     sex, birthdate,
-     phone_num, email, address
-FROM
-(
-    SELECT
-        control_objects.id AS cob_id,
-        control_objects.ts AS ts,
-        control_objects.passport AS passport,
-        control_objects.surname AS surname,
-        control_objects.name AS name,
-        control_objects.patronymic AS patronymic,
-        control_objects.sex AS sex,
-        control_objects.birthdate AS birthdate,
-        control_objects.phone_num AS phone_num,
-        control_objects.email AS email,
-        control_objects.address AS address
-    FROM
-       control_objects
-) JOIN
-(
-    SELECT
-        cob_id,
-        avg(cosine_on_ort) AS cosine_on_ort,
-        avgForEach(eff) AS eff
-    FROM
-        embedded_facial_features
-    GROUP BY cob_id
-) USING cob_id
-WHERE
-    (cosine_on_ort = ?) AND 
-    (arraySum(arrayMap((x, y) -> (x * y), eff, array(?))) / 
-     (sqrt(arraySum(arrayMap(x -> x * x, array(?)))) *
-      sqrt(arraySum(arrayMap(x -> x * x, eff)))) >= ?)
-    LIMIT 1
-`
-
-// SelectControlObjectByFFV ...
-func (fs *FaceStorage) SelectControlObjectByFFV(ff proto.FacialFeaturesVector) (*proto.ControlObject, error) {
-	ffSum := 0.0
-	ffLen := 0.0
-	for i := 0; i < len(ff); i++ {
-		ffSum += ff[i]
-		ffLen += ff[i] * ff[i]
+const (
+	// BucketMatchMode compares only vectors which buckets are close enough.
+	BucketMatchMode = "bucket"
+	// ExactMatchMode compares vector with all control objects.
+	ExactMatchMode = "exact"
+	// ANNMatchMode searches vector in in-process approximate nearest neighbour index.
+	ANNMatchMode = "ann"
+)
+
+// MaxBucketRadius is a distance between the lowest and the highest buckets.
+const MaxBucketRadius = 20
+
+// SafeBucketRadius returns bucket radius, which doesn't lose any
+// vectors with cosine, not less than cosineBoundary.
+func SafeBucketRadius(cosineBoundary float64) int {
+	if cosineBoundary <= -1.0 {
+		return MaxBucketRadius
 	}
-	cosineOnOrt := int8(ffSum / (math.Sqrt(ffLen) * math.Sqrt(128.0)) * 10.0)
-	fmt.Println(cosineOnOrt)
-	rows, err := fs.db.Query(SelectControlObjectByFFVQuery,
-		cosineOnOrt,
-		clickhouse.Array(ff), clickhouse.Array(ff),
-		fs.sineBoundary,
-	)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to execute query")
+	if cosineBoundary > 1.0 {
+		cosineBoundary = 1.0
 	}
-	defer rows.Close()
-
-	if rows.Next() {
-		cob := proto.CreateDefaultControlObject()
-		if err := rows.Scan(
-			&(cob.ID), &(cob.TS), &(cob.Passport),
-			&(cob.Surname), &(cob.Name), &(cob.Patronymic),
-			&(cob.Sex), &(cob.BirthDate),
-			&(cob.PhoneNum), &(cob.Email), &(cob.Address),
-		); err != nil {
-			return nil, errors.Wrap(err, "unable to unmarshal query result")
-		}
-		return cob, nil
+	r := int(math.Floor(10.0*math.Acos(cosineBoundary))) + 1
+	if r > MaxBucketRadius {
+		return MaxBucketRadius
 	}
+	return r
+}
 
-	return proto.CreateDefaultControlObject(), nil
+// GetBucketRadius returns bucket radius for storage config match mode.
+func GetBucketRadius(cfg *cfgparser.StorageCFG) (int, error) {
+	switch cfg.MatchMode {
+	case "", BucketMatchMode:
+		if cfg.BucketRadius < 0 {
+			return SafeBucketRadius(cfg.CosineBoundary), nil
+		}
+		return cfg.BucketRadius, nil
+	case ExactMatchMode, ANNMatchMode:
+		return MaxBucketRadius, nil
+	}
+	return 0, fmt.Errorf("unknown match mode \"%s\"", cfg.MatchMode)
 }
@@ -0,0 +1,555 @@
+package storages
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/indexes"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+IndexedFaceStorage wraps another FaceStorage and searches control objects by facial
+features vector in in-process HNSW index of their centroids, so storage is only asked
+for control objects by IDs. Vectors of different embedding models can't be compared,
+so there is separate index for every model. Indexes are built from all stored centroids
+on start and are updated after every InsertCentroids. Centroids, changed through other
+servers and commands, are reloaded periodically, if version of stored centroids was
+changed: only changed and deleted ones are replaced in indexes. To speed up restarts,
+indexes are saved to snapshot file periodically and on Close with version of centroids,
+which were loaded last, and are loaded from it on start, if snapshot is not outdated
+(version or number of facial features vectors differ, or snapshot has older format),
+otherwise indexes are rebuilt. Centroids, inserted through this server after the last
+reload, make snapshot outdated, so it is rejected rather than missing changes.
+
+Snapshot is encoded to memory under read lock and is written to unique temporary file
+outside of it, so searches aren't blocked by disk I/O. Commands only load snapshot, so
+they don't race with servers: erasure through command removes snapshot instead, and
+servers save new one, once erased centroids are reloaded.
+*/
+
+const defaultIndexReloadIntervalMS = 60000
+
+// IndexedFaceStorage is FaceStorage with in-process ANN index.
+type IndexedFaceStorage struct {
+	FaceStorage
+	cosineBoundary float64
+	indexCFG       indexes.HNSWCFG
+	indexes        map[string]*indexes.HNSW // model -> index.
+	dims           map[string]int           // model -> vectors dimension.
+	mu             sync.RWMutex
+	effs           map[string]map[string]EmbeddedFFV // model -> control object ID -> centroid.
+	ffvsNum        uint64
+	version        CentroidsVersion // version of storage centroids, when they were loaded last.
+	snapshotPath   string
+	readOnly       bool       // snapshot is loaded, but isn't written.
+	snapshotMu     sync.Mutex // serializes snapshots, so older one doesn't replace newer one.
+	stop           chan struct{}
+	wg             sync.WaitGroup
+	logger         *log.Logger
+}
+
+// indexSnapshotVersion is incremented on every change of snapshot format.
+const indexSnapshotVersion = 3
+
+// indexSnapshotHeader precedes HNSW snapshots of all Models (in the same order) in snapshot file.
+type indexSnapshotHeader struct {
+	Version          int
+	FFVsNum          uint64
+	CentroidsVersion CentroidsVersion
+	Models           []string
+	EFFs             map[string]map[string][]float64
+	Nums             map[string]map[string]uint64
+}
+
+// CreateIndexedFaceStorage builds or loads index for fs.
+func CreateIndexedFaceStorage(fs FaceStorage, cfg *cfgparser.StorageCFG,
+	logger *log.Logger) (*IndexedFaceStorage, error) {
+	ifs := &IndexedFaceStorage{
+		FaceStorage:    fs,
+		cosineBoundary: cfg.CosineBoundary,
+		indexCFG: indexes.HNSWCFG{
+			M:              cfg.IndexCFG.M,
+			EfConstruction: cfg.IndexCFG.EfConstruction,
+			EfSearch:       cfg.IndexCFG.EfSearch,
+		},
+		indexes:      make(map[string]*indexes.HNSW),
+		dims:         make(map[string]int),
+		mu:           sync.RWMutex{},
+		effs:         make(map[string]map[string]EmbeddedFFV),
+		snapshotPath: cfg.IndexCFG.SnapshotPath,
+		readOnly:     cfg.IndexCFG.ReadOnlySnapshot,
+		snapshotMu:   sync.Mutex{},
+		stop:         make(chan struct{}),
+		logger:       logger,
+	}
+
+	ffvsNum, err := fs.CountFFVs()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to count facial features vectors")
+	}
+	version, err := fs.SelectCentroidsVersion()
+	if err != nil {
+		return nil, err
+	}
+	loaded := false
+	if ifs.snapshotPath != "" {
+		if err := ifs.loadSnapshot(); err != nil {
+			logger.Warn(errors.Wrapf(err, "unable to load index snapshot \"%s\"", ifs.snapshotPath))
+		} else if ifs.ffvsNum != ffvsNum {
+			logger.Warnf("index snapshot \"%s\" is outdated: it contains %d facial features vectors, but storage contains %d",
+				ifs.snapshotPath, ifs.ffvsNum, ffvsNum)
+		} else if ifs.version != version {
+			logger.Warnf("index snapshot \"%s\" is outdated: it contains centroids of version %d (%d centroids), "+
+				"but storage contains version %d (%d centroids)", ifs.snapshotPath,
+				ifs.version.MaxVersion, ifs.version.Num, version.MaxVersion, version.Num)
+		} else {
+			loaded = true
+			logger.Debugf("loaded index snapshot \"%s\" with %d models", ifs.snapshotPath, len(ifs.indexes))
+		}
+	}
+	if !loaded {
+		if err := ifs.build(version); err != nil {
+			return nil, err
+		}
+		if err := ifs.Snapshot(); err != nil {
+			logger.Warn(err)
+		}
+	}
+
+	if (ifs.snapshotPath != "") && !ifs.readOnly && (cfg.IndexCFG.SnapshotIntervalMS > 0) {
+		ifs.runSnapshotter(time.Duration(cfg.IndexCFG.SnapshotIntervalMS) * time.Millisecond)
+	}
+	reloadIntervalMS := cfg.IndexCFG.ReloadIntervalMS
+	if reloadIntervalMS <= 0 {
+		reloadIntervalMS = defaultIndexReloadIntervalMS
+	}
+	ifs.runReloader(time.Duration(reloadIntervalMS) * time.Millisecond)
+
+	return ifs, nil
+}
+
+// build builds indexes from all stored centroids, which version was selected before them.
+func (ifs *IndexedFaceStorage) build(version CentroidsVersion) error {
+	effs, err := ifs.FaceStorage.SelectEmbeddedFFVs()
+	if err != nil {
+		return errors.Wrap(err, "unable to build index")
+	}
+
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+
+	ifs.version = version
+	ifs.effs = make(map[string]map[string]EmbeddedFFV)
+	ifs.dims = make(map[string]int)
+	ifs.indexes = make(map[string]*indexes.HNSW)
+	ifs.ffvsNum = 0
+	for _, eff := range effs {
+		ifs.setEFF(eff)
+	}
+	ifs.logger.Debugf("built indexes of %d models from centroids of %d facial features vectors",
+		len(ifs.indexes), ifs.ffvsNum)
+
+	return nil
+}
+
+// Reload replaces centroids, which were changed or deleted in storage, in index,
+// if version of stored centroids was changed since the last reload.
+func (ifs *IndexedFaceStorage) Reload() error {
+	version, err := ifs.FaceStorage.SelectCentroidsVersion()
+	if err != nil {
+		return err
+	}
+	ifs.mu.RLock()
+	unchanged := ifs.version == version
+	ifs.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	// Centroids, inserted through this server after selection, may be replaced by older
+	// ones, but then version is changed again, so they are reloaded next time.
+	effs, err := ifs.FaceStorage.SelectEmbeddedFFVs()
+	if err != nil {
+		return errors.Wrap(err, "unable to reload index")
+	}
+
+	ifs.mu.Lock()
+	changedNum, erasedNum := 0, 0
+	seen := make(map[string]map[string]struct{}, len(ifs.effs))
+	for _, eff := range effs {
+		if _, ok := seen[eff.Model]; !ok {
+			seen[eff.Model] = make(map[string]struct{})
+		}
+		seen[eff.Model][eff.CobID] = struct{}{}
+		if old, ok := ifs.effs[eff.Model][eff.CobID]; ok &&
+			(old.FFVsNum == eff.FFVsNum) && equalVectors(old.EFF, eff.EFF) {
+			continue
+		}
+		ifs.setEFF(eff)
+		changedNum++
+	}
+	for model, modelEFFs := range ifs.effs {
+		for cobID, e := range modelEFFs {
+			if _, ok := seen[model][cobID]; ok {
+				continue
+			}
+			// Centroid may be deleted by erasure, so it is not kept in index.
+			ifs.ffvsNum -= e.FFVsNum
+			delete(modelEFFs, cobID)
+			ifs.indexes[model].Erase(cobID)
+			erasedNum++
+		}
+	}
+	ifs.version = version
+	ifs.mu.Unlock()
+	ifs.logger.Debugf("reloaded index: %d centroids were changed, %d were deleted", changedNum, erasedNum)
+
+	// Old snapshot still contains erased vectors.
+	if erasedNum != 0 {
+		return ifs.Snapshot()
+	}
+	return nil
+}
+
+func equalVectors(a, b proto.FacialFeaturesVector) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (ifs *IndexedFaceStorage) runReloader(interval time.Duration) {
+	ifs.wg.Add(1)
+	go func() {
+		defer ifs.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ifs.stop:
+				return
+			case <-ticker.C:
+				if err := ifs.Reload(); err != nil {
+					ifs.logger.Warn(err)
+				}
+			}
+		}
+	}()
+}
+
+// setEFF replaces centroid in index and should be called under ifs.mu.
+// Empty centroid is removed from index.
+func (ifs *IndexedFaceStorage) setEFF(eff EmbeddedFFV) {
+	if old, ok := ifs.effs[eff.Model][eff.CobID]; ok {
+		ifs.ffvsNum -= old.FFVsNum
+		delete(ifs.effs[eff.Model], eff.CobID)
+		ifs.indexes[eff.Model].Remove(eff.CobID)
+	}
+	if len(eff.EFF) == 0 {
+		return
+	}
+	modelEFFs, ok := ifs.effs[eff.Model]
+	if !ok {
+		modelEFFs = make(map[string]EmbeddedFFV)
+		ifs.effs[eff.Model] = modelEFFs
+		ifs.dims[eff.Model] = len(eff.EFF)
+	}
+	modelEFFs[eff.CobID] = eff
+	ifs.modelIndex(eff.Model).Insert(eff.CobID, eff.EFF)
+	ifs.ffvsNum += eff.FFVsNum
+}
+
+// modelIndex should be called under ifs.mu.
+func (ifs *IndexedFaceStorage) modelIndex(model string) *indexes.HNSW {
+	index, ok := ifs.indexes[model]
+	if !ok {
+		index = indexes.CreateHNSW(ifs.indexCFG)
+		ifs.indexes[model] = index
+	}
+	return index
+}
+
+// InsertCentroids inserts centroids to wrapped storage and updates index.
+func (ifs *IndexedFaceStorage) InsertCentroids(centroids []Centroid) error {
+	if err := ifs.FaceStorage.InsertCentroids(centroids); err != nil {
+		return err
+	}
+
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+
+	for _, c := range centroids {
+		ifs.setEFF(EmbeddedFFV{
+			Model:       c.Model,
+			CobID:       c.CobID,
+			CosineOnOrt: float64(c.EFF.CosineOnOrt()),
+			EFF:         append(proto.FacialFeaturesVector{}, c.EFF...),
+			FFVsNum:     c.FFVsNum,
+		})
+	}
+
+	return nil
+}
+
+// EraseControlObject erases control object from wrapped storage and from index.
+func (ifs *IndexedFaceStorage) EraseControlObject(id, reason, requestedBy string) (*proto.Erasure, []Img, error) {
+	erasure, orphanImgs, err := ifs.FaceStorage.EraseControlObject(id, reason, requestedBy)
+	if (err != nil) || (erasure == nil) {
+		return erasure, orphanImgs, err
+	}
+
+	ifs.mu.Lock()
+	for model, modelEFFs := range ifs.effs {
+		if e, ok := modelEFFs[id]; ok {
+			ifs.ffvsNum -= e.FFVsNum
+			delete(modelEFFs, id)
+			ifs.indexes[model].Erase(id)
+		}
+	}
+	ifs.mu.Unlock()
+
+	// Old snapshot still contains erased vector, so servers replace it and commands remove it.
+	if !ifs.readOnly {
+		if err := ifs.Snapshot(); err != nil {
+			ifs.logger.Warn(err)
+		}
+	} else if ifs.snapshotPath != "" {
+		if err := os.Remove(ifs.snapshotPath); (err != nil) && !os.IsNotExist(err) {
+			ifs.logger.Warn(errors.Wrap(err, "unable to remove index snapshot"))
+		}
+	}
+
+	return erasure, orphanImgs, nil
+}
+
+// SelectCandidatesByFFV searches control objects in index of model.
+func (ifs *IndexedFaceStorage) SelectCandidatesByFFV(model string, ff proto.FacialFeaturesVector, k int) ([]proto.Candidate, error) {
+	ifs.mu.RLock()
+	index, ok := ifs.indexes[model]
+	dim := ifs.dims[model]
+	ifs.mu.RUnlock()
+	if (!ok) || (dim != len(ff)) {
+		return []proto.Candidate{}, nil
+	}
+
+	results := index.Search(ff, k)
+	ids := make([]string, 0, len(results))
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	if len(ids) == 0 {
+		return []proto.Candidate{}, nil
+	}
+
+	cobs, err := ifs.FaceStorage.SelectControlObjectsByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	cobsByID := make(map[string]proto.ControlObject, len(cobs))
+	for _, cob := range cobs {
+		cobsByID[cob.ID] = cob
+	}
+
+	candidates := make([]proto.Candidate, 0, len(ids))
+	for _, r := range results {
+		cob, ok := cobsByID[r.ID]
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, proto.Candidate{
+			ControlObject: cob,
+			Similarity:    r.Similarity,
+			Matched:       r.Similarity >= ifs.cosineBoundary,
+		})
+	}
+
+	return candidates, nil
+}
+
+// SelectControlObjectByFFV searches control object in index.
+func (ifs *IndexedFaceStorage) SelectControlObjectByFFV(model string, ff proto.FacialFeaturesVector) (*proto.ControlObject, error) {
+	return selectControlObjectByFFV(ifs, model, ff)
+}
+
+// SelectEmbeddedFFVs returns centroids from index.
+func (ifs *IndexedFaceStorage) SelectEmbeddedFFVs() ([]EmbeddedFFV, error) {
+	ifs.mu.RLock()
+	defer ifs.mu.RUnlock()
+
+	effs := make([]EmbeddedFFV, 0, 128)
+	for _, modelEFFs := range ifs.effs {
+		for _, e := range modelEFFs {
+			e.EFF = append(proto.FacialFeaturesVector{}, e.EFF...)
+			effs = append(effs, e)
+		}
+	}
+
+	return effs, nil
+}
+
+// Snapshot saves index to snapshot file. Commands don't save it.
+func (ifs *IndexedFaceStorage) Snapshot() error {
+	if (ifs.snapshotPath == "") || ifs.readOnly {
+		return nil
+	}
+
+	ifs.snapshotMu.Lock()
+	defer ifs.snapshotMu.Unlock()
+
+	data, err := ifs.encodeSnapshot()
+	if err != nil {
+		return errors.Wrap(err, "unable to encode index snapshot")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(ifs.snapshotPath), filepath.Base(ifs.snapshotPath)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "unable to create index snapshot file")
+	}
+	tmpPath := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "unable to write index snapshot")
+	}
+	if err := os.Rename(tmpPath, ifs.snapshotPath); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrap(err, "unable to replace index snapshot")
+	}
+
+	ifs.logger.Debugf("saved index snapshot \"%s\"", ifs.snapshotPath)
+	return nil
+}
+
+// encodeSnapshot encodes header and indexes under read lock, so searches aren't blocked.
+func (ifs *IndexedFaceStorage) encodeSnapshot() ([]byte, error) {
+	ifs.mu.RLock()
+	defer ifs.mu.RUnlock()
+
+	buf := &bytes.Buffer{}
+	header := &indexSnapshotHeader{
+		Version:          indexSnapshotVersion,
+		FFVsNum:          ifs.ffvsNum,
+		CentroidsVersion: ifs.version,
+		Models:           make([]string, 0, len(ifs.indexes)),
+		EFFs:             make(map[string]map[string][]float64, len(ifs.effs)),
+		Nums:             make(map[string]map[string]uint64, len(ifs.effs)),
+	}
+	for model := range ifs.indexes {
+		header.Models = append(header.Models, model)
+	}
+	for model, modelEFFs := range ifs.effs {
+		header.EFFs[model] = make(map[string][]float64, len(modelEFFs))
+		header.Nums[model] = make(map[string]uint64, len(modelEFFs))
+		for cobID, e := range modelEFFs {
+			header.EFFs[model][cobID] = e.EFF
+			header.Nums[model][cobID] = e.FFVsNum
+		}
+	}
+	if err := gob.NewEncoder(buf).Encode(header); err != nil {
+		return nil, err
+	}
+	for _, model := range header.Models {
+		if err := ifs.indexes[model].Snapshot(buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (ifs *IndexedFaceStorage) loadSnapshot() error {
+	f, err := os.Open(ifs.snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	header := &indexSnapshotHeader{}
+	if err := gob.NewDecoder(r).Decode(header); err != nil {
+		return errors.Wrap(err, "unable to decode index snapshot header")
+	}
+	if header.Version != indexSnapshotVersion {
+		return errors.Errorf("index snapshot has version %d instead of %d", header.Version, indexSnapshotVersion)
+	}
+	modelIndexes := make(map[string]*indexes.HNSW, len(header.Models))
+	for _, model := range header.Models {
+		index := indexes.CreateHNSW(ifs.indexCFG)
+		if err := index.Load(r); err != nil {
+			return errors.Wrapf(err, "unable to load index of model \"%s\"", model)
+		}
+		modelIndexes[model] = index
+	}
+
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+
+	ifs.ffvsNum = header.FFVsNum
+	ifs.version = header.CentroidsVersion
+	ifs.indexes = modelIndexes
+	ifs.effs = make(map[string]map[string]EmbeddedFFV, len(header.EFFs))
+	ifs.dims = make(map[string]int, len(header.EFFs))
+	for model, effs := range header.EFFs {
+		modelEFFs := make(map[string]EmbeddedFFV, len(effs))
+		for cobID, eff := range effs {
+			modelEFFs[cobID] = EmbeddedFFV{
+				Model:       model,
+				CobID:       cobID,
+				CosineOnOrt: float64(proto.FacialFeaturesVector(eff).CosineOnOrt()),
+				EFF:         eff,
+				FFVsNum:     header.Nums[model][cobID],
+			}
+			ifs.dims[model] = len(eff)
+		}
+		ifs.effs[model] = modelEFFs
+	}
+
+	return nil
+}
+
+func (ifs *IndexedFaceStorage) runSnapshotter(interval time.Duration) {
+	ifs.wg.Add(1)
+	go func() {
+		defer ifs.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ifs.stop:
+				return
+			case <-ticker.C:
+				if err := ifs.Snapshot(); err != nil {
+					ifs.logger.Warn(err)
+				}
+			}
+		}
+	}()
+}
+
+// Close saves index snapshot and closes wrapped storage.
+func (ifs *IndexedFaceStorage) Close() error {
+	close(ifs.stop)
+	ifs.wg.Wait()
+	if err := ifs.Snapshot(); err != nil {
+		ifs.logger.Warn(err)
+	}
+	return ifs.FaceStorage.Close()
+}
@@ -0,0 +1,86 @@
+package storages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestIndexedFaceStorageSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		readOnly bool
+		existing bool
+		erase    bool
+		// wantSnapshot is true, if snapshot file exists after all.
+		wantSnapshot bool
+	}{
+		{"server", false, false, false, true},
+		{"server erasure", false, false, true, true},
+		{"command", true, false, false, false},
+		{"command with server snapshot", true, true, false, true},
+		{"command erasure", true, true, true, false},
+	}
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "facedb-index")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			fs := CreateMemoryFaceStorage(0.95, SafeBucketRadius(0.95))
+			if err := fs.InsertControlObjects([]proto.ControlObject{{ID: "cob-1"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.InsertCentroids([]Centroid{{CobID: "cob-1", EFF: proto.FacialFeaturesVector{1.0, 0.0}, FFVsNum: 1}}); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &cfgparser.StorageCFG{CosineBoundary: 0.95}
+			cfg.IndexCFG.SnapshotPath = filepath.Join(dir, "index.snapshot")
+			if tt.existing {
+				ifs, err := CreateIndexedFaceStorage(fs, cfg, logger)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ifs.Close()
+			}
+
+			cfg.IndexCFG.ReadOnlySnapshot = tt.readOnly
+			ifs, err := CreateIndexedFaceStorage(fs, cfg, logger)
+			if err != nil {
+				t.Fatalf("CreateIndexedFaceStorage() error: %s", err)
+			}
+			if tt.erase {
+				if _, _, err := ifs.EraseControlObject("cob-1", "request", "operator"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ifs.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			infos, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(infos))
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			wantNum := 0
+			if tt.wantSnapshot {
+				wantNum = 1
+			}
+			if (len(names) != wantNum) || ((wantNum == 1) && (names[0] != "index.snapshot")) {
+				t.Errorf("files = %v, want snapshot %v without temporary files", names, tt.wantSnapshot)
+			}
+		})
+	}
+}
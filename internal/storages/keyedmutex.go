@@ -0,0 +1,111 @@
+package storages
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+/*
+Passports of control objects are unique: control object is created or its passport
+is changed only after check, that passport isn't used yet. Checks and writes of the
+same passport are serialized in process by LockPassports. Control objects may also
+be written by other servers and commands, so writers, which can't merge control
+objects (e.g. update of passport), also re-check passport after write.
+
+Control objects are updated by read-modify-write of the whole row, so updates of the
+same control object are serialized in process by LockControlObjects, otherwise one of
+concurrent updates would be lost. Control object lock is taken before passport one.
+*/
+
+// keyedMutex locks keys independently.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func createKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		mu:    sync.Mutex{},
+		locks: make(map[string]*keyedLock),
+	}
+}
+
+func (km *keyedMutex) lock(key string) {
+	km.mu.Lock()
+	l, ok := km.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		km.locks[key] = l
+	}
+	l.refs++
+	km.mu.Unlock()
+
+	l.mu.Lock()
+}
+
+func (km *keyedMutex) unlock(key string) {
+	km.mu.Lock()
+	l := km.locks[key]
+	l.refs--
+	if l.refs == 0 {
+		delete(km.locks, key)
+	}
+	km.mu.Unlock()
+
+	l.mu.Unlock()
+}
+
+// lockAll locks all unique keys in sorted order, so callers with overlapping keys
+// don't deadlock, and returns function, which unlocks them.
+func (km *keyedMutex) lockAll(keys []string) func() {
+	seen := make(map[string]struct{}, len(keys))
+	sorted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		km.lock(key)
+	}
+	return func() {
+		for i := len(sorted) - 1; i >= 0; i-- {
+			km.unlock(sorted[i])
+		}
+	}
+}
+
+// centroidsLocks are locks of control objects, which centroids are rebuilt.
+var centroidsLocks = createKeyedMutex()
+
+// controlObjectsLocks are locks of control objects, which are updated.
+var controlObjectsLocks = createKeyedMutex()
+
+// passportsLocks are locks of passports, which are checked and written.
+var passportsLocks = createKeyedMutex()
+
+// LockPassports locks passports of control objects until returned function is called.
+// Empty and default passports are not locked.
+func LockPassports(passports ...string) func() {
+	keys := make([]string, 0, len(passports))
+	for _, passport := range passports {
+		if (passport != "") && (passport != proto.DefaultStringField) {
+			keys = append(keys, passport)
+		}
+	}
+	return passportsLocks.lockAll(keys)
+}
+
+// LockControlObjects locks control objects with given IDs until returned function is called.
+func LockControlObjects(ids ...string) func() {
+	return controlObjectsLocks.lockAll(ids)
+}
@@ -0,0 +1,82 @@
+package storages
+
+import (
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+// copyAuditRecord returns copy of rec, which doesn't share entries with it.
+func copyAuditRecord(rec *proto.AuditRecord) proto.AuditRecord {
+	c := *rec
+	c.Entries = make([]proto.AuditEntry, len(rec.Entries))
+	for i, e := range rec.Entries {
+		c.Entries[i] = e
+		c.Entries[i].Changed = append([]string{}, e.Changed...)
+	}
+	return c
+}
+
+// InsertAuditRecord ...
+func (fs *MemoryFaceStorage) InsertAuditRecord(rec *proto.AuditRecord) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.auditLog = append(fs.auditLog, copyAuditRecord(rec))
+
+	return nil
+}
+
+// SelectAuditRecords ...
+func (fs *MemoryFaceStorage) SelectAuditRecords(filter *AuditFilter, offset, limit uint64) ([]proto.AuditRecord, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	recs := make([]proto.AuditRecord, 0, limit)
+	for i := len(fs.auditLog) - 1; (i >= 0) && (uint64(len(recs)) < limit); i-- {
+		if !filter.Match(&(fs.auditLog[i])) {
+			continue
+		}
+		if offset != 0 {
+			offset--
+			continue
+		}
+		recs = append(recs, copyAuditRecord(&(fs.auditLog[i])))
+	}
+
+	return recs, nil
+}
+
+// ScanAuditRecords ...
+func (fs *MemoryFaceStorage) ScanAuditRecords(fn func(rec *proto.AuditRecord) error) error {
+	fs.mu.RLock()
+	recs := make([]proto.AuditRecord, 0, len(fs.auditLog))
+	for i := range fs.auditLog {
+		recs = append(recs, copyAuditRecord(&(fs.auditLog[i])))
+	}
+	fs.mu.RUnlock()
+
+	for i := range recs {
+		if err := fn(&(recs[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shredAuditRecords should be called under fs.mu.
+func (fs *MemoryFaceStorage) shredAuditRecords(cobID string) uint64 {
+	recsNum := uint64(0)
+	for i := range fs.auditLog {
+		rec := &(fs.auditLog[i])
+		if rec.Salt == "" {
+			continue
+		}
+		for _, e := range rec.Entries {
+			if (e.SuggestedID == cobID) || (e.CobID == cobID) {
+				rec.Salt = ""
+				recsNum++
+				break
+			}
+		}
+	}
+	return recsNum
+}
@@ -0,0 +1,154 @@
+package storages
+
+import (
+	"sort"
+
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+func copyFFV(ffv FFV) FFV {
+	ffv.FaceBox = append(proto.FaceBox{}, ffv.FaceBox...)
+	ffv.FacialFeaturesVector = append(proto.FacialFeaturesVector{}, ffv.FacialFeaturesVector...)
+	return ffv
+}
+
+func copyCentroid(c Centroid) Centroid {
+	c.EFF = append(proto.FacialFeaturesVector{}, c.EFF...)
+	c.Outliers = append([]identities.Outlier{}, c.Outliers...)
+	c.AcceptedIDs = append([]string{}, c.AcceptedIDs...)
+	return c
+}
+
+// SelectFFVsByControlObject ...
+func (fs *MemoryFaceStorage) SelectFFVsByControlObject(cobID string) ([]FFV, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	ffvs := make([]FFV, 0, 16)
+	for _, ffv := range fs.ffvs {
+		if ffv.CobID == cobID {
+			ffvs = append(ffvs, copyFFV(ffv))
+		}
+	}
+
+	return ffvs, nil
+}
+
+// SelectFFVs ...
+func (fs *MemoryFaceStorage) SelectFFVs(ids []string) ([]FFV, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	idsSet := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		idsSet[id] = struct{}{}
+	}
+	ffvs := make([]FFV, 0, len(ids))
+	for _, ffv := range fs.ffvs {
+		if _, ok := idsSet[ffv.ID]; ok {
+			ffvs = append(ffvs, copyFFV(ffv))
+		}
+	}
+
+	return ffvs, nil
+}
+
+// DeleteFFVs ...
+func (fs *MemoryFaceStorage) DeleteFFVs(ids []string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	idsSet := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		idsSet[id] = struct{}{}
+	}
+	ffvs := make([]FFV, 0, len(fs.ffvs))
+	for _, ffv := range fs.ffvs {
+		if _, ok := idsSet[ffv.ID]; ok {
+			delete(fs.ffvIDs, ffv.ID)
+			continue
+		}
+		ffvs = append(ffvs, ffv)
+	}
+	fs.ffvs = ffvs
+
+	return nil
+}
+
+// InsertCentroids ...
+func (fs *MemoryFaceStorage) InsertCentroids(centroids []Centroid) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, c := range centroids {
+		cobCentroids, ok := fs.centroids[c.CobID]
+		if !ok {
+			cobCentroids = make(map[string]Centroid)
+			fs.centroids[c.CobID] = cobCentroids
+		}
+		cobCentroids[c.Model] = copyCentroid(c)
+	}
+	fs.centroidsVer++
+
+	return nil
+}
+
+// SelectCentroidsVersion ...
+func (fs *MemoryFaceStorage) SelectCentroidsVersion() (CentroidsVersion, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	v := CentroidsVersion{
+		MaxVersion: fs.centroidsVer,
+	}
+	for _, cobCentroids := range fs.centroids {
+		v.Num += uint64(len(cobCentroids))
+	}
+
+	return v, nil
+}
+
+// SelectCentroids ...
+func (fs *MemoryFaceStorage) SelectCentroids(cobID string) ([]Centroid, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	centroids := make([]Centroid, 0, len(fs.centroids[cobID]))
+	for _, c := range fs.centroids[cobID] {
+		centroids = append(centroids, copyCentroid(c))
+	}
+	sort.Slice(centroids, func(i, j int) bool {
+		return centroids[i].Model < centroids[j].Model
+	})
+
+	return centroids, nil
+}
+
+// SelectCentroidsWithOutliers ...
+func (fs *MemoryFaceStorage) SelectCentroidsWithOutliers(offset, limit uint64) ([]Centroid, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	centroids := make([]Centroid, 0, 16)
+	for _, cobCentroids := range fs.centroids {
+		for _, c := range cobCentroids {
+			if len(c.Outliers) != 0 {
+				centroids = append(centroids, copyCentroid(c))
+			}
+		}
+	}
+	sort.Slice(centroids, func(i, j int) bool {
+		return (centroids[i].CobID < centroids[j].CobID) ||
+			((centroids[i].CobID == centroids[j].CobID) && (centroids[i].Model < centroids[j].Model))
+	})
+	if offset >= uint64(len(centroids)) {
+		return []Centroid{}, nil
+	}
+	centroids = centroids[offset:]
+	if uint64(len(centroids)) > limit {
+		centroids = centroids[:limit]
+	}
+
+	return centroids, nil
+}
@@ -0,0 +1,164 @@
+package storages
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+// SelectUnmatchedSightings ...
+func (fs *MemoryFaceStorage) SelectUnmatchedSightings(from, to time.Time, limit uint64) ([]Sighting, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	filter := &SightingsFilter{
+		From: from,
+		To:   to,
+	}
+	sightings := make([]Sighting, 0, 128)
+	for i := range fs.sightings {
+		s := &(fs.sightings[i])
+		if (s.CobID == "") && (len(s.FacialFeaturesVector) != 0) && filter.Match(s) {
+			sightings = append(sightings, *s)
+		}
+	}
+	sortSightings(sightings)
+	if uint64(len(sightings)) > limit {
+		sightings = sightings[:limit]
+	}
+
+	return sightings, nil
+}
+
+// SelectSightingsByIDs ...
+func (fs *MemoryFaceStorage) SelectSightingsByIDs(ids []string) ([]Sighting, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	idsSet := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		idsSet[id] = struct{}{}
+	}
+	sightings := make([]Sighting, 0, len(ids))
+	for _, s := range fs.sightings {
+		if _, ok := idsSet[s.ID]; ok {
+			sightings = append(sightings, s)
+		}
+	}
+	sortSightings(sightings)
+
+	return sightings, nil
+}
+
+func sortSightings(sightings []Sighting) {
+	sort.Slice(sightings, func(i, j int) bool {
+		if !sightings[i].TS.Equal(sightings[j].TS) {
+			return sightings[i].TS.After(sightings[j].TS)
+		}
+		return sightings[i].ID > sightings[j].ID
+	})
+}
+
+// AssignSightings ...
+func (fs *MemoryFaceStorage) AssignSightings(ids []string, cobID string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	idsSet := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		idsSet[id] = struct{}{}
+	}
+	for i := range fs.sightings {
+		if _, ok := idsSet[fs.sightings[i].ID]; ok {
+			fs.sightings[i].CobID = cobID
+		}
+	}
+
+	return nil
+}
+
+// ReplaceClusters ...
+func (fs *MemoryFaceStorage) ReplaceClusters(clusters []Cluster) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for id, c := range fs.clusters {
+		if c.CobID == "" {
+			delete(fs.clusters, id)
+		}
+	}
+	for _, c := range clusters {
+		c.SightingIDs = append([]string{}, c.SightingIDs...)
+		c.RepresentativeIDs = append([]string{}, c.RepresentativeIDs...)
+		c.Centroid = append(proto.FacialFeaturesVector{}, c.Centroid...)
+		fs.clusters[c.ID] = c
+	}
+
+	return nil
+}
+
+// SelectClusters ...
+func (fs *MemoryFaceStorage) SelectClusters(offset, limit uint64) ([]Cluster, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	clusters := make([]Cluster, 0, len(fs.clusters))
+	for _, c := range fs.clusters {
+		if c.CobID == "" {
+			clusters = append(clusters, c)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].SightingIDs) != len(clusters[j].SightingIDs) {
+			return len(clusters[i].SightingIDs) > len(clusters[j].SightingIDs)
+		}
+		return clusters[i].ID < clusters[j].ID
+	})
+	if offset >= uint64(len(clusters)) {
+		return []Cluster{}, nil
+	}
+	clusters = clusters[offset:]
+	if uint64(len(clusters)) > limit {
+		clusters = clusters[:limit]
+	}
+
+	return clusters, nil
+}
+
+// SelectCluster ...
+func (fs *MemoryFaceStorage) SelectCluster(id string) (*Cluster, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	c, ok := fs.clusters[id]
+	if !ok {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// PromoteCluster ...
+func (fs *MemoryFaceStorage) PromoteCluster(id, cobID string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if c, ok := fs.clusters[id]; ok {
+		c.CobID = cobID
+		fs.clusters[id] = c
+	}
+
+	return nil
+}
+
+// eraseClusters should be called under fs.mu.
+func (fs *MemoryFaceStorage) eraseClusters(cobID string) uint64 {
+	clustersNum := uint64(0)
+	for id, c := range fs.clusters {
+		if c.CobID == cobID {
+			delete(fs.clusters, id)
+			clustersNum++
+		}
+	}
+	return clustersNum
+}
@@ -0,0 +1,637 @@
+package storages
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+/*
+MemoryFaceStorage keeps all data in process memory and mirrors ClickHouse DB schema:
+control objects, watchlists, centroids and clusters are replaced by their keys (as
+ReplacingMergeTree does).
+*/
+
+// MemoryFaceStorage is in-memory FaceStorage.
+type MemoryFaceStorage struct {
+	cosineBoundary float64
+	bucketRadius   int
+	mu             sync.RWMutex
+	cobs           map[string]proto.ControlObject
+	cobIDs         []string
+	deletedCobs    map[string]struct{}
+	imgs           []Img
+	imgIDs         map[string]struct{}
+	ffvs           []FFV
+	ffvIDs         map[string]struct{}
+	centroids      map[string]map[string]Centroid // control object ID -> model -> centroid.
+	centroidsVer   uint64                         // incremented on every insert and deletion of centroids.
+	sightings      []Sighting
+	erasures       []proto.Erasure
+	merges         []proto.Merge
+	purges         []proto.Purge
+	auditLog       []proto.AuditRecord
+	watchlists     map[string]proto.Watchlist
+	alerts         []Alert
+	clusters       map[string]Cluster
+}
+
+// CreateMemoryFaceStorage ...
+func CreateMemoryFaceStorage(cosineBoundary float64, bucketRadius int) *MemoryFaceStorage {
+	return &MemoryFaceStorage{
+		cosineBoundary: cosineBoundary,
+		bucketRadius:   bucketRadius,
+		mu:             sync.RWMutex{},
+		cobs:           make(map[string]proto.ControlObject),
+		cobIDs:         make([]string, 0, 128),
+		deletedCobs:    make(map[string]struct{}),
+		imgs:           make([]Img, 0, 128),
+		imgIDs:         make(map[string]struct{}),
+		ffvs:           make([]FFV, 0, 128),
+		ffvIDs:         make(map[string]struct{}),
+		centroids:      make(map[string]map[string]Centroid),
+		sightings:      make([]Sighting, 0, 128),
+		erasures:       make([]proto.Erasure, 0, 16),
+		merges:         make([]proto.Merge, 0, 16),
+		purges:         make([]proto.Purge, 0, 16),
+		auditLog:       make([]proto.AuditRecord, 0, 16),
+		watchlists:     make(map[string]proto.Watchlist),
+		alerts:         make([]Alert, 0, 16),
+		clusters:       make(map[string]Cluster),
+	}
+}
+
+// Close does nothing.
+func (fs *MemoryFaceStorage) Close() error {
+	return nil
+}
+
+// InsertControlObjects ...
+func (fs *MemoryFaceStorage) InsertControlObjects(cobs []proto.ControlObject) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, cob := range cobs {
+		dbTS := time.Now()
+		cob.DBTS = &dbTS
+		cob.Attributes = copyAttributes(cob.Attributes)
+		if _, ok := fs.cobs[cob.ID]; !ok {
+			fs.cobIDs = append(fs.cobIDs, cob.ID)
+		}
+		fs.cobs[cob.ID] = cob
+		delete(fs.deletedCobs, cob.ID)
+	}
+
+	return nil
+}
+
+// RewriteControlObjects replaces only control objects, which weren't changed or deleted
+// since they were selected (have the same DBTS).
+func (fs *MemoryFaceStorage) RewriteControlObjects(cobs []proto.ControlObject) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, cob := range cobs {
+		cur, ok := fs.aliveCob(cob.ID)
+		if !ok || (cob.DBTS == nil) || (cur.DBTS == nil) || !cur.DBTS.Equal(*(cob.DBTS)) {
+			continue
+		}
+		cob.Attributes = copyAttributes(cob.Attributes)
+		fs.cobs[cob.ID] = cob
+	}
+
+	return nil
+}
+
+// SelectControlObjectByPassport ...
+func (fs *MemoryFaceStorage) SelectControlObjectByPassport(passport string) (*proto.ControlObject, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for _, id := range fs.cobIDs {
+		cob, ok := fs.aliveCob(id)
+		if ok && (cob.Passport == passport) {
+			return &cob, nil
+		}
+	}
+
+	return proto.CreateDefaultControlObject(), nil
+}
+
+// SelectControlObjectsByIDs ...
+func (fs *MemoryFaceStorage) SelectControlObjectsByIDs(ids []string) ([]proto.ControlObject, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	cobs := make([]proto.ControlObject, 0, len(ids))
+	for _, id := range ids {
+		if cob, ok := fs.aliveCob(id); ok {
+			cobs = append(cobs, cob)
+		}
+	}
+
+	return cobs, nil
+}
+
+// SelectControlObjects ...
+func (fs *MemoryFaceStorage) SelectControlObjects(filter *ControlObjectsFilter, offset, limit uint64) ([]proto.ControlObject, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	ids := append([]string{}, fs.cobIDs...)
+	sort.Strings(ids)
+	cobs := make([]proto.ControlObject, 0, limit)
+	for _, id := range ids {
+		if uint64(len(cobs)) == limit {
+			break
+		}
+		cob, ok := fs.aliveCob(id)
+		if !ok || !filter.Match(&cob) {
+			continue
+		}
+		if offset != 0 {
+			offset--
+			continue
+		}
+		cobs = append(cobs, cob)
+	}
+
+	return cobs, nil
+}
+
+// DeleteControlObject ...
+func (fs *MemoryFaceStorage) DeleteControlObject(id string) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.aliveCob(id); !ok {
+		return false, nil
+	}
+	fs.deletedCobs[id] = struct{}{}
+
+	return true, nil
+}
+
+// EraseControlObject ...
+func (fs *MemoryFaceStorage) EraseControlObject(id, reason, requestedBy string) (*proto.Erasure, []Img, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ffvs := make([]FFV, 0, len(fs.ffvs))
+	for _, ffv := range fs.ffvs {
+		if ffv.CobID != id {
+			ffvs = append(ffvs, ffv)
+		}
+	}
+	ffvsNum := uint64(len(fs.ffvs) - len(ffvs))
+	if _, ok := fs.cobs[id]; !ok && (ffvsNum == 0) {
+		return nil, nil, nil
+	}
+
+	cobImgs := make([]Img, 0, 16)
+	imgs := make([]Img, 0, len(fs.imgs))
+	for _, img := range fs.imgs {
+		faceIDs := make([]string, 0, len(img.FaceIDs))
+		for _, faceID := range img.FaceIDs {
+			if faceID != id {
+				faceIDs = append(faceIDs, faceID)
+			}
+		}
+		if len(faceIDs) != len(img.FaceIDs) {
+			cobImgs = append(cobImgs, img)
+		}
+		if (len(faceIDs) != 0) || (len(img.FaceIDs) == 0) {
+			img.FaceIDs = faceIDs
+			imgs = append(imgs, img)
+		}
+	}
+	orphanImgs, _ := splitOrphanImgs(cobImgs, id)
+
+	cobIDs := make([]string, 0, len(fs.cobIDs))
+	for _, cobID := range fs.cobIDs {
+		if cobID != id {
+			cobIDs = append(cobIDs, cobID)
+		}
+	}
+	fs.cobIDs = cobIDs
+	delete(fs.cobs, id)
+	delete(fs.deletedCobs, id)
+	delete(fs.centroids, id)
+	fs.centroidsVer++
+	for _, ffv := range fs.ffvs {
+		if ffv.CobID == id {
+			delete(fs.ffvIDs, ffv.ID)
+		}
+	}
+	for _, img := range orphanImgs {
+		delete(fs.imgIDs, img.ID)
+	}
+	fs.ffvs = ffvs
+	fs.imgs = imgs
+	sightingsNum, sightingsImgs := fs.eraseSightings(id)
+	fs.eraseFromWatchlists(id)
+	clustersNum := fs.eraseClusters(id)
+	auditRecordsNum := fs.shredAuditRecords(id)
+
+	erasure := createErasure(id, reason, requestedBy, ffvsNum, sightingsNum, cobImgs, orphanImgs)
+	erasure.ClustersNum, erasure.AuditRecordsNum = clustersNum, auditRecordsNum
+	fs.erasures = append(fs.erasures, *erasure)
+
+	return erasure, append(orphanImgs, sightingsImgs...), nil
+}
+
+// eraseSightings should be called under fs.mu.
+func (fs *MemoryFaceStorage) eraseSightings(cobID string) (uint64, []Img) {
+	sharedImgs := make(map[string]bool)
+	sightings := make([]Sighting, 0, len(fs.sightings))
+	for _, s := range fs.sightings {
+		if s.CobID != cobID {
+			sightings = append(sightings, s)
+		}
+		sharedImgs[s.ImgID] = sharedImgs[s.ImgID] || (s.CobID != cobID)
+	}
+
+	imgs := make([]Img, 0, 16)
+	for _, s := range fs.sightings {
+		if (s.CobID == cobID) && (s.ImgPath != "") && !sharedImgs[s.ImgID] {
+			imgs = append(imgs, Img{ID: s.ImgID, Path: s.ImgPath})
+			sharedImgs[s.ImgID] = true
+		}
+	}
+	sightingsNum := uint64(len(fs.sightings) - len(sightings))
+	fs.sightings = sightings
+
+	return sightingsNum, imgs
+}
+
+// SelectErasures ...
+func (fs *MemoryFaceStorage) SelectErasures(offset, limit uint64) ([]proto.Erasure, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	erasures := make([]proto.Erasure, 0, limit)
+	for i := len(fs.erasures) - 1; (i >= 0) && (uint64(len(erasures)) < limit); i-- {
+		if offset != 0 {
+			offset--
+			continue
+		}
+		erasures = append(erasures, fs.erasures[i])
+	}
+
+	return erasures, nil
+}
+
+// aliveCob should be called under fs.mu.
+func (fs *MemoryFaceStorage) aliveCob(id string) (proto.ControlObject, bool) {
+	cob, ok := fs.cobs[id]
+	if !ok {
+		return cob, false
+	}
+	if _, deleted := fs.deletedCobs[id]; deleted {
+		return cob, false
+	}
+	cob.Attributes = copyAttributes(cob.Attributes)
+	return cob, true
+}
+
+// copyAttributes copies attributes, so stored control objects can't be changed by callers.
+func copyAttributes(attrs map[string]string) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		c[k] = v
+	}
+	return c
+}
+
+// InsertFFVs ...
+func (fs *MemoryFaceStorage) InsertFFVs(ffvs []FFV) ([]FFV, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	newFFVs := make([]FFV, 0, len(ffvs))
+	for _, ffv := range ffvs {
+		if _, ok := fs.ffvIDs[ffv.ID]; ok {
+			continue
+		}
+		fs.ffvIDs[ffv.ID] = struct{}{}
+		newFFVs = append(newFFVs, ffv)
+		ffv.FaceBox = append(proto.FaceBox{}, ffv.FaceBox...)
+		ffv.FacialFeaturesVector = append(proto.FacialFeaturesVector{}, ffv.FacialFeaturesVector...)
+		fs.ffvs = append(fs.ffvs, ffv)
+	}
+
+	return newFFVs, nil
+}
+
+// InsertImgs ...
+func (fs *MemoryFaceStorage) InsertImgs(imgs []Img) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, img := range imgs {
+		if _, ok := fs.imgIDs[img.ID]; ok {
+			continue
+		}
+		fs.imgIDs[img.ID] = struct{}{}
+		img.FaceIDs = append([]string{}, img.FaceIDs...)
+		fs.imgs = append(fs.imgs, img)
+	}
+
+	return nil
+}
+
+// SelectImgs ...
+func (fs *MemoryFaceStorage) SelectImgs(ids []string) ([]Img, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	idsSet := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		idsSet[id] = struct{}{}
+	}
+	imgs := make([]Img, 0, len(ids))
+	for _, img := range fs.imgs {
+		if _, ok := idsSet[img.ID]; ok {
+			img.FaceIDs = append([]string{}, img.FaceIDs...)
+			imgs = append(imgs, img)
+		}
+	}
+
+	return imgs, nil
+}
+
+// RevertInserts ...
+func (fs *MemoryFaceStorage) RevertInserts(cobIDs, imgIDs, ffvIDs []string) error {
+	if err := fs.DeleteFFVs(ffvIDs); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	revertedImgs := make(map[string]struct{}, len(imgIDs))
+	for _, id := range imgIDs {
+		revertedImgs[id] = struct{}{}
+		delete(fs.imgIDs, id)
+	}
+	imgs := make([]Img, 0, len(fs.imgs))
+	for _, img := range fs.imgs {
+		if _, ok := revertedImgs[img.ID]; !ok {
+			imgs = append(imgs, img)
+		}
+	}
+	fs.imgs = imgs
+
+	cobsWithFFVs := make(map[string]struct{}, len(fs.cobIDs))
+	for _, ffv := range fs.ffvs {
+		cobsWithFFVs[ffv.CobID] = struct{}{}
+	}
+	revertedCobs := make(map[string]struct{}, len(cobIDs))
+	for _, id := range cobIDs {
+		if _, ok := cobsWithFFVs[id]; !ok {
+			revertedCobs[id] = struct{}{}
+			delete(fs.cobs, id)
+			delete(fs.deletedCobs, id)
+		}
+	}
+	ids := make([]string, 0, len(fs.cobIDs))
+	for _, id := range fs.cobIDs {
+		if _, ok := revertedCobs[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	fs.cobIDs = ids
+
+	return nil
+}
+
+// InsertSightings ...
+func (fs *MemoryFaceStorage) InsertSightings(sightings []Sighting) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, s := range sightings {
+		s.FaceBox = append(proto.FaceBox{}, s.FaceBox...)
+		s.FacialFeaturesVector = append(proto.FacialFeaturesVector{}, s.FacialFeaturesVector...)
+		fs.sightings = append(fs.sightings, s)
+	}
+
+	return nil
+}
+
+// SelectSightings ...
+func (fs *MemoryFaceStorage) SelectSightings(filter *SightingsFilter, limit uint64) ([]Sighting, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	sightings := make([]Sighting, 0, 128)
+	for i := range fs.sightings {
+		if filter.Match(&(fs.sightings[i])) {
+			s := fs.sightings[i]
+			s.FacialFeaturesVector = nil
+			sightings = append(sightings, s)
+		}
+	}
+	sortSightings(sightings)
+	if uint64(len(sightings)) > limit {
+		sightings = sightings[:limit]
+	}
+
+	return sightings, nil
+}
+
+// SelectSightingImgPath ...
+func (fs *MemoryFaceStorage) SelectSightingImgPath(imgID string, ts time.Time) (string, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for _, s := range fs.sightings {
+		if (s.ImgID == imgID) && (s.TS.Unix() == ts.Unix()) && (s.ImgPath != "") {
+			return s.ImgPath, nil
+		}
+	}
+
+	return "", nil
+}
+
+// ScanSightingsImgs ...
+func (fs *MemoryFaceStorage) ScanSightingsImgs(fn func(img *Img) error) error {
+	fs.mu.RLock()
+	imgs := make([]Img, 0, 128)
+	seen := make(map[string]int)
+	for _, s := range fs.sightings {
+		if s.ImgPath == "" {
+			continue
+		}
+		if i, ok := seen[s.ImgID]; ok {
+			if s.TS.Before(imgs[i].TS) {
+				imgs[i].TS = s.TS
+			}
+			continue
+		}
+		seen[s.ImgID] = len(imgs)
+		imgs = append(imgs, Img{ID: s.ImgID, TS: s.TS, Path: s.ImgPath})
+	}
+	fs.mu.RUnlock()
+
+	for i := range imgs {
+		if err := fn(&(imgs[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SelectImgsByControlObject ...
+func (fs *MemoryFaceStorage) SelectImgsByControlObject(cob *proto.ControlObject) ([]Img, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	imgs := make([]Img, 0, 128)
+	for _, img := range fs.imgs {
+		for _, faceID := range img.FaceIDs {
+			if faceID == cob.ID {
+				img.FaceIDs = append([]string{}, img.FaceIDs...)
+				imgs = append(imgs, img)
+				break
+			}
+		}
+	}
+
+	return imgs, nil
+}
+
+// SelectCandidatesByFFV ...
+func (fs *MemoryFaceStorage) SelectCandidatesByFFV(model string, ff proto.FacialFeaturesVector, k int) ([]proto.Candidate, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	cosineOnOrt := int(ff.CosineOnOrt())
+	candidates := make([]proto.Candidate, 0, k)
+	for _, id := range fs.cobIDs {
+		eff := fs.centroids[id][model].EFF
+		if len(eff) != len(ff) {
+			continue
+		}
+		if d := int(eff.CosineOnOrt()) - cosineOnOrt; (d > fs.bucketRadius) || (-d > fs.bucketRadius) {
+			continue
+		}
+		similarity := eff.Cosine(ff)
+		cob, ok := fs.aliveCob(id)
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, proto.Candidate{
+			ControlObject: cob,
+			Similarity:    similarity,
+			Matched:       similarity >= fs.cosineBoundary,
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Similarity > candidates[j].Similarity
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+
+	return candidates, nil
+}
+
+// SelectControlObjectByFFV ...
+func (fs *MemoryFaceStorage) SelectControlObjectByFFV(model string, ff proto.FacialFeaturesVector) (*proto.ControlObject, error) {
+	return selectControlObjectByFFV(fs, model, ff)
+}
+
+// SelectEmbeddedFFVs ...
+func (fs *MemoryFaceStorage) SelectEmbeddedFFVs() ([]EmbeddedFFV, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.selectEmbeddedFFVs(fs.cobIDs), nil
+}
+
+// SelectEmbeddedFFVsByControlObjects ...
+func (fs *MemoryFaceStorage) SelectEmbeddedFFVsByControlObjects(cobIDs []string) ([]EmbeddedFFV, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return fs.selectEmbeddedFFVs(cobIDs), nil
+}
+
+// selectEmbeddedFFVs should be called under fs.mu.
+func (fs *MemoryFaceStorage) selectEmbeddedFFVs(cobIDs []string) []EmbeddedFFV {
+	effs := make([]EmbeddedFFV, 0, len(cobIDs))
+	for _, id := range cobIDs {
+		cobCentroids := fs.centroids[id]
+		models := make([]string, 0, len(cobCentroids))
+		for model := range cobCentroids {
+			models = append(models, model)
+		}
+		sort.Strings(models)
+		for _, model := range models {
+			c := cobCentroids[model]
+			if len(c.EFF) == 0 {
+				continue
+			}
+			effs = append(effs, EmbeddedFFV{
+				Model:       model,
+				CobID:       id,
+				CosineOnOrt: float64(c.EFF.CosineOnOrt()),
+				EFF:         append(proto.FacialFeaturesVector{}, c.EFF...),
+				FFVsNum:     c.FFVsNum,
+			})
+		}
+	}
+
+	return effs
+}
+
+// ScanFFVs ...
+func (fs *MemoryFaceStorage) ScanFFVs(fn func(ffv *FFV) error) error {
+	fs.mu.RLock()
+	ffvs := fs.ffvs[:len(fs.ffvs):len(fs.ffvs)]
+	fs.mu.RUnlock()
+
+	for i := range ffvs {
+		ffv := ffvs[i]
+		if err := fn(&ffv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ScanImgs ...
+func (fs *MemoryFaceStorage) ScanImgs(fn func(img *Img) error) error {
+	fs.mu.RLock()
+	imgs := make([]Img, 0, len(fs.imgs))
+	for _, img := range fs.imgs {
+		img.FaceIDs = append([]string{}, img.FaceIDs...)
+		imgs = append(imgs, img)
+	}
+	fs.mu.RUnlock()
+
+	for i := range imgs {
+		if err := fn(&(imgs[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CountFFVs ...
+func (fs *MemoryFaceStorage) CountFFVs() (uint64, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return uint64(len(fs.ffvs)), nil
+}
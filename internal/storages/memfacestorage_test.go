@@ -0,0 +1,59 @@
+package storages
+
+import (
+	"testing"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+func TestMemorySelectCandidatesByFFV(t *testing.T) {
+	fs := CreateMemoryFaceStorage(0.95, SafeBucketRadius(0.95))
+	vectors := map[string]proto.FacialFeaturesVector{
+		"cob-1": {1.0, 0.0, 0.0},
+		"cob-2": {0.98, 0.1, 0.0},
+		"cob-3": {0.6, 0.8, 0.0},
+	}
+	for id, ff := range vectors {
+		if err := fs.InsertControlObjects([]proto.ControlObject{{ID: id}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.InsertCentroids([]Centroid{{CobID: id, EFF: ff, FFVsNum: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		k           int
+		wantIDs     []string
+		wantMatched []bool
+	}{
+		{"top 1", 1, []string{"cob-1"}, []bool{true}},
+		{"near misses", 3, []string{"cob-1", "cob-2", "cob-3"}, []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates, err := fs.SelectCandidatesByFFV("", proto.FacialFeaturesVector{1.0, 0.0, 0.0}, tt.k)
+			if err != nil {
+				t.Fatalf("SelectCandidatesByFFV() error: %s", err)
+			}
+			if len(candidates) != len(tt.wantIDs) {
+				t.Fatalf("SelectCandidatesByFFV() = %v, want %v", candidates, tt.wantIDs)
+			}
+			for i, c := range candidates {
+				if (c.ControlObject.ID != tt.wantIDs[i]) || (c.Matched != tt.wantMatched[i]) {
+					t.Errorf("candidate %d = %s (matched %v), want %s (matched %v)",
+						i, c.ControlObject.ID, c.Matched, tt.wantIDs[i], tt.wantMatched[i])
+				}
+			}
+		})
+	}
+
+	cob, err := fs.SelectControlObjectByFFV("", proto.FacialFeaturesVector{0.0, 0.0, 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cob.ID != proto.DefaultStringField {
+		t.Errorf("SelectControlObjectByFFV() of near miss = %s, want default control object", cob.ID)
+	}
+}
@@ -0,0 +1,82 @@
+package storages
+
+import (
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+// MergeControlObjects ...
+func (fs *MemoryFaceStorage) MergeControlObjects(survivorID, duplicateID, requestedBy string) (*proto.Merge, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ffvsNum := uint64(0)
+	for i := range fs.ffvs {
+		if fs.ffvs[i].CobID == duplicateID {
+			fs.ffvs[i].CobID = survivorID
+			ffvsNum++
+		}
+	}
+	imgsNum := uint64(0)
+	for i := range fs.imgs {
+		replaced := false
+		for j, faceID := range fs.imgs[i].FaceIDs {
+			if faceID == duplicateID {
+				fs.imgs[i].FaceIDs[j] = survivorID
+				replaced = true
+			}
+		}
+		if replaced {
+			imgsNum++
+		}
+	}
+	sightingsNum := uint64(0)
+	for i := range fs.sightings {
+		if fs.sightings[i].CobID == duplicateID {
+			fs.sightings[i].CobID = survivorID
+			sightingsNum++
+		}
+	}
+	for i := range fs.alerts {
+		if fs.alerts[i].CobID == duplicateID {
+			fs.alerts[i].CobID = survivorID
+		}
+	}
+	for id, wl := range fs.watchlists {
+		cobIDs := make([]string, 0, len(wl.CobIDs))
+		seen := make(map[string]struct{}, len(wl.CobIDs))
+		for _, wlCobID := range wl.CobIDs {
+			if wlCobID == duplicateID {
+				wlCobID = survivorID
+			}
+			if _, ok := seen[wlCobID]; !ok {
+				seen[wlCobID] = struct{}{}
+				cobIDs = append(cobIDs, wlCobID)
+			}
+		}
+		wl.CobIDs = cobIDs
+		fs.watchlists[id] = wl
+	}
+	fs.deletedCobs[duplicateID] = struct{}{}
+
+	merge := createMerge(survivorID, duplicateID, requestedBy, ffvsNum, imgsNum, sightingsNum)
+	fs.merges = append(fs.merges, *merge)
+
+	return merge, nil
+}
+
+// SelectMerges ...
+func (fs *MemoryFaceStorage) SelectMerges(offset, limit uint64) ([]proto.Merge, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	merges := make([]proto.Merge, 0, limit)
+	for i := len(fs.merges) - 1; (i >= 0) && (uint64(len(merges)) < limit); i-- {
+		if offset != 0 {
+			offset--
+			continue
+		}
+		merges = append(merges, fs.merges[i])
+	}
+
+	return merges, nil
+}
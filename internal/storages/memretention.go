@@ -0,0 +1,175 @@
+package storages
+
+import (
+	"time"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+// SelectExpiredSightingsImgs ...
+func (fs *MemoryFaceStorage) SelectExpiredSightingsImgs(before time.Time, limit uint64) ([]Img, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	imgs := make([]Img, 0, 128)
+	seen := make(map[string]struct{})
+	for _, s := range fs.sightings {
+		if uint64(len(imgs)) >= limit {
+			break
+		}
+		if (s.ImgPath == "") || !s.TS.Before(before) {
+			continue
+		}
+		if _, ok := fs.imgIDs[s.ImgID]; ok {
+			continue
+		}
+		if _, ok := seen[s.ImgID]; !ok {
+			seen[s.ImgID] = struct{}{}
+			imgs = append(imgs, Img{ID: s.ImgID, Path: s.ImgPath})
+		}
+	}
+
+	return imgs, nil
+}
+
+// ClearSightingsImgs ...
+func (fs *MemoryFaceStorage) ClearSightingsImgs(imgIDs []string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ids := make(map[string]struct{}, len(imgIDs))
+	for _, id := range imgIDs {
+		ids[id] = struct{}{}
+	}
+	for i := range fs.sightings {
+		if _, ok := ids[fs.sightings[i].ImgID]; ok {
+			fs.sightings[i].ImgPath = ""
+		}
+	}
+	for i := range fs.alerts {
+		if _, ok := ids[fs.alerts[i].ImgID]; ok {
+			fs.alerts[i].ImgPath = ""
+		}
+	}
+
+	return nil
+}
+
+// DeleteSightings ...
+func (fs *MemoryFaceStorage) DeleteSightings(expiry *SightingsExpiry) (uint64, []Img, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	sightings := make([]Sighting, 0, len(fs.sightings))
+	keptImgs := make(map[string]struct{})
+	for i := range fs.sightings {
+		if !expiry.Match(&(fs.sightings[i])) {
+			sightings = append(sightings, fs.sightings[i])
+			keptImgs[fs.sightings[i].ImgID] = struct{}{}
+		}
+	}
+	imgs := make([]Img, 0, 16)
+	seen := make(map[string]struct{})
+	for _, s := range fs.sightings {
+		if s.ImgPath == "" {
+			continue
+		}
+		_, kept := keptImgs[s.ImgID]
+		_, cobImg := fs.imgIDs[s.ImgID]
+		_, ok := seen[s.ImgID]
+		if !kept && !cobImg && !ok {
+			seen[s.ImgID] = struct{}{}
+			imgs = append(imgs, Img{ID: s.ImgID, Path: s.ImgPath})
+		}
+	}
+	sightingsNum := uint64(len(fs.sightings) - len(sightings))
+	fs.sightings = sightings
+
+	return sightingsNum, imgs, nil
+}
+
+// SelectExpiredImgs ...
+func (fs *MemoryFaceStorage) SelectExpiredImgs(before time.Time, limit uint64) ([]Img, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	imgs := make([]Img, 0, 128)
+	for _, img := range fs.imgs {
+		if uint64(len(imgs)) >= limit {
+			break
+		}
+		if img.TS.Before(before) {
+			img.FaceIDs = append([]string{}, img.FaceIDs...)
+			imgs = append(imgs, img)
+		}
+	}
+
+	return imgs, nil
+}
+
+// SelectFFVsByImgs ...
+func (fs *MemoryFaceStorage) SelectFFVsByImgs(imgIDs []string) ([]FFV, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	ids := make(map[string]struct{}, len(imgIDs))
+	for _, id := range imgIDs {
+		ids[id] = struct{}{}
+	}
+	ffvs := make([]FFV, 0, 16)
+	for _, ffv := range fs.ffvs {
+		if _, ok := ids[ffv.ImgID]; ok {
+			ffvs = append(ffvs, ffv)
+		}
+	}
+
+	return ffvs, nil
+}
+
+// DeleteImgs ...
+func (fs *MemoryFaceStorage) DeleteImgs(ids []string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	deleted := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		deleted[id] = struct{}{}
+		delete(fs.imgIDs, id)
+	}
+	imgs := make([]Img, 0, len(fs.imgs))
+	for _, img := range fs.imgs {
+		if _, ok := deleted[img.ID]; !ok {
+			imgs = append(imgs, img)
+		}
+	}
+	fs.imgs = imgs
+
+	return nil
+}
+
+// InsertPurge ...
+func (fs *MemoryFaceStorage) InsertPurge(purge *proto.Purge) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.purges = append(fs.purges, *purge)
+
+	return nil
+}
+
+// SelectPurges ...
+func (fs *MemoryFaceStorage) SelectPurges(offset, limit uint64) ([]proto.Purge, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	purges := make([]proto.Purge, 0, limit)
+	for i := len(fs.purges) - 1; (i >= 0) && (uint64(len(purges)) < limit); i-- {
+		if offset != 0 {
+			offset--
+			continue
+		}
+		purges = append(purges, fs.purges[i])
+	}
+
+	return purges, nil
+}
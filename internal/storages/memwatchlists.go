@@ -0,0 +1,115 @@
+package storages
+
+import (
+	"sort"
+
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+func copyWatchlist(wl *proto.Watchlist) proto.Watchlist {
+	c := *wl
+	c.AlertPolicy.Webhooks = append([]string{}, wl.AlertPolicy.Webhooks...)
+	c.CobIDs = append([]string{}, wl.CobIDs...)
+	return c
+}
+
+// InsertWatchlist ...
+func (fs *MemoryFaceStorage) InsertWatchlist(wl *proto.Watchlist) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.watchlists[wl.ID] = copyWatchlist(wl)
+
+	return nil
+}
+
+// SelectWatchlists ...
+func (fs *MemoryFaceStorage) SelectWatchlists() ([]proto.Watchlist, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	wls := make([]proto.Watchlist, 0, len(fs.watchlists))
+	for _, wl := range fs.watchlists {
+		wls = append(wls, copyWatchlist(&wl))
+	}
+	sort.Slice(wls, func(i, j int) bool {
+		if wls[i].Name != wls[j].Name {
+			return wls[i].Name < wls[j].Name
+		}
+		return wls[i].ID < wls[j].ID
+	})
+
+	return wls, nil
+}
+
+// DeleteWatchlist ...
+func (fs *MemoryFaceStorage) DeleteWatchlist(id string) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.watchlists[id]; !ok {
+		return false, nil
+	}
+	delete(fs.watchlists, id)
+
+	return true, nil
+}
+
+// InsertAlerts ...
+func (fs *MemoryFaceStorage) InsertAlerts(alerts []Alert) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, a := range alerts {
+		a.FaceBox = append(proto.FaceBox{}, a.FaceBox...)
+		fs.alerts = append(fs.alerts, a)
+	}
+
+	return nil
+}
+
+// SelectAlerts ...
+func (fs *MemoryFaceStorage) SelectAlerts(filter *AlertsFilter, limit uint64) ([]Alert, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	alerts := make([]Alert, 0, 16)
+	for i := range fs.alerts {
+		if filter.Match(&(fs.alerts[i])) {
+			alerts = append(alerts, fs.alerts[i])
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if !alerts[i].TS.Equal(alerts[j].TS) {
+			return alerts[i].TS.After(alerts[j].TS)
+		}
+		return alerts[i].ID > alerts[j].ID
+	})
+	if uint64(len(alerts)) > limit {
+		alerts = alerts[:limit]
+	}
+
+	return alerts, nil
+}
+
+// eraseFromWatchlists should be called under fs.mu.
+func (fs *MemoryFaceStorage) eraseFromWatchlists(cobID string) {
+	for id, wl := range fs.watchlists {
+		cobIDs := make([]string, 0, len(wl.CobIDs))
+		for _, wlCobID := range wl.CobIDs {
+			if wlCobID != cobID {
+				cobIDs = append(cobIDs, wlCobID)
+			}
+		}
+		wl.CobIDs = cobIDs
+		fs.watchlists[id] = wl
+	}
+
+	alerts := make([]Alert, 0, len(fs.alerts))
+	for _, a := range fs.alerts {
+		if a.CobID != cobID {
+			alerts = append(alerts, a)
+		}
+	}
+	fs.alerts = alerts
+}
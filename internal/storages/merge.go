@@ -0,0 +1,164 @@
+package storages
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+The same person may be stored as several control objects (e.g. passport was mistyped
+or person was enrolled twice). Duplicates are found by centroids: every centroid is
+searched among centroids of other control objects of the same model, and pairs with
+similarity not less than duplicate threshold are reported. Duplicate is merged into
+survivor: its facial features vectors are re-inserted with survivor ID (cob_id is a
+partition key, so it can't be updated), it is replaced by survivor in images, sightings,
+alerts and watchlists, it is deleted and merge record is written. Vectors, accepted on
+review of duplicate outliers, remain accepted.
+*/
+
+// ErrSelfMerge is returned on attempt to merge control object into itself.
+var ErrSelfMerge = errors.New("control object can't be merged into itself")
+
+// FindDuplicates returns pairs of not deleted control objects, which centroids have similarity
+// not less than threshold, most similar first. Every centroid is compared with up to k most
+// similar ones, and only those, which are similar enough to be matched (see SelectCandidatesByFFV).
+func FindDuplicates(fs FaceStorage, threshold float64, k int) ([]proto.Duplicate, error) {
+	effs, err := fs.SelectEmbeddedFFVs()
+	if err != nil {
+		return nil, err
+	}
+
+	duplicates := make([]proto.Duplicate, 0, 16)
+	pairs := make(map[[2]string]int)
+	for _, eff := range effs {
+		candidates, err := fs.SelectCandidatesByFFV(eff.Model, eff.EFF, k+1)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range candidates {
+			if (c.ControlObject.ID == eff.CobID) || !c.Matched || (c.Similarity < threshold) {
+				continue
+			}
+			first := proto.ControlObject{ID: eff.CobID}
+			second := c.ControlObject
+			if first.ID > second.ID {
+				first, second = second, first
+			}
+			pair := [2]string{first.ID, second.ID}
+			if i, ok := pairs[pair]; ok {
+				if c.Similarity > duplicates[i].Similarity {
+					duplicates[i].Model = eff.Model
+					duplicates[i].Similarity = c.Similarity
+				}
+				continue
+			}
+			pairs[pair] = len(duplicates)
+			duplicates = append(duplicates, proto.Duplicate{
+				First:      first,
+				Second:     second,
+				Model:      eff.Model,
+				Similarity: c.Similarity,
+			})
+		}
+	}
+
+	// Only one control object of every pair is returned by candidates search.
+	ids := make([]string, 0, len(pairs))
+	for pair := range pairs {
+		ids = append(ids, pair[0], pair[1])
+	}
+	cobs, err := fs.SelectControlObjectsByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	cobsByID := make(map[string]proto.ControlObject, len(cobs))
+	for _, cob := range cobs {
+		cobsByID[cob.ID] = cob
+	}
+	aliveDuplicates := make([]proto.Duplicate, 0, len(duplicates))
+	for _, d := range duplicates {
+		first, ok1 := cobsByID[d.First.ID]
+		second, ok2 := cobsByID[d.Second.ID]
+		if !ok1 || !ok2 {
+			continue
+		}
+		d.First = first
+		d.Second = second
+		aliveDuplicates = append(aliveDuplicates, d)
+	}
+	sort.SliceStable(aliveDuplicates, func(i, j int) bool {
+		return aliveDuplicates[i].Similarity > aliveDuplicates[j].Similarity
+	})
+
+	return aliveDuplicates, nil
+}
+
+// MergeControlObjects merges duplicate control object into survivor and rebuilds their centroids.
+// It returns nil merge record, if there is no survivor or duplicate control object.
+func MergeControlObjects(fs FaceStorage, im *identities.Model,
+	survivorID, duplicateID, requestedBy string, logger *log.Logger) (*proto.Merge, error) {
+	if survivorID == duplicateID {
+		return nil, ErrSelfMerge
+	}
+	cobs, err := fs.SelectControlObjectsByIDs([]string{survivorID, duplicateID})
+	if err != nil {
+		return nil, err
+	}
+	if len(cobs) != 2 {
+		return nil, nil
+	}
+	ffvs, err := fs.SelectFFVsByControlObject(duplicateID)
+	if err != nil {
+		return nil, err
+	}
+	centroids, err := fs.SelectCentroids(duplicateID)
+	if err != nil {
+		return nil, err
+	}
+
+	merge, err := fs.MergeControlObjects(survivorID, duplicateID, requestedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deletion of moved vectors may be not applied yet, so they are skipped explicitly.
+	moved := make(map[string]struct{}, len(ffvs))
+	for _, ffv := range ffvs {
+		moved[ffv.ID] = struct{}{}
+	}
+	accepted := make(map[string]struct{})
+	for _, c := range centroids {
+		for _, id := range c.AcceptedIDs {
+			accepted[id] = struct{}{}
+		}
+	}
+	if err := refreshCentroids(fs, im, []string{duplicateID}, nil, moved); err != nil {
+		return nil, err
+	}
+	if err := refreshCentroids(fs, im, []string{survivorID}, accepted, nil); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("merged control object \"%s\" into \"%s\" (%d facial features vectors, %d images, %d sightings), requested by \"%s\"",
+		duplicateID, survivorID, merge.FFVsNum, merge.ImgsNum, merge.SightingsNum, requestedBy)
+	return merge, nil
+}
+
+func createMerge(survivorID, duplicateID, requestedBy string, ffvsNum, imgsNum, sightingsNum uint64) *proto.Merge {
+	return &proto.Merge{
+		ID:           uuid.Must(uuid.NewV4()).String(),
+		TS:           time.Now(),
+		SurvivorID:   survivorID,
+		DuplicateID:  duplicateID,
+		RequestedBy:  requestedBy,
+		FFVsNum:      ffvsNum,
+		ImgsNum:      imgsNum,
+		SightingsNum: sightingsNum,
+	}
+}
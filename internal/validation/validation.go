@@ -0,0 +1,228 @@
+package validation
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/imageprocessing"
+	"github.com/nofacedb/facedb/internal/proto"
+)
+
+/*
+Validator checks contents of incoming messages before they are processed, so
+malformed faceboxes can't panic handlers, and malformed facial features vectors
+can't get to storage (one NaN poisons averaged embedded vector of control object
+forever). Facebox must have 4 elements, positive area and (if image is known)
+fit into image. Facial features vector must have dimension of its model (if
+dimensions of models are configured), finite elements and norm in bounds.
+Attributes keys are used as query params and in filters, so they are limited
+to latin letters, digits, "_", "-" and ".".
+*/
+
+const (
+	faceBoxLen        = 4
+	defaultMinFFVNorm = 1e-6
+
+	maxAttributesNum     = 64
+	maxAttributeKeyLen   = 64
+	maxAttributeValueLen = 4096
+)
+
+// Validator checks faceboxes and facial features vectors.
+type Validator struct {
+	modelsDims map[string]int
+	minFFVNorm float64
+	maxFFVNorm float64
+}
+
+// CreateValidator ...
+func CreateValidator(cfg *cfgparser.ValidationCFG) *Validator {
+	minFFVNorm := cfg.MinFFVNorm
+	if minFFVNorm <= 0 {
+		minFFVNorm = defaultMinFFVNorm
+	}
+	maxFFVNorm := cfg.MaxFFVNorm
+	if maxFFVNorm <= 0 {
+		maxFFVNorm = math.Inf(1)
+	}
+	return &Validator{
+		modelsDims: cfg.ModelsDims,
+		minFFVNorm: minFFVNorm,
+		maxFFVNorm: maxFFVNorm,
+	}
+}
+
+func invalidFaceBoxErrorData(text string) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.InvalidFaceBoxCode,
+		Info: "invalid facebox",
+		Text: text,
+	}
+}
+
+func invalidFFVErrorData(text string) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.InvalidFFVCode,
+		Info: "invalid facial features vector",
+		Text: text,
+	}
+}
+
+// FaceBox checks arity and ordering of fb.
+func FaceBox(fb proto.FaceBox) *proto.ErrorData {
+	if len(fb) != faceBoxLen {
+		return invalidFaceBoxErrorData(fmt.Sprintf("expected %d elements, got %d", faceBoxLen, len(fb)))
+	}
+	if fb.Top() >= fb.Bottom() {
+		return invalidFaceBoxErrorData(fmt.Sprintf("top %d is not above bottom %d", fb.Top(), fb.Bottom()))
+	}
+	if fb.Left() >= fb.Right() {
+		return invalidFaceBoxErrorData(fmt.Sprintf("left %d is not before right %d", fb.Left(), fb.Right()))
+	}
+	return nil
+}
+
+// FaceBoxInImg checks fb and that it fits into image with given width and height.
+func FaceBoxInImg(fb proto.FaceBox, width, height uint64) *proto.ErrorData {
+	if errorData := FaceBox(fb); errorData != nil {
+		return errorData
+	}
+	if (fb.Right() > width) || (fb.Bottom() > height) {
+		return invalidFaceBoxErrorData(fmt.Sprintf("facebox %v is out of %dx%d image", []uint64(fb), width, height))
+	}
+	return nil
+}
+
+// ImgSize returns width and height of image or error data, if they can't be decoded.
+func ImgSize(img []byte) (uint64, uint64, *proto.ErrorData) {
+	width, height, err := imageprocessing.ImgSize(img)
+	if err != nil {
+		return 0, 0, &proto.ErrorData{
+			Code: proto.InvalidImageCode,
+			Info: "invalid image",
+			Text: err.Error(),
+		}
+	}
+	return width, height, nil
+}
+
+// Base64ImgSize returns width and height of base64-encoded image or error data, if they can't be decoded.
+func Base64ImgSize(imgBuff string) (uint64, uint64, *proto.ErrorData) {
+	width, height, err := imageprocessing.Base64ImgSize(imgBuff)
+	if err != nil {
+		return 0, 0, &proto.ErrorData{
+			Code: proto.InvalidImageCode,
+			Info: "invalid image",
+			Text: err.Error(),
+		}
+	}
+	return width, height, nil
+}
+
+// FaceBoxesInImg checks, that image dimensions can be decoded, and all faceboxes against them.
+func FaceBoxesInImg(fbs []proto.FaceBox, img []byte) *proto.ErrorData {
+	width, height, errorData := ImgSize(img)
+	if errorData != nil {
+		return errorData
+	}
+	for i, fb := range fbs {
+		if errorData := FaceBoxInImg(fb, width, height); errorData != nil {
+			errorData.Text = fmt.Sprintf("%d-th facebox: %s", i, errorData.Text)
+			return errorData
+		}
+	}
+	return nil
+}
+
+// FFV checks facial features vector ff, produced by model.
+func (v *Validator) FFV(model string, ff proto.FacialFeaturesVector) *proto.ErrorData {
+	if len(ff) == 0 {
+		return invalidFFVErrorData("vector is empty")
+	}
+	if len(v.modelsDims) != 0 {
+		dim, ok := v.modelsDims[model]
+		if !ok {
+			return invalidFFVErrorData(fmt.Sprintf("unknown model \"%s\"", model))
+		}
+		if len(ff) != dim {
+			return invalidFFVErrorData(fmt.Sprintf("expected %d elements for model \"%s\", got %d",
+				dim, model, len(ff)))
+		}
+	}
+	sqNorm := 0.0
+	for i, x := range ff {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return invalidFFVErrorData(fmt.Sprintf("%d-th element is not finite", i))
+		}
+		sqNorm += x * x
+	}
+	norm := math.Sqrt(sqNorm)
+	if (norm < v.minFFVNorm) || (norm > v.maxFFVNorm) {
+		return invalidFFVErrorData(fmt.Sprintf("norm %g is out of [%g, %g]", norm, v.minFFVNorm, v.maxFFVNorm))
+	}
+	return nil
+}
+
+// FacesData checks faceboxes and facial features vectors of all faces, found by
+// recognizer of model on image with given width and height. All vectors must have
+// the same dimension.
+func (v *Validator) FacesData(model string, facesData []proto.FaceData, width, height uint64) *proto.ErrorData {
+	for i, fd := range facesData {
+		errorData := FaceBoxInImg(fd.FaceBox, width, height)
+		if errorData == nil {
+			errorData = v.FFV(model, fd.FacialFeaturesVector)
+		}
+		if (errorData == nil) && (len(fd.FacialFeaturesVector) != len(facesData[0].FacialFeaturesVector)) {
+			errorData = invalidFFVErrorData(fmt.Sprintf("expected %d elements as in 0-th vector, got %d",
+				len(facesData[0].FacialFeaturesVector), len(fd.FacialFeaturesVector)))
+		}
+		if errorData != nil {
+			errorData.Text = fmt.Sprintf("%d-th face: %s", i, errorData.Text)
+			return errorData
+		}
+	}
+	return nil
+}
+
+func invalidAttributesErrorData(text string) *proto.ErrorData {
+	return &proto.ErrorData{
+		Code: proto.InvalidAttributesCode,
+		Info: "invalid attributes",
+		Text: text,
+	}
+}
+
+// AttributeKey checks key of control object attribute.
+func AttributeKey(k string) *proto.ErrorData {
+	if (len(k) == 0) || (len(k) > maxAttributeKeyLen) {
+		return invalidAttributesErrorData(fmt.Sprintf("key \"%s\" should have from 1 to %d characters",
+			k, maxAttributeKeyLen))
+	}
+	for _, c := range k {
+		if !(((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9')) ||
+			(c == '_') || (c == '-') || (c == '.')) {
+			return invalidAttributesErrorData(fmt.Sprintf("key \"%s\" contains invalid character %q", k, c))
+		}
+	}
+	return nil
+}
+
+// Attributes checks number, keys and values of control object attributes.
+// Empty values are allowed (they remove attributes on update).
+func Attributes(attrs map[string]string) *proto.ErrorData {
+	if len(attrs) > maxAttributesNum {
+		return invalidAttributesErrorData(fmt.Sprintf("expected at most %d attributes, got %d",
+			maxAttributesNum, len(attrs)))
+	}
+	for k, v := range attrs {
+		if errorData := AttributeKey(k); errorData != nil {
+			return errorData
+		}
+		if len(v) > maxAttributeValueLen {
+			return invalidAttributesErrorData(fmt.Sprintf("value of \"%s\" is longer than %d bytes",
+				k, maxAttributeValueLen))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,516 @@
+package watchlists
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/proto"
+	"github.com/nofacedb/facedb/internal/storages"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Watcher keeps all watchlists and centroids of their control objects in memory
+(they are also reloaded from storage periodically, so changes, made through other
+FACEDB servers, are applied) and compares every face, found on processed image,
+with all of them, because watchlist control object may be neither among top_k
+candidates of face nor above storage cosine boundary. Alert is raised at once,
+without waiting for control panel decision: it is posted to webhooks of watchlist
+alert policy and stored. Every face raises at most one alert per watchlist (for
+the most similar control object of this watchlist).
+*/
+
+const defaultReloadIntervalMS = 10000
+
+// Watcher raises alerts on matches of watchlists control objects.
+type Watcher struct {
+	fs             storages.FaceStorage
+	cosineBoundary float64
+	srcAddr        string
+	client         *http.Client
+	mu             sync.RWMutex
+	byCob          map[string][]*proto.Watchlist
+	effs           map[string][]storages.EmbeddedFFV // control object ID -> centroids.
+	suppressedMu   sync.Mutex
+	suppressed     map[string]time.Time
+	stop           chan struct{}
+	wg             sync.WaitGroup
+	logger         *log.Logger
+}
+
+// CreateWatcher loads all watchlists and runs their periodical reload.
+func CreateWatcher(cfg *cfgparser.WatchlistsCFG, cosineBoundary float64,
+	fs storages.FaceStorage, srcAddr string, client *http.Client, logger *log.Logger) (*Watcher, error) {
+	w := &Watcher{
+		fs:             fs,
+		cosineBoundary: cosineBoundary,
+		srcAddr:        srcAddr,
+		client:         client,
+		mu:             sync.RWMutex{},
+		byCob:          make(map[string][]*proto.Watchlist),
+		effs:           make(map[string][]storages.EmbeddedFFV),
+		suppressedMu:   sync.Mutex{},
+		suppressed:     make(map[string]time.Time),
+		stop:           make(chan struct{}),
+		logger:         logger,
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+
+	reloadIntervalMS := cfg.ReloadIntervalMS
+	if reloadIntervalMS <= 0 {
+		reloadIntervalMS = defaultReloadIntervalMS
+	}
+	w.runReloader(time.Duration(reloadIntervalMS) * time.Millisecond)
+
+	return w, nil
+}
+
+// Close stops reloading watchlists.
+func (w *Watcher) Close() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *Watcher) runReloader(interval time.Duration) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				if err := w.Reload(); err != nil {
+					w.logger.Warn(err)
+				}
+				w.pruneSuppressed()
+			}
+		}
+	}()
+}
+
+// Reload loads all watchlists and centroids of their control objects from storage.
+func (w *Watcher) Reload() error {
+	wls, err := w.fs.SelectWatchlists()
+	if err != nil {
+		return errors.Wrap(err, "unable to load watchlists")
+	}
+	byCob := make(map[string][]*proto.Watchlist)
+	cobIDs := make([]string, 0)
+	for i := range wls {
+		wl := &(wls[i])
+		for _, cobID := range wl.CobIDs {
+			if _, ok := byCob[cobID]; !ok {
+				cobIDs = append(cobIDs, cobID)
+			}
+			byCob[cobID] = append(byCob[cobID], wl)
+		}
+	}
+	effs, err := w.selectEFFs(cobIDs)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.byCob = byCob
+	w.effs = effs
+	w.mu.Unlock()
+
+	return nil
+}
+
+// selectEFFs returns centroids of control objects by their IDs.
+func (w *Watcher) selectEFFs(cobIDs []string) (map[string][]storages.EmbeddedFFV, error) {
+	effs, err := w.fs.SelectEmbeddedFFVsByControlObjects(cobIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load centroids of watchlists control objects")
+	}
+	byCob := make(map[string][]storages.EmbeddedFFV, len(cobIDs))
+	for _, eff := range effs {
+		byCob[eff.CobID] = append(byCob[eff.CobID], eff)
+	}
+	return byCob, nil
+}
+
+// Validate checks watchlist fields.
+func (w *Watcher) Validate(wl *proto.Watchlist) error {
+	if wl.Name == "" {
+		return errors.New("watchlist name should be set")
+	}
+	if (wl.Threshold <= 0.0) || (wl.Threshold > 1.0) {
+		return fmt.Errorf("watchlist threshold should be in (0, 1] (storage cosine boundary is %g)",
+			w.cosineBoundary)
+	}
+	for _, webhook := range wl.AlertPolicy.Webhooks {
+		u, err := url.Parse(webhook)
+		if (err != nil) || ((u.Scheme != "http") && (u.Scheme != "https")) || (u.Host == "") {
+			return fmt.Errorf("invalid webhook URL \"%s\"", webhook)
+		}
+	}
+	for _, cobID := range wl.CobIDs {
+		if _, err := uuid.FromString(cobID); err != nil {
+			return fmt.Errorf("invalid control object ID \"%s\"", cobID)
+		}
+	}
+	return nil
+}
+
+// Watchlists returns all watchlists.
+func (w *Watcher) Watchlists() ([]proto.Watchlist, error) {
+	return w.fs.SelectWatchlists()
+}
+
+// Watchlist returns watchlist by ID or nil, if there is no such watchlist.
+func (w *Watcher) Watchlist(id string) (*proto.Watchlist, error) {
+	wls, err := w.fs.SelectWatchlists()
+	if err != nil {
+		return nil, err
+	}
+	for i := range wls {
+		if wls[i].ID == id {
+			return &(wls[i]), nil
+		}
+	}
+	return nil, nil
+}
+
+// Put creates watchlist (new ID is generated, if it is empty) or replaces existing one.
+func (w *Watcher) Put(wl *proto.Watchlist) error {
+	if err := w.Validate(wl); err != nil {
+		return err
+	}
+	if wl.ID == "" {
+		wl.ID = uuid.Must(uuid.NewV4()).String()
+	}
+	wl.CobIDs = uniqueIDs(wl.CobIDs)
+	if wl.AlertPolicy.Webhooks == nil {
+		wl.AlertPolicy.Webhooks = []string{}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.put(wl)
+}
+
+// put should be called under w.mu.
+func (w *Watcher) put(wl *proto.Watchlist) error {
+	if err := w.fs.InsertWatchlist(wl); err != nil {
+		return errors.Wrap(err, "unable to insert watchlist")
+	}
+	w.removeCached(wl.ID)
+	cached := *wl
+	cached.CobIDs = append([]string{}, wl.CobIDs...)
+	cached.AlertPolicy.Webhooks = append([]string{}, wl.AlertPolicy.Webhooks...)
+	newIDs := make([]string, 0)
+	for _, cobID := range cached.CobIDs {
+		if _, ok := w.byCob[cobID]; !ok {
+			newIDs = append(newIDs, cobID)
+		}
+		w.byCob[cobID] = append(w.byCob[cobID], &cached)
+	}
+	effs, err := w.selectEFFs(newIDs)
+	if err != nil {
+		// Watchlist is already stored, so centroids are loaded on the next reload.
+		w.logger.Warn(err)
+		return nil
+	}
+	for cobID, cobEFFs := range effs {
+		w.effs[cobID] = cobEFFs
+	}
+	return nil
+}
+
+// removeCached should be called under w.mu.
+func (w *Watcher) removeCached(id string) {
+	for cobID, wls := range w.byCob {
+		filtered := make([]*proto.Watchlist, 0, len(wls))
+		for _, wl := range wls {
+			if wl.ID != id {
+				filtered = append(filtered, wl)
+			}
+		}
+		if len(filtered) == 0 {
+			delete(w.byCob, cobID)
+			delete(w.effs, cobID)
+		} else {
+			w.byCob[cobID] = filtered
+		}
+	}
+}
+
+// Delete deletes watchlist and returns false, if there is no such watchlist.
+func (w *Watcher) Delete(id string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ok, err := w.fs.DeleteWatchlist(id)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to delete watchlist")
+	}
+	w.removeCached(id)
+	return ok, nil
+}
+
+// UpdateMembers adds control objects to watchlist and removes them from it.
+// It returns updated watchlist or nil, if there is no such watchlist.
+func (w *Watcher) UpdateMembers(id string, add, remove []string) (*proto.Watchlist, error) {
+	for _, cobID := range add {
+		if _, err := uuid.FromString(cobID); err != nil {
+			return nil, fmt.Errorf("invalid control object ID \"%s\"", cobID)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wl, err := w.Watchlist(id)
+	if (err != nil) || (wl == nil) {
+		return nil, err
+	}
+	removed := make(map[string]struct{}, len(remove))
+	for _, cobID := range remove {
+		removed[cobID] = struct{}{}
+	}
+	cobIDs := make([]string, 0, len(wl.CobIDs)+len(add))
+	for _, cobID := range append(wl.CobIDs, add...) {
+		if _, ok := removed[cobID]; !ok {
+			cobIDs = append(cobIDs, cobID)
+		}
+	}
+	wl.CobIDs = uniqueIDs(cobIDs)
+
+	if err := w.put(wl); err != nil {
+		return nil, err
+	}
+	return wl, nil
+}
+
+func uniqueIDs(ids []string) []string {
+	unique := make([]string, 0, len(ids))
+	seen := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			unique = append(unique, id)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// match is the most similar control object of watchlist for face.
+type match struct {
+	wl         *proto.Watchlist
+	cobID      string
+	similarity float64
+	cob        *proto.ControlObject // nil, if control object is not among candidates of face.
+}
+
+// setMatch replaces match of watchlist, if cobID is more similar to face.
+func setMatch(matches map[string]*match, wl *proto.Watchlist, cobID string,
+	similarity float64, cob *proto.ControlObject) {
+	if similarity < wl.Threshold {
+		return
+	}
+	m, ok := matches[wl.ID]
+	if ok && (m.cobID == cobID) {
+		if m.similarity < similarity {
+			m.similarity = similarity
+		}
+		if m.cob == nil {
+			m.cob = cob
+		}
+		return
+	}
+	if ok && (m.similarity >= similarity) {
+		return
+	}
+	matches[wl.ID] = &match{
+		wl:         wl,
+		cobID:      cobID,
+		similarity: similarity,
+		cob:        cob,
+	}
+}
+
+// Check raises alerts on matches of watchlists control objects with faces. Every
+// face is compared with centroids of all watchlists members, so members, which are
+// not among its candidates (e.g. beyond top_k or below storage cosine boundary), are
+// matched too. sightings[i] is a sighting of face icos[i], imgBuff is base64-encoded
+// image and imgURL is its link.
+func (w *Watcher) Check(sightings []storages.Sighting, icos []proto.ImageControlObject, imgBuff, imgURL string) {
+	facesMatches := make([]map[string]*match, 0, len(icos))
+	missingIDs := make([]string, 0)
+	w.mu.RLock()
+	for i := 0; (i < len(icos)) && (i < len(sightings)); i++ {
+		s := &(sightings[i])
+		// The most similar control object of every watchlist.
+		matches := make(map[string]*match)
+		for j := range icos[i].Candidates {
+			c := &(icos[i].Candidates[j])
+			for _, wl := range w.byCob[c.ControlObject.ID] {
+				setMatch(matches, wl, c.ControlObject.ID, c.Similarity, &(c.ControlObject))
+			}
+		}
+		if len(s.FacialFeaturesVector) != 0 {
+			for cobID, effs := range w.effs {
+				for _, eff := range effs {
+					if (eff.Model != s.Model) || (len(eff.EFF) != len(s.FacialFeaturesVector)) {
+						continue
+					}
+					similarity := s.FacialFeaturesVector.Cosine(eff.EFF)
+					for _, wl := range w.byCob[cobID] {
+						setMatch(matches, wl, cobID, similarity, nil)
+					}
+				}
+			}
+		}
+		for _, m := range matches {
+			if m.cob == nil {
+				missingIDs = append(missingIDs, m.cobID)
+			}
+		}
+		facesMatches = append(facesMatches, matches)
+	}
+	w.mu.RUnlock()
+
+	// Deleted, erased and merged control objects aren't selected, so they raise no alerts.
+	cobs := make(map[string]*proto.ControlObject, len(missingIDs))
+	if len(missingIDs) != 0 {
+		selected, err := w.fs.SelectControlObjectsByIDs(uniqueIDs(missingIDs))
+		if err != nil {
+			w.logger.Error(errors.Wrap(err, "unable to select control objects of watchlists"))
+		}
+		for i := range selected {
+			cobs[selected[i].ID] = &(selected[i])
+		}
+	}
+
+	alerts := make([]storages.Alert, 0)
+	notifies := make([]*proto.NotifyAlertReq, 0)
+	webhooks := make([][]string, 0)
+	for i, matches := range facesMatches {
+		s := &(sightings[i])
+		for _, m := range matches {
+			wl := m.wl
+			cobPtr := m.cob
+			if cobPtr == nil {
+				if cobPtr = cobs[m.cobID]; cobPtr == nil {
+					continue
+				}
+			}
+			if !w.suppress(wl, m.cobID, s) {
+				continue
+			}
+			a := storages.Alert{
+				ID:            uuid.Must(uuid.NewV4()).String(),
+				TS:            s.TS,
+				WatchlistID:   wl.ID,
+				WatchlistName: wl.Name,
+				CobID:         m.cobID,
+				Score:         m.similarity,
+				SrcAddr:       s.SrcAddr,
+				SightingID:    s.ID,
+				ImgID:         s.ImgID,
+				ImgPath:       s.ImgPath,
+				FaceBox:       s.FaceBox,
+			}
+			alerts = append(alerts, a)
+			cob := *cobPtr
+			notifies = append(notifies, &proto.NotifyAlertReq{
+				Header: proto.Header{
+					SrcAddr: w.srcAddr,
+					UUID:    a.ID,
+				},
+				Alert: proto.Alert{
+					ID:            a.ID,
+					TS:            a.TS,
+					WatchlistID:   a.WatchlistID,
+					WatchlistName: a.WatchlistName,
+					CobID:         a.CobID,
+					ControlObject: &cob,
+					Score:         a.Score,
+					SrcAddr:       a.SrcAddr,
+					SightingID:    a.SightingID,
+					ImgID:         a.ImgID,
+					ImgURL:        imgURL,
+					ImgBuff:       imgBuff,
+					FaceBox:       a.FaceBox,
+				},
+			})
+			webhooks = append(webhooks, wl.AlertPolicy.Webhooks)
+		}
+	}
+
+	if len(alerts) == 0 {
+		return
+	}
+	for i, req := range notifies {
+		w.logger.Infof("alert \"%s\": control object \"%s\" of watchlist \"%s\" was matched with score %g on \"%s\"",
+			req.Alert.ID, req.Alert.CobID, req.Alert.WatchlistName, req.Alert.Score, req.Alert.SrcAddr)
+		for _, webhook := range webhooks[i] {
+			go w.notify(webhook, req)
+		}
+	}
+	if err := w.fs.InsertAlerts(alerts); err != nil {
+		w.logger.Error(errors.Wrap(err, "unable to insert alerts"))
+	}
+}
+
+// suppress returns true, if alert should be raised, and suppresses
+// repeated alerts for watchlist cooldown.
+func (w *Watcher) suppress(wl *proto.Watchlist, cobID string, s *storages.Sighting) bool {
+	if wl.AlertPolicy.CooldownS == 0 {
+		return true
+	}
+	k := wl.ID + "/" + cobID + "/" + s.SrcAddr
+	w.suppressedMu.Lock()
+	defer w.suppressedMu.Unlock()
+	if until, ok := w.suppressed[k]; ok && s.TS.Before(until) {
+		return false
+	}
+	w.suppressed[k] = s.TS.Add(time.Duration(wl.AlertPolicy.CooldownS) * time.Second)
+	return true
+}
+
+func (w *Watcher) pruneSuppressed() {
+	now := time.Now()
+	w.suppressedMu.Lock()
+	defer w.suppressedMu.Unlock()
+	for k, until := range w.suppressed {
+		if until.Before(now) {
+			delete(w.suppressed, k)
+		}
+	}
+}
+
+func (w *Watcher) notify(webhook string, req *proto.NotifyAlertReq) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		w.logger.Error(errors.Wrap(err, "unable to marshal \"NotifyAlertReq\" to JSON"))
+		return
+	}
+	resp, err := w.client.Post(webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		w.logger.Error(errors.Wrapf(err, "unable to send alert \"%s\" to \"%s\"", req.Alert.ID, webhook))
+		return
+	}
+	resp.Body.Close()
+	if (resp.StatusCode < 200) || (resp.StatusCode >= 300) {
+		w.logger.Errorf("unable to send alert \"%s\" to \"%s\": unexpected status \"%s\"",
+			req.Alert.ID, webhook, resp.Status)
+	}
+}
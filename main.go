@@ -7,11 +7,17 @@ import (
 	"time"
 
 	"github.com/nofacedb/facedb/internal/cfgparser"
+	"github.com/nofacedb/facedb/internal/commands"
 	"github.com/nofacedb/facedb/internal/httpserver"
+	"github.com/nofacedb/facedb/internal/identities"
+	"github.com/nofacedb/facedb/internal/imgstores"
 	log "github.com/nofacedb/facedb/internal/logger"
+	"github.com/nofacedb/facedb/internal/namesearch"
+	"github.com/nofacedb/facedb/internal/retention"
 	"github.com/nofacedb/facedb/internal/schedulers"
 	"github.com/nofacedb/facedb/internal/storages"
 	"github.com/nofacedb/facedb/internal/version"
+	"github.com/nofacedb/facedb/internal/watchlists"
 )
 
 func createSrcAddr(cfg *cfgparser.CFG) string {
@@ -40,21 +46,58 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.Command != "" {
+		if err := commands.Run(cfg, logger); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger.Debugf("FACEDB (%s) server was started...", version.Version)
 
-	logger.Debug("connecting to CLICKHOUSE DB...")
-	db, err := storages.CreateClickHouseDBConn(&(cfg.StorageCFG), logger)
+	logger.Debug("initializing FACE STORAGE...")
+	fStorage, err := storages.CreateFaceStorage(&(cfg.StorageCFG), logger)
 	if err != nil {
 		logger.Error(err)
 		os.Exit(1)
 	}
-	logger.Debug("successfully connected to CLICKHOUSE DB")
-	defer db.Close()
-
-	logger.Debug("initializing FACE STORAGE...")
-	fStorage := storages.CreateFaceStorage(db, cfg.StorageCFG.CosineBoundary)
+	defer fStorage.Close()
 	logger.Debug("FACE STORAGE was successfully initialized")
 
+	logger.Debug("initializing IMAGES STORE...")
+	imgStore, err := imgstores.CreateImgStore(&(cfg.StorageCFG), logger)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+	logger.Debug("IMAGES STORE was successfully initialized")
+
+	identitiesModel, err := identities.CreateModel(&(cfg.StorageCFG.IdentitiesCFG))
+	if err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+
+	logger.Debug("initializing RETENTION ENFORCER...")
+	enforcer, err := retention.CreateEnforcer(&(cfg.RetentionCFG), fStorage, imgStore, identitiesModel, logger)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+	defer enforcer.Close()
+	logger.Debug("RETENTION ENFORCER was successfully initialized")
+
+	logger.Debug("initializing COMMITTER...")
+	committer, err := storages.CreateCommitter(fStorage, imgStore, identitiesModel,
+		&(cfg.StorageCFG.WALCFG), logger)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+	defer committer.Close()
+	logger.Debug("COMMITTER was successfully initialized")
+
 	srcAddr := createSrcAddr(cfg)
 
 	logger.Debug("initializing HTTP CLIENT...")
@@ -64,6 +107,25 @@ func main() {
 	}
 	logger.Debug("HTTP CLIENT was successfully initialized")
 
+	logger.Debug("initializing WATCHER...")
+	watcher, err := watchlists.CreateWatcher(&(cfg.WatchlistsCFG), cfg.StorageCFG.CosineBoundary,
+		fStorage, srcAddr, client, logger)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+	defer watcher.Close()
+	logger.Debug("WATCHER was successfully initialized")
+
+	logger.Debug("initializing NAME SEARCH INDEX...")
+	names, err := namesearch.CreateIndex(&(cfg.NameSearchCFG), fStorage, logger)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+	defer names.Close()
+	logger.Debug("NAME SEARCH INDEX was successfully initialized")
+
 	logger.Debug("initializing FACE RECOGNIZERS SCHEDULER...")
 	frScheduler := schedulers.CreateFaceRecognitionScheduler(&(cfg.FaceRecognizersCFG), srcAddr, client, logger)
 	logger.Debug("FACE RECOGNIZERS SCHEDULER was successfully initialized")
@@ -76,7 +138,7 @@ func main() {
 	server := httpserver.CreateHTTPServer(
 		cfg, srcAddr,
 		frScheduler, cpScheduler,
-		fStorage, client, logger)
+		fStorage, imgStore, identitiesModel, committer, watcher, names, client, logger)
 	logger.Debug("HTTP SERVER was successfully initialized")
 
 	server.Run()
@@ -1,5 +0,0 @@
-DROP TABLE IF EXISTS `facedb`.`imgs`;
-DROP TABLE IF EXISTS `facedb`.`embedded_facial_features`;
-DROP TABLE IF EXISTS `facedb`.`facial_features`;
-DROP TABLE IF EXISTS `facedb`.`control_objects`;
-DROP DATABASE IF EXISTS `facedb`;
@@ -1,4 +0,0 @@
-TRUNCATE TABLE IF EXISTS `facedb`.`imgs`;
-TRUNCATE TABLE IF EXISTS `facedb`.`embedded_facial_features`;
-TRUNCATE TABLE IF EXISTS `facedb`.`facial_features`;
-TRUNCATE TABLE IF EXISTS `facedb`.`control_objects`;